@@ -7,14 +7,28 @@ import (
 	"runtime/debug"
 
 	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountpostgres "github.com/foxcpp/maddy-storage/internal/domain/account/repository/postgres"
 	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	blobfs "github.com/foxcpp/maddy-storage/internal/domain/blob/repository/fs"
+	blobs3 "github.com/foxcpp/maddy-storage/internal/domain/blob/repository/s3"
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	changelogpostgres "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/postgres"
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	datakeypostgres "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/postgres"
+	datakeysqlite "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	folderpostgres "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/postgres"
 	foldersqlite "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messageparser "github.com/foxcpp/maddy-storage/internal/domain/message/parser"
+	messagepostgres "github.com/foxcpp/maddy-storage/internal/domain/message/repository/postgres"
 	messagesqlite "github.com/foxcpp/maddy-storage/internal/domain/message/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/pkg/compress"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
 	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
 	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/usecase"
 	storagecli "github.com/foxcpp/maddy-storage/pkg/cli"
@@ -26,8 +40,11 @@ func storageInit(c *cli.Context) (storagecli.App, error) {
 	var (
 		accountsRepo  account.Repo
 		folderRepo    folder.Repo
+		folderSearch  folder.Searcher
 		messageRepo   message.Repo
 		changelogRepo changelog.Repo
+		tx            usecase.Transactor
+		blobStore     blob.Store
 	)
 	if c.IsSet("debug") {
 		dev, err := zap.NewDevelopment()
@@ -36,7 +53,24 @@ func storageInit(c *cli.Context) (storagecli.App, error) {
 		}
 		zap.ReplaceGlobals(dev)
 	}
-	if c.IsSet("sqlite") {
+
+	var (
+		master  []byte
+		keyring *datakey.Keyring
+	)
+	if c.IsSet("master-key-file") {
+		text, err := os.ReadFile(c.Path("master-key-file"))
+		if err != nil {
+			return storagecli.App{}, cli.Exit("Unable to read master key: "+err.Error(), 2)
+		}
+		master, err = crypt.ParseKey(string(text))
+		if err != nil {
+			return storagecli.App{}, cli.Exit("Unable to read master key: "+err.Error(), 2)
+		}
+	}
+
+	switch {
+	case c.IsSet("sqlite"):
 		db, err := sqlite.New(c.Path("sqlite"), sqlite.Cfg{})
 		if err != nil {
 			return storagecli.App{}, cli.Exit("Unable to open SQLite DB: "+err.Error(), 2)
@@ -44,17 +78,73 @@ func storageInit(c *cli.Context) (storagecli.App, error) {
 
 		accountsRepo = accountsqlite.New(db)
 		folderRepo = foldersqlite.New(db)
+		folderSearch = foldersqlite.NewSearcher(db)
 		messageRepo = messagesqlite.New(db)
+		if master != nil {
+			keyring = datakey.NewKeyring(datakeysqlite.New(db), master)
+			messageRepo = messagesqlite.NewEncrypted(db, keyring)
+		}
 		changelogRepo = changelogsqlite.New(db)
-	} else {
+		tx = db
+	case c.IsSet("postgres"):
+		db, err := postgres.New(c.String("postgres"), postgres.Cfg{})
+		if err != nil {
+			return storagecli.App{}, cli.Exit("Unable to open PostgreSQL DB: "+err.Error(), 2)
+		}
+
+		accountsRepo = accountpostgres.New(db)
+		folderRepo = folderpostgres.New(db)
+		folderSearch = folderpostgres.NewSearcher(db)
+		messageRepo = messagepostgres.New(db)
+		if master != nil {
+			keyring = datakey.NewKeyring(datakeypostgres.New(db), master)
+			messageRepo = messagepostgres.NewEncrypted(db, keyring)
+		}
+		changelogRepo = changelogpostgres.New(db)
+		tx = db
+	default:
 		return storagecli.App{}, cli.Exit("Missing DB path", 2)
 	}
+	if c.IsSet("blob-dir") {
+		var err error
+		blobStore, err = blobfs.New(c.Path("blob-dir"))
+		if err != nil {
+			return storagecli.App{}, cli.Exit("Unable to open blob store: "+err.Error(), 2)
+		}
+	} else if c.IsSet("s3-endpoint") {
+		var err error
+		blobStore, err = blobs3.New(blobs3.Cfg{
+			Endpoint:  c.String("s3-endpoint"),
+			Secure:    !c.Bool("s3-insecure"),
+			Region:    c.String("s3-region"),
+			AccessKey: c.String("s3-access-key"),
+			SecretKey: c.String("s3-secret-key"),
+			Bucket:    c.String("s3-bucket"),
+			Prefix:    c.String("s3-prefix"),
+		})
+		if err != nil {
+			return storagecli.App{}, cli.Exit("Unable to open blob store: "+err.Error(), 2)
+		}
+	}
+
+	msgUsecase, err := usecase.NewMessage(folderRepo, messageRepo, changelogRepo, tx, blobStore).
+		WithCompression(c.String("compress"), messageparser.DefaultCompressThreshold)
+	if err != nil {
+		return storagecli.App{}, cli.Exit(err.Error(), 2)
+	}
 
-	return storagecli.App{
-		Accounts: usecase.NewAccount(accountsRepo, usecase.StubAuth{}, changelogRepo),
-		Folders:  usecase.NewFolder(folderRepo, changelogRepo),
-		Message:  usecase.NewMessage(folderRepo, messageRepo, changelogRepo),
-	}, nil
+	app := storagecli.App{
+		Accounts:  usecase.NewAccount(accountsRepo, usecase.StubAuth{}, changelogRepo, tx),
+		Folders:   usecase.NewFolder(folderRepo, folderSearch, changelogRepo, tx),
+		Message:   msgUsecase,
+		ChangeLog: usecase.NewChangeLog(changelogRepo),
+	}
+	if keyring != nil {
+		app.Message = app.Message.WithEncryption(keyring)
+		encryption := usecase.NewEncryption(keyring, messageRepo, blobStore)
+		app.Encryption = &encryption
+	}
+	return app, nil
 }
 
 func main() {
@@ -80,6 +170,48 @@ func main() {
 			Name:      "sqlite",
 			TakesFile: true,
 		},
+		&cli.StringFlag{
+			Name:    "postgres",
+			Usage:   "PostgreSQL DSN, e.g. \"host=localhost dbname=maddy\"",
+			EnvVars: []string{"POSTGRES_DSN"},
+		},
+		&cli.StringFlag{
+			Name:      "blob-dir",
+			TakesFile: true,
+		},
+		&cli.StringFlag{
+			Name:      "master-key-file",
+			Usage:     "File with hex-encoded 32-byte key to encrypt stored messages with",
+			TakesFile: true,
+		},
+		&cli.StringFlag{
+			Name:  "compress",
+			Usage: "codec to compress message parts with (gzip, zstd), empty to disable",
+			Value: compress.Zstd,
+		},
+		&cli.StringFlag{
+			Name: "s3-endpoint",
+		},
+		&cli.StringFlag{
+			Name: "s3-bucket",
+		},
+		&cli.StringFlag{
+			Name: "s3-prefix",
+		},
+		&cli.StringFlag{
+			Name: "s3-region",
+		},
+		&cli.BoolFlag{
+			Name: "s3-insecure",
+		},
+		&cli.StringFlag{
+			Name:    "s3-access-key",
+			EnvVars: []string{"S3_ACCESS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "s3-secret-key",
+			EnvVars: []string{"S3_SECRET_KEY"},
+		},
 	}
 	app.Authors = []*cli.Author{
 		{
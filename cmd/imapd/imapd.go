@@ -1,28 +1,64 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"time"
 
-	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountmemory "github.com/foxcpp/maddy-storage/internal/domain/account/repository/memory"
+	accountpostgres "github.com/foxcpp/maddy-storage/internal/domain/account/repository/postgres"
 	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	blobfs "github.com/foxcpp/maddy-storage/internal/domain/blob/repository/fs"
+	blobs3 "github.com/foxcpp/maddy-storage/internal/domain/blob/repository/s3"
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	changelogmemory "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/memory"
+	changelogpostgres "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/postgres"
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	datakeymemory "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/memory"
+	datakeypostgres "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/postgres"
+	datakeysqlite "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	foldermemory "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/memory"
+	folderpostgres "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/postgres"
 	foldersqlite "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messageparser "github.com/foxcpp/maddy-storage/internal/domain/message/parser"
+	messagememory "github.com/foxcpp/maddy-storage/internal/domain/message/repository/memory"
+	messagepostgres "github.com/foxcpp/maddy-storage/internal/domain/message/repository/postgres"
 	messagesqlite "github.com/foxcpp/maddy-storage/internal/domain/message/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/pkg/compress"
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
 	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
 	"github.com/foxcpp/maddy-storage/internal/usecase"
 	"github.com/foxcpp/maddy-storage/pkg/imap2"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
+	"github.com/foxcpp/maddy-storage/pkg/jmap"
 	"go.uber.org/zap"
 )
 
 func main() {
 	addr := flag.String("listen", "127.0.0.1:143", "addr:port to listen on")
-	sqliteDB := flag.String("sqlite", "", "path to sqlite DB to operate on")
+	jmapAddr := flag.String("jmap-listen", "", "addr:port to serve JMAP over plain HTTP on, disabled if not set")
+	sqliteDB := flag.String("sqlite", "", "path to sqlite DB to operate on, data is kept in memory if neither -sqlite nor -postgres is set")
+	postgresDSN := flag.String("postgres", "", "PostgreSQL DSN (e.g. \"host=localhost dbname=maddy\") to operate on")
+	blobDir := flag.String("blob-dir", "", "directory to store large message parts in, stored in DB if not set")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint (host:port) to store large message parts in, credentials are read from S3_ACCESS_KEY and S3_SECRET_KEY")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket name")
+	s3Prefix := flag.String("s3-prefix", "", "prefix for S3 object names")
+	s3Region := flag.String("s3-region", "", "S3 region")
+	s3Insecure := flag.Bool("s3-insecure", false, "use plain HTTP for S3")
+	compression := flag.String("compress", compress.Zstd, "codec to compress message parts with (gzip, zstd), empty to disable")
+	masterKeyFile := flag.String("master-key-file", "", "file with hex-encoded 32-byte key to encrypt stored messages with")
+	gcInterval := flag.Duration("gc-interval", time.Hour, "how often to remove expunged messages and unused blobs, 0 to disable")
 	flag.Parse()
 
 	logger, err := zap.NewDevelopment()
@@ -34,10 +70,29 @@ func main() {
 	var (
 		accountsRepo  account.Repo
 		folderRepo    folder.Repo
+		folderSearch  folder.Searcher
 		messageRepo   message.Repo
 		changelogRepo changelog.Repo
+		tx            usecase.Transactor
+		blobStore     blob.Store
 	)
-	if *sqliteDB != "" {
+	var (
+		master  []byte
+		keyring *datakey.Keyring
+	)
+	if *masterKeyFile != "" {
+		text, err := os.ReadFile(*masterKeyFile)
+		if err != nil {
+			logger.Fatal("failed to read master key", zap.Error(err))
+		}
+		master, err = crypt.ParseKey(string(text))
+		if err != nil {
+			logger.Fatal("failed to read master key", zap.Error(err))
+		}
+	}
+
+	switch {
+	case *sqliteDB != "":
 		db, err := sqlite.New(*sqliteDB, sqlite.Cfg{})
 		if err != nil {
 			logger.Fatal("failed to init db", zap.Error(err))
@@ -45,8 +100,63 @@ func main() {
 
 		accountsRepo = accountsqlite.New(db)
 		folderRepo = foldersqlite.New(db)
+		folderSearch = foldersqlite.NewSearcher(db)
 		messageRepo = messagesqlite.New(db)
+		if master != nil {
+			keyring = datakey.NewKeyring(datakeysqlite.New(db), master)
+			messageRepo = messagesqlite.NewEncrypted(db, keyring)
+		}
 		changelogRepo = changelogsqlite.New(db)
+		tx = db
+	case *postgresDSN != "":
+		db, err := postgres.New(*postgresDSN, postgres.Cfg{})
+		if err != nil {
+			logger.Fatal("failed to init db", zap.Error(err))
+		}
+
+		accountsRepo = accountpostgres.New(db)
+		folderRepo = folderpostgres.New(db)
+		folderSearch = folderpostgres.NewSearcher(db)
+		messageRepo = messagepostgres.New(db)
+		if master != nil {
+			keyring = datakey.NewKeyring(datakeypostgres.New(db), master)
+			messageRepo = messagepostgres.NewEncrypted(db, keyring)
+		}
+		changelogRepo = changelogpostgres.New(db)
+		tx = db
+	default:
+		db := memory.New()
+
+		accountsRepo = accountmemory.New(db)
+		folderRepo = foldermemory.New(db)
+		folderSearch = foldermemory.NewSearcher(db)
+		messageRepo = messagememory.New(db)
+		if master != nil {
+			keyring = datakey.NewKeyring(datakeymemory.New(db), master)
+		}
+		changelogRepo = changelogmemory.New(db)
+		tx = db
+	}
+
+	switch {
+	case *blobDir != "":
+		blobStore, err = blobfs.New(*blobDir)
+		if err != nil {
+			logger.Fatal("failed to init blob store", zap.Error(err))
+		}
+	case *s3Endpoint != "":
+		blobStore, err = blobs3.New(blobs3.Cfg{
+			Endpoint:  *s3Endpoint,
+			Secure:    !*s3Insecure,
+			Region:    *s3Region,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+		})
+		if err != nil {
+			logger.Fatal("failed to init blob store", zap.Error(err))
+		}
 	}
 
 	cfg := imap2.Config{
@@ -56,12 +166,37 @@ func main() {
 		InsecureAuth: true,
 	}
 
-	backend := imap2.New(
-		cfg, logger,
-		usecase.NewAccount(accountsRepo, usecase.StubAuth{}, changelogRepo),
-		usecase.NewFolder(folderRepo, changelogRepo),
-		usecase.NewMessage(folderRepo, messageRepo, changelogRepo),
-	)
+	msgUsecase, err := usecase.NewMessage(folderRepo, messageRepo, changelogRepo, tx, blobStore).
+		WithCompression(*compression, messageparser.DefaultCompressThreshold)
+	if err != nil {
+		logger.Fatal("failed to init compression", zap.Error(err))
+	}
+	if keyring != nil {
+		msgUsecase = msgUsecase.WithEncryption(keyring)
+	}
+
+	if *gcInterval != 0 {
+		go msgUsecase.RunGarbageCollector(contextlog.WithLogger(context.Background(), logger), *gcInterval)
+	}
+
+	accounts := usecase.NewAccount(accountsRepo, usecase.StubAuth{}, changelogRepo, tx)
+	folders := usecase.NewFolder(folderRepo, folderSearch, changelogRepo, tx)
+	if keyring != nil {
+		folders = folders.WithEncryption(msgUsecase)
+	}
+
+	backend := imap2.New(cfg, logger, accounts, folders, msgUsecase)
+
+	if *jmapAddr != "" {
+		jmapSrv := jmap.New(jmap.Config{Notifier: backend}, logger, accounts, folders, msgUsecase, changelogRepo)
+		go func() {
+			logger.Info("serving JMAP", zap.String("addr", *jmapAddr))
+			if err := http.ListenAndServe(*jmapAddr, jmapSrv); err != nil {
+				logger.Fatal("failed to listen", zap.Error(err))
+			}
+		}()
+	}
+
 	srv := imapserver.New(backend.Options())
 	defer srv.Close()
 
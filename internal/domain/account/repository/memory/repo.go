@@ -0,0 +1,123 @@
+package accountmemory
+
+import (
+	"context"
+	"runtime/trace"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type repo struct {
+	db memory.DB
+}
+
+func New(db memory.DB) account.Repo {
+	return repo{db: db}
+}
+
+func less(o account.Order, lhs, rhs *account.Account) bool {
+	switch o {
+	case account.OrderID:
+		return lhs.ID_.Compare(rhs.ID_) < 0
+	case account.OrderName:
+		return lhs.Name_ < rhs.Name_
+	default:
+		panic("unknown order key")
+	}
+}
+
+func (r repo) GetAll(ctx context.Context, createdAtGt time.Time, order account.Order) ([]account.Account, error) {
+	defer trace.StartRegion(ctx, "account.Repository.GetAll").End()
+
+	var models []account.Account
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, acct := range t.Accounts {
+			if acct.CreatedAt_.After(createdAtGt) {
+				models = append(models, acct.Account)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return less(order, &models[i], &models[j])
+	})
+	return models, nil
+}
+
+func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*account.Account, error) {
+	defer trace.StartRegion(ctx, "account.Repository.GetByID").End()
+
+	var model *account.Account
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		acct, ok := t.Accounts[id]
+		if !ok {
+			return account.ErrNotFound
+		}
+		model = &acct.Account
+		return nil
+	})
+	return model, err
+}
+
+func (r repo) GetByName(ctx context.Context, name string) (*account.Account, error) {
+	defer trace.StartRegion(ctx, "account.Repository.GetByName").End()
+
+	var model *account.Account
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, acct := range t.Accounts {
+			if acct.Name_ == name {
+				model = &acct.Account
+				return nil
+			}
+		}
+		return account.ErrNotFound
+	})
+	return model, err
+}
+
+func (r repo) Create(ctx context.Context, acct *account.Account) error {
+	defer trace.StartRegion(ctx, "account.Repository.Create").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		if _, ok := t.Accounts[acct.ID_]; ok {
+			return account.ErrAlreadyExists
+		}
+		for _, other := range t.Accounts {
+			if other.Name_ == acct.Name_ {
+				return account.ErrAlreadyExists
+			}
+		}
+
+		memory.Set(tx, t.Accounts, acct.ID_, memory.Account{Account: *acct})
+		return nil
+	})
+}
+
+func (r repo) Delete(ctx context.Context, id ulid.ULID) error {
+	defer trace.StartRegion(ctx, "account.Repository.Delete").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for folderID, f := range t.Folders {
+			if f.AccountID_ == id {
+				memory.DeleteFolder(tx, folderID)
+			}
+		}
+		for keyID := range t.DataKeys {
+			if keyID.AccountID == id {
+				memory.Delete(tx, t.DataKeys, keyID)
+			}
+		}
+		memory.Delete(tx, t.Accounts, id)
+		return nil
+	})
+}
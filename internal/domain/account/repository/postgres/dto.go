@@ -0,0 +1,35 @@
+package accountpostgres
+
+import (
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	"github.com/oklog/ulid/v2"
+)
+
+type accountDTO struct {
+	ID        ulid.ULID `gorm:"column:id;primaryKey"`
+	Name      string    `gorm:"column:name"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime:false"`
+	UpdatedAt time.Time `gorm:"column:updated_at;autoUpdateTime:false"`
+}
+
+func (accountDTO) TableName() string { return "accounts" }
+
+func asDTO(model *account.Account) *accountDTO {
+	return &accountDTO{
+		ID:        model.ID_,
+		Name:      model.Name_,
+		CreatedAt: model.CreatedAt_,
+		UpdatedAt: model.UpdatedAt_,
+	}
+}
+
+func asModel(dto *accountDTO) *account.Account {
+	return &account.Account{
+		ID_:        dto.ID,
+		Name_:      dto.Name,
+		CreatedAt_: dto.CreatedAt,
+		UpdatedAt_: dto.UpdatedAt,
+	}
+}
@@ -62,8 +62,7 @@ func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*account.Account, erro
 	err := r.db.Gorm(ctx).
 		Model(&accountDTO{}).
 		Where("accounts.id = ?", id).
-		Limit(1).
-		Find(&dto).Error
+		First(&dto).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, account.ErrNotFound
@@ -97,14 +96,16 @@ func (r repo) GetByName(ctx context.Context, name string) (*account.Account, err
 	return model, nil
 }
 
-func (r repo) Create(ctx context.Context, account *account.Account) error {
+func (r repo) Create(ctx context.Context, acct *account.Account) error {
 	defer trace.StartRegion(ctx, "account.Repository.Create").End()
 
-	dto := asDTO(account)
+	dto := asDTO(acct)
 
 	err := r.db.Gorm(ctx).Create(dto).Error
 	if err != nil {
-		// TODO: Foreign key constraints, etc.
+		if sqlite.IsUniqueConstraintError(err) {
+			return account.ErrAlreadyExists
+		}
 		return storeerrors.InternalError{Reason: err}
 	}
 
@@ -0,0 +1,38 @@
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Put stores data under the SHA-256 hash of its contents and returns the
+// object path. Existing object is reused, so identical data is stored only
+// once.
+func Put(ctx context.Context, store Store, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	path := hex.EncodeToString(sum[:])
+
+	_, err := store.Stat(ctx, path)
+	if err == nil {
+		return path, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return "", fmt.Errorf("stat blob: %w", err)
+	}
+
+	w, err := store.Create(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("create blob: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return "", fmt.Errorf("write blob: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("write blob: %w", err)
+	}
+	return path, nil
+}
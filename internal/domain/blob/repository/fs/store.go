@@ -0,0 +1,209 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+)
+
+const tmpDir = "tmp"
+
+type store struct {
+	root string
+}
+
+// New returns blob.Store that keeps each object in a separate file under
+// root. Files are sharded into two levels of subdirectories named after
+// the object path prefix, e.g. "01/HG/01HGW2..." for "01HGW2...".
+func New(root string) (blob.Store, error) {
+	// Temporary files are placed into the same filesystem so they can be
+	// atomically renamed.
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), 0o700); err != nil {
+		return nil, fmt.Errorf("blobfs: %w", err)
+	}
+	return store{root: root}, nil
+}
+
+// objectPath returns the file name for the object. Only simple names are
+// accepted so objects cannot escape root.
+func (s store) objectPath(path string) (string, error) {
+	if len(path) < 5 || strings.ContainsAny(path, `/\`) || strings.HasPrefix(path, ".") {
+		return "", fmt.Errorf("blobfs: invalid object path: %q", path)
+	}
+	return filepath.Join(s.root, path[0:2], path[2:4], path), nil
+}
+
+type writer struct {
+	f        *os.File
+	dst      string
+	writeErr error
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	if err != nil && w.writeErr == nil {
+		w.writeErr = err
+	}
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if w.writeErr != nil {
+		w.discard()
+		return w.writeErr
+	}
+
+	if err := w.f.Sync(); err != nil {
+		w.discard()
+		return fmt.Errorf("blobfs: %w", err)
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("blobfs: %w", err)
+	}
+
+	dir := filepath.Dir(w.dst)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("blobfs: %w", err)
+	}
+	if err := os.Rename(w.f.Name(), w.dst); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("blobfs: %w", err)
+	}
+
+	// Make rename durable.
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("blobfs: %w", err)
+	}
+	return nil
+}
+
+func (w *writer) discard() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s store) Create(ctx context.Context, path string) (io.WriteCloser, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Create").End()
+
+	dst, err := s.objectPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Join(s.root, tmpDir), path+".*")
+	if err != nil {
+		return nil, fmt.Errorf("blobfs: %w", err)
+	}
+
+	return &writer{f: f, dst: dst}, nil
+}
+
+func (s store) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Open").End()
+
+	name, err := s.objectPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, blob.ErrNotFound
+		}
+		return nil, fmt.Errorf("blobfs: %w", err)
+	}
+	return f, nil
+}
+
+func (s store) Delete(ctx context.Context, path string) error {
+	defer trace.StartRegion(ctx, "blob.Store.Delete").End()
+
+	name, err := s.objectPath(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return blob.ErrNotFound
+		}
+		return fmt.Errorf("blobfs: %w", err)
+	}
+	return nil
+}
+
+func (s store) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Stat").End()
+
+	name, err := s.objectPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, blob.ErrNotFound
+		}
+		return nil, fmt.Errorf("blobfs: %w", err)
+	}
+	return &blob.Info{
+		Path:    path,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (s store) List(ctx context.Context, fn func(info blob.Info) error) error {
+	defer trace.StartRegion(ctx, "blob.Store.List").End()
+
+	tmp := filepath.Join(s.root, tmpDir)
+	return filepath.WalkDir(s.root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("blobfs: %w", err)
+		}
+		if d.IsDir() {
+			if name == tmp {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed concurrently.
+				return nil
+			}
+			return fmt.Errorf("blobfs: %w", err)
+		}
+		return fn(blob.Info{
+			Path:    d.Name(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := New(root)
+	require.NoError(t, err)
+
+	w, err := s.Create(ctx, "01HGW2ABCDEF")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// Not visible until Close.
+	_, err = s.Stat(ctx, "01HGW2ABCDEF")
+	require.ErrorIs(t, err, blob.ErrNotFound)
+
+	require.NoError(t, w.Close())
+	require.FileExists(t, filepath.Join(root, "01", "HG", "01HGW2ABCDEF"))
+
+	info, err := s.Stat(ctx, "01HGW2ABCDEF")
+	require.NoError(t, err)
+	require.EqualValues(t, 5, info.Size)
+
+	r, err := s.Open(ctx, "01HGW2ABCDEF")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "hello", string(b))
+
+	var listed []string
+	require.NoError(t, s.List(ctx, func(info blob.Info) error {
+		listed = append(listed, info.Path)
+		return nil
+	}))
+	require.Equal(t, []string{"01HGW2ABCDEF"}, listed)
+
+	require.NoError(t, s.Delete(ctx, "01HGW2ABCDEF"))
+	require.ErrorIs(t, s.Delete(ctx, "01HGW2ABCDEF"), blob.ErrNotFound)
+	_, err = s.Open(ctx, "01HGW2ABCDEF")
+	require.ErrorIs(t, err, blob.ErrNotFound)
+
+	_, err = s.Create(ctx, "../../etc/passwd")
+	require.Error(t, err)
+}
+
+func TestStoreFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := New(root)
+	require.NoError(t, err)
+
+	w, err := s.Create(ctx, "01HGW2ABCDEF")
+	require.NoError(t, err)
+	fw := w.(*writer)
+	_, err = fw.Write([]byte("partial"))
+	require.NoError(t, err)
+	fw.writeErr = errors.New("disk full")
+
+	require.Error(t, w.Close())
+	_, err = s.Stat(ctx, "01HGW2ABCDEF")
+	require.ErrorIs(t, err, blob.ErrNotFound)
+
+	tmp, err := os.ReadDir(filepath.Join(root, tmpDir))
+	require.NoError(t, err)
+	require.Empty(t, tmp)
+}
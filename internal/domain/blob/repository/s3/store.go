@@ -0,0 +1,208 @@
+package blobs3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/trace"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// DefaultPartSize is the size of parts for multipart uploads. Objects
+// smaller than this are uploaded using a single request.
+const DefaultPartSize = 16 * 1024 * 1024
+
+type Cfg struct {
+	Endpoint  string // host[:port]
+	Secure    bool   // use HTTPS
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	Bucket string
+	Prefix string // prepended to object paths, e.g. "blobs/"
+
+	PartSize uint64 // DefaultPartSize if zero, at least 5 MiB
+
+	// Transport is used for requests if set, e.g. to trust a custom CA.
+	Transport http.RoundTripper
+}
+
+type store struct {
+	cl       *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// New returns blob.Store that keeps objects in the S3-compatible object
+// storage. Path-style addressing is used, so it works with MinIO and
+// other self-hosted implementations. Bucket should exist.
+func New(cfg Cfg) (blob.Store, error) {
+	cl, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure:       cfg.Secure,
+		Region:       cfg.Region,
+		BucketLookup: minio.BucketLookupPath,
+		Transport:    cfg.Transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("blobs3: %w", err)
+	}
+
+	s := store{
+		cl:       cl,
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		partSize: cfg.PartSize,
+	}
+	if s.partSize == 0 {
+		s.partSize = DefaultPartSize
+	}
+	return s, nil
+}
+
+func (s store) key(path string) string {
+	return s.prefix + path
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// writer streams object contents to PutObject running in a separate
+// goroutine. Objects of unknown size are uploaded in parts of partSize.
+type writer struct {
+	pw       *io.PipeWriter
+	done     chan error
+	writeErr error
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	n, err := w.pw.Write(b)
+	if err != nil && w.writeErr == nil {
+		w.writeErr = err
+	}
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if w.writeErr != nil {
+		// Fails the upload, multipart upload is aborted by minio-go.
+		w.pw.CloseWithError(w.writeErr)
+		<-w.done
+		return w.writeErr
+	}
+
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("blobs3: %w", err)
+	}
+	return nil
+}
+
+func (s store) Create(ctx context.Context, path string) (io.WriteCloser, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Create").End()
+
+	pr, pw := io.Pipe()
+	w := &writer{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		_, err := s.cl.PutObject(ctx, s.bucket, s.key(path), pr, -1, minio.PutObjectOptions{
+			PartSize: s.partSize,
+		})
+		// Unblock writer if upload failed before all data is consumed.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+func (s store) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Open").End()
+
+	obj, err := s.cl.GetObject(ctx, s.bucket, s.key(path), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("blobs3: %w", err)
+	}
+	// GetObject does not send the request until the first read or Stat.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, blob.ErrNotFound
+		}
+		return nil, fmt.Errorf("blobs3: %w", err)
+	}
+	return obj, nil
+}
+
+func (s store) Delete(ctx context.Context, path string) error {
+	defer trace.StartRegion(ctx, "blob.Store.Delete").End()
+
+	// S3 does not report missing objects on removal.
+	if _, err := s.Stat(ctx, path); err != nil {
+		return err
+	}
+
+	if err := s.cl.RemoveObject(ctx, s.bucket, s.key(path), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("blobs3: %w", err)
+	}
+	return nil
+}
+
+func (s store) Stat(ctx context.Context, path string) (*blob.Info, error) {
+	defer trace.StartRegion(ctx, "blob.Store.Stat").End()
+
+	info, err := s.cl.StatObject(ctx, s.bucket, s.key(path), minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, blob.ErrNotFound
+		}
+		return nil, fmt.Errorf("blobs3: %w", err)
+	}
+	return &blob.Info{
+		Path:    path,
+		Size:    info.Size,
+		ModTime: info.LastModified,
+	}, nil
+}
+
+func (s store) List(ctx context.Context, fn func(info blob.Info) error) error {
+	defer trace.StartRegion(ctx, "blob.Store.List").End()
+
+	// Stops listing goroutine if fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objs := s.cl.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix,
+		Recursive: true,
+	})
+	for obj := range objs {
+		if obj.Err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("blobs3: %w", obj.Err)
+		}
+		err := fn(blob.Info{
+			Path:    strings.TrimPrefix(obj.Key, s.prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package blobs3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) blob.Store {
+	backend := s3mem.New()
+	require.NoError(t, backend.CreateBucket("test"))
+	// gofakes3 does not decode streaming signatures in multipart uploads,
+	// minio-go uses them only for plain HTTP.
+	// It also treats an empty delimiter as a real one, minio-go always sends
+	// it for recursive listings.
+	fake := gofakes3.New(backend).Server()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if d, ok := q["delimiter"]; ok && d[0] == "" {
+			q.Del("delimiter")
+			r.URL.RawQuery = q.Encode()
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	s, err := New(Cfg{
+		Endpoint:  strings.TrimPrefix(srv.URL, "https://"),
+		Secure:    true,
+		Transport: srv.Client().Transport,
+		Region:    "us-east-1",
+		AccessKey: "test",
+		SecretKey: "test",
+		Bucket:    "test",
+		Prefix:    "blobs/",
+		PartSize:  5 * 1024 * 1024,
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	// Larger than PartSize, uploaded using multipart upload.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 12*1024*1024/16)
+	for path, body := range map[string][]byte{
+		"small": []byte("hello"),
+		"large": large,
+	} {
+		w, err := s.Create(ctx, path)
+		require.NoError(t, err)
+		_, err = w.Write(body)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		info, err := s.Stat(ctx, path)
+		require.NoError(t, err)
+		require.EqualValues(t, len(body), info.Size)
+
+		r, err := s.Open(ctx, path)
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.True(t, bytes.Equal(body, b), path)
+	}
+
+	listed := map[string]int64{}
+	require.NoError(t, s.List(ctx, func(info blob.Info) error {
+		listed[info.Path] = info.Size
+		return nil
+	}))
+	require.Equal(t, map[string]int64{"small": 5, "large": int64(len(large))}, listed)
+
+	stop := errors.New("stop")
+	require.ErrorIs(t, s.List(ctx, func(info blob.Info) error {
+		return stop
+	}), stop)
+
+	require.NoError(t, s.Delete(ctx, "small"))
+	require.ErrorIs(t, s.Delete(ctx, "small"), blob.ErrNotFound)
+	_, err := s.Open(ctx, "small")
+	require.ErrorIs(t, err, blob.ErrNotFound)
+	_, err = s.Stat(ctx, "small")
+	require.ErrorIs(t, err, blob.ErrNotFound)
+}
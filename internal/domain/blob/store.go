@@ -4,11 +4,31 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 var ErrNotFound = errors.New("no such object")
 
+type Info struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
 type Store interface {
+	// Create returns the writer for a new object. Object becomes visible
+	// only after Close succeeds. If any Write failed, Close discards the
+	// object.
 	Create(ctx context.Context, path string) (io.WriteCloser, error)
 	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	// Delete removes the object. ErrNotFound is returned if it does not
+	// exist.
+	Delete(ctx context.Context, path string) error
+	// Stat returns information about the object. ErrNotFound is returned
+	// if it does not exist.
+	Stat(ctx context.Context, path string) (*Info, error)
+	// List calls fn for each stored object in no particular order.
+	// Iteration stops if fn returns an error, this error is returned by
+	// List.
+	List(ctx context.Context, fn func(info Info) error) error
 }
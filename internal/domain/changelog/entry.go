@@ -14,6 +14,7 @@ const (
 	TypeAccountDeleted = "account.deleted"
 	TypeFolderCreated  = "folder.created"
 	TypeFolderRenamed  = "folder.renamed"
+	TypeFolderUpdated  = "folder.updated"
 	TypeFolderDeleted  = "folder.deleted"
 	TypeMessageCreated = "message.created"
 	TypeMessageUpdated = "message.updated"
@@ -36,6 +37,9 @@ type MessageEntry struct {
 type Entry struct {
 	At   time.Time
 	Type Type
+	// ModSeq is unique and strictly increasing within the account, it is
+	// allocated by Repo.Create.
+	ModSeq int64
 
 	AccountID ulid.ULID // populated for all entries
 	FolderID  ulid.ULID // populated for all entries affecting folders and messages
@@ -47,10 +51,6 @@ type Entry struct {
 	Message  *MessageEntry
 }
 
-func (e *Entry) ModSeq() int64 {
-	return e.At.UnixMicro()
-}
-
 func NewMessage(type_ string, accountID, folderID, messageID ulid.ULID, msg *MessageEntry) *Entry {
 	return &Entry{
 		At:        time.Now(),
@@ -79,6 +79,7 @@ func NewAccount(type_ string, accountID ulid.ULID, acct *AccountEntry) *Entry {
 		At:        time.Now(),
 		Type:      Type(type_),
 		AccountID: accountID,
+		Metadata:  metadata.New(),
 		Account:   acct,
 	}
 }
@@ -4,17 +4,36 @@ import (
 	"context"
 	"time"
 
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/oklog/ulid/v2"
 )
 
+var ErrTooOld = storeerrors.ExpiredError{Text: "changes since the requested modification sequence are no longer available"}
+
 type Repo interface {
-	LastAccountTime(ctx context.Context, accountID ulid.ULID) (time.Time, error)
-	LastFolderTime(ctx context.Context, accountID ulid.ULID) (time.Time, error)
-	LastMessageTime(ctx context.Context, accountID ulid.ULID) (time.Time, error)
+	LastAccountModSeq(ctx context.Context, accountID ulid.ULID) (int64, error)
+	LastFolderModSeq(ctx context.Context, folderID ulid.ULID) (int64, error)
+	LastMessageModSeq(ctx context.Context, msgID ulid.ULID) (int64, error)
+
+	// Get*Changes return entries with ModSeq greater than modSeqGt ordered
+	// by ModSeq. GetAccountChanges and GetFolderChanges return ErrTooOld
+	// if some of these entries were pruned.
+	GetAccountChanges(ctx context.Context, accountID ulid.ULID, modSeqGt int64, limit int) ([]Entry, error)
+	GetFolderChanges(ctx context.Context, folderID ulid.ULID, modSeqGt int64, limit int) ([]Entry, error)
+	GetMessageChanges(ctx context.Context, msgID ulid.ULID, modSeqGt int64, limit int) ([]Entry, error)
 
-	GetAccountChanges(ctx context.Context, accountID ulid.ULID, atGt time.Time, limit int) ([]Entry, error)
-	GetFolderChanges(ctx context.Context, folderID ulid.ULID, atGt time.Time, limit int) ([]Entry, error)
-	GetMessageChanges(ctx context.Context, msgID ulid.ULID, atGt time.Time, limit int) ([]Entry, error)
+	// Create allocates modification sequences for entries from the
+	// per-account counter and stores them. ModSeq of entries is set and
+	// affected folders and messages get the new modification sequence.
+	// Entries are numbered in the passed order. Should be called in the
+	// same transaction as the change itself.
+	Create(ctx context.Context, entries ...*Entry) error
 
-	Create(ctx context.Context, entries ...Entry) error
+	// Prune removes entries created before olderThan (if not zero) and
+	// all but keep latest entries of each account (if not zero). Highest
+	// pruned ModSeq is recorded for accounts and folders.
+	Prune(ctx context.Context, olderThan time.Time, keep int) (int, error)
+	// Compact removes message update entries superseded by later update
+	// or delete entries for the same message in the same folder.
+	Compact(ctx context.Context) (int, error)
 }
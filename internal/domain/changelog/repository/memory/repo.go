@@ -0,0 +1,253 @@
+package changelogmemory
+
+import (
+	"context"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type repo struct {
+	db memory.DB
+}
+
+func New(db memory.DB) changelog.Repo {
+	return repo{db: db}
+}
+
+func copyEntry(ent *changelog.Entry) changelog.Entry {
+	cpy := *ent
+	cpy.Metadata = ent.Metadata.Copy()
+	if ent.Message != nil {
+		msg := *ent.Message
+		msg.Flags = append([]string(nil), msg.Flags...)
+		cpy.Message = &msg
+	}
+	if ent.Folder != nil {
+		f := *ent.Folder
+		cpy.Folder = &f
+	}
+	if ent.Account != nil {
+		acct := *ent.Account
+		cpy.Account = &acct
+	}
+	return cpy
+}
+
+func accountID(ent *changelog.Entry) ulid.ULID { return ent.AccountID }
+func folderID(ent *changelog.Entry) ulid.ULID  { return ent.FolderID }
+func messageID(ent *changelog.Entry) ulid.ULID { return ent.MessageID }
+
+func (r repo) LastAccountModSeq(ctx context.Context, id ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, accountID, id)
+}
+
+func (r repo) LastFolderModSeq(ctx context.Context, id ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, folderID, id)
+}
+
+func (r repo) LastMessageModSeq(ctx context.Context, id ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, messageID, id)
+}
+
+func (r repo) lastModSeq(ctx context.Context, key func(*changelog.Entry) ulid.ULID, id ulid.ULID) (int64, error) {
+	var modSeq int64
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for i := range t.ChangeLog {
+			ent := &t.ChangeLog[i]
+			if key(ent) == id && ent.ModSeq > modSeq {
+				modSeq = ent.ModSeq
+			}
+		}
+		return nil
+	})
+	return modSeq, err
+}
+
+func (r repo) GetAccountChanges(ctx context.Context, id ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, func(t *memory.Tables) int64 {
+		return t.Accounts[id].PrunedModSeq
+	}, accountID, id, modSeqGt, limit)
+}
+
+func (r repo) GetFolderChanges(ctx context.Context, id ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, func(t *memory.Tables) int64 {
+		return t.Folders[id].PrunedModSeq
+	}, folderID, id, modSeqGt, limit)
+}
+
+func (r repo) GetMessageChanges(ctx context.Context, id ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, nil, messageID, id, modSeqGt, limit)
+}
+
+// getChanges returns entries with key equal to id. If pruned is not nil,
+// it returns the pruned ModSeq of the object to check first.
+func (r repo) getChanges(ctx context.Context, pruned func(*memory.Tables) int64, key func(*changelog.Entry) ulid.ULID, id ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	var entries []changelog.Entry
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		// Object might be deleted already, remaining entries are still
+		// returned then.
+		if pruned != nil && modSeqGt < pruned(t) {
+			return changelog.ErrTooOld
+		}
+
+		// Entries of each account are stored in ModSeq order.
+		for i := range t.ChangeLog {
+			ent := &t.ChangeLog[i]
+			if key(ent) != id || ent.ModSeq <= modSeqGt {
+				continue
+			}
+			entries = append(entries, copyEntry(ent))
+			if limit != 0 && len(entries) == limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (r repo) Create(ctx context.Context, entries ...*changelog.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+
+		log := t.ChangeLog
+		for _, ent := range entries {
+			acct, ok := t.Accounts[ent.AccountID]
+			if !ok {
+				return storeerrors.NotExistsError{Text: "no such account"}
+			}
+			acct.ModSeq++
+			memory.Set(tx, t.Accounts, ent.AccountID, acct)
+			ent.ModSeq = acct.ModSeq
+
+			if f, ok := t.Folders[ent.FolderID]; ok && f.ModSeq_ < ent.ModSeq {
+				f.ModSeq_ = ent.ModSeq
+				memory.Set(tx, t.Folders, ent.FolderID, f)
+			}
+			if msg, ok := t.Messages[ent.MessageID]; ok && msg.ModSeq_ < ent.ModSeq {
+				msg.ModSeq_ = ent.ModSeq
+				memory.Set(tx, t.Messages, ent.MessageID, msg)
+			}
+
+			log = append(log, copyEntry(ent))
+		}
+		memory.Assign(tx, &t.ChangeLog, log)
+		return nil
+	})
+}
+
+func (r repo) Prune(ctx context.Context, olderThan time.Time, keep int) (int, error) {
+	pruned := 0
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		if !olderThan.IsZero() {
+			pruned += prune(tx, func(ent *changelog.Entry) bool {
+				return ent.At.Before(olderThan)
+			})
+		}
+		if keep != 0 {
+			// Entries are counted from the end, so the latest ones are
+			// kept.
+			count := make(map[ulid.ULID]int)
+			remove := make(map[int]bool)
+			for i := len(t.ChangeLog) - 1; i >= 0; i-- {
+				acct := t.ChangeLog[i].AccountID
+				count[acct]++
+				if count[acct] > keep {
+					remove[i] = true
+				}
+			}
+			i := -1
+			pruned += prune(tx, func(*changelog.Entry) bool {
+				i++
+				return remove[i]
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
+
+// prune removes entries matching cond and records the highest removed
+// ModSeq for affected accounts and folders. cond is called for entries in
+// order.
+func prune(tx *memory.Tx, cond func(ent *changelog.Entry) bool) int {
+	t := tx.Tables()
+
+	kept := make([]changelog.Entry, 0, len(t.ChangeLog))
+	for i := range t.ChangeLog {
+		ent := &t.ChangeLog[i]
+		if !cond(ent) {
+			kept = append(kept, *ent)
+			continue
+		}
+
+		if acct, ok := t.Accounts[ent.AccountID]; ok && acct.PrunedModSeq < ent.ModSeq {
+			acct.PrunedModSeq = ent.ModSeq
+			memory.Set(tx, t.Accounts, ent.AccountID, acct)
+		}
+		if f, ok := t.Folders[ent.FolderID]; ok && f.PrunedModSeq < ent.ModSeq {
+			f.PrunedModSeq = ent.ModSeq
+			memory.Set(tx, t.Folders, ent.FolderID, f)
+		}
+	}
+
+	pruned := len(t.ChangeLog) - len(kept)
+	memory.Assign(tx, &t.ChangeLog, kept)
+	return pruned
+}
+
+func (r repo) Compact(ctx context.Context) (int, error) {
+	compacted := 0
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+
+		type msgKey struct{ folderID, messageID ulid.ULID }
+		// Entries are processed from the end, so an update entry is
+		// superseded if there is already a later one for the message.
+		later := make(map[msgKey]bool)
+		superseded := make(map[int]bool)
+		for i := len(t.ChangeLog) - 1; i >= 0; i-- {
+			ent := &t.ChangeLog[i]
+			if ent.Type != changelog.TypeMessageUpdated && ent.Type != changelog.TypeMessageDeleted {
+				continue
+			}
+			key := msgKey{ent.FolderID, ent.MessageID}
+			if ent.Type == changelog.TypeMessageUpdated && later[key] {
+				superseded[i] = true
+			}
+			later[key] = true
+		}
+
+		kept := make([]changelog.Entry, 0, len(t.ChangeLog)-len(superseded))
+		for i, ent := range t.ChangeLog {
+			if !superseded[i] {
+				kept = append(kept, ent)
+			}
+		}
+		compacted = len(superseded)
+		memory.Assign(tx, &t.ChangeLog, kept)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return compacted, nil
+}
@@ -0,0 +1,99 @@
+package changelogpostgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/metadata"
+	"github.com/oklog/ulid/v2"
+)
+
+type entryDTO struct {
+	At        time.Time `gorm:"column:at"`
+	Type      string    `gorm:"column:type"`
+	ModSeq    int64     `gorm:"column:modseq"`
+	AccountID ulid.ULID `gorm:"column:account_id"`
+	FolderID  ulid.ULID `gorm:"column:folder_id"`
+	MessageID ulid.ULID `gorm:"column:message_id"`
+	Meta      []byte    `gorm:"column:meta"` // JSON
+	Data      []byte    `gorm:"column:data"` // JSON
+}
+
+func (entryDTO) TableName() string { return "changelog_entries" }
+
+func asDTO(ent *changelog.Entry) *entryDTO {
+	dto := &entryDTO{
+		At:        ent.At,
+		Type:      string(ent.Type),
+		ModSeq:    ent.ModSeq,
+		AccountID: ent.AccountID,
+		FolderID:  ent.FolderID,
+		MessageID: ent.MessageID,
+		Meta:      nil,
+		Data:      nil,
+	}
+
+	var err error
+	dto.Meta, err = json.Marshal(ent.Metadata)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal metadata for entry %v: %v", ent.At, err))
+	}
+
+	if ent.Account != nil {
+		dto.Data, err = json.Marshal(ent.Account)
+	}
+	if ent.Folder != nil {
+		dto.Data, err = json.Marshal(ent.Folder)
+	}
+	if ent.Message != nil {
+		dto.Data, err = json.Marshal(ent.Message)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal data for entry %v: %v", ent.At, err))
+	}
+
+	return dto
+}
+
+func asModel(dto *entryDTO) *changelog.Entry {
+	ent := &changelog.Entry{
+		At:        dto.At,
+		Type:      changelog.Type(dto.Type),
+		ModSeq:    dto.ModSeq,
+		AccountID: dto.AccountID,
+		FolderID:  dto.FolderID,
+		MessageID: dto.MessageID,
+		Account:   nil,
+		Folder:    nil,
+		Message:   nil,
+	}
+
+	ent.Metadata = metadata.New()
+	if err := json.Unmarshal(dto.Meta, &ent.Metadata); err != nil {
+		panic(fmt.Sprintf("failed to unmarshal metadata for entry %v: %v", dto.At, err))
+	}
+
+	switch prefix, _, _ := strings.Cut(dto.Type, "."); prefix {
+	case "account":
+		ent.Account = &changelog.AccountEntry{}
+		if err := json.Unmarshal(dto.Data, &ent.Account); err != nil {
+			panic(fmt.Sprintf("failed to unmarshal account data for entry %v: %v", dto.At, err))
+		}
+	case "folder":
+		ent.Folder = &changelog.FolderEntry{}
+		if err := json.Unmarshal(dto.Data, &ent.Folder); err != nil {
+			panic(fmt.Sprintln("failed to unmarshal folder data for entry: ", err))
+		}
+	case "message":
+		ent.Message = &changelog.MessageEntry{}
+		if err := json.Unmarshal(dto.Data, &ent.Message); err != nil {
+			panic(fmt.Sprintln("failed to unmarshal message data for entry: ", err))
+		}
+	default:
+	}
+
+	return ent
+}
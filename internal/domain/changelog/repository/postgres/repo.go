@@ -0,0 +1,244 @@
+package changelogpostgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+type repo struct {
+	db postgres.DB
+}
+
+func New(db postgres.DB) changelog.Repo {
+	return repo{db: db}
+}
+
+func (r repo) LastAccountModSeq(ctx context.Context, accountID ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, "changelog_entries.account_id", accountID)
+}
+
+func (r repo) LastFolderModSeq(ctx context.Context, folderID ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, "changelog_entries.folder_id", folderID)
+}
+
+func (r repo) LastMessageModSeq(ctx context.Context, messageID ulid.ULID) (int64, error) {
+	return r.lastModSeq(ctx, "changelog_entries.message_id", messageID)
+}
+
+func (r repo) lastModSeq(ctx context.Context, column string, id ulid.ULID) (int64, error) {
+	var modSeq int64
+	err := r.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Select("coalesce(max(changelog_entries.modseq), 0)").
+		Where(column+" = ?", id).
+		Row().Scan(&modSeq)
+	if err != nil {
+		return 0, storeerrors.InternalError{Reason: err}
+	}
+
+	return modSeq, nil
+}
+
+func (r repo) GetAccountChanges(ctx context.Context, accountID ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, "accounts", "changelog_entries.account_id", accountID, modSeqGt, limit)
+}
+
+func (r repo) GetFolderChanges(ctx context.Context, folderID ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, "folders", "changelog_entries.folder_id", folderID, modSeqGt, limit)
+}
+
+func (r repo) GetMessageChanges(ctx context.Context, msgID ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	return r.getChanges(ctx, "", "changelog_entries.message_id", msgID, modSeqGt, limit)
+}
+
+// getChanges returns entries with column equal to id. If prunedTable is
+// not empty, pruned_modseq of the object in this table is checked first.
+func (r repo) getChanges(ctx context.Context, prunedTable, column string, id ulid.ULID, modSeqGt int64, limit int) ([]changelog.Entry, error) {
+	var dtos []entryDTO
+
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		if prunedTable != "" {
+			var pruned int64
+			err := tx.Table(prunedTable).
+				Select("pruned_modseq").
+				Where("id = ?", id).
+				Row().Scan(&pruned)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return storeerrors.InternalError{Reason: err}
+			}
+			// Object might be deleted already, remaining entries are still
+			// returned then.
+			if modSeqGt < pruned {
+				return changelog.ErrTooOld
+			}
+		}
+
+		q := tx.Model(&entryDTO{}).
+			Where(column+" = ?", id).
+			Where("changelog_entries.modseq > ?", modSeqGt).
+			Order("changelog_entries.modseq")
+		if limit != 0 {
+			q = q.Limit(limit)
+		}
+		if err := q.Find(&dtos).Error; err != nil {
+			return storeerrors.InternalError{Reason: err}
+		}
+		return nil
+	}, &sql.TxOptions{
+		ReadOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]changelog.Entry, len(dtos))
+	for i, dto := range dtos {
+		entries[i] = *asModel(&dto)
+	}
+	return entries, nil
+}
+
+func (r repo) Create(ctx context.Context, entries ...*changelog.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	byAccount := make(map[ulid.ULID][]*changelog.Entry)
+	var accounts []ulid.ULID
+	for _, ent := range entries {
+		if _, ok := byAccount[ent.AccountID]; !ok {
+			accounts = append(accounts, ent.AccountID)
+		}
+		byAccount[ent.AccountID] = append(byAccount[ent.AccountID], ent)
+	}
+
+	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, accountID := range accounts {
+			accountEntries := byAccount[accountID]
+
+			// UPDATE locks the account row until the end of the
+			// transaction, so allocations for the account are serialized
+			// and entries become visible in the ModSeq order.
+			var last int64
+			err := tx.Raw(`UPDATE accounts SET modseq = modseq + ? WHERE id = ? RETURNING modseq`,
+				len(accountEntries), accountID).Row().Scan(&last)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return storeerrors.NotExistsError{Text: "no such account"}
+				}
+				return storeerrors.InternalError{Reason: err}
+			}
+			first := last - int64(len(accountEntries)) + 1
+			for i, ent := range accountEntries {
+				ent.ModSeq = first + int64(i)
+			}
+		}
+
+		dtos := make([]entryDTO, len(entries))
+		for i, ent := range entries {
+			dtos[i] = *asDTO(ent)
+		}
+		if err := tx.Create(dtos).Error; err != nil {
+			return storeerrors.InternalError{Reason: err}
+		}
+
+		for _, ent := range entries {
+			if ent.FolderID != (ulid.ULID{}) {
+				err := tx.Exec(`UPDATE folders SET modseq = ? WHERE id = ? AND modseq < ?`,
+					ent.ModSeq, ent.FolderID, ent.ModSeq).Error
+				if err != nil {
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
+			if ent.MessageID != (ulid.ULID{}) {
+				err := tx.Exec(`UPDATE messages SET modseq = ? WHERE id = ? AND modseq < ?`,
+					ent.ModSeq, ent.MessageID, ent.ModSeq).Error
+				if err != nil {
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r repo) Prune(ctx context.Context, olderThan time.Time, keep int) (int, error) {
+	pruned := 0
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		if !olderThan.IsZero() {
+			n, err := prune(tx, "changelog_entries.at < ?", olderThan)
+			if err != nil {
+				return err
+			}
+			pruned += n
+		}
+		if keep != 0 {
+			n, err := prune(tx, `(changelog_entries.account_id, changelog_entries.modseq) IN (
+				SELECT numbered.account_id, numbered.modseq FROM (
+					SELECT account_id, modseq, row_number() OVER (PARTITION BY account_id ORDER BY modseq DESC) AS n
+					FROM changelog_entries
+				) AS numbered
+				WHERE numbered.n > ?)`, keep)
+			if err != nil {
+				return err
+			}
+			pruned += n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
+
+// prune removes entries matching cond and records the highest removed
+// ModSeq for affected accounts and folders.
+func prune(tx *gorm.DB, cond string, arg interface{}) (int, error) {
+	for _, t := range []struct{ table, column string }{
+		{"accounts", "account_id"},
+		{"folders", "folder_id"},
+	} {
+		err := tx.Exec(`UPDATE `+t.table+` SET pruned_modseq = greatest(pruned_modseq, (
+				SELECT max(changelog_entries.modseq) FROM changelog_entries
+				WHERE changelog_entries.`+t.column+` = `+t.table+`.id AND `+cond+`))
+			WHERE `+t.table+`.id IN (
+				SELECT changelog_entries.`+t.column+` FROM changelog_entries WHERE `+cond+`)`,
+			arg, arg).Error
+		if err != nil {
+			return 0, storeerrors.InternalError{Reason: err}
+		}
+	}
+
+	q := tx.Where(cond, arg).Delete(&entryDTO{})
+	if q.Error != nil {
+		return 0, storeerrors.InternalError{Reason: q.Error}
+	}
+	return int(q.RowsAffected), nil
+}
+
+func (r repo) Compact(ctx context.Context) (int, error) {
+	q := r.db.Gorm(ctx).Exec(`
+		DELETE FROM changelog_entries
+		WHERE changelog_entries.type = ? AND EXISTS (
+			SELECT 1 FROM changelog_entries AS later
+			WHERE later.message_id = changelog_entries.message_id
+				AND later.folder_id = changelog_entries.folder_id
+				AND later.modseq > changelog_entries.modseq
+				AND later.type IN (?, ?)
+		)`, changelog.TypeMessageUpdated, changelog.TypeMessageUpdated, changelog.TypeMessageDeleted)
+	if q.Error != nil {
+		return 0, storeerrors.InternalError{Reason: q.Error}
+	}
+	return int(q.RowsAffected), nil
+}
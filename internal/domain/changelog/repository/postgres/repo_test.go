@@ -0,0 +1,58 @@
+package changelogpostgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountpostgres "github.com/foxcpp/maddy-storage/internal/domain/account/repository/postgres"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres/postgrestest"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	db := postgrestest.New(t)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountpostgres.New(db).Create(ctx, acct))
+
+	r := New(db)
+	folderID, msgID := ulid.Make(), ulid.Make()
+	for _, typ := range []string{
+		changelog.TypeMessageCreated,
+		changelog.TypeMessageUpdated,
+		changelog.TypeMessageUpdated,
+		changelog.TypeMessageUpdated,
+	} {
+		require.NoError(t, r.Create(ctx, changelog.NewMessage(typ, acct.ID_, folderID, msgID, &changelog.MessageEntry{UID: 1})))
+	}
+
+	compacted, err := r.Compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, compacted)
+
+	pruned, err := r.Prune(ctx, time.Time{}, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+
+	_, err = r.GetAccountChanges(ctx, acct.ID_, 0, 0)
+	require.ErrorIs(t, err, changelog.ErrTooOld)
+	changes, err := r.GetAccountChanges(ctx, acct.ID_, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.EqualValues(t, 4, changes[0].ModSeq)
+
+	pruned, err = r.Prune(ctx, time.Now().Add(time.Minute), 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+	_, err = r.GetFolderChanges(ctx, folderID, 1, 0)
+	require.ErrorIs(t, err, changelog.ErrTooOld)
+
+	err = r.Create(ctx, changelog.NewAccount(changelog.TypeAccountCreated, ulid.Make(), &changelog.AccountEntry{}))
+	require.Error(t, err)
+}
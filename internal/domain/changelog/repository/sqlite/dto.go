@@ -14,6 +14,7 @@ import (
 type entryDTO struct {
 	At        time.Time `gorm:"at"`
 	Type      string    `gorm:"type"`
+	ModSeq    int64     `gorm:"column:modseq"`
 	AccountID ulid.ULID `gorm:"account_id"`
 	FolderID  ulid.ULID `gorm:"folder_id"`
 	MessageID ulid.ULID `gorm:"message_id"`
@@ -21,12 +22,13 @@ type entryDTO struct {
 	Data      []byte    `gorm:"data"` // JSON
 }
 
-func (entryDTO) TableName() string { return "changelog_entry" }
+func (entryDTO) TableName() string { return "changelog_entries" }
 
 func asDTO(ent *changelog.Entry) *entryDTO {
 	dto := &entryDTO{
 		At:        ent.At,
 		Type:      string(ent.Type),
+		ModSeq:    ent.ModSeq,
 		AccountID: ent.AccountID,
 		FolderID:  ent.FolderID,
 		MessageID: ent.MessageID,
@@ -60,6 +62,7 @@ func asModel(dto *entryDTO) *changelog.Entry {
 	ent := &changelog.Entry{
 		At:        dto.At,
 		Type:      changelog.Type(dto.Type),
+		ModSeq:    dto.ModSeq,
 		AccountID: dto.AccountID,
 		FolderID:  dto.FolderID,
 		MessageID: dto.MessageID,
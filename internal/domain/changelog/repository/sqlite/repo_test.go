@@ -0,0 +1,107 @@
+package changelogsqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateAllocatesModSeq(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+
+	accounts := accountsqlite.New(db)
+	acct1, err := account.NewAccount("test1")
+	require.NoError(t, err)
+	require.NoError(t, accounts.Create(ctx, acct1))
+	acct2, err := account.NewAccount("test2")
+	require.NoError(t, err)
+	require.NoError(t, accounts.Create(ctx, acct2))
+
+	r := New(db)
+	folderID := ulid.Make()
+	entries := []*changelog.Entry{
+		changelog.NewFolder(changelog.TypeFolderCreated, acct1.ID_, folderID, &changelog.FolderEntry{NewName: "a"}),
+		changelog.NewAccount(changelog.TypeAccountCreated, acct2.ID_, &changelog.AccountEntry{}),
+		changelog.NewFolder(changelog.TypeFolderRenamed, acct1.ID_, folderID, &changelog.FolderEntry{OldName: "a", NewName: "b"}),
+	}
+	require.NoError(t, r.Create(ctx, entries...))
+	require.Equal(t, []int64{1, 1, 2}, []int64{entries[0].ModSeq, entries[1].ModSeq, entries[2].ModSeq})
+
+	require.NoError(t, r.Create(ctx,
+		changelog.NewFolder(changelog.TypeFolderDeleted, acct1.ID_, folderID, &changelog.FolderEntry{OldName: "b"})))
+
+	last, err := r.LastFolderModSeq(ctx, folderID)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, last)
+
+	changes, err := r.GetFolderChanges(ctx, folderID, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.EqualValues(t, 2, changes[0].ModSeq)
+	require.Equal(t, "b", changes[0].Folder.NewName)
+	require.EqualValues(t, 3, changes[1].ModSeq)
+
+	err = r.Create(ctx, changelog.NewAccount(changelog.TypeAccountCreated, ulid.Make(), &changelog.AccountEntry{}))
+	require.Error(t, err)
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountsqlite.New(db).Create(ctx, acct))
+
+	r := New(db)
+	folderID, msgID := ulid.Make(), ulid.Make()
+	for _, typ := range []string{
+		changelog.TypeMessageCreated,
+		changelog.TypeMessageUpdated,
+		changelog.TypeMessageUpdated,
+		changelog.TypeMessageUpdated,
+	} {
+		require.NoError(t, r.Create(ctx, changelog.NewMessage(typ, acct.ID_, folderID, msgID, &changelog.MessageEntry{UID: 1})))
+	}
+
+	// Only the latest update is needed.
+	compacted, err := r.Compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, compacted)
+
+	changes, err := r.GetAccountChanges(ctx, acct.ID_, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.EqualValues(t, 4, changes[1].ModSeq)
+
+	pruned, err := r.Prune(ctx, time.Time{}, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+
+	_, err = r.GetAccountChanges(ctx, acct.ID_, 0, 0)
+	require.ErrorIs(t, err, changelog.ErrTooOld)
+	changes, err = r.GetAccountChanges(ctx, acct.ID_, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	pruned, err = r.Prune(ctx, time.Now().Add(time.Minute), 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+
+	_, err = r.GetAccountChanges(ctx, acct.ID_, 1, 0)
+	require.ErrorIs(t, err, changelog.ErrTooOld)
+	changes, err = r.GetAccountChanges(ctx, acct.ID_, 4, 0)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
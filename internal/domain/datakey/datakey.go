@@ -0,0 +1,36 @@
+// Package datakey manages per-account keys used to encrypt stored
+// messages. Keys are stored wrapped (encrypted) by the master key.
+package datakey
+
+import (
+	"context"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	ErrNotFound      = storeerrors.NotExistsError{Text: "datakey: no such key"}
+	ErrAlreadyExists = storeerrors.AlreadyExistsError{Text: "datakey: key version already exists"}
+)
+
+type Key struct {
+	AccountID_ ulid.ULID
+	Version_   int // starts at 1, the key with the highest version is current
+	Wrapped_   []byte
+	CreatedAt_ time.Time
+}
+
+func (k *Key) AccountID() ulid.ULID { return k.AccountID_ }
+func (k *Key) Version() int         { return k.Version_ }
+func (k *Key) CreatedAt() time.Time { return k.CreatedAt_ }
+
+type Repo interface {
+	Get(ctx context.Context, accountID ulid.ULID, version int) (*Key, error)
+	// Latest returns the key with the highest version.
+	Latest(ctx context.Context, accountID ulid.ULID) (*Key, error)
+	// Create saves the key. ErrAlreadyExists is returned if the account
+	// already has the key with the same version.
+	Create(ctx context.Context, key *Key) error
+}
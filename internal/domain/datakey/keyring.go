@@ -0,0 +1,125 @@
+package datakey
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/oklog/ulid/v2"
+)
+
+// Keyring implements crypt.Keys using keys from Repo. Account key is
+// created on the first use.
+type Keyring struct {
+	repo   Repo
+	master []byte
+
+	// Unwrapped keys, keys are never changed once created.
+	cache sync.Map // cacheKey -> []byte
+}
+
+type cacheKey struct {
+	accountID ulid.ULID
+	version   int
+}
+
+func NewKeyring(repo Repo, master []byte) *Keyring {
+	return &Keyring{repo: repo, master: master}
+}
+
+// wrapAD binds the wrapped key to the account and version, so wrapped
+// keys cannot be swapped in the DB.
+func wrapAD(accountID ulid.ULID, version int) []byte {
+	ad := make([]byte, 0, len(accountID)+8)
+	ad = append(ad, accountID[:]...)
+	return binary.BigEndian.AppendUint64(ad, uint64(version))
+}
+
+func (k *Keyring) unwrap(key *Key) ([]byte, error) {
+	ck := cacheKey{key.AccountID_, key.Version_}
+	if raw, ok := k.cache.Load(ck); ok {
+		return raw.([]byte), nil
+	}
+
+	raw, err := crypt.Open(k.master, key.Wrapped_, wrapAD(key.AccountID_, key.Version_))
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: fmt.Errorf("datakey: unwrap key %d of %v (wrong master key?): %w", key.Version_, key.AccountID_, err)}
+	}
+	k.cache.Store(ck, raw)
+	return raw, nil
+}
+
+func (k *Keyring) create(ctx context.Context, accountID ulid.ULID, version int) ([]byte, error) {
+	raw, err := crypt.NewKey()
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+	wrapped, err := crypt.Seal(k.master, raw, wrapAD(accountID, version))
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	err = k.repo.Create(ctx, &Key{
+		AccountID_: accountID,
+		Version_:   version,
+		Wrapped_:   wrapped,
+		CreatedAt_: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	k.cache.Store(cacheKey{accountID, version}, raw)
+	return raw, nil
+}
+
+func (k *Keyring) CurrentKey(ctx context.Context, accountID ulid.ULID) (int, []byte, error) {
+	key, err := k.repo.Latest(ctx, accountID)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return 0, nil, err
+		}
+		raw, err := k.create(ctx, accountID, 1)
+		if errors.Is(err, ErrAlreadyExists) {
+			// Created concurrently.
+			return k.CurrentKey(ctx, accountID)
+		}
+		return 1, raw, err
+	}
+
+	raw, err := k.unwrap(key)
+	return key.Version_, raw, err
+}
+
+func (k *Keyring) Key(ctx context.Context, accountID ulid.ULID, version int) ([]byte, error) {
+	if raw, ok := k.cache.Load(cacheKey{accountID, version}); ok {
+		return raw.([]byte), nil
+	}
+
+	key, err := k.repo.Get(ctx, accountID, version)
+	if err != nil {
+		return nil, err
+	}
+	return k.unwrap(key)
+}
+
+// Rotate creates a new key for the account. It is used for new data,
+// existing data should be re-encrypted separately.
+func (k *Keyring) Rotate(ctx context.Context, accountID ulid.ULID) (int, error) {
+	version := 1
+	key, err := k.repo.Latest(ctx, accountID)
+	if err == nil {
+		version = key.Version_ + 1
+	} else if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	if _, err := k.create(ctx, accountID, version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
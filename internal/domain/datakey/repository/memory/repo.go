@@ -0,0 +1,71 @@
+package datakeymemory
+
+import (
+	"context"
+	"runtime/trace"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type repo struct {
+	db memory.DB
+}
+
+func New(db memory.DB) datakey.Repo {
+	return repo{db: db}
+}
+
+func (r repo) Get(ctx context.Context, accountID ulid.ULID, version int) (*datakey.Key, error) {
+	defer trace.StartRegion(ctx, "datakey.Repository.Get").End()
+
+	var model *datakey.Key
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		key, ok := t.DataKeys[memory.DataKeyID{AccountID: accountID, Version: version}]
+		if !ok {
+			return datakey.ErrNotFound
+		}
+		model = &key
+		return nil
+	})
+	return model, err
+}
+
+func (r repo) Latest(ctx context.Context, accountID ulid.ULID) (*datakey.Key, error) {
+	defer trace.StartRegion(ctx, "datakey.Repository.Latest").End()
+
+	var model *datakey.Key
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for id, key := range t.DataKeys {
+			if id.AccountID == accountID && (model == nil || key.Version_ > model.Version_) {
+				key := key
+				model = &key
+			}
+		}
+		if model == nil {
+			return datakey.ErrNotFound
+		}
+		return nil
+	})
+	return model, err
+}
+
+func (r repo) Create(ctx context.Context, key *datakey.Key) error {
+	defer trace.StartRegion(ctx, "datakey.Repository.Create").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		if _, ok := t.Accounts[key.AccountID_]; !ok {
+			return storeerrors.NotExistsError{Text: "no such account"}
+		}
+		id := memory.DataKeyID{AccountID: key.AccountID_, Version: key.Version_}
+		if _, ok := t.DataKeys[id]; ok {
+			return datakey.ErrAlreadyExists
+		}
+
+		memory.Set(tx, t.DataKeys, id, *key)
+		return nil
+	})
+}
@@ -0,0 +1,35 @@
+package datakeypostgres
+
+import (
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/oklog/ulid/v2"
+)
+
+type keyDTO struct {
+	AccountID ulid.ULID `gorm:"column:account_id"`
+	Version   int       `gorm:"column:version"`
+	Wrapped   []byte    `gorm:"column:wrapped"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime:false"`
+}
+
+func (keyDTO) TableName() string { return "account_keys" }
+
+func asDTO(model *datakey.Key) *keyDTO {
+	return &keyDTO{
+		AccountID: model.AccountID_,
+		Version:   model.Version_,
+		Wrapped:   model.Wrapped_,
+		CreatedAt: model.CreatedAt_,
+	}
+}
+
+func asModel(dto *keyDTO) *datakey.Key {
+	return &datakey.Key{
+		AccountID_: dto.AccountID,
+		Version_:   dto.Version,
+		Wrapped_:   dto.Wrapped,
+		CreatedAt_: dto.CreatedAt,
+	}
+}
@@ -0,0 +1,70 @@
+package datakeypostgres
+
+import (
+	"context"
+	"errors"
+	"runtime/trace"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+type repo struct {
+	db postgres.DB
+}
+
+func New(db postgres.DB) datakey.Repo {
+	return repo{db: db}
+}
+
+func (r repo) Get(ctx context.Context, accountID ulid.ULID, version int) (*datakey.Key, error) {
+	defer trace.StartRegion(ctx, "datakey.Repository.Get").End()
+
+	var dto keyDTO
+	err := r.db.Gorm(ctx).
+		Where("account_keys.account_id = ? AND account_keys.version = ?", accountID, version).
+		First(&dto).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, datakey.ErrNotFound
+		}
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return asModel(&dto), nil
+}
+
+func (r repo) Latest(ctx context.Context, accountID ulid.ULID) (*datakey.Key, error) {
+	defer trace.StartRegion(ctx, "datakey.Repository.Latest").End()
+
+	var dto keyDTO
+	err := r.db.Gorm(ctx).
+		Where("account_keys.account_id = ?", accountID).
+		Order("account_keys.version DESC").
+		First(&dto).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, datakey.ErrNotFound
+		}
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return asModel(&dto), nil
+}
+
+func (r repo) Create(ctx context.Context, key *datakey.Key) error {
+	defer trace.StartRegion(ctx, "datakey.Repository.Create").End()
+
+	err := r.db.Gorm(ctx).Create(asDTO(key)).Error
+	if err != nil {
+		if postgres.IsUniqueConstraintError(err) {
+			return datakey.ErrAlreadyExists
+		}
+		return storeerrors.InternalError{Reason: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package datakeysqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountsqlite.New(db).Create(ctx, acct))
+
+	master, err := crypt.NewKey()
+	require.NoError(t, err)
+	keyring := datakey.NewKeyring(New(db), master)
+
+	version, key1, err := keyring.CurrentKey(ctx, acct.ID_)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	_, again, err := keyring.CurrentKey(ctx, acct.ID_)
+	require.NoError(t, err)
+	require.Equal(t, key1, again)
+
+	version, err = keyring.Rotate(ctx, acct.ID_)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	version, key2, err := keyring.CurrentKey(ctx, acct.ID_)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+	require.NotEqual(t, key1, key2)
+
+	// Not cached.
+	other, err := crypt.NewKey()
+	require.NoError(t, err)
+	_, err = datakey.NewKeyring(New(db), other).Key(ctx, acct.ID_, 1)
+	require.Error(t, err)
+	key, err := datakey.NewKeyring(New(db), master).Key(ctx, acct.ID_, 1)
+	require.NoError(t, err)
+	require.Equal(t, key1, key)
+
+	_, err = keyring.Key(ctx, acct.ID_, 3)
+	require.ErrorIs(t, err, datakey.ErrNotFound)
+}
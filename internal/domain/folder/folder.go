@@ -57,6 +57,8 @@ type Folder struct {
 	UIDValidity_ uint32
 	UIDNext_     uint32 // mutable via repository only
 
+	ModSeq_ int64 // modification sequence of the latest change, assigned by changelog.Repo
+
 	Metadata_  metadata.Md // mutable
 	CreatedAt_ time.Time
 	UpdatedAt_ time.Time
@@ -80,6 +82,8 @@ func (f *Folder) SortOrder() uint  { return f.SortOrder_ }
 func (f *Folder) UIDValidity() uint32 { return f.UIDValidity_ }
 func (f *Folder) UIDNext() uint32     { return f.UIDNext_ }
 
+func (f *Folder) ModSeq() int64 { return f.ModSeq_ }
+
 func (f *Folder) Metadata() metadata.Md { return f.Metadata_ }
 func (f *Folder) CreatedAt() time.Time  { return f.CreatedAt_ }
 func (f *Folder) UpdatedAt() time.Time  { return f.UpdatedAt_ }
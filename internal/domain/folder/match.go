@@ -0,0 +1,170 @@
+package folder
+
+import (
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+)
+
+// Match reports whether the folder entry referencing msg with the given
+// text matches cond. Text conditions are matched as substrings, ignoring
+// the case of ASCII letters.
+func Match(cond *SearchCond, ent *Entry, msg *message.Msg, text *message.SearchText, encrypted bool) bool {
+	if cond.FolderIDs != nil && !containsID(cond.FolderIDs, ent.FolderID_) {
+		return false
+	}
+	if cond.UIDs != nil && !inRanges(ent.UID_, cond.UIDs) {
+		return false
+	}
+	if cond.Encrypted != nil && *cond.Encrypted != encrypted {
+		return false
+	}
+
+	if !inTimeRange(msg.ReceivedAt_, cond.DateSince, cond.DateUntil) ||
+		!inTimeRange(sentDate(msg), cond.SentSince, cond.SentUntil) ||
+		!inTimeRange(msg.CreatedAt_, cond.CreatedSince, cond.CreatedUntil) ||
+		!inTimeRange(msg.UpdatedAt_, cond.UpdatedSince, cond.UpdatedUntil) {
+		return false
+	}
+
+	if text == nil {
+		text = &message.SearchText{}
+	}
+	for _, fields := range []struct {
+		values []string
+		text   []string
+	}{
+		{cond.Body, []string{text.Body}},
+		{cond.Text, []string{text.From, text.To, text.Cc, text.Bcc, text.Subject, text.Header, text.Body}},
+		{cond.From, []string{text.From}},
+		{cond.To, []string{text.To}},
+		{cond.Cc, []string{text.Cc}},
+		{cond.Bcc, []string{text.Bcc}},
+		{cond.Subject, []string{text.Subject}},
+	} {
+		for _, v := range fields.values {
+			if !containsFold(fields.text, v) {
+				return false
+			}
+		}
+	}
+	for _, h := range cond.Header {
+		if !hasHeader(text.Header, h) {
+			return false
+		}
+	}
+
+	if cond.SizeSince != 0 && msg.Content_.Size < cond.SizeSince {
+		return false
+	}
+	if cond.SizeUntil != 0 && msg.Content_.Size >= cond.SizeUntil {
+		return false
+	}
+	if cond.ModSeqSince != 0 && msg.ModSeq_ < cond.ModSeqSince {
+		return false
+	}
+
+	for _, f := range cond.Flag {
+		if !message.HasFlag(msg.Flags_, f) {
+			return false
+		}
+	}
+	for _, f := range cond.NoFlag {
+		if message.HasFlag(msg.Flags_, f) {
+			return false
+		}
+	}
+
+	if cond.Not != nil && Match(cond.Not, ent, msg, text, encrypted) {
+		return false
+	}
+	for _, group := range cond.Or {
+		matched := false
+		for _, alt := range group {
+			if Match(alt, ent, msg, text, encrypted) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sentDate is the Date header field value, falling back to the internal
+// date if the field is missing.
+func sentDate(msg *message.Msg) time.Time {
+	if env := msg.Content_.Envelope; env != nil && !env.Date.IsZero() {
+		return env.Date
+	}
+	return msg.ReceivedAt_
+}
+
+func inRanges(uid uint32, ranges []UIDRange) bool {
+	for _, r := range ranges {
+		if uid >= r.Since && uid <= r.Until {
+			return true
+		}
+	}
+	return false
+}
+
+func inTimeRange(t, since, until time.Time) bool {
+	if !since.IsZero() && t.Before(since) {
+		return false
+	}
+	if !until.IsZero() && !t.Before(until) {
+		return false
+	}
+	return true
+}
+
+func containsID(ids []ulid.ULID, id ulid.ULID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiLower folds the case of ASCII letters only, as i;ascii-casemap
+// comparator used by IMAP SEARCH and SQL LIKE do.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+func containsFold(texts []string, value string) bool {
+	value = asciiLower(value)
+	for _, text := range texts {
+		if strings.Contains(asciiLower(text), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHeader reports whether the header (one field per line) has the field
+// containing the value.
+func hasHeader(header string, cond HeaderCond) bool {
+	for _, line := range strings.Split(header, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || asciiLower(strings.TrimSpace(name)) != asciiLower(cond.Name) {
+			continue
+		}
+		if containsFold([]string{value}, cond.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -28,6 +28,15 @@ func (r UIDRange) String() string {
 	return fmt.Sprintf("%d:%d", r.Since, r.Until)
 }
 
+// Stats contains aggregate counters over folder entries.
+type Stats struct {
+	Msgs        int
+	UnseenMsgs  int // without \Seen flag
+	DeletedMsgs int // with \Deleted flag
+	Size        int64
+	DeletedSize int64 // total size of messages with \Deleted flag
+}
+
 type Filter struct {
 	PathRegex    []*regexp.Regexp // Must be POSIX-compatible
 	NameContains *string
@@ -99,7 +108,11 @@ type Repo interface {
 
 	NextUID(ctx context.Context, folderID ulid.ULID, n int) ([]uint32, error)
 	CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...UIDRange) (int, error)
+	GetStats(ctx context.Context, folderID ulid.ULID) (*Stats, error)
 	GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...UIDRange) ([]Entry, error)
+	// GetEntryByMsgID returns entries referencing the listed messages
+	// ordered by folder and UID.
+	GetEntryByMsgID(ctx context.Context, msgIDs ...ulid.ULID) ([]Entry, error)
 	CreateEntry(ctx context.Context, entry ...Entry) error
 	ReplaceEntries(ctx context.Context, old []Entry, new []Entry) error
 	DeleteEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...UIDRange) error
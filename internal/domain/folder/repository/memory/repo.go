@@ -0,0 +1,561 @@
+package foldermemory
+
+import (
+	"context"
+	"runtime/trace"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type repo struct {
+	db memory.DB
+}
+
+func New(db memory.DB) folder.Repo {
+	return repo{db: db}
+}
+
+func asModel(f *memory.Folder) *folder.Folder {
+	model := f.Folder
+	model.Metadata_ = model.Metadata_.Copy()
+	model.InitialUpdatedAt = model.UpdatedAt_
+	return &model
+}
+
+func matches(f *folder.Folder, flt *folder.Filter) bool {
+	if flt.NameContains != nil && !strings.Contains(f.Name_, *flt.NameContains) {
+		return false
+	}
+	if flt.Path != nil && f.Path_ != *flt.Path {
+		return false
+	}
+	if flt.PathPrefix != nil && !strings.HasPrefix(f.Path_, *flt.PathPrefix) {
+		return false
+	}
+	if flt.ParentID != nil && f.ParentID_ != *flt.ParentID {
+		return false
+	}
+	if flt.ParentPath != nil && !strings.HasPrefix(f.Path_, *flt.ParentPath+folder.PathSeparator) {
+		return false
+	}
+	if flt.Subscribed != nil && f.Subscribed_ != *flt.Subscribed {
+		return false
+	}
+	if flt.HasRole != nil && (f.Role_ != folder.RoleNone) != *flt.HasRole {
+		return false
+	}
+	if flt.Role != nil && f.Role_ != *flt.Role {
+		return false
+	}
+	if len(flt.PathRegex) != 0 {
+		for _, re := range flt.PathRegex {
+			if re.MatchString(f.Path_) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// less compares folders the same way SQL repositories order them.
+func less(o folder.Order, lhs, rhs *folder.Folder) bool {
+	switch o {
+	case folder.OrderBySortOrder:
+		if lhs.SortOrder_ != rhs.SortOrder_ {
+			return lhs.SortOrder_ < rhs.SortOrder_
+		}
+		return lhs.Name_ < rhs.Name_
+	case folder.OrderBySortOrderDesc:
+		if lhs.SortOrder_ != rhs.SortOrder_ {
+			return lhs.SortOrder_ > rhs.SortOrder_
+		}
+		return lhs.Name_ > rhs.Name_
+	case folder.OrderByCreatedAt:
+		if !lhs.CreatedAt_.Equal(rhs.CreatedAt_) {
+			return lhs.CreatedAt_.Before(rhs.CreatedAt_)
+		}
+		return lhs.Name_ < rhs.Name_
+	case folder.OrderByCreatedAtDesc:
+		if !lhs.CreatedAt_.Equal(rhs.CreatedAt_) {
+			return lhs.CreatedAt_.After(rhs.CreatedAt_)
+		}
+		return lhs.Name_ > rhs.Name_
+	case folder.OrderByName:
+		return lhs.Name_ < rhs.Name_
+	case folder.OrderByNameDesc:
+		return lhs.Name_ > rhs.Name_
+	default:
+		panic("unknown sort order")
+	}
+}
+
+func inRanges(uid uint32, ranges []folder.UIDRange) bool {
+	for _, r := range ranges {
+		if uid >= r.Since && uid <= r.Until {
+			return true
+		}
+	}
+	return false
+}
+
+func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByID").End()
+
+	var model *folder.Folder
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		f, ok := t.Folders[id]
+		if !ok {
+			return folder.ErrNotFound
+		}
+		model = asModel(&f)
+		return nil
+	})
+	return model, err
+}
+
+func (r repo) GetByPath(ctx context.Context, accountID ulid.ULID, path string) (*folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByPath").End()
+
+	var model *folder.Folder
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		f, ok := findByPath(t, accountID, path)
+		if !ok {
+			return folder.ErrNotFound
+		}
+		model = asModel(&f)
+		return nil
+	})
+	return model, err
+}
+
+func findByPath(t *memory.Tables, accountID ulid.ULID, path string) (memory.Folder, bool) {
+	for _, f := range t.Folders {
+		if f.AccountID_ == accountID && f.Path_ == path {
+			return f, true
+		}
+	}
+	return memory.Folder{}, false
+}
+
+func (r repo) GetByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter, order folder.Order) ([]folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByAccount").End()
+
+	var models []folder.Folder
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, stored := range t.Folders {
+			if stored.AccountID_ == accountID && matches(&stored.Folder, &f) {
+				models = append(models, *asModel(&stored))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return less(order, &models[i], &models[j])
+	})
+	return models, nil
+}
+
+func (r repo) CountByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter) (int, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.CountByAccount").End()
+
+	cnt := 0
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, stored := range t.Folders {
+			if stored.AccountID_ == accountID && matches(&stored.Folder, &f) {
+				cnt++
+			}
+		}
+		return nil
+	})
+	return cnt, err
+}
+
+// checkUnique returns ErrAlreadyExists if another folder of the account
+// has the same path or role.
+func checkUnique(t *memory.Tables, f *folder.Folder) error {
+	for _, other := range t.Folders {
+		if other.ID_ == f.ID_ || other.AccountID_ != f.AccountID_ {
+			continue
+		}
+		if other.Path_ == f.Path_ {
+			return folder.ErrAlreadyExists
+		}
+		if f.Role_ != folder.RoleNone && other.Role_ == f.Role_ {
+			return storeerrors.AlreadyExistsError{Text: "folder with such role already exists"}
+		}
+	}
+	return nil
+}
+
+func (r repo) Create(ctx context.Context, f *folder.Folder) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Create").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		if _, ok := t.Folders[f.ID_]; ok {
+			return folder.ErrAlreadyExists
+		}
+		if err := checkUnique(t, f); err != nil {
+			return err
+		}
+		if _, ok := t.Accounts[f.AccountID_]; !ok {
+			return storeerrors.LogicError{Text: "account does not exist"}
+		}
+		if f.ParentID_ != (ulid.ULID{}) {
+			if _, ok := t.Folders[f.ParentID_]; !ok {
+				return storeerrors.LogicError{Text: "parent folder does not exist"}
+			}
+		}
+
+		stored := memory.Folder{Folder: *f}
+		stored.Metadata_ = stored.Metadata_.Copy()
+		memory.Set(tx, t.Folders, f.ID_, stored)
+		return nil
+	})
+}
+
+func (r repo) Update(ctx context.Context, f *folder.Folder) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Update").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		stored, ok := t.Folders[f.ID_]
+		if !ok || !stored.UpdatedAt_.Equal(f.InitialUpdatedAt) {
+			return folder.ErrNotFound // XXX: Figure out a way to differentiate OCC failure from missing object
+		}
+
+		stored.Subscribed_ = f.Subscribed_
+		stored.Role_ = f.Role_
+		stored.SortOrder_ = f.SortOrder_
+		stored.Metadata_ = f.Metadata_.Copy()
+		stored.UpdatedAt_ = f.UpdatedAt_
+		if err := checkUnique(t, &stored.Folder); err != nil {
+			return err
+		}
+
+		memory.Set(tx, t.Folders, f.ID_, stored)
+		return nil
+	})
+}
+
+func (r repo) Delete(ctx context.Context, folderID ulid.ULID) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Delete").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for _, f := range t.Folders {
+			if f.ParentID_ == folderID {
+				return folder.ErrHasChildren
+			}
+		}
+
+		memory.DeleteFolder(tx, folderID)
+		return nil
+	})
+}
+
+func (r repo) RenameMove(
+	ctx context.Context, accountID ulid.ULID,
+	oldParent, newParent *folder.Folder,
+	oldName, newName string,
+) ([]folder.RenamedFolder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.RenameMove").End()
+
+	var oldParentID, newParentID ulid.ULID
+	var oldPath, newPath string
+	if oldParent != nil {
+		oldParentID = oldParent.ID_
+		oldPath = oldParent.Path_ + folder.PathSeparator + oldName
+	} else {
+		oldPath = oldName
+	}
+	if newParent != nil {
+		newParentID = newParent.ID_
+		newPath = newParent.Path_ + folder.PathSeparator + newName
+	} else {
+		newPath = newName
+	}
+
+	var renamed []folder.RenamedFolder
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+
+		root, ok := findByPath(t, accountID, oldPath)
+		if !ok || root.ParentID_ != oldParentID || root.Name_ != oldName {
+			return folder.ErrNotFound
+		}
+		if newParentID != (ulid.ULID{}) {
+			if _, ok := t.Folders[newParentID]; !ok {
+				return storeerrors.NotExistsError{Text: "parent folder does not exist"}
+			}
+		}
+		if _, ok := findByPath(t, accountID, newPath); ok && newPath != oldPath {
+			return folder.ErrAlreadyExists
+		}
+
+		root.ParentID_ = newParentID
+		root.Name_ = newName
+		root.Path_ = newPath
+		memory.Set(tx, t.Folders, root.ID_, root)
+		renamed = append(renamed, folder.RenamedFolder{ID: root.ID_, OldPath: oldPath, NewPath: newPath})
+
+		for id, f := range t.Folders {
+			if f.AccountID_ != accountID || !strings.HasPrefix(f.Path_, oldPath+folder.PathSeparator) {
+				continue
+			}
+			path := newPath + strings.TrimPrefix(f.Path_, oldPath)
+			if _, ok := findByPath(t, accountID, path); ok {
+				// Pretty much should be impossible, but check just in case.
+				return folder.ErrAlreadyExists
+			}
+			renamed = append(renamed, folder.RenamedFolder{ID: id, OldPath: f.Path_, NewPath: path})
+			f.Path_ = path
+			memory.Set(tx, t.Folders, id, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return renamed, nil
+}
+
+func (r repo) DeleteTree(ctx context.Context, accountID ulid.ULID, root string) ([]folder.DeletedFolder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.DeleteTree").End()
+
+	var deleted []folder.DeletedFolder
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for id, f := range t.Folders {
+			if f.AccountID_ != accountID {
+				continue
+			}
+			if f.Path_ != root && !strings.HasPrefix(f.Path_, root+folder.PathSeparator) {
+				continue
+			}
+			deleted = append(deleted, folder.DeletedFolder{ID: id, Path: f.Path_})
+			memory.DeleteFolder(tx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+func (r repo) NextUID(ctx context.Context, folderID ulid.ULID, n int) ([]uint32, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.NextUID").End()
+
+	if n <= 0 {
+		panic("n must be positive")
+	}
+
+	var uids []uint32
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		f, ok := t.Folders[folderID]
+		if !ok {
+			return folder.ErrNotFound
+		}
+
+		uids = make([]uint32, n)
+		for i := range uids {
+			uids[i] = f.UIDNext_ + uint32(i)
+		}
+		f.UIDNext_ += uint32(n)
+		memory.Set(tx, t.Folders, folderID, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uids, nil
+}
+
+func (r repo) CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) (int, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.CountEntryByUIDRange").End()
+
+	cnt := 0
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for uid := range t.Entries[folderID] {
+			if inRanges(uid, ranges) {
+				cnt++
+			}
+		}
+		return nil
+	})
+	return cnt, err
+}
+
+func (r repo) GetStats(ctx context.Context, folderID ulid.ULID) (*folder.Stats, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetStats").End()
+
+	var stats folder.Stats
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, ent := range t.Entries[folderID] {
+			msg := t.Messages[ent.MsgID_]
+
+			stats.Msgs++
+			stats.Size += msg.Content_.Size
+			if !message.HasFlag(msg.Flags_, `\Seen`) {
+				stats.UnseenMsgs++
+			}
+			if message.HasFlag(msg.Flags_, `\Deleted`) {
+				stats.DeletedMsgs++
+				stats.DeletedSize += msg.Content_.Size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (r repo) GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetEntryByUIDRange").End()
+
+	var entries []folder.Entry
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for uid, ent := range t.Entries[folderID] {
+			if inRanges(uid, ranges) {
+				entries = append(entries, ent)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].UID_ < entries[j].UID_
+	})
+	return entries, nil
+}
+
+func (r repo) GetEntryByMsgID(ctx context.Context, msgIDs ...ulid.ULID) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetEntryByMsgID").End()
+
+	ids := make(map[ulid.ULID]struct{}, len(msgIDs))
+	for _, id := range msgIDs {
+		ids[id] = struct{}{}
+	}
+
+	var entries []folder.Entry
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, folderEntries := range t.Entries {
+			for _, ent := range folderEntries {
+				if _, ok := ids[ent.MsgID_]; ok {
+					entries = append(entries, ent)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if c := entries[i].FolderID_.Compare(entries[j].FolderID_); c != 0 {
+			return c < 0
+		}
+		return entries[i].UID_ < entries[j].UID_
+	})
+	return entries, nil
+}
+
+func createEntry(tx *memory.Tx, ent folder.Entry) error {
+	t := tx.Tables()
+	if _, ok := t.Folders[ent.FolderID_]; !ok {
+		return folder.ErrDanglingEntry
+	}
+	if _, ok := t.Messages[ent.MsgID_]; !ok {
+		return folder.ErrDanglingEntry
+	}
+
+	entries := t.Entries[ent.FolderID_]
+	if entries == nil {
+		entries = make(map[uint32]folder.Entry)
+		memory.Set(tx, t.Entries, ent.FolderID_, entries)
+	}
+	if _, ok := entries[ent.UID_]; ok {
+		return folder.ErrEntryAlreadyExists
+	}
+	memory.Set(tx, entries, ent.UID_, ent)
+	return nil
+}
+
+func (r repo) CreateEntry(ctx context.Context, entry ...folder.Entry) error {
+	defer trace.StartRegion(ctx, "folder.Repository.CreateEntry").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		for _, ent := range entry {
+			if err := createEntry(tx, ent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r repo) ReplaceEntries(ctx context.Context, old []folder.Entry, new []folder.Entry) error {
+	defer trace.StartRegion(ctx, "folder.Repository.ReplaceEntries").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for _, ent := range old {
+			entries := t.Entries[ent.FolderID_]
+			for uid, stored := range entries {
+				if stored.MsgID_ == ent.MsgID_ {
+					memory.Delete(tx, entries, uid)
+				}
+			}
+		}
+		for _, ent := range new {
+			if err := createEntry(tx, ent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r repo) DeleteEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) error {
+	defer trace.StartRegion(ctx, "folder.Repository.DeleteEntryByUIDRange").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		entries := tx.Tables().Entries[folderID]
+		for uid := range entries {
+			if inRanges(uid, ranges) {
+				memory.Delete(tx, entries, uid)
+			}
+		}
+		return nil
+	})
+}
+
+func (r repo) Tx(ctx context.Context, readOnly bool, f func(r folder.Repo) error) error {
+	return r.db.Tx(ctx, readOnly, func(tx memory.DB) error {
+		txRepo := repo{db: tx}
+		return f(txRepo)
+	})
+}
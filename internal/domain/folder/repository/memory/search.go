@@ -0,0 +1,151 @@
+package foldermemory
+
+import (
+	"context"
+	"runtime/trace"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type searcher struct {
+	db memory.DB
+}
+
+// NewSearcher returns folder.Searcher matching text conditions as
+// case-insensitive substrings of the message text.
+func NewSearcher(db memory.DB) folder.Searcher {
+	return searcher{db: db}
+}
+
+func (s searcher) Search(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Searcher.Search").End()
+
+	var entries []folder.Entry
+	err := s.db.Read(ctx, func(t *memory.Tables) error {
+		for folderID, folderEntries := range t.Entries {
+			if t.Folders[folderID].AccountID_ != accountID {
+				continue
+			}
+			for _, ent := range folderEntries {
+				msg := t.Messages[ent.MsgID_]
+				// Memory repository does not encrypt messages.
+				if folder.Match(cond, &ent, &msg.Msg, msg.Search, false) {
+					entries = append(entries, ent)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FolderID_ != entries[j].FolderID_ {
+			return entries[i].FolderID_.Compare(entries[j].FolderID_) < 0
+		}
+		return entries[i].UID_ < entries[j].UID_
+	})
+	return entries, nil
+}
+
+func (s searcher) SearchMsgIDs(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond, order []folder.SearchOrder, limit int) ([]ulid.ULID, error) {
+	defer trace.StartRegion(ctx, "folder.Searcher.SearchMsgIDs").End()
+
+	var msgs []message.Msg
+	err := s.db.Read(ctx, func(t *memory.Tables) error {
+		found := make(map[ulid.ULID]bool)
+		for folderID, folderEntries := range t.Entries {
+			if t.Folders[folderID].AccountID_ != accountID {
+				continue
+			}
+			for _, ent := range folderEntries {
+				msg := t.Messages[ent.MsgID_]
+				if found[ent.MsgID_] || !folder.Match(cond, &ent, &msg.Msg, msg.Search, false) {
+					continue
+				}
+				found[ent.MsgID_] = true
+				msgs = append(msgs, msg.Msg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		if res := compareMsgs(order, &msgs[i], &msgs[j]); res != 0 {
+			return res < 0
+		}
+		return msgs[i].ID_.Compare(msgs[j].ID_) < 0
+	})
+	if limit != 0 && len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	ids := make([]ulid.ULID, len(msgs))
+	for i := range msgs {
+		ids[i] = msgs[i].ID_
+	}
+	return ids, nil
+}
+
+func compareMsgs(order []folder.SearchOrder, lhs, rhs *message.Msg) int {
+	for _, o := range order {
+		var res int
+		switch o.Key {
+		case folder.SortReceived:
+			res = compareTime(lhs.ReceivedAt_, rhs.ReceivedAt_)
+		case folder.SortSent:
+			res = compareTime(sentDate(lhs), sentDate(rhs))
+		case folder.SortSize:
+			switch {
+			case lhs.Content_.Size < rhs.Content_.Size:
+				res = -1
+			case lhs.Content_.Size > rhs.Content_.Size:
+				res = 1
+			}
+		case folder.SortFlag:
+			lhsHas, rhsHas := message.HasFlag(lhs.Flags_, o.Flag), message.HasFlag(rhs.Flags_, o.Flag)
+			switch {
+			case !lhsHas && rhsHas:
+				res = -1
+			case lhsHas && !rhsHas:
+				res = 1
+			}
+		default:
+			panic("unknown sort key")
+		}
+		if o.Desc {
+			res = -res
+		}
+		if res != 0 {
+			return res
+		}
+	}
+	return 0
+}
+
+// sentDate is the Date header field value, zero if it is missing.
+func sentDate(msg *message.Msg) time.Time {
+	if env := msg.Content_.Envelope; env != nil {
+		return env.Date
+	}
+	return time.Time{}
+}
+
+func compareTime(lhs, rhs time.Time) int {
+	switch {
+	case lhs.Before(rhs):
+		return -1
+	case lhs.After(rhs):
+		return 1
+	}
+	return 0
+}
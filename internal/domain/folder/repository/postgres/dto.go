@@ -0,0 +1,124 @@
+package folderpostgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/oklog/ulid/v2"
+)
+
+type folderDTO struct {
+	ID        ulid.ULID `gorm:"column:id;primaryKey"`
+	ParentID  []byte    `gorm:"column:parent_id"`
+	AccountID ulid.ULID `gorm:"column:account_id"`
+
+	Name string `gorm:"column:name"`
+	Path string `gorm:"column:path"`
+
+	Role       sql.NullString `gorm:"column:role"`
+	Subscribed bool           `gorm:"column:subscribed"`
+	SortOrder  uint           `gorm:"column:sort_order"`
+
+	UIDNext     uint32 `gorm:"column:uid_next"`
+	UIDValidity uint32 `gorm:"column:uid_validity"`
+
+	ModSeq int64 `gorm:"column:modseq"`
+
+	Meta      json.RawMessage `gorm:"column:meta"`
+	CreatedAt time.Time       `gorm:"column:created_at;autoCreateTime:false"`
+	UpdatedAt time.Time       `gorm:"column:updated_at;autoUpdateTime:false"`
+}
+
+func (folderDTO) TableName() string { return "folders" }
+
+func asDTO(model *folder.Folder) *folderDTO {
+	role := sql.NullString{}
+	if model.Role_ != "" {
+		role.Valid = true
+		role.String = string(model.Role_)
+	}
+	metaJSON, err := json.Marshal(model.Metadata_)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal metadata for folder %v: %v", model.ID_, err))
+	}
+
+	var parentID []byte
+	if model.ParentID_ != (ulid.ULID{}) {
+		parentID = model.ParentID_.Bytes()
+	}
+
+	return &folderDTO{
+		ID:          model.ID_,
+		ParentID:    parentID,
+		AccountID:   model.AccountID_,
+		Name:        model.Name_,
+		Path:        model.Path_,
+		Role:        role,
+		Subscribed:  model.Subscribed_,
+		SortOrder:   model.SortOrder_,
+		UIDNext:     model.UIDNext_,
+		UIDValidity: model.UIDValidity_,
+		ModSeq:      model.ModSeq_,
+		Meta:        metaJSON,
+		CreatedAt:   model.CreatedAt_,
+		UpdatedAt:   model.UpdatedAt_,
+	}
+}
+
+func asModel(dto *folderDTO) *folder.Folder {
+	model := &folder.Folder{
+		ID_:              dto.ID,
+		AccountID_:       dto.AccountID,
+		Name_:            dto.Name,
+		Path_:            dto.Path,
+		Subscribed_:      dto.Subscribed,
+		SortOrder_:       dto.SortOrder,
+		UIDValidity_:     dto.UIDValidity,
+		UIDNext_:         dto.UIDNext,
+		ModSeq_:          dto.ModSeq,
+		CreatedAt_:       dto.CreatedAt,
+		UpdatedAt_:       dto.UpdatedAt,
+		InitialUpdatedAt: dto.UpdatedAt,
+	}
+
+	if dto.Role.Valid {
+		model.Role_ = folder.Role(dto.Role.String)
+	}
+
+	if err := json.Unmarshal(dto.Meta, &model.Metadata_); err != nil {
+		panic(fmt.Sprintf("failed to unmarshal metadata for folder %v: %v", model.ID_, err))
+	}
+
+	if len(dto.ParentID) != 0 {
+		model.ParentID_ = ulid.ULID(dto.ParentID)
+	}
+
+	return model
+}
+
+type entryDTO struct {
+	FolderID  ulid.ULID `gorm:"column:folder_id"`
+	MessageID ulid.ULID `gorm:"column:message_id"`
+	UID       uint32    `gorm:"column:uid"`
+}
+
+func (entryDTO) TableName() string { return "folder_entries" }
+
+func entryAsDTO(entry *folder.Entry) *entryDTO {
+	return &entryDTO{
+		FolderID:  entry.FolderID_,
+		MessageID: entry.MsgID_,
+		UID:       entry.UID_,
+	}
+}
+
+func entryAsModel(dto *entryDTO) *folder.Entry {
+	return &folder.Entry{
+		FolderID_: dto.FolderID,
+		MsgID_:    dto.MessageID,
+		UID_:      dto.UID,
+	}
+}
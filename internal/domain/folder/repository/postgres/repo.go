@@ -0,0 +1,692 @@
+package folderpostgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"runtime/trace"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+type repo struct {
+	db postgres.DB
+}
+
+func New(db postgres.DB) folder.Repo {
+	return repo{db: db}
+}
+
+var likeEscape = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func addFilterToQuery(q *gorm.DB, f *folder.Filter) *gorm.DB {
+	// regexp is handled in GetByAccount
+
+	if f.NameContains != nil {
+		q = q.Where(`folders.name LIKE ?`, "%"+likeEscape.Replace(*f.NameContains)+"%")
+	}
+	if f.Path != nil {
+		q = q.Where("folders.path = ?", *f.Path)
+	}
+	if f.PathPrefix != nil {
+		q = q.Where(`folders.path LIKE ?`, likeEscape.Replace(*f.PathPrefix)+"%")
+	}
+	if f.ParentID != nil {
+		q = q.Where("folders.parent_id = ?", *f.ParentID)
+	}
+	if f.ParentPath != nil {
+		q = q.Where(`folders.path LIKE ?`, likeEscape.Replace(*f.ParentPath)+folder.PathSeparator+"%")
+	}
+	if f.Subscribed != nil {
+		q = q.Where("folders.subscribed = ?", *f.Subscribed)
+	}
+	if f.HasRole != nil {
+		if *f.HasRole {
+			q = q.Where("folders.role IS NOT NULL")
+		} else {
+			q = q.Where("folders.role IS NULL")
+		}
+	}
+	if f.Role != nil {
+		q = q.Where("folders.role = ?", *f.Role)
+	}
+
+	return q
+}
+
+func orderKey(o folder.Order) string {
+	switch o {
+	case folder.OrderBySortOrder:
+		return "folders.sort_order, folders.name"
+	case folder.OrderBySortOrderDesc:
+		return "folders.sort_order, folders.name DESC"
+	case folder.OrderByCreatedAt:
+		return "folders.created_at, folders.name"
+	case folder.OrderByCreatedAtDesc:
+		return "folders.created_at DESC, folders.name DESC"
+	case folder.OrderByName:
+		return "folders.name"
+	case folder.OrderByNameDesc:
+		return "folders.name DESC"
+	default:
+		panic("unknown sort order")
+	}
+}
+
+func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByID").End()
+
+	var f folderDTO
+
+	err := r.db.Gorm(ctx).
+		Model(&folderDTO{}).
+		Where("folders.id = ?", id).
+		First(&f).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, folder.ErrNotFound
+		}
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return asModel(&f), nil
+}
+
+func (r repo) GetByPath(ctx context.Context, accountID ulid.ULID, path string) (*folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByPath").End()
+
+	var f folderDTO
+
+	err := r.db.Gorm(ctx).
+		Model(&folderDTO{}).
+		Where("folders.account_id = ?", accountID).
+		Where("folders.path = ?", path).
+		First(&f).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, folder.ErrNotFound
+		}
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return asModel(&f), nil
+}
+
+// getByRegexp returns folders matching f and any of regexes. Regexes
+// are applied to the loaded folders, the literal prefix of the single
+// anchored regex is used to narrow the query.
+func (r repo) getByRegexp(tx *gorm.DB, accountID ulid.ULID, f folder.Filter, order folder.Order, regexes []*regexp.Regexp) ([]folderDTO, error) {
+	q := tx.
+		Model(&folderDTO{}).
+		Where("folders.account_id = ?", accountID)
+	if len(regexes) == 1 && strings.HasPrefix(regexes[0].String(), "^") {
+		if prefix, _ := regexes[0].LiteralPrefix(); prefix != "" {
+			q = q.Where(`folders.path LIKE ?`, likeEscape.Replace(prefix)+"%")
+		}
+	}
+
+	var dtos []folderDTO
+	err := addFilterToQuery(q, &f).
+		Order(orderKey(order)).
+		Find(&dtos).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	filtered := dtos[:0]
+	for _, dto := range dtos {
+		for _, re := range regexes {
+			if re.MatchString(dto.Path) {
+				filtered = append(filtered, dto)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
+
+func (r repo) GetByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter, order folder.Order) ([]folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByAccount").End()
+
+	var (
+		dto []folderDTO
+		err error
+	)
+	if len(f.PathRegex) == 0 {
+		err = addFilterToQuery(r.db.Gorm(ctx).
+			Model(&folderDTO{}).
+			Where("folders.account_id = ?", accountID),
+			&f).
+			Order(orderKey(order)).
+			Find(&dto).Error
+	} else {
+		dto, err = r.getByRegexp(r.db.Gorm(ctx), accountID, f, order, f.PathRegex)
+	}
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	models := make([]folder.Folder, len(dto))
+	for i, d := range dto {
+		models[i] = *asModel(&d)
+	}
+
+	return models, nil
+}
+
+func (r repo) CountByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter) (int, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.CountByAccount").End()
+
+	if len(f.PathRegex) != 0 {
+		dto, err := r.getByRegexp(r.db.Gorm(ctx), accountID, f, folder.OrderByCreatedAt, f.PathRegex)
+		if err != nil {
+			return 0, err
+		}
+		return len(dto), nil
+	}
+
+	var cnt int64
+	err := addFilterToQuery(r.db.Gorm(ctx).
+		Model(&folderDTO{}).
+		Where("folders.account_id = ?", accountID),
+		&f).
+		Count(&cnt).Error
+	if err != nil {
+		return 0, storeerrors.InternalError{Reason: err}
+	}
+
+	return int(cnt), nil
+}
+
+func (r repo) GetByPrefix(ctx context.Context, accountID ulid.ULID, f folder.Filter, prefixes ...string) ([]folder.Folder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetByPrefix").End()
+
+	dtoMap := make(map[ulid.ULID]folderDTO)
+
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, p := range prefixes {
+			var dtos []folderDTO
+
+			err := addFilterToQuery(tx.
+				Model(&folderDTO{}).
+				Where("folders.account_id = ?", accountID).
+				Where(`folders.path = ? OR folders.path LIKE ?`, p, likeEscape.Replace(p)+folder.PathSeparator+"%"),
+				&f).
+				Find(&dtos).Error
+			if err != nil {
+				return err
+			}
+
+			for _, dto := range dtos {
+				dtoMap[dto.ID] = dto
+			}
+		}
+		return nil
+
+	}, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	models := make([]folder.Folder, 0, len(dtoMap))
+	for _, dto := range dtoMap {
+		models = append(models, *asModel(&dto))
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].CreatedAt_.Before(models[j].CreatedAt_)
+	})
+
+	return models, nil
+}
+
+func (r repo) Create(ctx context.Context, f *folder.Folder) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Create").End()
+
+	dto := asDTO(f)
+
+	err := r.db.Gorm(ctx).Create(dto).Error
+	if err != nil {
+		if postgres.IsUniqueConstraintError(err) {
+			return folder.ErrAlreadyExists
+		}
+		if postgres.IsForeignConstraintError(err) {
+			return storeerrors.LogicError{Text: "parent folder does not exist"}
+		}
+		return storeerrors.InternalError{Reason: err}
+	}
+
+	return nil
+}
+
+func (r repo) Update(ctx context.Context, f *folder.Folder) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Update").End()
+
+	dto := asDTO(f)
+
+	q := r.db.Gorm(ctx).
+		Model(&folderDTO{}).
+		Where("folders.id = ? AND folders.updated_at = ?", dto.ID, f.InitialUpdatedAt).
+		Updates(map[string]interface{}{
+			"subscribed": dto.Subscribed,
+			"role":       dto.Role,
+			"sort_order": dto.SortOrder,
+			"meta":       dto.Meta,
+			"updated_at": dto.UpdatedAt,
+		})
+	if err := q.Error; err != nil {
+		if postgres.IsUniqueConstraintError(err) {
+			return storeerrors.AlreadyExistsError{Text: "folder with such role already exists", Cause: err}
+		}
+		return storeerrors.InternalError{Reason: err}
+	}
+	if q.RowsAffected == 0 {
+		return folder.ErrNotFound // XXX: Figure out a way to differentiate OCC failure from missing object
+	}
+
+	return nil
+}
+
+func (r repo) Delete(ctx context.Context, folderID ulid.ULID) error {
+	defer trace.StartRegion(ctx, "folder.Repository.Delete").End()
+
+	err := r.db.Gorm(ctx).
+		Where("folders.id = ?", folderID).
+		Delete(&folderDTO{}).Error
+	if err != nil {
+		if postgres.IsForeignConstraintError(err) {
+			return folder.ErrHasChildren
+		}
+		return storeerrors.InternalError{Reason: err}
+	}
+
+	return nil
+}
+
+func (r repo) RenameMove(
+	ctx context.Context, accountID ulid.ULID,
+	oldParent, newParent *folder.Folder,
+	oldName, newName string,
+) ([]folder.RenamedFolder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.RenameMove").End()
+
+	var data []struct {
+		ID      ulid.ULID `gorm:"column:id"`
+		NewPath string    `gorm:"column:new_path"`
+	}
+
+	var oldParentID, newParentID []byte
+	var oldPath, newPath string
+	if oldParent != nil {
+		oldParentID = oldParent.ID_[:]
+		oldPath = oldParent.Path_ + folder.PathSeparator + oldName
+	} else {
+		oldPath = oldName
+	}
+	if newParent != nil {
+		newParentID = newParent.ID_[:]
+		newPath = newParent.Path_ + folder.PathSeparator + newName
+	} else {
+		newPath = newName
+	}
+	childPattern := likeEscape.Replace(oldPath) + folder.PathSeparator + "%"
+
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		// 1. Lock the whole subtree so concurrent renames of the folder or
+		// its children wait for this one instead of computing paths from
+		// stale values. Rows are locked in the path order to not deadlock
+		// with another RenameMove.
+		var locked []ulid.ULID
+		err := tx.Raw(`
+			SELECT folders.id FROM folders
+			WHERE folders.account_id = ? AND (folders.path = ? OR folders.path LIKE ?)
+			ORDER BY folders.path
+			FOR UPDATE`,
+			accountID, oldPath, childPattern).
+			Scan(&locked).Error
+		if err != nil {
+			return storeerrors.InternalError{Reason: err}
+		}
+		if len(locked) == 0 {
+			return folder.ErrNotFound
+		}
+
+		var dataFirst []struct {
+			ID      ulid.ULID `gorm:"column:id"`
+			NewPath string    `gorm:"column:new_path"`
+		}
+
+		// 2. Change parent, update path and name.
+		res1 := tx.
+			Raw(`
+				UPDATE folders
+				SET
+					parent_id = ?,
+					path = ?,
+					name = ?
+				WHERE
+					folders.account_id = ?
+					AND parent_id IS NOT DISTINCT FROM ? -- Constraints are redundant for consistency.
+					AND path = ?
+					AND name = ?
+				RETURNING folders.id AS id, folders.path AS new_path
+				`,
+				newParentID, newPath, newName,
+				accountID, oldParentID, oldPath, oldName).
+			Find(&dataFirst)
+		if err := res1.Error; err != nil {
+			if postgres.IsUniqueConstraintError(err) {
+				return folder.ErrAlreadyExists
+			}
+			if postgres.IsForeignConstraintError(err) {
+				return storeerrors.NotExistsError{Text: "parent folder does not exist"}
+			}
+			return storeerrors.InternalError{Reason: err}
+		}
+		if res1.RowsAffected == 0 {
+			return folder.ErrNotFound
+		}
+
+		// 3. Update path for children directories (parent_id stays the same).
+		err = tx.
+			Raw(`
+			UPDATE folders SET path = ? || substr(path, ?)
+			WHERE folders.account_id = ? AND folders.path LIKE ?
+			RETURNING folders.id AS id, folders.path AS new_path`,
+				newPath, len(oldPath)+1, accountID, childPattern).
+			Find(&data).Error
+		if err != nil {
+			if postgres.IsUniqueConstraintError(err) { // Pretty much should be impossible, but check just in case.
+				return folder.ErrAlreadyExists
+			}
+			return storeerrors.InternalError{Reason: err}
+		}
+
+		data = append(data, dataFirst...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]folder.RenamedFolder, len(data))
+	for i, f := range data {
+		res[i] = folder.RenamedFolder{
+			ID:      f.ID,
+			OldPath: oldPath + strings.TrimPrefix(f.NewPath, newPath),
+			NewPath: f.NewPath,
+		}
+	}
+
+	return res, nil
+}
+
+func (r repo) DeleteTree(ctx context.Context, accountID ulid.ULID, root string) ([]folder.DeletedFolder, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.DeleteTree").End()
+
+	var data []struct {
+		ID   ulid.ULID `gorm:"column:id"`
+		Path string    `gorm:"column:path"`
+	}
+
+	err := r.db.Gorm(ctx).
+		Raw(`
+			DELETE FROM folders
+			WHERE folders.account_id = ? AND (folders.path = ? OR folders.path LIKE ?)
+			RETURNING folders.id AS id, folders.path AS path`,
+			accountID, root, likeEscape.Replace(root)+folder.PathSeparator+"%").
+		Find(&data).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	ids := make([]folder.DeletedFolder, len(data))
+	for i, id := range data {
+		ids[i] = folder.DeletedFolder{
+			ID:   id.ID,
+			Path: id.Path,
+		}
+	}
+
+	return ids, nil
+}
+
+func (r repo) NextUID(ctx context.Context, folderID ulid.ULID, n int) ([]uint32, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.NextUID").End()
+
+	if n <= 0 {
+		panic("n must be positive")
+	}
+
+	// UPDATE locks the folder row until the end of the transaction, so
+	// concurrent allocations for the same folder are serialized and UIDs
+	// are never reused even if entries are created later in the
+	// transaction.
+	var lastUID uint32
+
+	err := r.db.Gorm(ctx).Raw(`
+		UPDATE folders
+		SET uid_next = uid_next + ?
+		WHERE folders.id = ?
+		RETURNING uid_next - 1`, n, folderID).Row().Scan(&lastUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, folder.ErrNotFound
+		}
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	uids := make([]uint32, n)
+	for i := range uids {
+		uids[i] = lastUID - uint32(n) + 1 + uint32(i)
+	}
+
+	return uids, nil
+}
+
+func (r repo) CreateEntry(ctx context.Context, entry ...folder.Entry) error {
+	defer trace.StartRegion(ctx, "folder.Repository.CreateEntry").End()
+
+	dtos := make([]entryDTO, len(entry))
+	for i, ent := range entry {
+		dtos[i] = *entryAsDTO(&ent)
+	}
+
+	err := r.db.Gorm(ctx).Create(dtos).Error
+	if err != nil {
+		if postgres.IsForeignConstraintError(err) {
+			return folder.ErrDanglingEntry
+		}
+		if postgres.IsUniqueConstraintError(err) {
+			return folder.ErrEntryAlreadyExists
+		}
+		return storeerrors.InternalError{Reason: err}
+	}
+
+	return nil
+}
+
+func (r repo) ReplaceEntries(ctx context.Context, old []folder.Entry, new []folder.Entry) error {
+	defer trace.StartRegion(ctx, "folder.Repository.ReplaceEntries").End()
+
+	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, ent := range old {
+			err := tx.
+				Where("folder_entries.folder_id = ?", ent.FolderID_).
+				Where("folder_entries.message_id = ?", ent.MsgID_).
+				Delete(&entryDTO{}).Error
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+		}
+		for _, ent := range new {
+			err := tx.Create(entryAsDTO(&ent)).Error
+			if err != nil {
+				if postgres.IsForeignConstraintError(err) {
+					return folder.ErrDanglingEntry
+				}
+				if postgres.IsUniqueConstraintError(err) {
+					return folder.ErrEntryAlreadyExists
+				}
+				return storeerrors.InternalError{Reason: err}
+			}
+		}
+
+		return nil
+	})
+}
+
+// uidRanges returns the condition matching any of ranges.
+func uidRanges(ranges []folder.UIDRange) (string, []interface{}) {
+	conds := make([]string, len(ranges))
+	args := make([]interface{}, 0, len(ranges)*2)
+	for i, r := range ranges {
+		conds[i] = "folder_entries.uid BETWEEN ? AND ?"
+		args = append(args, r.Since, r.Until)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+func (r repo) GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetEntryByUIDRange").End()
+
+	if len(ranges) == 0 {
+		return []folder.Entry{}, nil
+	}
+
+	cond, args := uidRanges(ranges)
+
+	var entries []entryDTO
+	err := r.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Where("folder_entries.folder_id = ?", folderID).
+		Where(cond, args...).
+		Order("folder_entries.uid").
+		Find(&entries).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	models := make([]folder.Entry, len(entries))
+	for i, ent := range entries {
+		models[i] = *entryAsModel(&ent)
+	}
+	return models, nil
+}
+
+func (r repo) GetEntryByMsgID(ctx context.Context, msgIDs ...ulid.ULID) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetEntryByMsgID").End()
+
+	if len(msgIDs) == 0 {
+		return []folder.Entry{}, nil
+	}
+
+	var entries []entryDTO
+	err := r.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Where("folder_entries.message_id IN ?", msgIDs).
+		Order("folder_entries.folder_id, folder_entries.uid").
+		Find(&entries).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	models := make([]folder.Entry, len(entries))
+	for i, ent := range entries {
+		models[i] = *entryAsModel(&ent)
+	}
+	return models, nil
+}
+
+func (r repo) CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) (int, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.CountEntryByUIDRange").End()
+
+	if len(ranges) == 0 {
+		return 0, nil
+	}
+
+	cond, args := uidRanges(ranges)
+
+	var cnt int64
+	err := r.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Where("folder_entries.folder_id = ?", folderID).
+		Where(cond, args...).
+		Count(&cnt).Error
+	if err != nil {
+		return 0, storeerrors.InternalError{Reason: err}
+	}
+	return int(cnt), nil
+}
+
+func (r repo) GetStats(ctx context.Context, folderID ulid.ULID) (*folder.Stats, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetStats").End()
+
+	var stats folder.Stats
+	err := r.db.Gorm(ctx).Raw(`
+		SELECT
+			count(*),
+			count(*) FILTER (WHERE NOT seen),
+			count(*) FILTER (WHERE deleted),
+			coalesce(sum(size), 0)::bigint,
+			coalesce(sum(size) FILTER (WHERE deleted), 0)::bigint
+		FROM (
+			SELECT
+				messages.size AS size,
+				EXISTS (
+					SELECT 1 FROM message_flags
+					WHERE message_flags.message_id = folder_entries.message_id
+						AND lower(message_flags.flag) = lower(?)
+				) AS seen,
+				EXISTS (
+					SELECT 1 FROM message_flags
+					WHERE message_flags.message_id = folder_entries.message_id
+						AND lower(message_flags.flag) = lower(?)
+				) AS deleted
+			FROM folder_entries
+			JOIN messages ON messages.id = folder_entries.message_id
+			WHERE folder_entries.folder_id = ?
+		) AS entries`, `\Seen`, `\Deleted`, folderID).
+		Row().Scan(&stats.Msgs, &stats.UnseenMsgs, &stats.DeletedMsgs, &stats.Size, &stats.DeletedSize)
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return &stats, nil
+}
+
+func (r repo) DeleteEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) error {
+	defer trace.StartRegion(ctx, "folder.Repository.DeleteEntryByUIDRange").End()
+
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	cond, args := uidRanges(ranges)
+
+	err := r.db.Gorm(ctx).
+		Where("folder_entries.folder_id = ?", folderID).
+		Where(cond, args...).
+		Delete(&entryDTO{}).Error
+	if err != nil {
+		return storeerrors.InternalError{Reason: err}
+	}
+	return nil
+}
+
+func (r repo) Tx(ctx context.Context, readOnly bool, f func(r folder.Repo) error) error {
+	return r.db.Tx(ctx, readOnly, func(tx postgres.DB) error {
+		txRepo := repo{db: tx}
+		return f(txRepo)
+	})
+}
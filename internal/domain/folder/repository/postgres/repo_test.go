@@ -0,0 +1,110 @@
+package folderpostgres
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountpostgres "github.com/foxcpp/maddy-storage/internal/domain/account/repository/postgres"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres/postgrestest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextUIDConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := postgrestest.New(t)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountpostgres.New(db).Create(ctx, acct))
+	r := New(db)
+	f, err := folder.NewFolder(nil, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+	require.NoError(t, r.Create(ctx, f))
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		uids []uint32
+		errs = make(chan error, 8)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.InTx(ctx, func(ctx context.Context) error {
+				allocated, err := r.NextUID(ctx, f.ID_, 3)
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				uids = append(uids, allocated...)
+				lock.Unlock()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	for i, uid := range uids {
+		require.EqualValues(t, i+1, uid)
+	}
+
+	_, err = r.NextUID(ctx, acct.ID_, 1)
+	require.ErrorIs(t, err, folder.ErrNotFound)
+}
+
+func TestRenameMove(t *testing.T) {
+	ctx := context.Background()
+	db := postgrestest.New(t)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountpostgres.New(db).Create(ctx, acct))
+	r := New(db)
+
+	create := func(parent *folder.Folder, name string) *folder.Folder {
+		f, err := folder.NewFolder(parent, acct.ID_, name, "")
+		require.NoError(t, err)
+		require.NoError(t, r.Create(ctx, f))
+		return f
+	}
+	a := create(nil, "a")
+	b := create(a, "b")
+	create(b, "c")
+	d := create(nil, "d")
+
+	dup, err := folder.NewFolder(nil, acct.ID_, "d", "")
+	require.NoError(t, err)
+	require.ErrorIs(t, r.Create(ctx, dup), folder.ErrAlreadyExists)
+
+	renamed, err := r.RenameMove(ctx, acct.ID_, a, d, "b", "e")
+	require.NoError(t, err)
+	paths := make(map[string]string)
+	for _, rf := range renamed {
+		paths[rf.OldPath] = rf.NewPath
+	}
+	require.Equal(t, map[string]string{"a/b": "d/e", "a/b/c": "d/e/c"}, paths)
+
+	moved, err := r.GetByPath(ctx, acct.ID_, "d/e/c")
+	require.NoError(t, err)
+	require.Equal(t, "c", moved.Name_)
+
+	_, err = r.RenameMove(ctx, acct.ID_, a, d, "b", "e")
+	require.ErrorIs(t, err, folder.ErrNotFound)
+	_, err = r.RenameMove(ctx, acct.ID_, nil, nil, "a", "d")
+	require.ErrorIs(t, err, folder.ErrAlreadyExists)
+
+	require.ErrorIs(t, r.Delete(ctx, d.ID_), folder.ErrHasChildren)
+	deleted, err := r.DeleteTree(ctx, acct.ID_, "d")
+	require.NoError(t, err)
+	require.Len(t, deleted, 3)
+}
@@ -0,0 +1,240 @@
+package folderpostgres
+
+import (
+	"context"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
+	"github.com/oklog/ulid/v2"
+)
+
+type searcher struct {
+	db postgres.DB
+}
+
+// NewSearcher returns folder.Searcher matching text conditions as
+// case-insensitive substrings of message_search columns.
+func NewSearcher(db postgres.DB) folder.Searcher {
+	return searcher{db: db}
+}
+
+func (s searcher) Search(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Searcher.Search").End()
+
+	var b condBuilder
+	b.cond(cond)
+
+	var entries []entryDTO
+	err := s.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Select("folder_entries.*").
+		Joins("JOIN folders ON folders.id = folder_entries.folder_id").
+		Joins("JOIN messages ON messages.id = folder_entries.message_id").
+		Where("folders.account_id = ?", accountID).
+		Where(b.sql.String(), b.args...).
+		Order("folder_entries.folder_id, folder_entries.uid").
+		Find(&entries).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	models := make([]folder.Entry, len(entries))
+	for i, ent := range entries {
+		models[i] = *entryAsModel(&ent)
+	}
+	return models, nil
+}
+
+func (s searcher) SearchMsgIDs(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond, order []folder.SearchOrder, limit int) ([]ulid.ULID, error) {
+	defer trace.StartRegion(ctx, "folder.Searcher.SearchMsgIDs").End()
+
+	var b condBuilder
+	b.cond(cond)
+
+	args := append([]interface{}{accountID}, b.args...)
+	query := `
+		SELECT messages.id FROM messages
+		WHERE messages.id IN (
+			SELECT folder_entries.message_id FROM folder_entries
+			JOIN folders ON folders.id = folder_entries.folder_id
+			JOIN messages ON messages.id = folder_entries.message_id
+			WHERE folders.account_id = ? AND ` + b.sql.String() + `)
+		ORDER BY `
+	for _, o := range order {
+		dir := " ASC NULLS FIRST"
+		if o.Desc {
+			dir = " DESC NULLS LAST"
+		}
+		switch o.Key {
+		case folder.SortReceived:
+			query += "messages.date" + dir + ", "
+		case folder.SortSent:
+			query += "messages.sent_date" + dir + ", "
+		case folder.SortSize:
+			query += "messages.size" + dir + ", "
+		case folder.SortModSeq:
+			query += "messages.modseq" + dir + ", "
+		case folder.SortFlag:
+			query += `EXISTS (
+				SELECT 1 FROM message_flags
+				WHERE message_flags.message_id = messages.id
+					AND lower(message_flags.flag) = lower(?))` + dir + ", "
+			args = append(args, o.Flag)
+		default:
+			panic("unknown sort key")
+		}
+	}
+	query += "messages.id"
+	if limit != 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	var ids []ulid.ULID
+	if err := s.db.Gorm(ctx).Raw(query, args...).Scan(&ids).Error; err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+	return ids, nil
+}
+
+// condBuilder compiles SearchCond into the SQL expression over
+// folder_entries and messages tables.
+type condBuilder struct {
+	sql  strings.Builder
+	args []interface{}
+}
+
+// sentDate is the Date header field value, falling back to the internal
+// date if the field is missing.
+const sentDate = `coalesce(messages.sent_date, messages.date)`
+
+func (b *condBuilder) cond(cond *folder.SearchCond) {
+	b.sql.WriteString("(TRUE")
+
+	if cond.FolderIDs != nil {
+		b.and("folder_entries.folder_id IN ?", cond.FolderIDs)
+	}
+	if cond.UIDs != nil {
+		b.sql.WriteString(" AND (FALSE")
+		for _, r := range cond.UIDs {
+			b.sql.WriteString(" OR folder_entries.uid BETWEEN ? AND ?")
+			b.args = append(b.args, r.Since, r.Until)
+		}
+		b.sql.WriteString(")")
+	}
+	if cond.Encrypted != nil {
+		if *cond.Encrypted {
+			b.and("messages.key_version != 0")
+		} else {
+			b.and("messages.key_version = 0")
+		}
+	}
+
+	b.timeRange("messages.date", cond.DateSince, cond.DateUntil)
+	b.timeRange(sentDate, cond.SentSince, cond.SentUntil)
+	b.timeRange("messages.created_at", cond.CreatedSince, cond.CreatedUntil)
+	b.timeRange("messages.updated_at", cond.UpdatedSince, cond.UpdatedUntil)
+
+	for _, v := range cond.Body {
+		b.match([]string{"body"}, "", v)
+	}
+	for _, v := range cond.Text {
+		b.match(textColumns, "", v)
+	}
+	for _, h := range cond.Header {
+		b.match([]string{"header"}, h.Name, h.Value)
+	}
+	for _, v := range cond.From {
+		b.match([]string{"from_field"}, "", v)
+	}
+	for _, v := range cond.To {
+		b.match([]string{"to_field"}, "", v)
+	}
+	for _, v := range cond.Cc {
+		b.match([]string{"cc_field"}, "", v)
+	}
+	for _, v := range cond.Bcc {
+		b.match([]string{"bcc_field"}, "", v)
+	}
+	for _, v := range cond.Subject {
+		b.match([]string{"subject"}, "", v)
+	}
+
+	if cond.SizeSince != 0 {
+		b.and("messages.size >= ?", cond.SizeSince)
+	}
+	if cond.SizeUntil != 0 {
+		b.and("messages.size < ?", cond.SizeUntil)
+	}
+	if cond.ModSeqSince != 0 {
+		b.and("messages.modseq >= ?", cond.ModSeqSince)
+	}
+
+	for _, f := range cond.Flag {
+		b.and(`EXISTS (
+			SELECT 1 FROM message_flags
+			WHERE message_flags.message_id = folder_entries.message_id
+				AND lower(message_flags.flag) = lower(?))`, f)
+	}
+	for _, f := range cond.NoFlag {
+		b.and(`NOT EXISTS (
+			SELECT 1 FROM message_flags
+			WHERE message_flags.message_id = folder_entries.message_id
+				AND lower(message_flags.flag) = lower(?))`, f)
+	}
+
+	if cond.Not != nil {
+		b.sql.WriteString(" AND NOT ")
+		b.cond(cond.Not)
+	}
+	for _, group := range cond.Or {
+		b.sql.WriteString(" AND (FALSE")
+		for _, alt := range group {
+			b.sql.WriteString(" OR ")
+			b.cond(alt)
+		}
+		b.sql.WriteString(")")
+	}
+
+	b.sql.WriteString(")")
+}
+
+func (b *condBuilder) and(expr string, args ...interface{}) {
+	b.sql.WriteString(" AND ")
+	b.sql.WriteString(expr)
+	b.args = append(b.args, args...)
+}
+
+var textColumns = []string{"from_field", "to_field", "cc_field", "bcc_field", "subject", "header", "body"}
+
+// match adds the substring search condition. If field is not empty, value
+// is matched only in the specified header field, columns should be
+// []string{"header"} in this case.
+func (b *condBuilder) match(columns []string, field, value string) {
+	pattern := "%" + likeEscape.Replace(value) + "%"
+	if field != "" {
+		pattern = "%" + likeEscape.Replace(field) + ": " + pattern
+	}
+	conds := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i, c := range columns {
+		conds[i] = "message_search." + c + " ILIKE ?"
+		args[i] = pattern
+	}
+	b.and(`folder_entries.message_id IN (
+		SELECT message_search.message_id FROM message_search
+		WHERE `+strings.Join(conds, " OR ")+`)`, args...)
+}
+
+func (b *condBuilder) timeRange(column string, since, until time.Time) {
+	if !since.IsZero() {
+		b.and(column+" >= ?", since)
+	}
+	if !until.IsZero() {
+		b.and(column+" < ?", until)
+	}
+}
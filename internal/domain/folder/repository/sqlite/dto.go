@@ -25,6 +25,8 @@ type folderDTO struct {
 	UIDNext     uint32 `json:"uid_next"`
 	UIDValidity uint32 `gorm:"uid_validity"`
 
+	ModSeq int64 `gorm:"column:modseq"`
+
 	Meta      json.RawMessage `gorm:"meta"`
 	CreatedAt time.Time       `gorm:"created_at,autoCreateTime:false"`
 	UpdatedAt time.Time       `gorm:"updated_at,autoUpdateTime:false"`
@@ -63,6 +65,7 @@ func asDTO(model *folder.Folder) *folderDTO {
 		SortOrder:   model.SortOrder_,
 		UIDNext:     model.UIDNext_,
 		UIDValidity: model.UIDValidity_,
+		ModSeq:      model.ModSeq_,
 		Meta:        metaJSON,
 		CreatedAt:   model.CreatedAt_,
 		UpdatedAt:   model.UpdatedAt_,
@@ -79,6 +82,7 @@ func asModel(dto *folderDTO) *folder.Folder {
 		SortOrder_:       dto.SortOrder,
 		UIDValidity_:     dto.UIDValidity,
 		UIDNext_:         dto.UIDNext,
+		ModSeq_:          dto.ModSeq,
 		CreatedAt_:       dto.CreatedAt,
 		UpdatedAt_:       dto.UpdatedAt,
 		InitialUpdatedAt: dto.UpdatedAt,
@@ -105,7 +109,7 @@ type entryDTO struct {
 	UID       uint32    `gorm:"uid"`
 }
 
-func (entryDTO) TableName() string { return "entry" }
+func (entryDTO) TableName() string { return "folder_entries" }
 
 func entryAsDTO(entry *folder.Entry) *entryDTO {
 	return &entryDTO{
@@ -12,7 +12,6 @@ import (
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
 	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
-	"github.com/mattn/go-sqlite3"
 	"github.com/oklog/ulid/v2"
 	"gorm.io/gorm"
 )
@@ -25,7 +24,7 @@ func New(db sqlite.DB) folder.Repo {
 	return repo{db: db}
 }
 
-var likeEscape = strings.NewReplacer(`\`, `\\`, `%`, `\%`)
+var likeEscape = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
 
 func addFilterToQuery(q *gorm.DB, f *folder.Filter) *gorm.DB {
 	// regexp is handled in GetByAccount
@@ -54,9 +53,9 @@ func addFilterToQuery(q *gorm.DB, f *folder.Filter) *gorm.DB {
 	}
 	if f.HasRole != nil {
 		if *f.HasRole {
-			q = q.Where("folders.role IS NOT NONE")
+			q = q.Where("folders.role IS NOT NULL")
 		} else {
-			q = q.Where("folders.role IS NONE")
+			q = q.Where("folders.role IS NULL")
 		}
 	}
 	if f.Role != nil {
@@ -124,34 +123,37 @@ func (r repo) GetByPath(ctx context.Context, accountID ulid.ULID, path string) (
 	return asModel(&f), nil
 }
 
-func (r repo) getByRegexp(tx *gorm.DB, accountID ulid.ULID, f folder.Filter, order folder.Order, regex *regexp.Regexp) ([]folderDTO, error) {
-	prefix, complete := regex.LiteralPrefix()
-
-	var reDTO []folderDTO
-	err := addFilterToQuery(tx.
+// getByRegexp returns folders matching f and any of regexes. Regexes
+// are applied to the loaded folders, the literal prefix of the single
+// anchored regex is used to narrow the query.
+func (r repo) getByRegexp(tx *gorm.DB, accountID ulid.ULID, f folder.Filter, order folder.Order, regexes []*regexp.Regexp) ([]folderDTO, error) {
+	q := tx.
 		Model(&folderDTO{}).
-		Where("folders.account_id = ?", accountID).
-		Where(`folders.path LIKE ? ESCAPE '\'`, likeEscape.Replace(prefix)+"%"),
-		&f).
+		Where("folders.account_id = ?", accountID)
+	if len(regexes) == 1 && strings.HasPrefix(regexes[0].String(), "^") {
+		if prefix, _ := regexes[0].LiteralPrefix(); prefix != "" {
+			q = q.Where(`folders.path LIKE ? ESCAPE '\'`, likeEscape.Replace(prefix)+"%")
+		}
+	}
+
+	var dtos []folderDTO
+	err := addFilterToQuery(q, &f).
 		Order(orderKey(order)).
-		Find(&reDTO).Error
+		Find(&dtos).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, folder.ErrNotFound
-		}
 		return nil, storeerrors.InternalError{Reason: err}
 	}
-	if !complete {
-		foldersFiltered := reDTO[:0]
-		for _, f := range foldersFiltered {
-			if regex.MatchString(f.Path) {
-				foldersFiltered = append(foldersFiltered, f)
+
+	filtered := dtos[:0]
+	for _, dto := range dtos {
+		for _, re := range regexes {
+			if re.MatchString(dto.Path) {
+				filtered = append(filtered, dto)
+				break
 			}
 		}
-		return foldersFiltered, nil
 	}
-
-	return reDTO, nil
+	return filtered, nil
 }
 
 func (r repo) GetByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter, order folder.Order) ([]folder.Folder, error) {
@@ -161,29 +163,15 @@ func (r repo) GetByAccount(ctx context.Context, accountID ulid.ULID, f folder.Fi
 		dto []folderDTO
 		err error
 	)
-	switch len(f.PathRegex) {
-	case 0:
+	if len(f.PathRegex) == 0 {
 		err = addFilterToQuery(r.db.Gorm(ctx).
 			Model(&folderDTO{}).
 			Where("folders.account_id = ?", accountID),
 			&f).
 			Order(orderKey(order)).
 			Find(&dto).Error
-	case 1:
-		dto, err = r.getByRegexp(r.db.Gorm(ctx), accountID, f, order, f.PathRegex[0])
-	default:
-		err = r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-			for _, re := range f.PathRegex {
-				reDTO, err := r.getByRegexp(tx, accountID, f, order, re)
-				if err != nil {
-					return err
-				}
-				dto = append(dto, reDTO...)
-			}
-			return nil
-		}, &sql.TxOptions{
-			ReadOnly: true,
-		})
+	} else {
+		dto, err = r.getByRegexp(r.db.Gorm(ctx), accountID, f, order, f.PathRegex)
 	}
 	if err != nil {
 		return nil, storeerrors.InternalError{Reason: err}
@@ -198,43 +186,22 @@ func (r repo) GetByAccount(ctx context.Context, accountID ulid.ULID, f folder.Fi
 }
 
 func (r repo) CountByAccount(ctx context.Context, accountID ulid.ULID, f folder.Filter) (int, error) {
-	defer trace.StartRegion(ctx, "folder.Repository.GetByAccount").End()
+	defer trace.StartRegion(ctx, "folder.Repository.CountByAccount").End()
 
-	var (
-		cnt int64
-		err error
-	)
-	switch len(f.PathRegex) {
-	case 0:
-		err = addFilterToQuery(r.db.Gorm(ctx).
-			Model(&folderDTO{}).
-			Where("folders.account_id = ?", accountID),
-			&f).
-			Count(&cnt).Error
-	case 1:
-		dto, err := r.getByRegexp(r.db.Gorm(ctx), accountID, f, folder.OrderByCreatedAt, f.PathRegex[0])
+	if len(f.PathRegex) != 0 {
+		dto, err := r.getByRegexp(r.db.Gorm(ctx), accountID, f, folder.OrderByCreatedAt, f.PathRegex)
 		if err != nil {
 			return 0, err
 		}
-		cnt = int64(len(dto))
-	default:
-		ids := make(map[ulid.ULID]struct{})
-		err = r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-			for _, re := range f.PathRegex {
-				reDTO, err := r.getByRegexp(tx, accountID, f, folder.OrderByCreatedAt, re)
-				if err != nil {
-					return err
-				}
-				for _, f := range reDTO {
-					ids[f.ID] = struct{}{}
-				}
-			}
-			return nil
-		}, &sql.TxOptions{
-			ReadOnly: true,
-		})
-		cnt = int64(len(ids))
+		return len(dto), nil
 	}
+
+	var cnt int64
+	err := addFilterToQuery(r.db.Gorm(ctx).
+		Model(&folderDTO{}).
+		Where("folders.account_id = ?", accountID),
+		&f).
+		Count(&cnt).Error
 	if err != nil {
 		return 0, storeerrors.InternalError{Reason: err}
 	}
@@ -245,13 +212,13 @@ func (r repo) CountByAccount(ctx context.Context, accountID ulid.ULID, f folder.
 func (r repo) GetByPrefix(ctx context.Context, accountID ulid.ULID, f folder.Filter, prefixes ...string) ([]folder.Folder, error) {
 	defer trace.StartRegion(ctx, "folder.Repository.GetByPrefix").End()
 
-	var dtoMap map[ulid.ULID]folderDTO
+	dtoMap := make(map[ulid.ULID]folderDTO)
 
 	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
 		for _, p := range prefixes {
 			var dtos []folderDTO
 
-			err := addFilterToQuery(r.db.Gorm(ctx).
+			err := addFilterToQuery(tx.
 				Model(&folderDTO{}).
 				Where("folders.account_id = ?", accountID).
 				Where(`folders.path = ? OR folders.path LIKE ? ESCAPE '\'`, p, likeEscape.Replace(p)+folder.PathSeparator+"%"),
@@ -312,14 +279,20 @@ func (r repo) Update(ctx context.Context, f *folder.Folder) error {
 	dto := asDTO(f)
 
 	q := r.db.Gorm(ctx).
-		Model(dto).
+		Model(&folderDTO{}).
 		Where("folders.id = ? AND folders.updated_at = ?", dto.ID, f.InitialUpdatedAt).
 		Updates(map[string]interface{}{
-			"subscribed":  dto.Subscribed,
-			"special_use": dto.Role,
+			"subscribed": dto.Subscribed,
+			"role":       dto.Role,
+			"sort_order": dto.SortOrder,
+			"meta":       dto.Meta,
+			"updated_at": dto.UpdatedAt,
 		})
 	if err := q.Error; err != nil {
-		return err
+		if sqlite.IsUniqueConstraintError(err) {
+			return storeerrors.AlreadyExistsError{Text: "folder with such role already exists", Cause: err}
+		}
+		return storeerrors.InternalError{Reason: err}
 	}
 	if q.RowsAffected == 0 {
 		return folder.ErrNotFound // XXX: Figure out a way to differentiate OCC failure from missing object
@@ -378,7 +351,7 @@ func (r repo) RenameMove(
 		}
 
 		// 1. Change parent, update path and name.
-		res1 := r.db.Gorm(ctx).
+		res1 := tx.
 			Raw(`
 				UPDATE folders 
 				SET
@@ -408,7 +381,7 @@ func (r repo) RenameMove(
 		}
 
 		// 2. Update path for children directories (parent_id stays the same).
-		err := r.db.Gorm(ctx).
+		err := tx.
 			Raw(`
 			UPDATE folders SET path = ? || substr(path, ?)
 			WHERE folders.account_id = ? AND folders.path LIKE ? ESCAPE '\'
@@ -449,7 +422,7 @@ func (r repo) DeleteTree(ctx context.Context, accountID ulid.ULID, root string)
 	err := r.db.Gorm(ctx).
 		Raw(`
 			DELETE FROM folders
-			WHERE folders.account_id = ? AND folders.path = ? OR folders.path LIKE ? ESCAPE '\'
+			WHERE folders.account_id = ? AND (folders.path = ? OR folders.path LIKE ? ESCAPE '\')
 			RETURNING folders.id AS id, folders.path AS path`,
 			accountID, root, likeEscape.Replace(root)+folder.PathSeparator+"%").
 		Find(&data).Error
@@ -479,20 +452,20 @@ func (r repo) NextUID(ctx context.Context, folderID ulid.ULID, n int) ([]uint32,
 	var lastUID uint32
 
 	err := r.db.Gorm(ctx).Raw(`
-		UPDATE folders 
-		SET uidnext = uidnext + ?
+		UPDATE folders
+		SET uid_next = uid_next + ?
 		WHERE folders.id = ?
-		RETURNING uidnext - 1`, n, folderID).Scan(&lastUID).Error
+		RETURNING uid_next - 1`, n, folderID).Row().Scan(&lastUID)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return nil, folder.ErrNotFound
 		}
 		return nil, storeerrors.InternalError{Reason: err}
 	}
 
 	uids := make([]uint32, n)
-	for i := lastUID - uint32(n) + 1; i <= lastUID; i++ {
-		uids[i] = i
+	for i := range uids {
+		uids[i] = lastUID - uint32(n) + 1 + uint32(i)
 	}
 
 	return uids, nil
@@ -508,12 +481,12 @@ func (r repo) CreateEntry(ctx context.Context, entry ...folder.Entry) error {
 
 	err := r.db.Gorm(ctx).Create(dtos).Error
 	if err != nil {
-		var sqlErr sqlite3.Error
-		if errors.As(err, &sqlErr) && errors.Is(sqlErr.ExtendedCode, sqlite3.ErrConstraintForeignKey) {
+		if sqlite.IsForeignConstraintError(err) {
 			return folder.ErrDanglingEntry
 		}
-
-		// TODO: Foreign key constraints, etc.
+		if sqlite.IsUniqueConstraintError(err) {
+			return folder.ErrEntryAlreadyExists
+		}
 		return storeerrors.InternalError{Reason: err}
 	}
 
@@ -523,26 +496,31 @@ func (r repo) CreateEntry(ctx context.Context, entry ...folder.Entry) error {
 func (r repo) ReplaceEntries(ctx context.Context, old []folder.Entry, new []folder.Entry) error {
 	defer trace.StartRegion(ctx, "folder.Repository.ReplaceEntries").End()
 
-	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
 		for _, ent := range old {
-			err := r.db.Gorm(ctx).
+			err := tx.
 				Where("folder_entries.folder_id = ?", ent.FolderID_).
-				Where("folder_entries.msg_id = ?", ent.MsgID_).
+				Where("folder_entries.message_id = ?", ent.MsgID_).
 				Delete(&entryDTO{}).Error
 			if err != nil {
-				return err
+				return storeerrors.InternalError{Reason: err}
 			}
 		}
 		for _, ent := range new {
-			err := r.db.Gorm(ctx).Create(entryAsDTO(&ent)).Error
+			err := tx.Create(entryAsDTO(&ent)).Error
 			if err != nil {
-				return err
+				if sqlite.IsForeignConstraintError(err) {
+					return folder.ErrDanglingEntry
+				}
+				if sqlite.IsUniqueConstraintError(err) {
+					return folder.ErrEntryAlreadyExists
+				}
+				return storeerrors.InternalError{Reason: err}
 			}
 		}
 
 		return nil
 	})
-	return err
 }
 
 func (r repo) GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) ([]folder.Entry, error) {
@@ -555,6 +533,7 @@ func (r repo) GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges
 			Model(&entries).
 			Where("folder_entries.folder_id = ?", folderID).
 			Where("folder_entries.uid BETWEEN ? AND ?", ranges[0].Since, ranges[0].Until).
+			Order("folder_entries.uid").
 			Find(&entries).Error
 		if err != nil {
 			return nil, err
@@ -597,11 +576,38 @@ func (r repo) GetEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges
 		for _, ent := range entryMap {
 			models = append(models, *entryAsModel(&ent))
 		}
+		sort.Slice(models, func(i, j int) bool {
+			return models[i].UID_ < models[j].UID_
+		})
 
 		return models, nil
 	}
 }
 
+func (r repo) GetEntryByMsgID(ctx context.Context, msgIDs ...ulid.ULID) ([]folder.Entry, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetEntryByMsgID").End()
+
+	if len(msgIDs) == 0 {
+		return []folder.Entry{}, nil
+	}
+
+	var entries []entryDTO
+	err := r.db.Gorm(ctx).
+		Model(&entryDTO{}).
+		Where("folder_entries.message_id IN ?", msgIDs).
+		Order("folder_entries.folder_id, folder_entries.uid").
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]folder.Entry, len(entries))
+	for i, ent := range entries {
+		models[i] = *entryAsModel(&ent)
+	}
+	return models, nil
+}
+
 func (r repo) CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) (int, error) {
 	defer trace.StartRegion(ctx, "folder.Repository.CountEntryByUIDRange").End()
 
@@ -614,7 +620,7 @@ func (r repo) CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, rang
 			Count(&cnt).Error
 		return int(cnt), err
 	} else {
-		var entryMap map[uint32]bool
+		entryMap := make(map[uint32]bool)
 		err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
 			for _, r := range ranges {
 				var entries []entryDTO
@@ -643,6 +649,42 @@ func (r repo) CountEntryByUIDRange(ctx context.Context, folderID ulid.ULID, rang
 	}
 }
 
+func (r repo) GetStats(ctx context.Context, folderID ulid.ULID) (*folder.Stats, error) {
+	defer trace.StartRegion(ctx, "folder.Repository.GetStats").End()
+
+	var stats folder.Stats
+	err := r.db.Gorm(ctx).Raw(`
+		SELECT
+			count(*),
+			coalesce(sum(NOT seen), 0),
+			coalesce(sum(deleted), 0),
+			coalesce(sum(size), 0),
+			coalesce(sum(CASE WHEN deleted THEN size ELSE 0 END), 0)
+		FROM (
+			SELECT
+				messages.size AS size,
+				EXISTS (
+					SELECT 1 FROM message_flags
+					WHERE message_flags.message_id = folder_entries.message_id
+						AND message_flags.flag = ? COLLATE NOCASE
+				) AS seen,
+				EXISTS (
+					SELECT 1 FROM message_flags
+					WHERE message_flags.message_id = folder_entries.message_id
+						AND message_flags.flag = ? COLLATE NOCASE
+				) AS deleted
+			FROM folder_entries
+			JOIN messages ON messages.id = folder_entries.message_id
+			WHERE folder_entries.folder_id = ?
+		)`, `\Seen`, `\Deleted`, folderID).
+		Row().Scan(&stats.Msgs, &stats.UnseenMsgs, &stats.DeletedMsgs, &stats.Size, &stats.DeletedSize)
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return &stats, nil
+}
+
 func (r repo) DeleteEntryByUIDRange(ctx context.Context, folderID ulid.ULID, ranges ...folder.UIDRange) error {
 	defer trace.StartRegion(ctx, "folder.Repository.DeleteEntryByUIDRange").End()
 
@@ -7,28 +7,104 @@ import (
 	"github.com/oklog/ulid/v2"
 )
 
+// SearchCond describes the set of folder entries to find. All specified
+// conditions must match. Zero values mean "no restriction". Time ranges
+// include the Since bound and exclude the Until bound, same for sizes.
 type SearchCond struct {
 	FolderIDs []ulid.ULID
+	UIDs      []UIDRange // nil means any UID, empty non-nil slice matches nothing
 
 	DateSince    time.Time
 	DateUntil    time.Time
+	SentSince    time.Time // Date header field
+	SentUntil    time.Time
 	CreatedSince time.Time
 	CreatedUntil time.Time
 	UpdatedSince time.Time
 	UpdatedUntil time.Time
 
-	// TODO: Body and header search - probably via FTS.
+	// Full-text search, each value must match as a case-insensitive
+	// substring.
+	Body    []string // text/* parts
+	Text    []string // header or body
+	Header  []HeaderCond
+	From    []string // From header field only
+	To      []string
+	Cc      []string
+	Bcc     []string
+	Subject []string
 
 	SizeSince int64
 	SizeUntil int64
 
+	ModSeqSince int64
+
 	Flag   []string
 	NoFlag []string
 
+	// Encrypted restricts matches to messages stored encrypted (true) or
+	// in plaintext (false). Text of encrypted messages is not indexed, so
+	// searchers cannot match text conditions against it.
+	Encrypted *bool
+
 	Not *SearchCond
-	Or  [][]*SearchCond
+	// Or contains groups of alternatives, at least one condition in each
+	// group must match.
+	Or [][]*SearchCond
+}
+
+// HasText reports whether cond or any of nested conditions matches
+// message text.
+func (cond *SearchCond) HasText() bool {
+	if len(cond.Body) != 0 || len(cond.Text) != 0 || len(cond.Header) != 0 ||
+		len(cond.From) != 0 || len(cond.To) != 0 || len(cond.Cc) != 0 ||
+		len(cond.Bcc) != 0 || len(cond.Subject) != 0 {
+		return true
+	}
+	if cond.Not != nil && cond.Not.HasText() {
+		return true
+	}
+	for _, group := range cond.Or {
+		for _, alt := range group {
+			if alt.HasText() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HeaderCond matches messages with the header field that contains the
+// value. Empty Value matches any message with the field.
+type HeaderCond struct {
+	Name  string
+	Value string
+}
+
+// SortKey is the message property search results can be ordered by.
+type SortKey int
+
+const (
+	SortReceived SortKey = iota // internal date
+	SortSent                    // Date header field, messages without it go first
+	SortSize
+	SortFlag   // messages without the flag go first
+	SortModSeq // modification sequence
+)
+
+// SearchOrder is one of the keys to order found messages by.
+type SearchOrder struct {
+	Key  SortKey
+	Flag string // for SortFlag
+	Desc bool
 }
 
 type Searcher interface {
+	// Search returns matching entries of the account ordered by folder and
+	// UID.
 	Search(ctx context.Context, accountID ulid.ULID, cond *SearchCond) ([]Entry, error)
+	// SearchMsgIDs returns IDs of messages referenced by matching entries
+	// of the account ordered by order and then by ID. At most limit IDs
+	// are returned, 0 means no limit.
+	SearchMsgIDs(ctx context.Context, accountID ulid.ULID, cond *SearchCond, order []SearchOrder, limit int) ([]ulid.ULID, error)
 }
@@ -1,8 +1,79 @@
 package folder
 
-import "github.com/oklog/ulid/v2"
+import (
+	"sort"
 
-// SortAsTree sorts list of folders as defined by sortAsTree JMAP option.
-func SortAsTree[T any](slice []T, parentID func(i int) ulid.ULID, less func(i int, j int) bool) {
-	// XXX: TODO
+	"github.com/oklog/ulid/v2"
+)
+
+// SortAsTree sorts list of folders as defined by sortAsTree JMAP option:
+// each folder is followed by its children, siblings are ordered using less.
+// Folders whose parent is not in the list are sorted as top-level ones.
+//
+// Callbacks are called with indexes of the original order, before any
+// elements are moved.
+func SortAsTree[T any](slice []T, id, parentID func(i int) ulid.ULID, less func(i int, j int) bool) {
+	index := make(map[ulid.ULID]int, len(slice))
+	for i := range slice {
+		index[id(i)] = i
+	}
+
+	var roots []int
+	children := make(map[int][]int)
+	for i := range slice {
+		parent, ok := index[parentID(i)]
+		if !ok || parent == i {
+			roots = append(roots, i)
+			continue
+		}
+		children[parent] = append(children[parent], i)
+	}
+
+	sortIdx := func(idx []int) {
+		sort.SliceStable(idx, func(a, b int) bool {
+			return less(idx[a], idx[b])
+		})
+	}
+	sortIdx(roots)
+	for _, idx := range children {
+		sortIdx(idx)
+	}
+
+	order := make([]int, 0, len(slice))
+	visited := make([]bool, len(slice))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		order = append(order, i)
+		for _, child := range children[i] {
+			visit(child)
+		}
+	}
+	for _, i := range roots {
+		visit(i)
+	}
+
+	// Folders in a parent cycle are not reachable from any top-level one,
+	// they are kept at the end instead of being lost.
+	if len(order) != len(slice) {
+		var rest []int
+		for i := range slice {
+			if !visited[i] {
+				rest = append(rest, i)
+			}
+		}
+		sortIdx(rest)
+		for _, i := range rest {
+			visit(i)
+		}
+	}
+
+	sorted := make([]T, len(slice))
+	for k, i := range order {
+		sorted[k] = slice[i]
+	}
+	copy(slice, sorted)
 }
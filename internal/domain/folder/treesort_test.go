@@ -0,0 +1,103 @@
+package folder
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortAsTree(t *testing.T) {
+	type node struct {
+		name   string
+		parent string
+	}
+	cases := []struct {
+		name   string
+		nodes  []node
+		sorted []string
+	}{
+		{
+			name:   "empty",
+			nodes:  nil,
+			sorted: []string{},
+		},
+		{
+			name:   "flat",
+			nodes:  []node{{"c", ""}, {"a", ""}, {"b", ""}},
+			sorted: []string{"a", "b", "c"},
+		},
+		{
+			name: "nested",
+			nodes: []node{
+				{"b/y", "b"},
+				{"b", ""},
+				{"a/z", "a"},
+				{"a", ""},
+				{"a/x", "a"},
+				{"a/x/1", "a/x"},
+				{"c", ""},
+			},
+			sorted: []string{"a", "a/x", "a/x/1", "a/z", "b", "b/y", "c"},
+		},
+		{
+			name: "children before parent",
+			nodes: []node{
+				{"a/b/c", "a/b"},
+				{"a/b", "a"},
+				{"a", ""},
+			},
+			sorted: []string{"a", "a/b", "a/b/c"},
+		},
+		{
+			name: "orphans",
+			nodes: []node{
+				{"b/y", "b"},
+				{"c", ""},
+				{"a/x/1", "a/x"},
+				{"a/x/1/i", "a/x/1"},
+				{"a", ""},
+			},
+			sorted: []string{"a", "a/x/1", "a/x/1/i", "b/y", "c"},
+		},
+		{
+			name: "cycle",
+			nodes: []node{
+				{"y", "x"},
+				{"x", "y"},
+				{"a", ""},
+			},
+			sorted: []string{"a", "x", "y"},
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ids := make(map[string]ulid.ULID)
+			for _, n := range c.nodes {
+				ids[n.name] = ulid.Make()
+			}
+			for _, n := range c.nodes {
+				if _, ok := ids[n.parent]; !ok && n.parent != "" {
+					// Parent is not in the list.
+					ids[n.parent] = ulid.Make()
+				}
+			}
+
+			nodes := append([]node(nil), c.nodes...)
+			SortAsTree(nodes, func(i int) ulid.ULID {
+				return ids[nodes[i].name]
+			}, func(i int) ulid.ULID {
+				return ids[nodes[i].parent]
+			}, func(i, j int) bool {
+				return nodes[i].name < nodes[j].name
+			})
+
+			names := make([]string, 0, len(nodes))
+			for _, n := range nodes {
+				names = append(names, n.name)
+			}
+			require.Equal(t, c.sorted, names)
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package message
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Disposition struct {
 	Value  string            `json:"value"`
@@ -13,6 +16,15 @@ type ContentData struct {
 	Disposition Disposition       `json:"disposition,omitempty"`
 	Language    []string          `json:"language,omitempty"`
 	Location    string            `json:"location,omitempty"`
+
+	Header   []byte           `json:"header,omitempty"`   // raw header, including the terminating empty line
+	Size     int64            `json:"size"`               // header + body, in octets
+	Envelope *ContentEnvelope `json:"envelope,omitempty"` // top-level message only, see ContentPartData.Envelope
+	Layout   *MultipartLayout `json:"layout,omitempty"`   // multipart only
+}
+
+func (cd *ContentData) IsMultipart() bool {
+	return isMultipart(cd.Type)
 }
 
 type Address struct {
@@ -47,5 +59,40 @@ type ContentPartData struct {
 	Size        uint32 `json:"size"`
 	NumLines    int64  `json:"num_lines"`
 
-	Envelope *ContentEnvelope `json:"envelope,omitempty"`
+	// Raw MIME header of the part, including the terminating empty line.
+	// Empty if the part is the only body of a non-multipart message,
+	// in this case, message header is used.
+	Header []byte `json:"header,omitempty"`
+
+	Envelope *ContentEnvelope `json:"envelope,omitempty"` // message/rfc822 only
+	Message  *ContentData     `json:"message,omitempty"`  // message/rfc822 only, encapsulated message
+	Layout   *MultipartLayout `json:"layout,omitempty"`   // multipart only
+}
+
+func (cpd *ContentPartData) IsMultipart() bool {
+	return isMultipart(cpd.Type)
+}
+
+func (cpd *ContentPartData) IsMessage() bool {
+	return cpd.Message != nil
+}
+
+// MultipartLayout contains the multipart body octets that are not part of
+// any child part. It allows to reconstruct the original body exactly:
+//
+//	Preamble + Delimiters[0] + child 1 + ... + Delimiters[n-1] + child n + Epilogue
+type MultipartLayout struct {
+	// Text before the first delimiter, excluding the line break that
+	// precedes it.
+	Preamble []byte `json:"preamble,omitempty"`
+	// Delimiter lines for each child, including the preceding line break,
+	// transport padding and the trailing line break.
+	Delimiters [][]byte `json:"delimiters"`
+	// Close delimiter line (including the preceding line break) and
+	// everything after it. Empty if close delimiter is missing.
+	Epilogue []byte `json:"epilogue,omitempty"`
+}
+
+func isMultipart(contentType string) bool {
+	return strings.HasPrefix(strings.ToLower(contentType), "multipart/")
 }
@@ -10,9 +10,11 @@ import (
 
 type Msg struct {
 	ID_         ulid.ULID
+	AccountID_  ulid.ULID // zero for messages created before it was recorded
 	ReceivedAt_ time.Time
 	CreatedAt_  time.Time
 	UpdatedAt_  time.Time
+	ModSeq_     int64 // assigned by changelog.Repo
 
 	// Mutable fields.
 	Meta_  metadata.Md
@@ -20,28 +22,54 @@ type Msg struct {
 
 	Content_ *ContentData
 	Parts_   []Part
-}
 
-func (m *Msg) ID() ulid.ULID         { return m.ID_ }
-func (m *Msg) ReceivedAt() time.Time { return m.ReceivedAt_ }
-func (m *Msg) CreatedAt() time.Time  { return m.CreatedAt_ }
-func (m *Msg) UpdatedAt() time.Time  { return m.UpdatedAt_ }
-func (m *Msg) Meta() metadata.Md     { return m.Meta_ }
-func (m *Msg) Flags() []string       { return m.Flags_ }
-func (m *Msg) Content() *ContentData { return m.Content_ }
-func (m *Msg) Parts() []Part         { return m.Parts_ }
+	// Search_ is set only for new messages, it is not loaded from the
+	// repository.
+	Search_ *SearchText
+}
 
+func (m *Msg) ID() ulid.ULID           { return m.ID_ }
+func (m *Msg) AccountID() ulid.ULID    { return m.AccountID_ }
+func (m *Msg) ReceivedAt() time.Time   { return m.ReceivedAt_ }
+func (m *Msg) CreatedAt() time.Time    { return m.CreatedAt_ }
+func (m *Msg) UpdatedAt() time.Time    { return m.UpdatedAt_ }
+func (m *Msg) Meta() metadata.Md       { return m.Meta_ }
+func (m *Msg) Flags() []string         { return m.Flags_ }
+func (m *Msg) Content() *ContentData   { return m.Content_ }
+func (m *Msg) Parts() []Part           { return m.Parts_ }
+func (m *Msg) SearchText() *SearchText { return m.Search_ }
+
+// ModSeq returns the modification sequence of the message, it is changed
+// each time mutable fields are changed.
+func (m *Msg) ModSeq() int64 { return m.ModSeq_ }
+
+// Copy returns a new message with the same contents. External blobs are
+// shared with the original message, but parts get new IDs, so each copy
+// stores its own part rows, including bodies stored inline. Copying is
+// therefore linear in the number of parts and the size of inline bodies.
 func (m *Msg) Copy() *Msg {
 	meta := m.Meta_.Copy()
 	meta.Set("copy_of", m.ID_.String())
 
+	parts := make([]Part, len(m.Parts_))
+	for i, p := range m.Parts_ {
+		parts[i] = p
+		parts[i].ID_ = ulid.Make()
+	}
+	flags := make([]string, len(m.Flags_))
+	copy(flags, m.Flags_)
+
 	return &Msg{
 		ID_:         ulid.Make(),
+		AccountID_:  m.AccountID_,
 		ReceivedAt_: m.ReceivedAt_,
 		CreatedAt_:  time.Now(),
 		UpdatedAt_:  time.Now(),
 		Meta_:       meta,
-		Parts_:      m.Parts_,
+		Flags_:      flags,
+		Content_:    m.Content_,
+		Parts_:      parts,
+		Search_:     m.Search_,
 	}
 }
 
@@ -54,6 +82,8 @@ type Part struct {
 	Content_        *ContentPartData
 	Inline_         []byte
 	ExternalBlobID_ string
+	Codec_          string // compression codec of the body, see package compress
+	KeyVersion_     int    // data key used to encrypt the body, 0 if not encrypted
 }
 
 func (p *Part) ID() ulid.ULID             { return p.ID_ }
@@ -61,15 +91,22 @@ func (p *Part) Path() Path                { return p.Path_ }
 func (p *Part) Content() *ContentPartData { return p.Content_ }
 func (p *Part) InlineBlob() []byte        { return p.Inline_ }
 func (p *Part) ExternalBlobID() string    { return p.ExternalBlobID_ }
+func (p *Part) Codec() string             { return p.Codec_ }
+func (p *Part) KeyVersion() int           { return p.KeyVersion_ }
 
 type NewMsg struct {
-	Date    time.Time // IMAP internal date, can be zero (will default to created_at)
-	Flags   []string
-	Content *ContentData
-	Parts   []NewPart // must have at least one part (with path 1).
+	AccountID ulid.ULID
+	Date      time.Time // IMAP internal date, can be zero (will default to created_at)
+	Flags     []string
+	Content   *ContentData
+	Parts     []NewPart // must have at least one part (with path 1).
+	Search    *SearchText
 }
 
 func (nm *NewMsg) Validate() error {
+	if nm.Content == nil {
+		return fmt.Errorf("no content data")
+	}
 	for i, p := range nm.Parts {
 		if err := p.Validate(); err != nil {
 			return fmt.Errorf("invalid part at index %d: %v", i, err)
@@ -85,16 +122,28 @@ type NewPart struct {
 	Content    *ContentPartData
 	InlineBlob []byte
 	ExternalID string
+	Codec      string // body is compressed if not empty
+	KeyVersion int    // body is encrypted if not zero
 }
 
 func (np *NewPart) Validate() error {
-	if np.ExternalID == "" && np.InlineBlob == nil {
-		return fmt.Errorf("no body content")
-	}
 	if np.Content == nil {
 		return fmt.Errorf("no content data")
 	}
-	if np.InlineBlob != nil && uint32(len(np.InlineBlob)) != np.Content.Size {
+	if np.Content.IsMultipart() || np.Content.IsMessage() {
+		// Body is made of children parts.
+		if np.ExternalID != "" || np.InlineBlob != nil {
+			return fmt.Errorf("multipart or message part cannot have body content")
+		}
+		if np.Path.Empty() {
+			return fmt.Errorf("empty part path")
+		}
+		return nil
+	}
+	if np.ExternalID == "" && np.InlineBlob == nil {
+		return fmt.Errorf("no body content")
+	}
+	if np.Codec == "" && np.KeyVersion == 0 && np.InlineBlob != nil && uint32(len(np.InlineBlob)) != np.Content.Size {
 		return fmt.Errorf("inline blob (%d octets) size is not equal to size (%d)", len(np.InlineBlob), np.Content.Size)
 	}
 	if np.Path.Empty() {
@@ -120,12 +169,15 @@ func New(data *NewMsg) (*Msg, error) {
 			Content_:        p.Content,
 			Inline_:         p.InlineBlob,
 			ExternalBlobID_: p.ExternalID,
+			Codec_:          p.Codec,
+			KeyVersion_:     p.KeyVersion,
 		}
 	}
 
 	now := time.Now()
 	msg := &Msg{
 		ID_:         ulid.Make(),
+		AccountID_:  data.AccountID,
 		ReceivedAt_: data.Date,
 		CreatedAt_:  now,
 		UpdatedAt_:  now,
@@ -133,6 +185,7 @@ func New(data *NewMsg) (*Msg, error) {
 		Flags_:      data.Flags,
 		Content_:    data.Content,
 		Parts_:      parts,
+		Search_:     data.Search,
 	}
 	if msg.ReceivedAt_.IsZero() {
 		msg.ReceivedAt_ = msg.CreatedAt_
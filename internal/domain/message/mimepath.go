@@ -20,6 +20,25 @@ func (p Path) Depth() int {
 	return len(p)
 }
 
+func (p Path) Equal(other Path) bool {
+	if len(p) != len(other) {
+		return false
+	}
+	for i := range p {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Path) Parent() Path {
+	if p.Empty() {
+		return p
+	}
+	return p[:len(p)-1]
+}
+
 func (p Path) NextSibling() Path {
 	if p.Empty() {
 		return p
@@ -0,0 +1,220 @@
+package messageparser
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+)
+
+// splitHeader splits the entity into header (including the terminating
+// empty line) and body. If there is no empty line, whole entity is
+// considered to be a header.
+func splitHeader(data []byte) (hdr, body []byte) {
+	for i := 0; i < len(data); {
+		lineEnd := bytes.IndexByte(data[i:], '\n')
+		if lineEnd == -1 {
+			break
+		}
+		lineEnd += i + 1
+
+		line := data[i:lineEnd]
+		if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
+			return data[:lineEnd], data[lineEnd:]
+		}
+		i = lineEnd
+	}
+	return data, nil
+}
+
+type headerField struct {
+	Name  string
+	Value string // unfolded
+}
+
+type header []headerField
+
+func parseHeader(hdr []byte) header {
+	var (
+		fields header
+		cur    *headerField
+	)
+	for len(hdr) != 0 {
+		line := hdr
+		if i := bytes.IndexByte(hdr, '\n'); i != -1 {
+			line = hdr[:i+1]
+		}
+		hdr = hdr[len(line):]
+		line = bytes.TrimRight(line, "\r\n")
+
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if cur != nil {
+				cur.Value += string(line)
+			}
+			continue
+		}
+
+		name, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			// Malformed line, ignore it.
+			cur = nil
+			continue
+		}
+		fields = append(fields, headerField{
+			Name:  string(bytes.TrimSpace(name)),
+			Value: string(value),
+		})
+		cur = &fields[len(fields)-1]
+	}
+
+	for i := range fields {
+		fields[i].Value = strings.TrimSpace(fields[i].Value)
+	}
+	return fields
+}
+
+// Get returns the value of the first field with the specified name.
+func (h header) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+func decodeWords(s string) string {
+	dec, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
+
+func mediaType(h header, name, def string) (string, map[string]string) {
+	value := h.Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	typ, params, err := mime.ParseMediaType(value)
+	if typ == "" {
+		// Completely broken value, params are not useful either.
+		return def, nil
+	}
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return def, nil
+	}
+	if len(params) == 0 {
+		params = nil
+	}
+	return typ, params
+}
+
+func disposition(h header) message.Disposition {
+	value := h.Get("Content-Disposition")
+	if value == "" {
+		return message.Disposition{}
+	}
+
+	typ, params, err := mime.ParseMediaType(value)
+	if typ == "" || (err != nil && err != mime.ErrInvalidMediaParameter) {
+		return message.Disposition{}
+	}
+	if len(params) == 0 {
+		params = nil
+	}
+	return message.Disposition{
+		Value:  typ,
+		Params: params,
+	}
+}
+
+func languages(h header) []string {
+	value := h.Get("Content-Language")
+	if value == "" {
+		return nil
+	}
+
+	var res []string
+	for _, l := range strings.Split(value, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+var addrParser = mail.AddressParser{WordDecoder: &wordDecoder}
+
+func addressList(h header, name string) []message.Address {
+	value := h.Get(name)
+	if value == "" {
+		return nil
+	}
+
+	list, err := addrParser.ParseList(value)
+	if err != nil {
+		return nil
+	}
+
+	res := make([]message.Address, 0, len(list))
+	for _, a := range list {
+		addr := message.Address{
+			Name:    a.Name,
+			Mailbox: a.Address,
+		}
+		if i := strings.LastIndexByte(a.Address, '@'); i != -1 {
+			addr.Mailbox = a.Address[:i]
+			addr.Host = a.Address[i+1:]
+		}
+		res = append(res, addr)
+	}
+	return res
+}
+
+// msgIDs returns message identifiers (without angle brackets) listed in
+// the field value.
+func msgIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end == -1 {
+			break
+		}
+		ids = append(ids, value[start+1:start+end])
+		value = value[start+end+1:]
+	}
+	return ids
+}
+
+func envelope(h header) *message.ContentEnvelope {
+	env := &message.ContentEnvelope{
+		Subject: decodeWords(h.Get("Subject")),
+		From:    addressList(h, "From"),
+		Sender:  addressList(h, "Sender"),
+		ReplyTo: addressList(h, "Reply-To"),
+		To:      addressList(h, "To"),
+		Cc:      addressList(h, "Cc"),
+		Bcc:     addressList(h, "Bcc"),
+	}
+	if date, err := mail.ParseDate(h.Get("Date")); err == nil {
+		env.Date = date
+	}
+	env.InReplyTo = msgIDs(h.Get("In-Reply-To"))
+	if ids := msgIDs(h.Get("Message-Id")); len(ids) != 0 {
+		env.MessageID = ids[0]
+	}
+	return env
+}
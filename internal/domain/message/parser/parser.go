@@ -0,0 +1,414 @@
+// Package messageparser implements decomposition of RFC 5322 messages into
+// message parts.
+package messageparser
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/compress"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+)
+
+// DefaultInlineThreshold is the maximum size of the part body that is
+// stored inline.
+const DefaultInlineThreshold = 64 * 1024
+
+// DefaultCompressThreshold is the minimum size of the part body that is
+// compressed.
+const DefaultCompressThreshold = 1024
+
+// maxDepth limits nesting of multiparts and encapsulated messages.
+const maxDepth = 32
+
+type Parser struct {
+	store           blob.Store
+	inlineThreshold int
+
+	codecName         string
+	codec             compress.Codec
+	compressThreshold int
+
+	keyVersion int
+	key        []byte
+}
+
+// New creates the Parser that writes part bodies larger than
+// inlineThreshold to store. If store is nil, all parts are stored inline.
+func New(store blob.Store, inlineThreshold int) Parser {
+	return Parser{
+		store:           store,
+		inlineThreshold: inlineThreshold,
+	}
+}
+
+// WithCompression returns the Parser that compresses part bodies larger
+// than threshold using the named codec. Compressed body is stored only if
+// it is smaller than the original one.
+func (p Parser) WithCompression(codecName string, threshold int) (Parser, error) {
+	codec, err := compress.Get(codecName)
+	if err != nil {
+		return Parser{}, err
+	}
+	p.codecName = codecName
+	p.codec = codec
+	p.compressThreshold = threshold
+	return p, nil
+}
+
+// WithKey returns the Parser that encrypts part bodies using the data key
+// with the specified version. Bodies are encrypted after compression.
+func (p Parser) WithKey(version int, key []byte) Parser {
+	p.keyVersion = version
+	p.key = key
+	return p
+}
+
+// Parse reads the message from r and splits it into parts.
+//
+// Returned NewMsg has only content information filled, Date and Flags are
+// to be set by the caller.
+//
+// If an error is returned, some blobs might have been already written to
+// the store, they are expected to be removed by the garbage collector.
+func (p Parser) Parse(ctx context.Context, r io.Reader) (*message.NewMsg, error) {
+	defer trace.StartRegion(ctx, "messageparser.Parse").End()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, storeerrors.ValidationError{
+			Text:  "Empty message",
+			Field: "message",
+		}
+	}
+
+	s := &state{ctx: ctx, p: p}
+	content, err := s.parseMessage(message.EmptyPath(), data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message.NewMsg{
+		Content: content,
+		Parts:   s.parts,
+		Search:  searchText(parseHeader(content.Header), content.Envelope, &s.body),
+	}, nil
+}
+
+type state struct {
+	ctx   context.Context
+	p     Parser
+	parts []message.NewPart
+	body  strings.Builder // text for the search index
+}
+
+// parseMessage parses top-level or encapsulated message at path. Its
+// body is stored as parts starting at path.FirstChild().
+func (s *state) parseMessage(path message.Path, data []byte, depth int) (*message.ContentData, error) {
+	hdr, body := splitHeader(data)
+	h := parseHeader(hdr)
+
+	typ, params := mediaType(h, "Content-Type", "text/plain")
+
+	cd := &message.ContentData{
+		Type:        typ,
+		Params:      params,
+		Disposition: disposition(h),
+		Language:    languages(h),
+		Location:    h.Get("Content-Location"),
+		Header:      hdr,
+		Size:        int64(len(data)),
+		Envelope:    envelope(h),
+	}
+
+	if cd.IsMultipart() {
+		children, layout, ok := splitMultipart(body, params["boundary"])
+		if ok {
+			cd.Layout = layout
+			if err := s.parseMultipart(path, typ, children, depth); err != nil {
+				return nil, err
+			}
+			return cd, nil
+		}
+
+		// Multipart without boundary or delimiters, treat it as a plain text.
+		cd.Type = "text/plain"
+		cd.Params = nil
+	}
+
+	// The sole body of a non-multipart message shares the header with the
+	// message itself.
+	if err := s.parsePart(path.FirstChild(), nil, h, cd.Type, body, depth); err != nil {
+		return nil, err
+	}
+	return cd, nil
+}
+
+func (s *state) parseMultipart(path message.Path, typ string, children [][]byte, depth int) error {
+	if depth >= maxDepth {
+		return storeerrors.ValidationError{
+			Text:  "Message structure is too deep",
+			Field: "message",
+		}
+	}
+
+	defaultType := "text/plain"
+	if strings.EqualFold(typ, "multipart/digest") {
+		defaultType = "message/rfc822"
+	}
+
+	childPath := path.FirstChild()
+	for _, child := range children {
+		hdr, childBody := splitHeader(child)
+		if err := s.parsePart(childPath, hdr, parseHeader(hdr), defaultType, childBody, depth+1); err != nil {
+			return err
+		}
+		childPath = childPath.NextSibling()
+	}
+	return nil
+}
+
+// parsePart adds the part at path to the list. hdr is the raw part
+// header, it is nil if the part is the sole body of a non-multipart
+// message. In this case, h contains the fields from the message header.
+func (s *state) parsePart(path message.Path, hdr []byte, h header, defaultType string, body []byte, depth int) error {
+	typ, params := mediaType(h, "Content-Type", defaultType)
+
+	cpd := &message.ContentPartData{
+		Type:        typ,
+		Params:      params,
+		Disposition: disposition(h),
+		Language:    languages(h),
+		Location:    h.Get("Content-Location"),
+		ID:          h.Get("Content-Id"),
+		Description: decodeWords(h.Get("Content-Description")),
+		Encoding:    strings.ToLower(h.Get("Content-Transfer-Encoding")),
+		Size:        uint32(len(body)),
+		Header:      hdr,
+	}
+	if cpd.Encoding == "" {
+		cpd.Encoding = "7bit"
+	}
+
+	if cpd.IsMultipart() {
+		children, layout, ok := splitMultipart(body, params["boundary"])
+		if ok {
+			cpd.Layout = layout
+			s.parts = append(s.parts, message.NewPart{
+				Path:    path,
+				Content: cpd,
+			})
+			return s.parseMultipart(path, typ, children, depth)
+		}
+
+		// Multipart without boundary or delimiters, treat it as a plain text.
+		cpd.Type = "text/plain"
+		cpd.Params = nil
+	}
+
+	if isEncapsulated(cpd) {
+		if depth >= maxDepth {
+			return storeerrors.ValidationError{
+				Text:  "Message structure is too deep",
+				Field: "message",
+			}
+		}
+
+		s.parts = append(s.parts, message.NewPart{
+			Path:    path,
+			Content: cpd,
+		})
+
+		msg, err := s.parseMessage(path, body, depth+1)
+		if err != nil {
+			return err
+		}
+		cpd.Envelope = msg.Envelope
+		msg.Envelope = nil
+		cpd.Message = msg
+		cpd.NumLines = numLines(body)
+		return nil
+	}
+
+	if strings.HasPrefix(cpd.Type, "text/") {
+		cpd.NumLines = numLines(body)
+		s.addSearchText(cpd, body)
+	}
+
+	part := message.NewPart{
+		Path:    path,
+		Content: cpd,
+	}
+	if s.p.codec != nil && len(body) > s.p.compressThreshold {
+		compressed, err := s.p.codec.Compress(nil, body)
+		if err != nil {
+			return fmt.Errorf("messageparser: compress: %w", err)
+		}
+		if len(compressed) < len(body) {
+			body = compressed
+			part.Codec = s.p.codecName
+		}
+	}
+	if s.p.key != nil {
+		// Deterministic, so identical parts are deduplicated within the
+		// account.
+		encrypted, err := crypt.SealDeterministic(s.p.key, body, nil)
+		if err != nil {
+			return fmt.Errorf("messageparser: encrypt: %w", err)
+		}
+		body = encrypted
+		part.KeyVersion = s.p.keyVersion
+	}
+	if s.p.store != nil && len(body) > s.p.inlineThreshold {
+		id, err := s.writeBlob(body)
+		if err != nil {
+			return err
+		}
+		part.ExternalID = id
+	} else {
+		part.InlineBlob = body
+		if part.InlineBlob == nil {
+			part.InlineBlob = []byte{}
+		}
+	}
+	s.parts = append(s.parts, part)
+	return nil
+}
+
+func (s *state) addSearchText(cpd *message.ContentPartData, body []byte) {
+	if s.body.Len() >= maxSearchBody {
+		return
+	}
+	text := partText(cpd, body)
+	if rest := maxSearchBody - s.body.Len(); len(text) > rest {
+		text = strings.ToValidUTF8(text[:rest], "")
+	}
+	if s.body.Len() != 0 {
+		s.body.WriteString("\n")
+	}
+	s.body.WriteString(text)
+}
+
+func (s *state) writeBlob(body []byte) (string, error) {
+	// CONSISTENCY: Existing blob might be removed by the garbage collector
+	// if it is unused and the message is not saved within the grace period.
+	id, err := blob.Put(s.ctx, s.p.store, body)
+	if err != nil {
+		return "", fmt.Errorf("messageparser: %w", err)
+	}
+	return id, nil
+}
+
+// isEncapsulated reports whether the part contains an encapsulated
+// message that should be split further.
+func isEncapsulated(cpd *message.ContentPartData) bool {
+	if !strings.EqualFold(cpd.Type, "message/rfc822") && !strings.EqualFold(cpd.Type, "message/global") {
+		return false
+	}
+	switch cpd.Encoding {
+	case "7bit", "8bit", "binary":
+		return true
+	default:
+		// Encoded messages are not allowed by RFC 2046, but seen in the
+		// wild. Keep them opaque.
+		return false
+	}
+}
+
+func numLines(body []byte) int64 {
+	n := int64(bytes.Count(body, []byte{'\n'}))
+	if len(body) != 0 && body[len(body)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// splitMultipart returns bodies of the multipart children (including
+// their headers) and the layout of the remaining octets. Line break
+// preceding the delimiter belongs to the delimiter and is not included into
+// the child. ok is false if there are no delimiters in the body.
+func splitMultipart(body []byte, boundary string) (children [][]byte, layout *message.MultipartLayout, ok bool) {
+	if boundary == "" {
+		return nil, nil, false
+	}
+
+	delim := []byte("--" + boundary)
+	layout = &message.MultipartLayout{}
+
+	partStart := -1
+	for i := 0; i < len(body); {
+		lineEnd := bytes.IndexByte(body[i:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(body)
+		} else {
+			lineEnd += i + 1
+		}
+
+		isClose, isDelim := matchDelimiter(body[i:lineEnd], delim)
+		if !isDelim {
+			i = lineEnd
+			continue
+		}
+
+		delimStart := i
+		if bytes.HasSuffix(body[:i], []byte("\r\n")) {
+			delimStart -= 2
+		} else if bytes.HasSuffix(body[:i], []byte("\n")) {
+			delimStart--
+		}
+
+		if partStart == -1 {
+			layout.Preamble = body[:delimStart]
+		} else {
+			// Line break might be already consumed by the previous
+			// delimiter if the part is empty.
+			if delimStart < partStart {
+				delimStart = partStart
+			}
+			children = append(children, body[partStart:delimStart])
+		}
+
+		if isClose {
+			layout.Epilogue = body[delimStart:]
+			return children, layout, true
+		}
+
+		layout.Delimiters = append(layout.Delimiters, body[delimStart:lineEnd])
+		partStart = lineEnd
+		i = lineEnd
+	}
+
+	if partStart == -1 {
+		return nil, nil, false
+	}
+
+	// Missing close delimiter, last part extends to the end of body.
+	children = append(children, body[partStart:])
+	return children, layout, true
+}
+
+func matchDelimiter(line, delim []byte) (isClose, ok bool) {
+	if !bytes.HasPrefix(line, delim) {
+		return false, false
+	}
+	rest := line[len(delim):]
+	if bytes.HasPrefix(rest, []byte("--")) {
+		isClose = true
+		rest = rest[2:]
+	}
+	// Only transport padding is allowed after the delimiter.
+	if len(bytes.TrimRight(rest, " \t\r\n")) != 0 {
+		return false, false
+	}
+	return isClose, true
+}
@@ -0,0 +1,410 @@
+package messageparser
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/compress"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/stretchr/testify/require"
+)
+
+type memStore struct {
+	lock  sync.Mutex
+	blobs map[string][]byte
+}
+
+type memWriter struct {
+	bytes.Buffer
+	s    *memStore
+	path string
+}
+
+func (w *memWriter) Close() error {
+	w.s.lock.Lock()
+	defer w.s.lock.Unlock()
+	w.s.blobs[w.path] = w.Bytes()
+	return nil
+}
+
+func (s *memStore) Create(_ context.Context, path string) (io.WriteCloser, error) {
+	return &memWriter{s: s, path: path}, nil
+}
+
+func (s *memStore) Open(_ context.Context, path string) (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.blobs[path]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) Delete(_ context.Context, path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.blobs[path]; !ok {
+		return blob.ErrNotFound
+	}
+	delete(s.blobs, path)
+	return nil
+}
+
+func (s *memStore) Stat(_ context.Context, path string) (*blob.Info, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.blobs[path]
+	if !ok {
+		return nil, blob.ErrNotFound
+	}
+	return &blob.Info{Path: path, Size: int64(len(b))}, nil
+}
+
+func (s *memStore) List(_ context.Context, fn func(info blob.Info) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for path, b := range s.blobs {
+		if err := fn(blob.Info{Path: path, Size: int64(len(b))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var roundTripCases = []struct {
+	name string
+	msg  string
+}{
+	{
+		name: "simple",
+		msg:  "From: a@example.org\r\nSubject: test\r\n\r\nHello\r\n",
+	},
+	{
+		name: "lf only",
+		msg:  "From: a@example.org\nSubject: test\n\nHello\nworld\n",
+	},
+	{
+		name: "mixed line endings",
+		msg:  "From: a@example.org\r\nSubject: test\n\r\nHello\nworld\r\n\r\n",
+	},
+	{
+		name: "folded header",
+		msg: "Subject: very\r\n long\r\n\tsubject\r\nTo: a@example.org,\r\n    b@example.org\r\n\r\n" +
+			"body",
+	},
+	{
+		name: "header only",
+		msg:  "Subject: no body\r\nFrom: a@example.org\r\n",
+	},
+	{
+		name: "header only without line break",
+		msg:  "Subject: no body",
+	},
+	{
+		name: "empty header",
+		msg:  "\r\nJust body\r\n",
+	},
+	{
+		name: "8bit",
+		msg:  "Subject: =?utf-8?q?caf=C3=A9?=\r\nContent-Transfer-Encoding: 8bit\r\n\r\ncafé \x00\xff\r\n",
+	},
+	{
+		name: "multipart with preamble and epilogue",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"This is a preamble.\r\n\r\n" +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\nfirst\r\n" +
+			"--XYZ\r\nContent-Type: text/html\r\n\r\n<p>second</p>\r\n\r\n" +
+			"--XYZ--\r\n\r\nThis is an epilogue.\r\n",
+	},
+	{
+		name: "multipart without preamble",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\n\r\nimplicit text/plain\r\n" +
+			"--XYZ--",
+	},
+	{
+		name: "transport padding",
+		msg: "Content-Type: multipart/mixed; boundary=\"X Y\"\r\n\r\n" +
+			"--X Y \t \r\nContent-Type: text/plain\r\n\r\nfirst\r\n" +
+			"--X Y--   \r\n",
+	},
+	{
+		name: "boundary-like lines",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\n\r\n--XYZa\r\n --XYZ\r\n--XY\r\n" +
+			"--XYZ--\r\n",
+	},
+	{
+		name: "empty parts",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\n--XYZ\r\n\r\n--XYZ\r\n" +
+			"--XYZ--\r\n",
+	},
+	{
+		name: "missing close delimiter",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\nfirst\r\n" +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\nsecond, truncated\r\n",
+	},
+	{
+		name: "only close delimiter",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"preamble\r\n--XYZ--\r\nepilogue",
+	},
+	{
+		name: "no delimiters",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"Not a multipart actually\r\n",
+	},
+	{
+		name: "no boundary",
+		msg: "Content-Type: multipart/mixed\r\n\r\n" +
+			"--XYZ\r\n\r\ntext\r\n--XYZ--\r\n",
+	},
+	{
+		name: "nested multipart",
+		msg: "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+			"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+			"inner preamble\r\n" +
+			"--inner\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+			"--inner\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n" +
+			"--inner--\r\ninner epilogue\r\n" +
+			"--outer\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			"AAECAwQFBgcICQ==\r\n" +
+			"--outer--\r\n",
+	},
+	{
+		name: "lf only multipart",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\n\n" +
+			"--XYZ\nContent-Type: text/plain\n\nfirst\n" +
+			"--XYZ\n\nsecond\n\n" +
+			"--XYZ--\n",
+	},
+	{
+		name: "encapsulated message",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--XYZ\r\nContent-Type: message/rfc822\r\n\r\n" +
+			"Subject: inner\r\nContent-Type: multipart/alternative; boundary=in\r\n\r\n" +
+			"--in\r\n\r\nplain\r\n--in\r\nContent-Type: text/html\r\n\r\nhtml\r\n--in--\r\n" +
+			"--XYZ--\r\n",
+	},
+	{
+		name: "top-level encapsulated message",
+		msg: "Content-Type: message/rfc822\r\n\r\n" +
+			"Subject: inner\r\n\r\ninner body\r\n",
+	},
+	{
+		name: "encoded encapsulated message",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\nContent-Type: message/rfc822\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			"U3ViamVjdDogaW5uZXINCg0KYm9keQ0K\r\n" +
+			"--XYZ--\r\n",
+	},
+	{
+		name: "digest",
+		msg: "Content-Type: multipart/digest; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\n\r\nSubject: first\r\n\r\nbody 1\r\n" +
+			"--XYZ\r\n\r\nSubject: second\r\n\r\nbody 2\r\n" +
+			"--XYZ--\r\n",
+	},
+	{
+		name: "large part",
+		msg: "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("long line\r\n", 100) +
+			"--XYZ\r\nContent-Type: text/plain\r\n\r\nshort\r\n" +
+			"--XYZ--\r\n",
+	},
+}
+
+// storeRoundTrip simulates storing the message in the repository.
+func storeRoundTrip(t *testing.T, msg *message.Msg) *message.Msg {
+	content, err := json.Marshal(msg.Content_)
+	require.NoError(t, err)
+	res := *msg
+	res.Content_ = nil
+	require.NoError(t, json.Unmarshal(content, &res.Content_))
+
+	res.Parts_ = make([]message.Part, len(msg.Parts_))
+	for i, p := range msg.Parts_ {
+		content, err := json.Marshal(p.Content_)
+		require.NoError(t, err)
+		res.Parts_[i] = p
+		res.Parts_[i].Content_ = nil
+		require.NoError(t, json.Unmarshal(content, &res.Parts_[i].Content_))
+	}
+	return &res
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, c := range roundTripCases {
+		t.Run(c.name, func(t *testing.T) {
+			testParseRoundTrip(t, c.msg, New(&memStore{blobs: map[string][]byte{}}, 512), nil)
+		})
+	}
+}
+
+func TestParseRoundTripCompressed(t *testing.T) {
+	for _, codec := range []string{compress.Gzip, compress.Zstd} {
+		for _, c := range roundTripCases {
+			t.Run(codec+"/"+c.name, func(t *testing.T) {
+				p, err := New(&memStore{blobs: map[string][]byte{}}, 128).WithCompression(codec, 16)
+				require.NoError(t, err)
+				msg := testParseRoundTrip(t, c.msg, p, nil)
+				if c.name == "large part" {
+					large, ok := msg.Part(message.Path{1})
+					require.True(t, ok)
+					require.Equal(t, codec, large.Codec_)
+				}
+			})
+		}
+	}
+}
+
+func TestParseRoundTripEncrypted(t *testing.T) {
+	key, err := crypt.NewKey()
+	require.NoError(t, err)
+	keys := func(_ context.Context, version int) ([]byte, error) {
+		require.Equal(t, 3, version)
+		return key, nil
+	}
+
+	for _, c := range roundTripCases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := New(&memStore{blobs: map[string][]byte{}}, 128).WithCompression(compress.Zstd, 16)
+			require.NoError(t, err)
+			msg := testParseRoundTrip(t, c.msg, p.WithKey(3, key), keys)
+			for _, part := range msg.Parts_ {
+				if part.Inline_ != nil || part.ExternalBlobID_ != "" {
+					require.Equal(t, 3, part.KeyVersion_)
+				}
+			}
+		})
+	}
+}
+
+func testParseRoundTrip(t *testing.T, msgText string, p Parser, keys message.KeyFunc) *message.Msg {
+	ctx := context.Background()
+	store := p.store
+
+	data, err := p.Parse(ctx, strings.NewReader(msgText))
+	require.NoError(t, err)
+	require.NoError(t, data.Validate())
+
+	msg, err := message.New(data)
+	require.NoError(t, err)
+	msg = storeRoundTrip(t, msg)
+	require.EqualValues(t, len(msgText), msg.Content_.Size)
+
+	r, err := msg.Open(ctx, store, keys)
+	require.NoError(t, err)
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, msgText, string(raw))
+	return msg
+}
+
+func TestParseStructure(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{blobs: map[string][]byte{}}
+
+	var msg string
+	for _, c := range roundTripCases {
+		if c.name == "encapsulated message" {
+			msg = c.msg
+		}
+	}
+
+	data, err := New(store, 512).Parse(ctx, strings.NewReader(msg))
+	require.NoError(t, err)
+
+	paths := make([]string, len(data.Parts))
+	for i, p := range data.Parts {
+		paths[i] = p.Path.String() + " " + p.Content.Type
+	}
+	require.Equal(t, []string{
+		"1 text/plain",
+		"2 message/rfc822",
+		"2.1 text/plain",
+		"2.2 text/html",
+	}, paths)
+
+	encapsulated := data.Parts[1].Content
+	require.Equal(t, "inner", encapsulated.Envelope.Subject)
+	require.Equal(t, "multipart/alternative", encapsulated.Message.Type)
+
+	m, err := message.New(data)
+	require.NoError(t, err)
+
+	text, err := m.Text(message.Path{2})
+	require.NoError(t, err)
+	r := text.Open(ctx, store, nil)
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "--in\r\n\r\nplain\r\n--in\r\nContent-Type: text/html\r\n\r\nhtml\r\n--in--", string(b))
+
+	part, err := m.PartBody(message.Path{2, 1})
+	require.NoError(t, err)
+	r = part.Open(ctx, store, nil)
+	defer r.Close()
+	b, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "plain", string(b))
+}
+
+func TestParseSearchText(t *testing.T) {
+	msg := "From: =?iso-8859-1?q?J=F6hn?= <john@example.org>\r\n" +
+		"To: alice@example.com\r\n" +
+		"Subject: =?iso-8859-1?q?Caf=E9?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+		"--XYZ\r\nContent-Type: text/plain; charset=iso-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"caf=E9 au=\r\n lait\r\n" +
+		"--XYZ\r\nContent-Type: text/html\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		"PGI+Ym9sZDwvYj4mYW1wOw==\r\n" +
+		"--XYZ\r\nContent-Type: application/octet-stream\r\n\r\nbinary\r\n" +
+		"--XYZ--\r\n"
+
+	data, err := New(nil, 0).Parse(context.Background(), strings.NewReader(msg))
+	require.NoError(t, err)
+
+	text := data.Search
+	require.Equal(t, "Jöhn <john@example.org>", text.From)
+	require.Equal(t, "<alice@example.com>", text.To)
+	require.Equal(t, "Café", text.Subject)
+	require.Contains(t, text.Header, "Subject: Café\n")
+	require.Equal(t, "café au lait\n bold &", text.Body)
+}
+
+func TestParseCompressionThreshold(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=XYZ\r\n\r\n" +
+		"--XYZ\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("a", 32) + "\r\n" +
+		"--XYZ\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("a", 64) + "\r\n" +
+		"--XYZ\r\nContent-Type: application/octet-stream\r\n\r\n\x8f\x1a\x00\x77\xe2\x11\xc0\x5b\x3e\xd4\x9a\x02\xf6\x71\x28\x6c\x93\x4e\xb5\x0d\xaa\x17\x6f\xe8\x31\xcc\x58\x84\x2b\xf9\x46\x1d\x7a\xbe\r\n" +
+		"--XYZ--\r\n"
+
+	p, err := New(nil, 0).WithCompression(compress.Zstd, 32)
+	require.NoError(t, err)
+	data, err := p.Parse(context.Background(), strings.NewReader(msg))
+	require.NoError(t, err)
+	require.Len(t, data.Parts, 3)
+
+	// Not larger than threshold.
+	require.Empty(t, data.Parts[0].Codec)
+	require.Equal(t, strings.Repeat("a", 32), string(data.Parts[0].InlineBlob))
+	// Compressed.
+	require.Equal(t, compress.Zstd, data.Parts[1].Codec)
+	require.Less(t, len(data.Parts[1].InlineBlob), 64)
+	// Compressed data is larger than the original one.
+	require.Empty(t, data.Parts[2].Codec)
+	require.Len(t, data.Parts[2].InlineBlob, 34)
+}
@@ -0,0 +1,151 @@
+package messageparser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxSearchBody limits the amount of body text indexed for a single
+// message.
+const maxSearchBody = 1024 * 1024
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeBody reverses the Content-Transfer-Encoding. Malformed encoding
+// is not an error, as much data as possible is decoded.
+func decodeBody(encoding string, body []byte) []byte {
+	switch encoding {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, body)
+		clean = bytes.TrimRight(clean, "=")
+		dec := make([]byte, base64.RawStdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.RawStdEncoding.Decode(dec, clean)
+		return dec[:n]
+	case "quoted-printable":
+		dec, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return dec
+	default:
+		return body
+	}
+}
+
+// decodeCharset converts text in the specified charset to UTF-8.
+func decodeCharset(charset string, text []byte) string {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "us-ascii":
+	default:
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			break
+		}
+		dec, err := enc.NewDecoder().Bytes(text)
+		if err != nil {
+			break
+		}
+		return string(dec)
+	}
+	if utf8.Valid(text) {
+		return string(text)
+	}
+	return strings.ToValidUTF8(string(text), "�")
+}
+
+// stripTags removes HTML markup leaving only the text.
+func stripTags(s string) string {
+	var (
+		b     strings.Builder
+		inTag bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			b.WriteByte(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	return html.UnescapeString(b.String())
+}
+
+// DecodeText returns the body of the text/* part converted to UTF-8.
+func DecodeText(cpd *message.ContentPartData, body []byte) string {
+	return decodeCharset(cpd.Params["charset"], decodeBody(cpd.Encoding, body))
+}
+
+// partText returns the text of the text/* part for indexing.
+func partText(cpd *message.ContentPartData, body []byte) string {
+	text := DecodeText(cpd, body)
+	if strings.EqualFold(cpd.Type, "text/html") {
+		text = stripTags(text)
+	}
+	return text
+}
+
+func addressesText(lists ...[]message.Address) string {
+	var b strings.Builder
+	for _, list := range lists {
+		for _, a := range list {
+			if b.Len() != 0 {
+				b.WriteString(", ")
+			}
+			if a.Name != "" {
+				b.WriteString(a.Name)
+				b.WriteString(" ")
+			}
+			b.WriteString("<")
+			b.WriteString(a.Mailbox)
+			if a.Host != "" {
+				b.WriteString("@")
+				b.WriteString(a.Host)
+			}
+			b.WriteString(">")
+		}
+	}
+	return b.String()
+}
+
+func headerText(h header) string {
+	var b strings.Builder
+	for _, f := range h {
+		b.WriteString(f.Name)
+		b.WriteString(": ")
+		b.WriteString(decodeWords(f.Value))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// searchText builds SearchText for the top-level message.
+func searchText(h header, env *message.ContentEnvelope, body *strings.Builder) *message.SearchText {
+	return &message.SearchText{
+		From:    addressesText(env.From),
+		To:      addressesText(env.To),
+		Cc:      addressesText(env.Cc),
+		Bcc:     addressesText(env.Bcc),
+		Subject: env.Subject,
+		Header:  headerText(h),
+		Body:    body.String(),
+	}
+}
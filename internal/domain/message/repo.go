@@ -2,16 +2,135 @@ package message
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/oklog/ulid/v2"
 )
 
-var ErrNotFound = storeerrors.NotExistsError{Text: "message: no such message"}
+var (
+	ErrNotFound      = storeerrors.NotExistsError{Text: "message: no such message"}
+	ErrAlreadyExists = storeerrors.AlreadyExistsError{Text: "message: message already exists"}
+)
+
+type FlagOp int
+
+const (
+	FlagsAdd FlagOp = iota + 1
+	FlagsRemove
+	FlagsReplace
+)
+
+type FlagUpdate struct {
+	Op    FlagOp
+	Flags []string
+
+	// If set, messages with ModSeq greater than this value are not
+	// changed and reported as Modified. Zero fails for all messages
+	// (RFC 7162).
+	UnchangedSince *int64
+}
+
+// Modified reports whether the UnchangedSince check fails for a message
+// with the modification sequence.
+func (u FlagUpdate) Modified(modSeq int64) bool {
+	if u.UnchangedSince == nil {
+		return false
+	}
+	return *u.UnchangedSince == 0 || modSeq > *u.UnchangedSince
+}
+
+// Apply returns the new flags set for a message that currently has
+// the flags listed.
+func (u FlagUpdate) Apply(flags []string) []string {
+	res := make([]string, 0, len(flags)+len(u.Flags))
+	switch u.Op {
+	case FlagsAdd:
+		res = append(res, flags...)
+		for _, f := range u.Flags {
+			if !HasFlag(res, f) {
+				res = append(res, f)
+			}
+		}
+	case FlagsRemove:
+		for _, f := range flags {
+			if !HasFlag(u.Flags, f) {
+				res = append(res, f)
+			}
+		}
+	case FlagsReplace:
+		for _, f := range u.Flags {
+			if !HasFlag(res, f) {
+				res = append(res, f)
+			}
+		}
+	default:
+		panic("unknown flag operation")
+	}
+	return res
+}
+
+// HasFlag reports whether the flag is in the list. Flags are compared
+// case-insensitively.
+func HasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// FlagsEqual reports whether both lists contain the same set of flags.
+func FlagsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, f := range a {
+		if !HasFlag(b, f) {
+			return false
+		}
+	}
+	return true
+}
+
+type FlagsResult struct {
+	ID    ulid.ULID
+	Flags []string // flags after update
+	// ModSeq before the update, new one is assigned by changelog.Repo if
+	// flags were changed.
+	ModSeq int64
+
+	Changed  bool // flags were changed by the update
+	Modified bool // UnchangedSince check failed, flags were not changed
+}
 
 type Repo interface {
 	GetByID(ctx context.Context, id ulid.ULID) (*Msg, error)
 	GetByIDs(ctx context.Context, ids ...ulid.ULID) ([]Msg, error)
 	Create(ctx context.Context, m ...Msg) error
 	DeleteByID(ctx context.Context, id ...ulid.ULID) error
+
+	// GetFlags returns flags of the listed messages. Missing messages are
+	// skipped.
+	GetFlags(ctx context.Context, ids ...ulid.ULID) (map[ulid.ULID][]string, error)
+	// UpdateFlags changes flags of the listed messages. Missing messages
+	// are skipped.
+	UpdateFlags(ctx context.Context, upd FlagUpdate, ids ...ulid.ULID) ([]FlagsResult, error)
+
+	// GetIDsByOldKey returns IDs of up to limit messages of the account
+	// that have data not encrypted using the specified key version.
+	GetIDsByOldKey(ctx context.Context, accountID ulid.ULID, version int, limit int) ([]ulid.ULID, error)
+	// Reencrypt saves metadata and part bodies of existing messages,
+	// metadata is encrypted using the current account key.
+	Reencrypt(ctx context.Context, m ...Msg) error
+
+	// DeleteOrphaned removes messages created before the specified time that
+	// are not referenced by any folder entry.
+	DeleteOrphaned(ctx context.Context, createdBefore time.Time) (deleted int, err error)
+	// DeleteUnusedBlobs removes reference counters of external blobs that
+	// are not used by any message part since the specified time. IDs of
+	// removed blobs are returned, it is up to the caller to delete them.
+	DeleteUnusedBlobs(ctx context.Context, unusedSince time.Time) (blobIDs []string, err error)
 }
@@ -0,0 +1,337 @@
+package messagememory
+
+import (
+	"context"
+	"runtime/trace"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/oklog/ulid/v2"
+)
+
+type repo struct {
+	db memory.DB
+}
+
+// New returns message.Repo storing messages in memory. Metadata is never
+// encrypted, part bodies are expected to be encrypted by the caller.
+func New(db memory.DB) message.Repo {
+	return repo{db: db}
+}
+
+func copyMsg(msg *message.Msg) message.Msg {
+	cpy := *msg
+	cpy.Meta_ = msg.Meta_.Copy()
+	cpy.Flags_ = make([]string, len(msg.Flags_))
+	copy(cpy.Flags_, msg.Flags_)
+	cpy.Parts_ = make([]message.Part, len(msg.Parts_))
+	copy(cpy.Parts_, msg.Parts_)
+	cpy.Search_ = nil
+	return cpy
+}
+
+func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*message.Msg, error) {
+	var model message.Msg
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		msg, ok := t.Messages[id]
+		if !ok {
+			return message.ErrNotFound
+		}
+		model = copyMsg(&msg.Msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &model, nil
+}
+
+// GetByIDs returns messages in the same order as ids. Missing messages
+// are skipped.
+func (r repo) GetByIDs(ctx context.Context, ids ...ulid.ULID) ([]message.Msg, error) {
+	models := make([]message.Msg, 0, len(ids))
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, id := range ids {
+			if msg, ok := t.Messages[id]; ok {
+				models = append(models, copyMsg(&msg.Msg))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return models, nil
+}
+
+// refBlobs changes reference counters of external blobs used by parts.
+func refBlobs(tx *memory.Tx, parts []message.Part, delta int) {
+	t := tx.Tables()
+	now := time.Now()
+	for _, p := range parts {
+		if p.ExternalBlobID_ == "" {
+			continue
+		}
+		blob := t.Blobs[p.ExternalBlobID_]
+		blob.RefCount += delta
+		blob.UpdatedAt = now
+		memory.Set(tx, t.Blobs, p.ExternalBlobID_, blob)
+	}
+}
+
+// searchText returns the text to add to the search index. Text is not
+// loaded from the repository, so for copies it is taken from the original
+// message.
+func searchText(t *memory.Tables, model *message.Msg) *message.SearchText {
+	if model.Search_ != nil {
+		return model.Search_
+	}
+
+	origID, ok := model.Meta_.Get("copy_of")
+	if !ok {
+		return nil
+	}
+	orig, err := ulid.Parse(origID)
+	if err != nil {
+		return nil
+	}
+	return t.Messages[orig].Search
+}
+
+func (r repo) Create(ctx context.Context, msgs ...message.Msg) error {
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for i := range msgs {
+			model := &msgs[i]
+			if _, ok := t.Messages[model.ID_]; ok {
+				return message.ErrAlreadyExists
+			}
+
+			memory.Set(tx, t.Messages, model.ID_, memory.Message{
+				Msg:    copyMsg(model),
+				Search: searchText(t, model),
+			})
+			refBlobs(tx, model.Parts_, 1)
+		}
+		return nil
+	})
+}
+
+// deleteMessages removes messages together with their folder entries.
+func deleteMessages(tx *memory.Tx, ids map[ulid.ULID]struct{}) {
+	t := tx.Tables()
+	for _, entries := range t.Entries {
+		for uid, ent := range entries {
+			if _, ok := ids[ent.MsgID_]; ok {
+				memory.Delete(tx, entries, uid)
+			}
+		}
+	}
+	for id := range ids {
+		msg, ok := t.Messages[id]
+		if !ok {
+			continue
+		}
+		refBlobs(tx, msg.Parts_, -1)
+		memory.Delete(tx, t.Messages, id)
+	}
+}
+
+func (r repo) DeleteByID(ctx context.Context, ids ...ulid.ULID) error {
+	set := make(map[ulid.ULID]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		deleteMessages(tx, set)
+		return nil
+	})
+}
+
+func (r repo) UpdateFlags(ctx context.Context, upd message.FlagUpdate, ids ...ulid.ULID) ([]message.FlagsResult, error) {
+	defer trace.StartRegion(ctx, "message.Repository.UpdateFlags").End()
+
+	results := make([]message.FlagsResult, 0, len(ids))
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		now := time.Now()
+
+		for _, id := range ids {
+			msg, ok := t.Messages[id]
+			if !ok {
+				continue
+			}
+
+			res := message.FlagsResult{
+				ID:     id,
+				Flags:  msg.Flags_,
+				ModSeq: msg.ModSeq_,
+			}
+			if upd.Modified(res.ModSeq) {
+				res.Modified = true
+				results = append(results, res)
+				continue
+			}
+
+			updated := upd.Apply(res.Flags)
+			if !message.FlagsEqual(updated, res.Flags) {
+				res.Flags = updated
+				res.Changed = true
+
+				msg.Flags_ = updated
+				msg.UpdatedAt_ = now
+				memory.Set(tx, t.Messages, id, msg)
+			}
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		flags := make([]string, len(results[i].Flags))
+		copy(flags, results[i].Flags)
+		results[i].Flags = flags
+	}
+	return results, nil
+}
+
+func (r repo) GetFlags(ctx context.Context, ids ...ulid.ULID) (map[ulid.ULID][]string, error) {
+	defer trace.StartRegion(ctx, "message.Repository.GetFlags").End()
+
+	res := make(map[ulid.ULID][]string, len(ids))
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for _, id := range ids {
+			msg, ok := t.Messages[id]
+			if !ok {
+				continue
+			}
+			flags := make([]string, len(msg.Flags_))
+			copy(flags, msg.Flags_)
+			res[id] = flags
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r repo) GetIDsByOldKey(ctx context.Context, accountID ulid.ULID, version int, limit int) ([]ulid.ULID, error) {
+	defer trace.StartRegion(ctx, "message.Repository.GetIDsByOldKey").End()
+
+	var ids []ulid.ULID
+	err := r.db.Read(ctx, func(t *memory.Tables) error {
+		for id, msg := range t.Messages {
+			if msg.AccountID_ != accountID {
+				continue
+			}
+			for _, p := range msg.Parts_ {
+				hasBody := p.Inline_ != nil || p.ExternalBlobID_ != ""
+				if hasBody && p.KeyVersion_ != version {
+					ids = append(ids, id)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (r repo) Reencrypt(ctx context.Context, msgs ...message.Msg) error {
+	defer trace.StartRegion(ctx, "message.Repository.Reencrypt").End()
+
+	return r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for i := range msgs {
+			model := &msgs[i]
+			msg, ok := t.Messages[model.ID_]
+			if !ok {
+				continue
+			}
+
+			refBlobs(tx, model.Parts_, 1)
+			refBlobs(tx, msg.Parts_, -1)
+
+			updated := copyMsg(model)
+			msg.Meta_ = updated.Meta_
+			msg.Content_ = updated.Content_
+			msg.Parts_ = updated.Parts_
+			memory.Set(tx, t.Messages, model.ID_, msg)
+		}
+		return nil
+	})
+}
+
+func (r repo) DeleteOrphaned(ctx context.Context, createdBefore time.Time) (int, error) {
+	defer trace.StartRegion(ctx, "message.Repository.DeleteOrphaned").End()
+
+	var deleted int
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+
+		used := make(map[ulid.ULID]struct{})
+		for _, entries := range t.Entries {
+			for _, ent := range entries {
+				used[ent.MsgID_] = struct{}{}
+			}
+		}
+
+		orphaned := make(map[ulid.ULID]struct{})
+		for id, msg := range t.Messages {
+			if _, ok := used[id]; !ok && msg.CreatedAt_.Before(createdBefore) {
+				orphaned[id] = struct{}{}
+			}
+		}
+		deleteMessages(tx, orphaned)
+		deleted = len(orphaned)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+func (r repo) DeleteUnusedBlobs(ctx context.Context, unusedSince time.Time) ([]string, error) {
+	defer trace.StartRegion(ctx, "message.Repository.DeleteUnusedBlobs").End()
+
+	var ids []string
+	err := r.db.Write(ctx, func(tx *memory.Tx) error {
+		t := tx.Tables()
+		for id, blob := range t.Blobs {
+			if blob.RefCount == 0 && blob.UpdatedAt.Before(unusedSince) {
+				ids = append(ids, id)
+				memory.Delete(tx, t.Blobs, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,186 @@
+package messagepostgres
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+)
+
+type msgDTO struct {
+	ID         ulid.ULID  `gorm:"column:id;primaryKey"`
+	AccountID  *ulid.ULID `gorm:"column:account_id"`
+	Date       time.Time  `gorm:"column:date"`
+	CreatedAt  time.Time  `gorm:"column:created_at;autoCreateTime:false"`
+	UpdatedAt  time.Time  `gorm:"column:updated_at;autoUpdateTime:false"`
+	ModSeq     int64      `gorm:"column:modseq"`
+	Meta       []byte     `gorm:"column:meta"`      // JSON, encrypted if KeyVersion is not 0
+	Content    []byte     `gorm:"column:content"`   // JSON, encrypted if KeyVersion is not 0
+	Size       int64      `gorm:"column:size"`      // duplicates content.size for aggregate queries
+	SentDate   *time.Time `gorm:"column:sent_date"` // duplicates content.envelope.date for SENT* search
+	KeyVersion int        `gorm:"column:key_version"`
+}
+
+func (msgDTO) TableName() string { return "messages" }
+
+type msgFlagDTO struct {
+	MsgID ulid.ULID `gorm:"column:message_id"`
+	Flag  string    `gorm:"column:flag"`
+}
+
+func (msgFlagDTO) TableName() string { return "message_flags" }
+
+type msgPartDTO struct {
+	ID             ulid.ULID `gorm:"column:id;primaryKey"`
+	MessageID      ulid.ULID `gorm:"column:message_id"`
+	Path           string    `gorm:"column:path"`
+	Content        []byte    `gorm:"column:content"` // JSON, encrypted using msgDTO.KeyVersion
+	Inline         []byte    `gorm:"column:inline"`  // BYTEA
+	ExternalBlobID string    `gorm:"column:external_blob_id"`
+	Codec          string    `gorm:"column:codec"`
+	KeyVersion     int       `gorm:"column:key_version"` // of the body
+}
+
+func (msgPartDTO) TableName() string { return "message_parts" }
+
+type msgSearchDTO struct {
+	MessageID ulid.ULID `gorm:"column:message_id"`
+	FromField string    `gorm:"column:from_field"`
+	ToField   string    `gorm:"column:to_field"`
+	CcField   string    `gorm:"column:cc_field"`
+	BccField  string    `gorm:"column:bcc_field"`
+	Subject   string    `gorm:"column:subject"`
+	Header    string    `gorm:"column:header"`
+	Body      string    `gorm:"column:body"`
+}
+
+func (msgSearchDTO) TableName() string { return "message_search" }
+
+func searchAsDTO(msgID ulid.ULID, text *message.SearchText) *msgSearchDTO {
+	return &msgSearchDTO{
+		MessageID: msgID,
+		FromField: text.From,
+		ToField:   text.To,
+		CcField:   text.Cc,
+		BccField:  text.Bcc,
+		Subject:   text.Subject,
+		Header:    text.Header,
+		Body:      text.Body,
+	}
+}
+
+func asDTO(model *message.Msg) (*msgDTO, []msgFlagDTO, []msgPartDTO, error) {
+	metaJson, err := json.Marshal(model.Meta_)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to marshal metadata: %v", err)
+	}
+	contentJson, err := json.Marshal(model.Content_)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to marshal content data: %v", err)
+	}
+
+	msgDto := &msgDTO{
+		ID:        model.ID_,
+		Date:      model.ReceivedAt_,
+		CreatedAt: model.CreatedAt_,
+		UpdatedAt: model.UpdatedAt_,
+		ModSeq:    model.ModSeq_,
+		Meta:      metaJson,
+		Content:   contentJson,
+	}
+	if model.Content_ != nil {
+		msgDto.Size = model.Content_.Size
+		if model.Content_.Envelope != nil && !model.Content_.Envelope.Date.IsZero() {
+			sentDate := model.Content_.Envelope.Date
+			msgDto.SentDate = &sentDate
+		}
+	}
+	if model.AccountID_ != (ulid.ULID{}) {
+		accountID := model.AccountID_
+		msgDto.AccountID = &accountID
+	}
+	flagsDto := make([]msgFlagDTO, len(model.Flags_))
+	for i, f := range model.Flags_ {
+		flagsDto[i] = msgFlagDTO{
+			MsgID: msgDto.ID,
+			Flag:  f,
+		}
+	}
+	partsDto := make([]msgPartDTO, len(model.Parts_))
+	for i, p := range model.Parts_ {
+		contentJson, err := json.Marshal(p.Content_)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to marshal content data: %v", err)
+		}
+
+		partsDto[i] = msgPartDTO{
+			ID:             p.ID_,
+			MessageID:      msgDto.ID,
+			Path:           p.Path_.String(),
+			Content:        contentJson,
+			Inline:         p.Inline_,
+			ExternalBlobID: p.ExternalBlobID_,
+			Codec:          p.Codec_,
+			KeyVersion:     p.KeyVersion_,
+		}
+	}
+
+	return msgDto, flagsDto, partsDto, nil
+}
+
+func asModel(msgDTO *msgDTO, flagsDTO []msgFlagDTO, partsDTO []msgPartDTO) (*message.Msg, error) {
+	msg := &message.Msg{
+		ID_:         msgDTO.ID,
+		ReceivedAt_: msgDTO.Date,
+		CreatedAt_:  msgDTO.CreatedAt,
+		UpdatedAt_:  msgDTO.UpdatedAt,
+		ModSeq_:     msgDTO.ModSeq,
+	}
+	if msgDTO.AccountID != nil {
+		msg.AccountID_ = *msgDTO.AccountID
+	}
+
+	if err := json.Unmarshal(msgDTO.Meta, &msg.Meta_); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+	if msg.Meta_ == nil {
+		return nil, fmt.Errorf("nil metadata")
+	}
+
+	msg.Flags_ = make([]string, len(flagsDTO))
+	for i, f := range flagsDTO {
+		msg.Flags_[i] = f.Flag
+	}
+
+	if err := json.Unmarshal(msgDTO.Content, &msg.Content_); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal content data: %v", err)
+	}
+	if msg.Content_ == nil {
+		return nil, fmt.Errorf("nil message content data")
+	}
+
+	msg.Parts_ = make([]message.Part, len(partsDTO))
+	for i, p := range partsDTO {
+		path, err := message.PathFromString(p.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal part %v path: %v", p.ID, err)
+		}
+
+		msg.Parts_[i] = message.Part{
+			ID_:             p.ID,
+			Path_:           path,
+			Inline_:         p.Inline,
+			ExternalBlobID_: p.ExternalBlobID,
+			Codec_:          p.Codec,
+			KeyVersion_:     p.KeyVersion,
+		}
+
+		if err := json.Unmarshal(p.Content, &msg.Parts_[i].Content_); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal part %v content data: %v", p.ID, err)
+		}
+	}
+
+	return msg, nil
+}
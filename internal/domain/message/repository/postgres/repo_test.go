@@ -0,0 +1,44 @@
+package messagepostgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres/postgrestest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobRefCount(t *testing.T) {
+	ctx := context.Background()
+	r := New(postgrestest.New(t))
+
+	orig, err := message.New(&message.NewMsg{
+		Content: &message.ContentData{Type: "text/plain"},
+		Parts: []message.NewPart{{
+			Path:       message.Path{1},
+			Content:    &message.ContentPartData{Type: "text/plain", Size: 5},
+			ExternalID: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}},
+	})
+	require.NoError(t, err)
+	cp := orig.Copy()
+	require.NoError(t, r.Create(ctx, *orig, *cp))
+	require.ErrorIs(t, r.Create(ctx, *orig), message.ErrAlreadyExists)
+
+	future := time.Now().Add(time.Minute)
+
+	require.NoError(t, r.DeleteByID(ctx, orig.ID_))
+	unused, err := r.DeleteUnusedBlobs(ctx, future)
+	require.NoError(t, err)
+	require.Empty(t, unused)
+
+	require.NoError(t, r.DeleteByID(ctx, cp.ID_))
+	unused, err = r.DeleteUnusedBlobs(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, unused, "recently used blob removed")
+	unused, err = r.DeleteUnusedBlobs(ctx, future)
+	require.NoError(t, err)
+	require.Equal(t, []string{orig.Parts_[0].ExternalBlobID_}, unused)
+}
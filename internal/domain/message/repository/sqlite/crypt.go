@@ -0,0 +1,162 @@
+package messagesqlite
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// columnAD binds the ciphertext to the row and column, so encrypted values
+// cannot be moved around in the DB.
+func columnAD(id ulid.ULID, column string) []byte {
+	return append(id[:], column...)
+}
+
+// encrypt encrypts JSON columns of the message and its parts using the
+// current account key. Messages without account are stored as is.
+func (r repo) encrypt(ctx context.Context, msg *msgDTO, parts []msgPartDTO) error {
+	if r.keys == nil || msg.AccountID == nil {
+		return nil
+	}
+
+	version, key, err := r.keys.CurrentKey(ctx, *msg.AccountID)
+	if err != nil {
+		return err
+	}
+
+	seal := func(id ulid.ULID, column string, data *[]byte) error {
+		var err error
+		*data, err = crypt.Seal(key, *data, columnAD(id, column))
+		if err != nil {
+			return storeerrors.InternalError{Reason: err}
+		}
+		return nil
+	}
+	if err := seal(msg.ID, "meta", &msg.Meta); err != nil {
+		return err
+	}
+	if err := seal(msg.ID, "content", &msg.Content); err != nil {
+		return err
+	}
+	for i := range parts {
+		if err := seal(parts[i].ID, "content", &parts[i].Content); err != nil {
+			return err
+		}
+	}
+	msg.KeyVersion = version
+	return nil
+}
+
+func (r repo) decrypt(ctx context.Context, f *fetchedMsg) error {
+	if f.msg.KeyVersion == 0 {
+		return nil
+	}
+	if r.keys == nil || f.msg.AccountID == nil {
+		return storeerrors.InternalError{Reason: fmt.Errorf("message %v is encrypted, but no keys are configured", f.msg.ID)}
+	}
+
+	key, err := r.keys.Key(ctx, *f.msg.AccountID, f.msg.KeyVersion)
+	if err != nil {
+		return err
+	}
+
+	open := func(id ulid.ULID, column string, data *[]byte) error {
+		var err error
+		*data, err = crypt.Open(key, *data, columnAD(id, column))
+		if err != nil {
+			return storeerrors.InternalError{Reason: fmt.Errorf("failed to decrypt %v of %v: %w", column, id, err)}
+		}
+		return nil
+	}
+	if err := open(f.msg.ID, "meta", &f.msg.Meta); err != nil {
+		return err
+	}
+	if err := open(f.msg.ID, "content", &f.msg.Content); err != nil {
+		return err
+	}
+	for i := range f.parts {
+		if err := open(f.parts[i].ID, "content", &f.parts[i].Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r repo) GetIDsByOldKey(ctx context.Context, accountID ulid.ULID, version int, limit int) ([]ulid.ULID, error) {
+	defer trace.StartRegion(ctx, "message.Repository.GetIDsByOldKey").End()
+
+	var ids []ulid.ULID
+	err := r.db.Gorm(ctx).Model(&msgDTO{}).
+		Where("messages.account_id = ?", accountID).
+		Where(`messages.key_version != ? OR EXISTS (
+			SELECT 1 FROM message_parts
+			WHERE message_parts.message_id = messages.id AND message_parts.key_version != ?
+			AND (message_parts.inline IS NOT NULL OR message_parts.external_blob_id != '')
+		)`, version, version).
+		Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+	return ids, nil
+}
+
+func (r repo) Reencrypt(ctx context.Context, msgs ...message.Msg) error {
+	defer trace.StartRegion(ctx, "message.Repository.Reencrypt").End()
+
+	rows := make([]msgRows, len(msgs))
+	for i := range msgs {
+		msg, _, parts, err := asDTO(&msgs[i])
+		if err != nil {
+			return err
+		}
+		if err := r.encrypt(ctx, msg, parts); err != nil {
+			return err
+		}
+		rows[i] = msgRows{msg: msg, parts: parts}
+	}
+
+	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			err := tx.Model(&msgDTO{}).
+				Where("messages.id = ?", row.msg.ID).
+				Updates(map[string]interface{}{
+					"meta":        row.msg.Meta,
+					"content":     row.msg.Content,
+					"key_version": row.msg.KeyVersion,
+					"sent_date":   row.msg.SentDate,
+				}).Error
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+
+			// Messages stored before encryption was enabled are indexed.
+			err = tx.Where("message_id = ?", row.msg.ID).Delete(&msgSearchDTO{}).Error
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+
+			for _, p := range row.parts {
+				err := tx.Model(&msgPartDTO{}).
+					Where("message_parts.id = ?", p.ID).
+					Updates(map[string]interface{}{
+						"content":          p.Content,
+						"inline":           p.Inline,
+						"external_blob_id": p.ExternalBlobID,
+						"codec":            p.Codec,
+						"key_version":      p.KeyVersion,
+					}).Error
+				if err != nil {
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
+		}
+		return nil
+	})
+}
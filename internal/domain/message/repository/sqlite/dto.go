@@ -10,18 +10,23 @@ import (
 )
 
 type msgDTO struct {
-	ID        ulid.ULID `gorm:"id,primaryKey"`
-	Date      time.Time `gorm:"date"`
-	CreatedAt time.Time `gorm:"created_at,autoCreateTime:false"`
-	UpdatedAt time.Time `gorm:"updated_at,autoUpdateTime:false"`
-	Meta      []byte    `gorm:"meta"`    // JSON
-	Content   []byte    `gorm:"content"` // JSON
+	ID         ulid.ULID  `gorm:"id,primaryKey"`
+	AccountID  *ulid.ULID `gorm:"column:account_id"`
+	Date       time.Time  `gorm:"date"`
+	CreatedAt  time.Time  `gorm:"created_at,autoCreateTime:false"`
+	UpdatedAt  time.Time  `gorm:"updated_at,autoUpdateTime:false"`
+	ModSeq     int64      `gorm:"column:modseq"`
+	Meta       []byte     `gorm:"meta"`             // JSON, encrypted if KeyVersion is not 0
+	Content    []byte     `gorm:"content"`          // JSON, encrypted if KeyVersion is not 0
+	Size       int64      `gorm:"size"`             // duplicates content.size for aggregate queries
+	SentDate   *time.Time `gorm:"column:sent_date"` // duplicates content.envelope.date for SENT* search
+	KeyVersion int        `gorm:"column:key_version"`
 }
 
 func (msgDTO) TableName() string { return "messages" }
 
 type msgFlagDTO struct {
-	MsgID ulid.ULID `gorm:"message_id"`
+	MsgID ulid.ULID `gorm:"column:message_id"`
 	Flag  string    `gorm:"flag"`
 }
 
@@ -31,13 +36,41 @@ type msgPartDTO struct {
 	ID             ulid.ULID `gorm:"id,primaryKey"`
 	MessageID      ulid.ULID `gorm:"message_id"`
 	Path           string    `gorm:"path"`
-	Content        []byte    `gorm:"content"` // JSON
+	Content        []byte    `gorm:"content"` // JSON, encrypted using msgDTO.KeyVersion
 	Inline         []byte    `gorm:"inline"`  // BLOB
 	ExternalBlobID string    `gorm:"external_blob_id"`
+	Codec          string    `gorm:"column:codec"`
+	KeyVersion     int       `gorm:"column:key_version"` // of the body
 }
 
 func (msgPartDTO) TableName() string { return "message_parts" }
 
+type msgSearchDTO struct {
+	MessageID ulid.ULID `gorm:"column:message_id"`
+	FromField string    `gorm:"column:from_field"`
+	ToField   string    `gorm:"column:to_field"`
+	CcField   string    `gorm:"column:cc_field"`
+	BccField  string    `gorm:"column:bcc_field"`
+	Subject   string    `gorm:"column:subject"`
+	Header    string    `gorm:"column:header"`
+	Body      string    `gorm:"column:body"`
+}
+
+func (msgSearchDTO) TableName() string { return "message_search" }
+
+func searchAsDTO(msgID ulid.ULID, text *message.SearchText) *msgSearchDTO {
+	return &msgSearchDTO{
+		MessageID: msgID,
+		FromField: text.From,
+		ToField:   text.To,
+		CcField:   text.Cc,
+		BccField:  text.Bcc,
+		Subject:   text.Subject,
+		Header:    text.Header,
+		Body:      text.Body,
+	}
+}
+
 func asDTO(model *message.Msg) (*msgDTO, []msgFlagDTO, []msgPartDTO, error) {
 	metaJson, err := json.Marshal(model.Meta_)
 	if err != nil {
@@ -53,9 +86,21 @@ func asDTO(model *message.Msg) (*msgDTO, []msgFlagDTO, []msgPartDTO, error) {
 		Date:      model.ReceivedAt_,
 		CreatedAt: model.CreatedAt_,
 		UpdatedAt: model.UpdatedAt_,
+		ModSeq:    model.ModSeq_,
 		Meta:      metaJson,
 		Content:   contentJson,
 	}
+	if model.Content_ != nil {
+		msgDto.Size = model.Content_.Size
+		if model.Content_.Envelope != nil && !model.Content_.Envelope.Date.IsZero() {
+			sentDate := model.Content_.Envelope.Date
+			msgDto.SentDate = &sentDate
+		}
+	}
+	if model.AccountID_ != (ulid.ULID{}) {
+		accountID := model.AccountID_
+		msgDto.AccountID = &accountID
+	}
 	flagsDto := make([]msgFlagDTO, len(model.Flags_))
 	for i, f := range model.Flags_ {
 		flagsDto[i] = msgFlagDTO{
@@ -77,6 +122,8 @@ func asDTO(model *message.Msg) (*msgDTO, []msgFlagDTO, []msgPartDTO, error) {
 			Content:        contentJson,
 			Inline:         p.Inline_,
 			ExternalBlobID: p.ExternalBlobID_,
+			Codec:          p.Codec_,
+			KeyVersion:     p.KeyVersion_,
 		}
 	}
 
@@ -89,12 +136,16 @@ func asModel(msgDTO *msgDTO, flagsDTO []msgFlagDTO, partsDTO []msgPartDTO) (*mes
 		ReceivedAt_: msgDTO.Date,
 		CreatedAt_:  msgDTO.CreatedAt,
 		UpdatedAt_:  msgDTO.UpdatedAt,
+		ModSeq_:     msgDTO.ModSeq,
+	}
+	if msgDTO.AccountID != nil {
+		msg.AccountID_ = *msgDTO.AccountID
 	}
 
 	if err := json.Unmarshal(msgDTO.Meta, &msg.Meta_); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
 	}
-	if msg.Content_ == nil {
+	if msg.Meta_ == nil {
 		return nil, fmt.Errorf("nil metadata")
 	}
 
@@ -122,6 +173,8 @@ func asModel(msgDTO *msgDTO, flagsDTO []msgFlagDTO, partsDTO []msgPartDTO) (*mes
 			Path_:           path,
 			Inline_:         p.Inline,
 			ExternalBlobID_: p.ExternalBlobID,
+			Codec_:          p.Codec,
+			KeyVersion_:     p.KeyVersion,
 		}
 
 		if err := json.Unmarshal(p.Content, &msg.Parts_[i].Content_); err != nil {
@@ -3,11 +3,12 @@ package messagesqlite
 import (
 	"context"
 	"database/sql"
-	"errors"
 	"fmt"
+	"runtime/trace"
+	"time"
 
-	"github.com/foxcpp/maddy-storage/internal/domain/folder"
 	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
 	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
 	"github.com/oklog/ulid/v2"
@@ -15,58 +16,92 @@ import (
 )
 
 type repo struct {
-	db sqlite.DB
+	db   sqlite.DB
+	keys crypt.Keys
 }
 
 func New(db sqlite.DB) message.Repo {
 	return repo{db: db}
 }
 
-func (r repo) fetch(tx *gorm.DB, id ulid.ULID) (*msgDTO, []msgFlagDTO, []msgPartDTO, error) {
-	var (
-		msg   msgDTO
-		flags []msgFlagDTO
-		parts []msgPartDTO
-	)
-
-	err := tx.Model(&msgDTO{}).
-		Where("messages.id = ?", id).
-		Limit(1).
-		Find(&msg).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, nil, nil, folder.ErrNotFound
+// NewEncrypted returns message.Repo that encrypts message and part
+// metadata using account keys. Part bodies are expected to be encrypted
+// by the caller.
+func NewEncrypted(db sqlite.DB, keys crypt.Keys) message.Repo {
+	return repo{db: db, keys: keys}
+}
+
+// fetchBatchSize limits the amount of messages loaded by a single
+// query to stay within SQLite variables limit.
+const fetchBatchSize = 256
+
+type fetchedMsg struct {
+	msg   msgDTO
+	flags []msgFlagDTO
+	parts []msgPartDTO
+}
+
+// fetch loads all listed messages, missing messages are skipped.
+func (r repo) fetch(tx *gorm.DB, ids []ulid.ULID) (map[ulid.ULID]*fetchedMsg, error) {
+	res := make(map[ulid.ULID]*fetchedMsg, len(ids))
+
+	for len(ids) != 0 {
+		batch := ids
+		if len(batch) > fetchBatchSize {
+			batch = batch[:fetchBatchSize]
 		}
-		return nil, nil, nil, storeerrors.InternalError{Reason: err}
-	}
+		ids = ids[len(batch):]
 
-	err = tx.Model(&msgFlagDTO{}).
-		Where("message_flags.message_id = ?", id).
-		Find(&flags).Error
-	if err != nil {
-		return nil, nil, nil, storeerrors.InternalError{Reason: err}
-	}
+		var (
+			msgs  []msgDTO
+			flags []msgFlagDTO
+			parts []msgPartDTO
+		)
 
-	err = tx.Model(&msgPartDTO{}).
-		Where("message_parts.message_id = ?", id).
-		Find(&parts).Error
-	if err != nil {
-		return nil, nil, nil, storeerrors.InternalError{Reason: err}
+		err := tx.Model(&msgDTO{}).
+			Where("messages.id IN ?", batch).
+			Find(&msgs).Error
+		if err != nil {
+			return nil, storeerrors.InternalError{Reason: err}
+		}
+		for _, m := range msgs {
+			res[m.ID] = &fetchedMsg{msg: m}
+		}
+
+		err = tx.Model(&msgFlagDTO{}).
+			Where("message_flags.message_id IN ?", batch).
+			Find(&flags).Error
+		if err != nil {
+			return nil, storeerrors.InternalError{Reason: err}
+		}
+		for _, f := range flags {
+			if m := res[f.MsgID]; m != nil {
+				m.flags = append(m.flags, f)
+			}
+		}
+
+		err = tx.Model(&msgPartDTO{}).
+			Where("message_parts.message_id IN ?", batch).
+			Find(&parts).Error
+		if err != nil {
+			return nil, storeerrors.InternalError{Reason: err}
+		}
+		for _, p := range parts {
+			if m := res[p.MessageID]; m != nil {
+				m.parts = append(m.parts, p)
+			}
+		}
 	}
 
-	return &msg, flags, parts, nil
+	return res, nil
 }
 
 func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*message.Msg, error) {
-	var (
-		msg   *msgDTO
-		flags []msgFlagDTO
-		parts []msgPartDTO
-	)
+	var fetched map[ulid.ULID]*fetchedMsg
 
 	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
 		var err error
-		msg, flags, parts, err = r.fetch(tx, id)
+		fetched, err = r.fetch(tx, []ulid.ULID{id})
 		return err
 	}, &sql.TxOptions{
 		Isolation: sql.LevelRepeatableRead,
@@ -76,80 +111,339 @@ func (r repo) GetByID(ctx context.Context, id ulid.ULID) (*message.Msg, error) {
 		return nil, err
 	}
 
-	model, err := asModel(msg, flags, parts)
+	f, ok := fetched[id]
+	if !ok {
+		return nil, message.ErrNotFound
+	}
+
+	if err := r.decrypt(ctx, f); err != nil {
+		return nil, err
+	}
+	model, err := asModel(&f.msg, f.flags, f.parts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to restore msg %v: %v", msg.ID, err)
+		return nil, storeerrors.InternalError{Reason: fmt.Errorf("failed to restore msg %v: %v", id, err)}
 	}
 	return model, nil
 }
 
+// GetByIDs returns messages in the same order as ids. Missing messages
+// are skipped.
 func (r repo) GetByIDs(ctx context.Context, ids ...ulid.ULID) ([]message.Msg, error) {
-	models := make([]message.Msg, 0, len(ids))
+	var fetched map[ulid.ULID]*fetchedMsg
 
 	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-		for _, id := range ids {
-			msg, flags, parts, err := r.fetch(tx, id)
+		var err error
+		fetched, err = r.fetch(tx, ids)
+		return err
+	}, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]message.Msg, 0, len(fetched))
+	for _, id := range ids {
+		f, ok := fetched[id]
+		if !ok {
+			continue
+		}
+
+		if err := r.decrypt(ctx, f); err != nil {
+			return nil, err
+		}
+		model, err := asModel(&f.msg, f.flags, f.parts)
+		if err != nil {
+			return nil, storeerrors.InternalError{Reason: fmt.Errorf("failed to restore msg %v: %v", id, err)}
+		}
+
+		models = append(models, *model)
+	}
+
+	return models, nil
+}
+
+type msgRows struct {
+	model *message.Msg
+	msg   *msgDTO
+	flags []msgFlagDTO
+	parts []msgPartDTO
+}
+
+func (r repo) Create(ctx context.Context, msgs ...message.Msg) error {
+	// Encrypted before the transaction is started, key might need to be
+	// created.
+	rows := make([]msgRows, len(msgs))
+	for i := range msgs {
+		msg, flags, parts, err := asDTO(&msgs[i])
+		if err != nil {
+			return err
+		}
+		if err := r.encrypt(ctx, msg, parts); err != nil {
+			return err
+		}
+		rows[i] = msgRows{model: &msgs[i], msg: msg, flags: flags, parts: parts}
+	}
+
+	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			err := tx.Create(row.msg).Error
 			if err != nil {
-				return err
+				if sqlite.IsUniqueConstraintError(err) {
+					return message.ErrAlreadyExists
+				}
+				return storeerrors.InternalError{Reason: err}
 			}
 
-			model, err := asModel(msg, flags, parts)
-			if err != nil {
-				return fmt.Errorf("failed to restore msg %v: %v", msg.ID, err)
+			if len(row.flags) != 0 {
+				err = tx.Create(row.flags).Error
+				if err != nil {
+					// TODO: Foreign key constraints, etc.
+					return storeerrors.InternalError{Reason: err}
+				}
 			}
 
-			models = append(models, *model)
+			if len(row.parts) != 0 {
+				err = tx.Create(row.parts).Error
+				if err != nil {
+					// TODO: Foreign key constraints, etc.
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
+
+			// Text of encrypted messages is not indexed, it would be
+			// stored in plaintext.
+			if row.msg.KeyVersion == 0 {
+				if err := createSearchText(tx, row.model); err != nil {
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
 		}
 		return nil
-	}, &sql.TxOptions{
-		Isolation: sql.LevelRepeatableRead,
-		ReadOnly:  true,
 	})
+}
+
+// createSearchText adds the message text to the search index. Text is not
+// loaded from the repository, so for copies it is taken from the original
+// message.
+func createSearchText(tx *gorm.DB, model *message.Msg) error {
+	if model.Search_ != nil {
+		return tx.Create(searchAsDTO(model.ID_, model.Search_)).Error
+	}
 
-	return models, err
+	origID, ok := model.Meta_.Get("copy_of")
+	if !ok {
+		return nil
+	}
+	orig, err := ulid.Parse(origID)
+	if err != nil {
+		return nil
+	}
+	return tx.Exec(`
+		INSERT INTO message_search (message_id, from_field, to_field, cc_field, bcc_field, subject, header, body)
+		SELECT ?, from_field, to_field, cc_field, bcc_field, subject, header, body
+		FROM message_search WHERE message_id = ?`, model.ID_, orig).Error
 }
 
-func (r repo) Create(ctx context.Context, msgs ...message.Msg) error {
+func (r repo) DeleteByID(ctx context.Context, ids ...ulid.ULID) error {
 	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-		for _, model := range msgs {
-			msg, flags, parts, err := asDTO(&model)
+		for _, id := range ids {
+			err := tx.
+				Where("messages.id = ?", id).
+				Delete(&msgDTO{}).Error
 			if err != nil {
-				return err
+				// TODO: Foreign key constraints, etc.
+				return storeerrors.InternalError{Reason: err}
+			}
+		}
+		return nil
+	})
+}
+
+func (r repo) UpdateFlags(ctx context.Context, upd message.FlagUpdate, ids ...ulid.ULID) ([]message.FlagsResult, error) {
+	defer trace.StartRegion(ctx, "message.Repository.UpdateFlags").End()
+
+	results := make([]message.FlagsResult, 0, len(ids))
+
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		for len(ids) != 0 {
+			batch := ids
+			if len(batch) > fetchBatchSize {
+				batch = batch[:fetchBatchSize]
 			}
+			ids = ids[len(batch):]
 
-			err = tx.Create(msg).Error
+			var (
+				msgs  []msgDTO
+				flags []msgFlagDTO
+			)
+			err := tx.Model(&msgDTO{}).
+				Select("id", "modseq").
+				Where("messages.id IN ?", batch).
+				Find(&msgs).Error
 			if err != nil {
-				// TODO: Foreign key constraints, etc.
 				return storeerrors.InternalError{Reason: err}
 			}
-
-			err = tx.Create(flags).Error
+			err = tx.Model(&msgFlagDTO{}).
+				Where("message_flags.message_id IN ?", batch).
+				Find(&flags).Error
 			if err != nil {
-				// TODO: Foreign key constraints, etc.
 				return storeerrors.InternalError{Reason: err}
 			}
+			current := make(map[ulid.ULID][]string, len(msgs))
+			for _, f := range flags {
+				current[f.MsgID] = append(current[f.MsgID], f.Flag)
+			}
 
-			err = tx.Create(parts).Error
+			var (
+				changedIDs []ulid.ULID
+				newFlags   []msgFlagDTO
+			)
+			for _, m := range msgs {
+				res := message.FlagsResult{
+					ID:     m.ID,
+					Flags:  current[m.ID],
+					ModSeq: m.ModSeq,
+				}
+				if res.Flags == nil {
+					res.Flags = []string{}
+				}
+
+				if upd.Modified(res.ModSeq) {
+					res.Modified = true
+					results = append(results, res)
+					continue
+				}
+
+				updated := upd.Apply(res.Flags)
+				if !message.FlagsEqual(updated, res.Flags) {
+					res.Flags = updated
+					res.Changed = true
+
+					changedIDs = append(changedIDs, m.ID)
+					for _, f := range updated {
+						newFlags = append(newFlags, msgFlagDTO{MsgID: m.ID, Flag: f})
+					}
+				}
+				results = append(results, res)
+			}
+			if len(changedIDs) == 0 {
+				continue
+			}
+
+			err = tx.Where("message_flags.message_id IN ?", changedIDs).
+				Delete(&msgFlagDTO{}).Error
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+			if len(newFlags) != 0 {
+				if err := tx.Create(newFlags).Error; err != nil {
+					return storeerrors.InternalError{Reason: err}
+				}
+			}
+			err = tx.Model(&msgDTO{}).
+				Where("messages.id IN ?", changedIDs).
+				UpdateColumn("updated_at", now).Error
 			if err != nil {
-				// TODO: Foreign key constraints, etc.
 				return storeerrors.InternalError{Reason: err}
 			}
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
 }
 
-func (r repo) DeleteByID(ctx context.Context, ids ...ulid.ULID) error {
-	return r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-		for _, id := range ids {
-			err := tx.
-				Where("messages.id = ?", id).
-				Delete(&msgDTO{}).Error
+func (r repo) GetFlags(ctx context.Context, ids ...ulid.ULID) (map[ulid.ULID][]string, error) {
+	defer trace.StartRegion(ctx, "message.Repository.GetFlags").End()
+
+	res := make(map[ulid.ULID][]string, len(ids))
+
+	err := r.db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		for len(ids) != 0 {
+			batch := ids
+			if len(batch) > fetchBatchSize {
+				batch = batch[:fetchBatchSize]
+			}
+			ids = ids[len(batch):]
+
+			var msgIDs []ulid.ULID
+			err := tx.Model(&msgDTO{}).
+				Where("messages.id IN ?", batch).
+				Pluck("id", &msgIDs).Error
 			if err != nil {
-				// TODO: Foreign key constraints, etc.
 				return storeerrors.InternalError{Reason: err}
 			}
+			for _, id := range msgIDs {
+				res[id] = []string{}
+			}
+
+			var flags []msgFlagDTO
+			err = tx.Model(&msgFlagDTO{}).
+				Where("message_flags.message_id IN ?", batch).
+				Find(&flags).Error
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+			for _, f := range flags {
+				res[f.MsgID] = append(res[f.MsgID], f.Flag)
+			}
 		}
 		return nil
+	}, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r repo) DeleteOrphaned(ctx context.Context, createdBefore time.Time) (int, error) {
+	defer trace.StartRegion(ctx, "message.Repository.DeleteOrphaned").End()
+
+	// Blob reference counters are updated by message_parts triggers.
+	res := r.db.Gorm(ctx).
+		Where("julianday(messages.created_at) < julianday(?)", createdBefore).
+		Where("NOT EXISTS (SELECT 1 FROM folder_entries WHERE folder_entries.message_id = messages.id)").
+		Delete(&msgDTO{})
+	if res.Error != nil {
+		return 0, storeerrors.InternalError{Reason: res.Error}
+	}
+
+	return int(res.RowsAffected), nil
+}
+
+func (r repo) DeleteUnusedBlobs(ctx context.Context, unusedSince time.Time) ([]string, error) {
+	defer trace.StartRegion(ctx, "message.Repository.DeleteUnusedBlobs").End()
+
+	var ids []string
+	rows, err := r.db.Gorm(ctx).Raw(`
+		DELETE FROM blobs
+		WHERE refcount = 0 AND julianday(updated_at) < julianday(?)
+		RETURNING id`, unusedSince).Rows()
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, storeerrors.InternalError{Reason: err}
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	return ids, nil
 }
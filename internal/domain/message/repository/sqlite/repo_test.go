@@ -0,0 +1,149 @@
+package messagesqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	datakeysqlite "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobRefCount(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+	r := New(db)
+
+	orig, err := message.New(&message.NewMsg{
+		Content: &message.ContentData{Type: "text/plain"},
+		Parts: []message.NewPart{{
+			Path:       message.Path{1},
+			Content:    &message.ContentPartData{Type: "text/plain", Size: 5},
+			ExternalID: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}},
+	})
+	require.NoError(t, err)
+	cp := orig.Copy()
+	require.NoError(t, r.Create(ctx, *orig, *cp))
+
+	future := time.Now().Add(time.Minute)
+
+	require.NoError(t, r.DeleteByID(ctx, orig.ID_))
+	unused, err := r.DeleteUnusedBlobs(ctx, future)
+	require.NoError(t, err)
+	require.Empty(t, unused)
+
+	require.NoError(t, r.DeleteByID(ctx, cp.ID_))
+	unused, err = r.DeleteUnusedBlobs(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, unused, "recently used blob removed")
+	unused, err = r.DeleteUnusedBlobs(ctx, future)
+	require.NoError(t, err)
+	require.Equal(t, []string{orig.Parts_[0].ExternalBlobID_}, unused)
+}
+
+func TestEncrypted(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountsqlite.New(db).Create(ctx, acct))
+	master, err := crypt.NewKey()
+	require.NoError(t, err)
+	keyring := datakey.NewKeyring(datakeysqlite.New(db), master)
+	r := NewEncrypted(db, keyring)
+
+	msg, err := message.New(&message.NewMsg{
+		AccountID: acct.ID_,
+		Content:   &message.ContentData{Type: "text/plain", Header: []byte("Subject: secret\r\n\r\n")},
+		Parts: []message.NewPart{{
+			Path:       message.Path{1},
+			Content:    &message.ContentPartData{Type: "text/plain", Size: 5},
+			InlineBlob: []byte("hello"),
+		}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, r.Create(ctx, *msg))
+
+	var raw msgDTO
+	require.NoError(t, db.Gorm(ctx).Where("id = ?", msg.ID_).First(&raw).Error)
+	require.Equal(t, 1, raw.KeyVersion)
+	require.NotContains(t, string(raw.Content), "secret")
+
+	loaded, err := r.GetByID(ctx, msg.ID_)
+	require.NoError(t, err)
+	require.Equal(t, msg.Content_.Header, loaded.Content_.Header)
+	require.Equal(t, acct.ID_, loaded.AccountID_)
+
+	// Part body is encrypted by the parser, plaintext one is reported.
+	ids, err := r.GetIDsByOldKey(ctx, acct.ID_, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	version, err := keyring.Rotate(ctx, acct.ID_)
+	require.NoError(t, err)
+	loaded.Parts_[0].KeyVersion_ = version
+	require.NoError(t, r.Reencrypt(ctx, *loaded))
+
+	ids, err = r.GetIDsByOldKey(ctx, acct.ID_, version, 10)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+	loaded, err = r.GetByID(ctx, msg.ID_)
+	require.NoError(t, err)
+	require.Equal(t, msg.Content_.Header, loaded.Content_.Header)
+
+	_, err = New(db).GetByID(ctx, msg.ID_)
+	require.Error(t, err)
+}
+
+func TestEncryptedSearchText(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+
+	acct, err := account.NewAccount("test")
+	require.NoError(t, err)
+	require.NoError(t, accountsqlite.New(db).Create(ctx, acct))
+	master, err := crypt.NewKey()
+	require.NoError(t, err)
+	keyring := datakey.NewKeyring(datakeysqlite.New(db), master)
+	r := NewEncrypted(db, keyring)
+
+	countIndexed := func() int64 {
+		var n int64
+		require.NoError(t, db.Gorm(ctx).Model(&msgSearchDTO{}).Count(&n).Error)
+		return n
+	}
+	newMsg := func() *message.Msg {
+		msg, err := message.New(&message.NewMsg{
+			AccountID: acct.ID_,
+			Content:   &message.ContentData{Type: "text/plain"},
+			Search:    &message.SearchText{Subject: "secret"},
+		})
+		require.NoError(t, err)
+		return msg
+	}
+
+	require.NoError(t, r.Create(ctx, *newMsg()))
+	require.Zero(t, countIndexed())
+
+	// Stored before encryption was enabled.
+	plain := newMsg()
+	require.NoError(t, New(db).Create(ctx, *plain))
+	require.EqualValues(t, 1, countIndexed())
+
+	loaded, err := r.GetByID(ctx, plain.ID_)
+	require.NoError(t, err)
+	require.NoError(t, r.Reencrypt(ctx, *loaded))
+	require.Zero(t, countIndexed())
+}
@@ -0,0 +1,471 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/foxcpp/maddy-storage/internal/pkg/compress"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+)
+
+var ErrNoSuchPart = storeerrors.NotExistsError{Text: "message: no such part"}
+
+// KeyFunc returns the data key with the specified version. It is used to
+// decrypt part bodies, keys belong to the account that owns the message.
+type KeyFunc func(ctx context.Context, version int) ([]byte, error)
+
+// Part returns the message part with the specified path.
+func (m *Msg) Part(path Path) (*Part, bool) {
+	for i := range m.Parts_ {
+		if m.Parts_[i].Path_.Equal(path) {
+			return &m.Parts_[i], true
+		}
+	}
+	return nil, false
+}
+
+// Children returns direct children of the part with the specified path
+// in order.
+func (m *Msg) Children(path Path) []*Part {
+	var children []*Part
+	for childPath := path.FirstChild(); ; childPath = childPath.NextSibling() {
+		child, ok := m.Part(childPath)
+		if !ok {
+			break
+		}
+		children = append(children, child)
+	}
+	return children
+}
+
+// message returns content data for the message at path - either top-level
+// message (empty path) or encapsulated message/rfc822 part.
+func (m *Msg) message(path Path) (*ContentData, error) {
+	if path.Empty() {
+		if m.Content_ == nil {
+			return nil, fmt.Errorf("message: missing content data")
+		}
+		return m.Content_, nil
+	}
+
+	part, ok := m.Part(path)
+	if !ok || !part.Content_.IsMessage() {
+		return nil, ErrNoSuchPart
+	}
+	return part.Content_.Message, nil
+}
+
+// Raw returns full message, including the header.
+func (m *Msg) Raw() (*Body, error) {
+	return m.PartBody(EmptyPath())
+}
+
+// Open returns the reader for the full message. Message octets are
+// exactly the same as were used to create it.
+func (m *Msg) Open(ctx context.Context, store blob.Store, keys KeyFunc) (io.ReadCloser, error) {
+	b, err := m.Raw()
+	if err != nil {
+		return nil, err
+	}
+	return b.Open(ctx, store, keys), nil
+}
+
+// Header returns raw header of the message at path - either top-level
+// message (empty path) or encapsulated message/rfc822 part.
+func (m *Msg) Header(path Path) ([]byte, error) {
+	cd, err := m.message(path)
+	if err != nil {
+		return nil, err
+	}
+	return cd.Header, nil
+}
+
+// Text returns the body of the message at path - either top-level
+// message (empty path) or encapsulated message/rfc822 part.
+func (m *Msg) Text(path Path) (*Body, error) {
+	cd, err := m.message(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Body{}
+	if err := m.addMessageText(b, path, cd); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// MIMEHeader returns the MIME header of the part at path.
+func (m *Msg) MIMEHeader(path Path) ([]byte, error) {
+	part, ok := m.Part(path)
+	if !ok {
+		return nil, ErrNoSuchPart
+	}
+	return m.mimeHeader(part)
+}
+
+func (m *Msg) mimeHeader(part *Part) ([]byte, error) {
+	if len(part.Content_.Header) != 0 {
+		return part.Content_.Header, nil
+	}
+
+	parentPath := part.Path_.Parent()
+	if !parentPath.Empty() {
+		parent, ok := m.Part(parentPath)
+		if !ok || !parent.Content_.IsMessage() {
+			// Child of a multipart with an empty header.
+			return nil, nil
+		}
+	}
+
+	// The part is the only body of a non-multipart message, use message header.
+	cd, err := m.message(parentPath)
+	if err != nil {
+		return nil, err
+	}
+	if cd.IsMultipart() {
+		return nil, nil
+	}
+	return cd.Header, nil
+}
+
+// PartBody returns body of the part at path. For message/rfc822 parts it
+// includes the encapsulated message header. For empty path, full message
+// is returned.
+func (m *Msg) PartBody(path Path) (*Body, error) {
+	b := &Body{}
+	if path.Empty() {
+		cd, err := m.message(path)
+		if err != nil {
+			return nil, err
+		}
+		b.addBytes(cd.Header)
+		if err := m.addMessageText(b, path, cd); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	part, ok := m.Part(path)
+	if !ok {
+		return nil, ErrNoSuchPart
+	}
+	if err := m.addPartBody(b, part); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (m *Msg) addMessageText(b *Body, path Path, cd *ContentData) error {
+	if cd.IsMultipart() {
+		return m.addMultipart(b, path, cd.Params["boundary"], cd.Layout)
+	}
+
+	part, ok := m.Part(path.FirstChild())
+	if !ok {
+		return fmt.Errorf("message: missing body part %v", path.FirstChild())
+	}
+	return m.addPartBody(b, part)
+}
+
+func (m *Msg) addPartBody(b *Body, part *Part) error {
+	switch {
+	case part.Content_.IsMultipart():
+		return m.addMultipart(b, part.Path_, part.Content_.Params["boundary"], part.Content_.Layout)
+	case part.Content_.IsMessage():
+		b.addBytes(part.Content_.Message.Header)
+		return m.addMessageText(b, part.Path_, part.Content_.Message)
+	default:
+		b.addPart(part)
+		return nil
+	}
+}
+
+func (m *Msg) addMultipart(b *Body, path Path, boundary string, layout *MultipartLayout) error {
+	if layout != nil {
+		children := m.Children(path)
+		if len(children) != len(layout.Delimiters) {
+			return fmt.Errorf("message: multipart %v layout does not match its children", path)
+		}
+
+		b.addBytes(layout.Preamble)
+		for i, child := range children {
+			b.addBytes(layout.Delimiters[i])
+			hdr, err := m.mimeHeader(child)
+			if err != nil {
+				return err
+			}
+			b.addBytes(hdr)
+			if err := m.addPartBody(b, child); err != nil {
+				return err
+			}
+		}
+		b.addBytes(layout.Epilogue)
+		return nil
+	}
+
+	// No layout information, synthesize the body using boundary.
+	if boundary == "" {
+		return fmt.Errorf("message: missing boundary for multipart %v", path)
+	}
+
+	for _, child := range m.Children(path) {
+		b.addBytes([]byte("--" + boundary + "\r\n"))
+		hdr, err := m.mimeHeader(child)
+		if err != nil {
+			return err
+		}
+		b.addBytes(hdr)
+		if err := m.addPartBody(b, child); err != nil {
+			return err
+		}
+		b.addBytes([]byte("\r\n"))
+	}
+	b.addBytes([]byte("--" + boundary + "--\r\n"))
+
+	return nil
+}
+
+type bodyChunk struct {
+	data []byte // used if part is nil
+
+	part   *Part
+	offset int64
+	size   int64
+}
+
+func (c bodyChunk) len() int64 {
+	if c.part == nil {
+		return int64(len(c.data))
+	}
+	return c.size
+}
+
+// Body is a section of the message made of inline data and
+// references to parts content. Actual content of the parts is read
+// only when Open is called.
+type Body struct {
+	chunks []bodyChunk
+}
+
+// BodyFromBytes creates the Body object that consists of the specified
+// bytes.
+func BodyFromBytes(b []byte) *Body {
+	body := &Body{}
+	body.addBytes(b)
+	return body
+}
+
+func (b *Body) addBytes(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.chunks = append(b.chunks, bodyChunk{data: data})
+}
+
+func (b *Body) addPart(part *Part) {
+	b.chunks = append(b.chunks, bodyChunk{
+		part: part,
+		size: int64(part.Content_.Size),
+	})
+}
+
+func (b *Body) Size() int64 {
+	var size int64
+	for _, c := range b.chunks {
+		size += c.len()
+	}
+	return size
+}
+
+// Slice returns the Body containing only size octets starting at offset.
+func (b *Body) Slice(offset, size int64) *Body {
+	res := &Body{}
+	for _, c := range b.chunks {
+		if size <= 0 {
+			break
+		}
+
+		l := c.len()
+		if offset >= l {
+			offset -= l
+			continue
+		}
+
+		n := l - offset
+		if n > size {
+			n = size
+		}
+		if c.part == nil {
+			res.chunks = append(res.chunks, bodyChunk{data: c.data[offset : offset+n]})
+		} else {
+			res.chunks = append(res.chunks, bodyChunk{
+				part:   c.part,
+				offset: c.offset + offset,
+				size:   n,
+			})
+		}
+
+		offset = 0
+		size -= n
+	}
+	return res
+}
+
+// Open returns the reader for the body contents. Part blobs are
+// opened lazily, as the reader reaches them.
+func (b *Body) Open(ctx context.Context, store blob.Store, keys KeyFunc) io.ReadCloser {
+	return &bodyReader{ctx: ctx, store: store, keys: keys, chunks: b.chunks}
+}
+
+type bodyReader struct {
+	ctx    context.Context
+	store  blob.Store
+	keys   KeyFunc
+	chunks []bodyChunk
+
+	cur io.ReadCloser
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			var err error
+			r.cur, err = r.chunks[0].open(r.ctx, r.store, r.keys)
+			if err != nil {
+				return 0, err
+			}
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			if closeErr := r.cur.Close(); closeErr != nil {
+				return n, closeErr
+			}
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *bodyReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+func (c bodyChunk) open(ctx context.Context, store blob.Store, keys KeyFunc) (io.ReadCloser, error) {
+	if c.part == nil {
+		return io.NopCloser(bytes.NewReader(c.data)), nil
+	}
+
+	rc, err := c.part.Open(ctx, store, keys)
+	if err != nil {
+		return nil, err
+	}
+	if c.offset != 0 {
+		if _, err := io.CopyN(io.Discard, rc, c.offset); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("message: part %v is shorter than expected: %w", c.part.ID_, err)
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.LimitReader(rc, c.size),
+		Closer: rc,
+	}, nil
+}
+
+// Open returns the reader for the part body. External blobs are read from
+// the specified store. Encrypted bodies are decrypted using keys, then
+// compressed bodies are decompressed.
+func (p *Part) Open(ctx context.Context, store blob.Store, keys KeyFunc) (io.ReadCloser, error) {
+	rc, err := p.openRaw(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	if p.KeyVersion_ != 0 {
+		rc, err = p.decrypt(ctx, rc, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.Codec_ == "" {
+		return rc, nil
+	}
+
+	codec, err := compress.Get(p.Codec_)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("message: part %v: %w", p.ID_, err)
+	}
+	dec, err := codec.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("message: part %v: %w", p.ID_, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: dec,
+		Closer: closeBoth{dec, rc},
+	}, nil
+}
+
+func (p *Part) openRaw(ctx context.Context, store blob.Store) (io.ReadCloser, error) {
+	if p.ExternalBlobID_ == "" {
+		return io.NopCloser(bytes.NewReader(p.Inline_)), nil
+	}
+	if store == nil {
+		return nil, fmt.Errorf("message: part %v is stored externally, but no blob store is configured", p.ID_)
+	}
+	return store.Open(ctx, p.ExternalBlobID_)
+}
+
+// decrypt reads the whole body, AEAD cannot authenticate partial data.
+func (p *Part) decrypt(ctx context.Context, rc io.ReadCloser, keys KeyFunc) (io.ReadCloser, error) {
+	defer rc.Close()
+
+	if keys == nil {
+		return nil, fmt.Errorf("message: part %v is encrypted, but no keys are configured", p.ID_)
+	}
+	key, err := keys(ctx, p.KeyVersion_)
+	if err != nil {
+		return nil, fmt.Errorf("message: part %v: %w", p.ID_, err)
+	}
+	ciphertext, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := crypt.Open(key, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("message: part %v: %w", p.ID_, err)
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+type closeBoth [2]io.Closer
+
+func (c closeBoth) Close() error {
+	err := c[0].Close()
+	if err2 := c[1].Close(); err == nil {
+		err = err2
+	}
+	return err
+}
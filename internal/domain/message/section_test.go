@@ -0,0 +1,230 @@
+package message_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messageparser "github.com/foxcpp/maddy-storage/internal/domain/message/parser"
+	"github.com/stretchr/testify/require"
+)
+
+const sectionTestMsg = "From: a@example.org\r\n" +
+	"Subject: nested\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"plain\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<b>html</b>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: inner\r\n" +
+	"To: b@example.org\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--outer--\r\n"
+
+func parseMsg(t *testing.T, text string) *message.Msg {
+	t.Helper()
+
+	data, err := messageparser.New(nil, 0).Parse(context.Background(), strings.NewReader(text))
+	require.NoError(t, err)
+	msg, err := message.New(data)
+	require.NoError(t, err)
+	return msg
+}
+
+func readBody(t *testing.T, b *message.Body) string {
+	t.Helper()
+
+	r := b.Open(context.Background(), nil, nil)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), b.Size())
+	return string(data)
+}
+
+func TestSections(t *testing.T) {
+	msg := parseMsg(t, sectionTestMsg)
+
+	cases := []struct {
+		name string
+		get  func() (*message.Body, error)
+		res  string
+	}{
+		{
+			name: "full message",
+			get:  msg.Raw,
+			res:  sectionTestMsg,
+		},
+		{
+			name: "header",
+			get: func() (*message.Body, error) {
+				hdr, err := msg.Header(message.EmptyPath())
+				return message.BodyFromBytes(hdr), err
+			},
+			res: "From: a@example.org\r\nSubject: nested\r\n" +
+				"Content-Type: multipart/mixed; boundary=outer\r\n\r\n",
+		},
+		{
+			name: "text",
+			get: func() (*message.Body, error) {
+				return msg.Text(message.EmptyPath())
+			},
+			res: strings.SplitN(sectionTestMsg, "\r\n\r\n", 2)[1],
+		},
+		{
+			name: "nested multipart",
+			get: func() (*message.Body, error) {
+				return msg.PartBody(message.Path{1})
+			},
+			res: "--inner\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+				"--inner\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n" +
+				"--inner--",
+		},
+		{
+			name: "nested part",
+			get: func() (*message.Body, error) {
+				return msg.PartBody(message.Path{1, 2})
+			},
+			res: "<b>html</b>",
+		},
+		{
+			name: "nested part MIME",
+			get: func() (*message.Body, error) {
+				hdr, err := msg.MIMEHeader(message.Path{1, 2})
+				return message.BodyFromBytes(hdr), err
+			},
+			res: "Content-Type: text/html\r\n\r\n",
+		},
+		{
+			name: "encapsulated message",
+			get: func() (*message.Body, error) {
+				return msg.PartBody(message.Path{2})
+			},
+			res: "Subject: inner\r\nTo: b@example.org\r\n\r\ninner body",
+		},
+		{
+			name: "encapsulated message header",
+			get: func() (*message.Body, error) {
+				hdr, err := msg.Header(message.Path{2})
+				return message.BodyFromBytes(hdr), err
+			},
+			res: "Subject: inner\r\nTo: b@example.org\r\n\r\n",
+		},
+		{
+			name: "encapsulated message text",
+			get: func() (*message.Body, error) {
+				return msg.Text(message.Path{2})
+			},
+			res: "inner body",
+		},
+		{
+			name: "encapsulated message body",
+			get: func() (*message.Body, error) {
+				return msg.PartBody(message.Path{2, 1})
+			},
+			res: "inner body",
+		},
+		{
+			// Body of non-multipart message uses the message header as
+			// its MIME header.
+			name: "encapsulated message body MIME",
+			get: func() (*message.Body, error) {
+				hdr, err := msg.MIMEHeader(message.Path{2, 1})
+				return message.BodyFromBytes(hdr), err
+			},
+			res: "Subject: inner\r\nTo: b@example.org\r\n\r\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := c.get()
+			require.NoError(t, err)
+			require.Equal(t, c.res, readBody(t, b))
+		})
+	}
+}
+
+func TestSectionsMissing(t *testing.T) {
+	msg := parseMsg(t, sectionTestMsg)
+
+	_, err := msg.PartBody(message.Path{3})
+	require.ErrorIs(t, err, message.ErrNoSuchPart)
+	_, err = msg.PartBody(message.Path{1, 1, 1})
+	require.ErrorIs(t, err, message.ErrNoSuchPart)
+	_, err = msg.MIMEHeader(message.Path{1, 3})
+	require.ErrorIs(t, err, message.ErrNoSuchPart)
+	// Only message/rfc822 parts have a header and text.
+	_, err = msg.Header(message.Path{1})
+	require.ErrorIs(t, err, message.ErrNoSuchPart)
+	_, err = msg.Text(message.Path{1, 1})
+	require.ErrorIs(t, err, message.ErrNoSuchPart)
+}
+
+func TestBodySlice(t *testing.T) {
+	msg := parseMsg(t, sectionTestMsg)
+	raw, err := msg.Raw()
+	require.NoError(t, err)
+	size := int64(len(sectionTestMsg))
+
+	cases := []struct {
+		name         string
+		offset, size int64
+		res          string
+	}{
+		{
+			name:   "header",
+			offset: 0, size: 19,
+			res: "From: a@example.org",
+		},
+		{
+			name:   "across parts",
+			offset: int64(strings.Index(sectionTestMsg, "\r\nplain\r\n") + 2), size: 12,
+			res: "plain\r\n--inn",
+		},
+		{
+			name:   "inside part",
+			offset: int64(strings.Index(sectionTestMsg, "html</b>")), size: 4,
+			res: "html",
+		},
+		{
+			name:   "tail",
+			offset: size - 10, size: 10,
+			res: "-outer--\r\n",
+		},
+		{
+			name:   "past EOF",
+			offset: size - 4, size: 100,
+			res: "--\r\n",
+		},
+		{
+			name:   "offset past EOF",
+			offset: size + 1, size: 10,
+			res: "",
+		},
+		{
+			name:   "zero size",
+			offset: 5, size: 0,
+			res: "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.res, readBody(t, raw.Slice(c.offset, c.size)))
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package message
+
+// SearchText contains the message text indexed for the full-text search.
+// All values are decoded to UTF-8.
+type SearchText struct {
+	From    string // From addresses
+	To      string
+	Cc      string
+	Bcc     string
+	Subject string
+	Header  string // all top-level header fields, one per line
+	Body    string // text/* parts
+}
@@ -0,0 +1,96 @@
+// Package compress implements codecs used to compress stored message
+// parts. Codecs are identified by name, the name is stored together with
+// compressed data.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+type Codec interface {
+	// Compress appends compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// NewReader returns the reader that decompresses r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{
+		Gzip: gzipCodec{},
+		Zstd: &zstdCodec{},
+	}
+)
+
+// Register makes codec available by name. It replaces the existing codec
+// with the same name.
+func Register(name string, codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[name] = codec
+}
+
+// Get returns the codec registered under name.
+func Get(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compress: unknown codec: %q", name)
+	}
+	return c, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	err  error
+}
+
+func (c *zstdCodec) Compress(dst, src []byte) ([]byte, error) {
+	// Encoder is safe for concurrent EncodeAll calls.
+	c.once.Do(func() {
+		c.enc, c.err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.enc.EncodeAll(src, dst), nil
+}
+
+func (*zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
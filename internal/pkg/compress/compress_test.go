@@ -0,0 +1,76 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("hello"),
+		"repetitive": []byte(strings.Repeat("long line\r\n", 1000)),
+		"binary":     {0x00, 0xff, 0x10, 0x80, 0x00},
+	}
+	for _, name := range []string{Gzip, Zstd} {
+		codec, err := Get(name)
+		require.NoError(t, err)
+
+		for inputName, input := range inputs {
+			t.Run(name+"/"+inputName, func(t *testing.T) {
+				prefix := []byte("prefix")
+				compressed, err := codec.Compress(append([]byte{}, prefix...), input)
+				require.NoError(t, err)
+				require.True(t, bytes.HasPrefix(compressed, prefix))
+
+				r, err := codec.NewReader(bytes.NewReader(compressed[len(prefix):]))
+				require.NoError(t, err)
+				defer r.Close()
+				res, err := io.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, string(input), string(res))
+			})
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	input := []byte(strings.Repeat("long line\r\n", 1000))
+	for _, name := range []string{Gzip, Zstd} {
+		codec, err := Get(name)
+		require.NoError(t, err)
+		compressed, err := codec.Compress(nil, input)
+		require.NoError(t, err)
+		require.Less(t, len(compressed), len(input)/10, name)
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	for _, name := range []string{Gzip, Zstd} {
+		codec, err := Get(name)
+		require.NoError(t, err)
+		compressed, err := codec.Compress(nil, []byte(strings.Repeat("data", 100)))
+		require.NoError(t, err)
+
+		r, err := codec.NewReader(bytes.NewReader(compressed[:len(compressed)/2]))
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		require.Error(t, err, name)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	_, err := Get("lzma")
+	require.ErrorContains(t, err, `unknown codec: "lzma"`)
+
+	Register("test-gzip", gzipCodec{})
+	codec, err := Get("test-gzip")
+	require.NoError(t, err)
+	require.Equal(t, gzipCodec{}, codec)
+}
@@ -0,0 +1,148 @@
+// Package crypt implements authenticated encryption of stored data using
+// XChaCha20-Poly1305.
+//
+// Part bodies are sealed using SealDeterministic with nil AD so that equal
+// bodies of the same account produce equal blobs and can be deduplicated.
+// This is a deliberate tradeoff: anyone with access to the storage can tell
+// that two messages of the account share a part body, though not what it
+// contains. Bodies of different accounts are encrypted with different keys
+// and cannot be compared.
+//
+// Keys passed to this package are not used directly. Separate subkeys for
+// encryption and for nonce derivation are derived from them using HKDF.
+package crypt
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const KeySize = chacha20poly1305.KeySize
+
+var ErrDecrypt = errors.New("crypt: decryption failed")
+
+// Keys provides per-account data keys. Keys are identified by version,
+// version 0 means that data is not encrypted.
+type Keys interface {
+	// CurrentKey returns the key that should be used for new data.
+	CurrentKey(ctx context.Context, accountID ulid.ULID) (version int, key []byte, err error)
+	Key(ctx context.Context, accountID ulid.ULID, version int) ([]byte, error)
+}
+
+// NewKey returns a new random key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("crypt: %w", err)
+	}
+	return key, nil
+}
+
+// ParseKey decodes the hex-encoded key, e.g. generated using
+// "openssl rand -hex 32".
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("crypt: malformed key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("crypt: key should be %d bytes long, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Seal encrypts and authenticates plaintext and ad using a random nonce.
+// Nonce is prepended to the returned ciphertext.
+func Seal(key, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("crypt: %w", err)
+	}
+	return seal(key, nonce, plaintext, ad)
+}
+
+// SealDeterministic is similar to Seal, but the nonce is derived from key,
+// plaintext and ad, so equal inputs produce equal ciphertexts. It is used
+// for content-addressed blobs, so they can be deduplicated. Equality of
+// plaintexts sealed with the same key is revealed, see the package
+// documentation.
+func SealDeterministic(key, plaintext, ad []byte) ([]byte, error) {
+	nonceKey, err := deriveKey(key, "nonce")
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	// Length of ad is included so that ad and plaintext cannot be shifted
+	// into each other to get the same nonce.
+	var adLen [8]byte
+	binary.BigEndian.PutUint64(adLen[:], uint64(len(ad)))
+	mac.Write(adLen[:])
+	mac.Write(ad)
+	mac.Write(plaintext)
+	return seal(key, mac.Sum(nil)[:chacha20poly1305.NonceSizeX], plaintext, ad)
+}
+
+// deriveKey returns the subkey of key for the purpose described by info.
+func deriveKey(key []byte, info string) ([]byte, error) {
+	subkey := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), subkey); err != nil {
+		return nil, fmt.Errorf("crypt: %w", err)
+	}
+	return subkey, nil
+}
+
+// newAEAD returns XChaCha20-Poly1305 using the encryption subkey of key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("crypt: key should be %d bytes long, got %d", KeySize, len(key))
+	}
+	sealKey, err := deriveKey(key, "seal")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(sealKey)
+	if err != nil {
+		return nil, fmt.Errorf("crypt: %w", err)
+	}
+	return aead, nil
+}
+
+func seal(key, nonce, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(nonce), len(nonce)+len(plaintext)+aead.Overhead())
+	copy(out, nonce)
+	return aead.Seal(out, nonce, plaintext, ad), nil
+}
+
+// Open decrypts ciphertext created by Seal or SealDeterministic.
+func Open(key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,156 @@
+package crypt
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey(" " + strings.Repeat("0f", KeySize) + "\n")
+	require.NoError(t, err)
+	require.Len(t, key, KeySize)
+	require.Equal(t, byte(0x0f), key[0])
+
+	_, err = ParseKey(strings.Repeat("0f", KeySize-1))
+	require.Error(t, err)
+	_, err = ParseKey(strings.Repeat("zz", KeySize))
+	require.Error(t, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	seals := map[string]func(key, plaintext, ad []byte) ([]byte, error){
+		"Seal":              Seal,
+		"SealDeterministic": SealDeterministic,
+	}
+	for name, seal := range seals {
+		for _, plaintext := range []string{"", "hello", strings.Repeat("long text ", 1000)} {
+			ciphertext, err := seal(key, []byte(plaintext), []byte("ad"))
+			require.NoError(t, err)
+			if plaintext != "" {
+				require.NotContains(t, string(ciphertext), plaintext, name)
+			}
+
+			res, err := Open(key, ciphertext, []byte("ad"))
+			require.NoError(t, err, name)
+			require.Equal(t, plaintext, string(res), name)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+	otherKey, err := NewKey()
+	require.NoError(t, err)
+
+	ciphertext, err := Seal(key, []byte("secret"), []byte("ad"))
+	require.NoError(t, err)
+
+	_, err = Open(otherKey, ciphertext, []byte("ad"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = Open(key, ciphertext, []byte("other ad"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = Open(key, ciphertext, nil)
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	for i := range ciphertext {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[i] ^= 0x01
+		_, err = Open(key, tampered, []byte("ad"))
+		require.ErrorIs(t, err, ErrDecrypt, "byte %d", i)
+	}
+
+	_, err = Open(key, ciphertext[:len(ciphertext)-1], []byte("ad"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = Open(key, ciphertext[:10], []byte("ad"))
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	_, err = Seal(key[:16], []byte("secret"), nil)
+	require.Error(t, err)
+}
+
+func TestDeterminism(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+	otherKey, err := NewKey()
+	require.NoError(t, err)
+
+	a, err := SealDeterministic(key, []byte("body"), nil)
+	require.NoError(t, err)
+	b, err := SealDeterministic(key, []byte("body"), nil)
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+
+	c, err := SealDeterministic(key, []byte("other body"), nil)
+	require.NoError(t, err)
+	require.NotEqual(t, a[:24], c[:24])
+	d, err := SealDeterministic(key, []byte("body"), []byte("ad"))
+	require.NoError(t, err)
+	require.NotEqual(t, a, d)
+	e, err := SealDeterministic(otherKey, []byte("body"), nil)
+	require.NoError(t, err)
+	require.NotEqual(t, a, e)
+
+	// Seal uses random nonces.
+	f, err := Seal(key, []byte("body"), nil)
+	require.NoError(t, err)
+	g, err := Seal(key, []byte("body"), nil)
+	require.NoError(t, err)
+	require.NotEqual(t, f, g)
+}
+
+// Changing key derivation makes existing blobs unreadable and breaks their
+// deduplication, so the results are pinned.
+func TestKeyDerivation(t *testing.T) {
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	nonceKey, err := deriveKey(key, "nonce")
+	require.NoError(t, err)
+	require.Equal(t, "460217f90f821a82ed2ebd9e4c29c5d6b46889fc4f7b2b43f2deef93647c99ad", hex.EncodeToString(nonceKey))
+	sealKey, err := deriveKey(key, "seal")
+	require.NoError(t, err)
+	require.Equal(t, "1f28daac514d841274e4541f0ac720aedc1a1801279e144ba82e6ad8c1c9592d", hex.EncodeToString(sealKey))
+
+	ciphertext, err := SealDeterministic(key, []byte("body"), []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, "d2a75c55e96c251c1a30b7e5134e71cff038f3966e529de7e4595ba8f7e5eea2a9a84a75102fe44ba7f5230e", hex.EncodeToString(ciphertext))
+
+	// Keys passed by callers are not used directly.
+	_, err = openWith(key, ciphertext, []byte("ad"))
+	require.Error(t, err)
+	plaintext, err := openWith(sealKey, ciphertext, []byte("ad"))
+	require.NoError(t, err)
+	require.Equal(t, "body", string(plaintext))
+}
+
+func TestDeterministicNonceAD(t *testing.T) {
+	key, err := NewKey()
+	require.NoError(t, err)
+
+	// AD and plaintext are not simply concatenated for the nonce.
+	a, err := SealDeterministic(key, []byte("bc"), []byte("a"))
+	require.NoError(t, err)
+	b, err := SealDeterministic(key, []byte("c"), []byte("ab"))
+	require.NoError(t, err)
+	require.NotEqual(t, a[:24], b[:24])
+}
+
+// openWith decrypts ciphertext using the raw XChaCha20-Poly1305 key.
+func openWith(rawKey, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
@@ -68,6 +68,21 @@ func (e ValidationError) Unwrap() error {
 	return e.Cause
 }
 
+// ExpiredError is returned if the requested state is no longer available,
+// e.g. changelog entries were pruned. Client needs to do a full resync.
+type ExpiredError struct {
+	Text  string
+	Cause error
+}
+
+func (e ExpiredError) Error() string {
+	return e.Text
+}
+
+func (e ExpiredError) Unwrap() error {
+	return e.Cause
+}
+
 func IsTemporary(err error) bool {
 	return false
 }
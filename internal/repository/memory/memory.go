@@ -0,0 +1,224 @@
+// Package memory implements the non-persistent storage shared by
+// in-memory repositories. It is intended for tests and throwaway servers.
+//
+// All objects are stored in Tables protected by a single lock. Write
+// transactions are serialized and changes made by a failed transaction are
+// reverted using the undo log.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+)
+
+type Account struct {
+	account.Account
+	ModSeq       int64 // last allocated modification sequence
+	PrunedModSeq int64
+}
+
+type Folder struct {
+	folder.Folder
+	PrunedModSeq int64
+}
+
+type Message struct {
+	message.Msg
+	Search *message.SearchText
+}
+
+type Blob struct {
+	RefCount  int
+	UpdatedAt time.Time
+}
+
+type DataKeyID struct {
+	AccountID ulid.ULID
+	Version   int
+}
+
+// Tables contains all stored objects. Stored values must not be modified
+// in place, they are replaced using Set, Delete and Assign instead.
+type Tables struct {
+	Accounts  map[ulid.ULID]Account
+	Folders   map[ulid.ULID]Folder
+	Entries   map[ulid.ULID]map[uint32]folder.Entry // folder ID -> UID -> entry
+	Messages  map[ulid.ULID]Message
+	Blobs     map[string]Blob
+	ChangeLog []changelog.Entry // ordered by creation
+	DataKeys  map[DataKeyID]datakey.Key
+}
+
+type store struct {
+	lock sync.RWMutex
+	t    Tables
+}
+
+// DB is the handle to the storage, optionally bound to the transaction.
+type DB struct {
+	s  *store
+	tx *Tx
+}
+
+func New() DB {
+	return DB{s: &store{t: Tables{
+		Accounts: make(map[ulid.ULID]Account),
+		Folders:  make(map[ulid.ULID]Folder),
+		Entries:  make(map[ulid.ULID]map[uint32]folder.Entry),
+		Messages: make(map[ulid.ULID]Message),
+		Blobs:    make(map[string]Blob),
+		DataKeys: make(map[DataKeyID]datakey.Key),
+	}}}
+}
+
+// Tx is the write transaction. It must not be used concurrently.
+type Tx struct {
+	s    *store
+	undo []func()
+}
+
+// Tables returns the storage contents.
+func (tx *Tx) Tables() *Tables {
+	return &tx.s.t
+}
+
+func (tx *Tx) rollback(savepoint int) {
+	for i := len(tx.undo) - 1; i >= savepoint; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = tx.undo[:savepoint]
+}
+
+// run calls fn in the transaction, changes made by fn are rolled back if it
+// fails.
+func (tx *Tx) run(fn func() error) (err error) {
+	savepoint := len(tx.undo)
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback(savepoint)
+			panic(p)
+		}
+		if err != nil {
+			tx.rollback(savepoint)
+		}
+	}()
+	return fn()
+}
+
+type txKey struct{}
+
+// current returns the transaction the DB is bound to or the one started
+// by InTx.
+func (db DB) current(ctx context.Context) *Tx {
+	if db.tx != nil {
+		return db.tx
+	}
+	if tx, ok := ctx.Value(txKey{}).(*Tx); ok && tx.s == db.s {
+		return tx
+	}
+	return nil
+}
+
+// begin starts the new transaction and calls fn with it.
+func (db DB) begin(fn func(tx *Tx) error) error {
+	db.s.lock.Lock()
+	defer db.s.lock.Unlock()
+
+	tx := &Tx{s: db.s}
+	return tx.run(func() error {
+		return fn(tx)
+	})
+}
+
+// Read calls fn to read the storage contents. fn must not change them.
+func (db DB) Read(ctx context.Context, fn func(t *Tables) error) error {
+	if tx := db.current(ctx); tx != nil {
+		return fn(tx.Tables())
+	}
+
+	db.s.lock.RLock()
+	defer db.s.lock.RUnlock()
+	return fn(&db.s.t)
+}
+
+// Write calls fn in a transaction. If there is one already, changes made
+// by fn are rolled back on failure, similarly to savepoints.
+func (db DB) Write(ctx context.Context, fn func(tx *Tx) error) error {
+	if tx := db.current(ctx); tx != nil {
+		return tx.run(func() error {
+			return fn(tx)
+		})
+	}
+	return db.begin(fn)
+}
+
+func (db DB) Tx(ctx context.Context, readOnly bool, fn func(tx DB) error) error {
+	return db.Write(ctx, func(tx *Tx) error {
+		return fn(DB{s: db.s, tx: tx})
+	})
+}
+
+// InTx runs fn in a transaction. All repositories using the DB with the
+// context passed to fn participate in this transaction. Nested InTx calls
+// reuse the outer transaction.
+//
+// Transactions are serialized, so repositories must not be called
+// with other contexts from fn.
+func (db DB) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if tx := db.current(ctx); tx != nil {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	}
+	return db.begin(func(tx *Tx) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// Set stores the value in the map, the previous value is restored on
+// rollback.
+func Set[K comparable, V any](tx *Tx, m map[K]V, k K, v V) {
+	old, ok := m[k]
+	tx.undo = append(tx.undo, func() {
+		if ok {
+			m[k] = old
+		} else {
+			delete(m, k)
+		}
+	})
+	m[k] = v
+}
+
+// Delete removes the value from the map, it is restored on rollback.
+func Delete[K comparable, V any](tx *Tx, m map[K]V, k K) {
+	old, ok := m[k]
+	if !ok {
+		return
+	}
+	tx.undo = append(tx.undo, func() {
+		m[k] = old
+	})
+	delete(m, k)
+}
+
+// Assign sets the variable, the previous value is restored on rollback.
+func Assign[T any](tx *Tx, p *T, v T) {
+	old := *p
+	tx.undo = append(tx.undo, func() {
+		*p = old
+	})
+	*p = v
+}
+
+// DeleteFolder removes the folder together with its entries.
+func DeleteFolder(tx *Tx, id ulid.ULID) {
+	t := tx.Tables()
+	Delete(tx, t.Entries, id)
+	Delete(tx, t.Folders, id)
+}
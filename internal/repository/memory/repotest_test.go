@@ -0,0 +1,40 @@
+package memory_test
+
+import (
+	"testing"
+
+	accountmemory "github.com/foxcpp/maddy-storage/internal/domain/account/repository/memory"
+	changelogmemory "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/memory"
+	foldermemory "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/memory"
+	messagememory "github.com/foxcpp/maddy-storage/internal/domain/message/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/repository/repotest"
+)
+
+func newRepos(t *testing.T) repotest.Repos {
+	db := memory.New()
+
+	return repotest.Repos{
+		Accounts:  accountmemory.New(db),
+		Folders:   foldermemory.New(db),
+		Messages:  messagememory.New(db),
+		ChangeLog: changelogmemory.New(db),
+		Tx:        db,
+	}
+}
+
+func TestAccountRepo(t *testing.T) {
+	repotest.RunAccountRepo(t, newRepos)
+}
+
+func TestFolderRepo(t *testing.T) {
+	repotest.RunFolderRepo(t, newRepos)
+}
+
+func TestMessageRepo(t *testing.T) {
+	repotest.RunMessageRepo(t, newRepos)
+}
+
+func TestChangeLogRepo(t *testing.T) {
+	repotest.RunChangeLogRepo(t, newRepos)
+}
@@ -0,0 +1,27 @@
+package postgres
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// SQLSTATE codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	codeForeignKeyViolation = "23503"
+	codeUniqueViolation     = "23505"
+)
+
+func hasCode(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+func IsUniqueConstraintError(err error) bool {
+	return errors.Is(err, gorm.ErrDuplicatedKey) || hasCode(err, codeUniqueViolation)
+}
+
+func IsForeignConstraintError(err error) bool {
+	return errors.Is(err, gorm.ErrForeignKeyViolated) || hasCode(err, codeForeignKeyViolation)
+}
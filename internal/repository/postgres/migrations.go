@@ -0,0 +1,40 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+func (db DB) migrationsUp(ctx context.Context) error {
+	sqlDB, err := db.SQL()
+	if err != nil {
+		return err
+	}
+
+	migrationsFolder, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+
+	// Several processes might be started against the same DB.
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return err
+	}
+
+	p, err := goose.NewProvider(goose.DialectPostgres, sqlDB, migrationsFolder,
+		goose.WithSessionLocker(locker))
+	if err != nil {
+		return err
+	}
+
+	_, err = p.Up(ctx)
+	return err
+}
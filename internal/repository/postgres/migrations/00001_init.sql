@@ -0,0 +1,218 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Schema matches the SQLite one after all of its migrations, see
+-- internal/repository/sqlite/migrations for the history of each column.
+-- IDs are stored as 16-byte binary ULIDs.
+CREATE TABLE accounts (
+    id BYTEA NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    -- Modification sequences are allocated from this counter by
+    -- changelog repository.
+    modseq BIGINT NOT NULL DEFAULT 0,
+    -- Highest modification sequence of pruned changelog entries.
+    pruned_modseq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE folders (
+    id BYTEA NOT NULL PRIMARY KEY,
+    parent_id BYTEA DEFAULT NULL
+        REFERENCES folders(id)
+            ON UPDATE CASCADE ON DELETE NO ACTION,
+    account_id BYTEA NOT NULL
+        REFERENCES accounts(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+
+    name TEXT NOT NULL DEFAULT 'INBOX',
+    path TEXT NOT NULL DEFAULT 'INBOX',
+
+    role TEXT DEFAULT NULL,
+    subscribed BOOLEAN NOT NULL DEFAULT TRUE,
+    sort_order INTEGER NOT NULL DEFAULT 1,
+
+    uid_validity BIGINT NOT NULL DEFAULT (floor(random() * 2147483646) + 1),
+    uid_next BIGINT NOT NULL DEFAULT 1,
+
+    modseq BIGINT NOT NULL DEFAULT 0,
+    pruned_modseq BIGINT NOT NULL DEFAULT 0,
+
+    meta BYTEA NOT NULL DEFAULT '\x7b7d', -- {}
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    UNIQUE(account_id, path),
+    UNIQUE(parent_id, name),
+    UNIQUE(account_id, role),
+    CHECK(uid_validity > 0),
+    CHECK(uid_next > 0),
+    CHECK(right(path, length(name) + 1) = '/' || name OR path = name)
+);
+
+CREATE TABLE messages (
+    id BYTEA NOT NULL PRIMARY KEY,
+    -- Messages are encrypted using keys of the account they belong to.
+    account_id BYTEA DEFAULT NULL,
+    date TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    modseq BIGINT NOT NULL DEFAULT 0,
+    meta BYTEA NOT NULL DEFAULT '\x7b7d', -- {}
+    content BYTEA NOT NULL DEFAULT '\x7b7d', -- {}
+    size BIGINT NOT NULL DEFAULT 0,
+    -- Key version used for meta, content and message_parts.content, 0 if
+    -- not encrypted.
+    key_version INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX messages_account_id ON messages(account_id, key_version);
+
+CREATE TABLE folder_entries (
+    folder_id BYTEA NOT NULL
+        REFERENCES folders(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    message_id BYTEA NOT NULL
+        REFERENCES messages(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    uid BIGINT NOT NULL DEFAULT 1,
+
+    UNIQUE(folder_id, uid),
+    CHECK(uid > 0)
+);
+CREATE INDEX folder_entries_message_id ON folder_entries(message_id);
+
+CREATE TABLE message_flags (
+    message_id BYTEA NOT NULL
+        REFERENCES messages(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    flag TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY(message_id, flag)
+);
+
+CREATE TABLE message_parts (
+    id BYTEA NOT NULL PRIMARY KEY,
+    message_id BYTEA NOT NULL
+        REFERENCES messages(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    path TEXT NOT NULL DEFAULT '1',
+    content BYTEA NOT NULL DEFAULT '\x7b7d', -- {}
+    inline BYTEA DEFAULT NULL,
+    external_blob_id TEXT DEFAULT NULL,
+    -- Compression codec of the body, empty if stored as is.
+    codec TEXT NOT NULL DEFAULT '',
+    -- Key version used for the body, 0 if not encrypted.
+    key_version INTEGER NOT NULL DEFAULT 0,
+
+    UNIQUE(message_id, path)
+);
+
+-- Text extracted from messages for the full-text search.
+CREATE TABLE message_search (
+    message_id BYTEA NOT NULL UNIQUE
+        REFERENCES messages(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    from_field TEXT NOT NULL DEFAULT '',
+    to_field TEXT NOT NULL DEFAULT '',
+    cc_field TEXT NOT NULL DEFAULT '',
+    bcc_field TEXT NOT NULL DEFAULT '',
+    subject TEXT NOT NULL DEFAULT '',
+    header TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE changelog_entries (
+    at TIMESTAMPTZ NOT NULL,
+    type TEXT NOT NULL,
+    modseq BIGINT NOT NULL DEFAULT 0,
+    account_id BYTEA NOT NULL,
+    folder_id BYTEA,
+    message_id BYTEA,
+    meta BYTEA NOT NULL,
+    data BYTEA
+);
+CREATE UNIQUE INDEX changelog_entries_account_id ON changelog_entries(account_id, modseq);
+CREATE INDEX changelog_entries_folder_id ON changelog_entries(folder_id, modseq);
+CREATE INDEX changelog_entries_message_id ON changelog_entries(message_id, modseq);
+
+-- Per-account data keys encrypted by the master key.
+CREATE TABLE account_keys (
+    account_id BYTEA NOT NULL
+        REFERENCES accounts(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    wrapped BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    PRIMARY KEY(account_id, version),
+    CHECK(version > 0)
+);
+
+-- Reference counts of external blobs, maintained by message_parts
+-- triggers.
+CREATE TABLE blobs (
+    id TEXT NOT NULL PRIMARY KEY,
+    refcount BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    CHECK(refcount >= 0)
+);
+CREATE INDEX blobs_unused ON blobs(updated_at) WHERE refcount = 0;
+
+CREATE FUNCTION blobs_ref(blob_id TEXT) RETURNS VOID AS $$
+BEGIN
+    IF blob_id IS NOT NULL AND blob_id != '' THEN
+        INSERT INTO blobs (id, refcount) VALUES (blob_id, 1)
+        ON CONFLICT (id) DO UPDATE SET refcount = blobs.refcount + 1, updated_at = now();
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION blobs_unref(blob_id TEXT) RETURNS VOID AS $$
+BEGIN
+    UPDATE blobs SET refcount = refcount - 1, updated_at = now()
+    WHERE id = blob_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION message_parts_blobs() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM blobs_unref(OLD.external_blob_id);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM blobs_ref(NEW.external_blob_id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER blobs_ref AFTER INSERT ON message_parts
+FOR EACH ROW EXECUTE FUNCTION message_parts_blobs();
+
+CREATE TRIGGER blobs_unref AFTER DELETE ON message_parts
+FOR EACH ROW EXECUTE FUNCTION message_parts_blobs();
+
+-- Re-encrypted parts are stored in new blobs.
+CREATE TRIGGER blobs_reref AFTER UPDATE OF external_blob_id ON message_parts
+FOR EACH ROW WHEN (OLD.external_blob_id IS DISTINCT FROM NEW.external_blob_id)
+EXECUTE FUNCTION message_parts_blobs();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE blobs;
+DROP TABLE account_keys;
+DROP TABLE changelog_entries;
+DROP TABLE message_search;
+DROP TABLE message_parts;
+DROP TABLE message_flags;
+DROP TABLE folder_entries;
+DROP TABLE messages;
+DROP TABLE folders;
+DROP TABLE accounts;
+
+DROP FUNCTION message_parts_blobs;
+DROP FUNCTION blobs_unref;
+DROP FUNCTION blobs_ref;
+-- +goose StatementEnd
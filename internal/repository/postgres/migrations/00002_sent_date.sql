@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Date header field value, duplicated from content so it can be searched
+-- even if content is encrypted. NULL if the field is missing.
+ALTER TABLE messages ADD COLUMN sent_date TIMESTAMPTZ DEFAULT NULL;
+
+-- Encrypted messages are filled in on the next key rotation.
+UPDATE messages SET sent_date = nullif(convert_from(content, 'UTF8')::jsonb #>> '{envelope,date}', '0001-01-01T00:00:00Z')::timestamptz
+WHERE key_version = 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE messages DROP COLUMN sent_date;
+-- +goose StatementEnd
@@ -0,0 +1,84 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlcommon"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+type Cfg struct {
+	SlowLogThreshold time.Duration
+}
+
+type DB struct {
+	db *gorm.DB
+}
+
+// New connects to the PostgreSQL server using the DSN in libpq format,
+// e.g. "host=localhost user=maddy dbname=maddy", or URL format, and
+// applies migrations.
+func New(dsn string, cfg Cfg) (DB, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		Logger: sqlcommon.GormLogger{
+			SlowThreshold: cfg.SlowLogThreshold,
+		},
+	})
+	if err != nil {
+		return DB{}, err
+	}
+
+	ret := DB{db: db}
+
+	if err := ret.migrationsUp(context.Background()); err != nil {
+		return DB{}, err
+	}
+
+	return ret, nil
+}
+
+func (db DB) Tx(ctx context.Context, readOnly bool, fn func(tx DB) error) error {
+	return db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(DB{db: tx})
+	}, &sql.TxOptions{
+		ReadOnly: readOnly,
+	})
+}
+
+type txKey struct{}
+
+// InTx runs fn in a transaction. All repositories using the DB with the
+// context passed to fn participate in this transaction. Nested InTx calls
+// reuse the outer transaction.
+func (db DB) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return fn(ctx)
+	}
+	return db.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// Gorm returns the handle for queries, bound to the transaction started
+// by InTx if there is one in ctx.
+func (db DB) Gorm(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return db.db.WithContext(ctx)
+}
+
+func (db DB) SQL() (*sql.DB, error) {
+	return db.db.DB()
+}
+
+func (db DB) Close() error {
+	sqlDB, err := db.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
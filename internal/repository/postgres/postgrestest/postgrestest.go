@@ -0,0 +1,61 @@
+// Package postgrestest provides PostgreSQL databases for repository tests.
+package postgrestest
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/oklog/ulid/v2"
+)
+
+// DSNEnv is the environment variable with the DSN of the server to run
+// tests against, e.g. "host=localhost user=postgres dbname=maddy_test".
+const DSNEnv = "MADDY_TEST_POSTGRES"
+
+// New returns DB using a new schema that is dropped when the test ends.
+// Test is skipped if DSNEnv is not set.
+func New(t testing.TB) postgres.DB {
+	t.Helper()
+
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skip(DSNEnv + " is not set")
+	}
+
+	schema := "test_" + strings.ToLower(ulid.Make().String())
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	db, err := postgres.New(withSearchPath(dsn, schema), postgres.Cfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if strings.Contains(dsn, "?") {
+			return dsn + "&search_path=" + schema
+		}
+		return dsn + "?search_path=" + schema
+	}
+	return dsn + " search_path=" + schema
+}
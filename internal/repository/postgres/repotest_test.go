@@ -0,0 +1,40 @@
+package postgres_test
+
+import (
+	"testing"
+
+	accountpostgres "github.com/foxcpp/maddy-storage/internal/domain/account/repository/postgres"
+	changelogpostgres "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/postgres"
+	folderpostgres "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/postgres"
+	messagepostgres "github.com/foxcpp/maddy-storage/internal/domain/message/repository/postgres"
+	"github.com/foxcpp/maddy-storage/internal/repository/postgres/postgrestest"
+	"github.com/foxcpp/maddy-storage/internal/repository/repotest"
+)
+
+func newRepos(t *testing.T) repotest.Repos {
+	db := postgrestest.New(t)
+
+	return repotest.Repos{
+		Accounts:  accountpostgres.New(db),
+		Folders:   folderpostgres.New(db),
+		Messages:  messagepostgres.New(db),
+		ChangeLog: changelogpostgres.New(db),
+		Tx:        db,
+	}
+}
+
+func TestAccountRepo(t *testing.T) {
+	repotest.RunAccountRepo(t, newRepos)
+}
+
+func TestFolderRepo(t *testing.T) {
+	repotest.RunFolderRepo(t, newRepos)
+}
+
+func TestMessageRepo(t *testing.T) {
+	repotest.RunMessageRepo(t, newRepos)
+}
+
+func TestChangeLogRepo(t *testing.T) {
+	repotest.RunChangeLogRepo(t, newRepos)
+}
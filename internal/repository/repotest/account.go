@@ -0,0 +1,83 @@
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func RunAccountRepo(t *testing.T, newRepos Factory) {
+	t.Run("Create", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+
+		acct := newAccount(t, r, "test")
+
+		got, err := r.Accounts.GetByID(ctx, acct.ID_)
+		require.NoError(t, err)
+		require.Equal(t, acct.ID_, got.ID_)
+		require.Equal(t, "test", got.Name_)
+		require.WithinDuration(t, acct.CreatedAt_, got.CreatedAt_, time.Millisecond)
+
+		got, err = r.Accounts.GetByName(ctx, "test")
+		require.NoError(t, err)
+		require.Equal(t, acct.ID_, got.ID_)
+
+		dup, err := account.NewAccount("test")
+		require.NoError(t, err)
+		require.ErrorIs(t, r.Accounts.Create(ctx, dup), account.ErrAlreadyExists)
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+
+		_, err := r.Accounts.GetByID(ctx, ulid.Make())
+		require.ErrorIs(t, err, account.ErrNotFound)
+		_, err = r.Accounts.GetByName(ctx, "test")
+		require.ErrorIs(t, err, account.ErrNotFound)
+	})
+	t.Run("GetAll", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+
+		b := newAccount(t, r, "b")
+		a := newAccount(t, r, "a")
+
+		all, err := r.Accounts.GetAll(ctx, time.Time{}, account.OrderName)
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+		require.Equal(t, []string{"a", "b"}, []string{all[0].Name_, all[1].Name_})
+
+		all, err = r.Accounts.GetAll(ctx, time.Time{}, account.OrderID)
+		require.NoError(t, err)
+		require.Equal(t, []ulid.ULID{b.ID_, a.ID_}, []ulid.ULID{all[0].ID_, all[1].ID_})
+
+		all, err = r.Accounts.GetAll(ctx, time.Now().Add(time.Minute), account.OrderID)
+		require.NoError(t, err)
+		require.Empty(t, all)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+
+		acct := newAccount(t, r, "test")
+		newFolder(t, r, acct, nil, "INBOX")
+
+		require.NoError(t, r.Accounts.Delete(ctx, acct.ID_))
+		_, err := r.Accounts.GetByID(ctx, acct.ID_)
+		require.ErrorIs(t, err, account.ErrNotFound)
+
+		// Folders are removed together with the account.
+		folders, err := r.Folders.GetByAccount(ctx, acct.ID_, folder.Filter{}, folder.OrderByName)
+		require.NoError(t, err)
+		require.Empty(t, folders)
+
+		// Name can be reused.
+		newAccount(t, r, "test")
+	})
+}
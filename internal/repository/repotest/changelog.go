@@ -0,0 +1,191 @@
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/stretchr/testify/require"
+)
+
+func entryModSeqs(entries []changelog.Entry) []int64 {
+	modSeqs := make([]int64, len(entries))
+	for i, e := range entries {
+		modSeqs[i] = e.ModSeq
+	}
+	return modSeqs
+}
+
+func RunChangeLogRepo(t *testing.T, newRepos Factory) {
+	t.Run("Create", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		other := newAccount(t, r, "other")
+		f := newFolder(t, r, acct, nil, "INBOX")
+		msg := newMessage(t, r, acct, "a")
+
+		entries := []*changelog.Entry{
+			changelog.NewFolder(changelog.TypeFolderCreated, acct.ID_, f.ID_, &changelog.FolderEntry{NewName: "INBOX"}),
+			changelog.NewMessage(changelog.TypeMessageCreated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{UID: 1}),
+			changelog.NewAccount(changelog.TypeAccountCreated, other.ID_, &changelog.AccountEntry{}),
+			changelog.NewMessage(changelog.TypeMessageUpdated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{
+				UID:   1,
+				Flags: []string{`\Seen`},
+			}),
+		}
+		require.NoError(t, r.ChangeLog.Create(ctx, entries...))
+		require.Equal(t, []int64{1, 2, 1, 3}, []int64{
+			entries[0].ModSeq, entries[1].ModSeq, entries[2].ModSeq, entries[3].ModSeq,
+		})
+
+		ent := changelog.NewFolder(changelog.TypeFolderRenamed, acct.ID_, f.ID_, &changelog.FolderEntry{OldName: "INBOX", NewName: "Inbox"})
+		require.NoError(t, r.ChangeLog.Create(ctx, ent))
+		require.EqualValues(t, 4, ent.ModSeq)
+
+		for _, tc := range []struct {
+			name   string
+			last   func() (int64, error)
+			modSeq int64
+		}{
+			{"account", func() (int64, error) { return r.ChangeLog.LastAccountModSeq(ctx, acct.ID_) }, 4},
+			{"other account", func() (int64, error) { return r.ChangeLog.LastAccountModSeq(ctx, other.ID_) }, 1},
+			{"folder", func() (int64, error) { return r.ChangeLog.LastFolderModSeq(ctx, f.ID_) }, 4},
+			{"message", func() (int64, error) { return r.ChangeLog.LastMessageModSeq(ctx, msg.ID_) }, 3},
+		} {
+			modSeq, err := tc.last()
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.modSeq, modSeq, tc.name)
+		}
+
+		// Affected objects get the new modification sequence.
+		gotFolder, err := r.Folders.GetByID(ctx, f.ID_)
+		require.NoError(t, err)
+		require.EqualValues(t, 4, gotFolder.ModSeq_)
+		gotMsg, err := r.Messages.GetByID(ctx, msg.ID_)
+		require.NoError(t, err)
+		require.EqualValues(t, 3, gotMsg.ModSeq_)
+	})
+	t.Run("GetChanges", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+		msg := newMessage(t, r, acct, "a")
+
+		require.NoError(t, r.ChangeLog.Create(ctx,
+			changelog.NewFolder(changelog.TypeFolderCreated, acct.ID_, f.ID_, &changelog.FolderEntry{NewName: "INBOX"}),
+			changelog.NewMessage(changelog.TypeMessageCreated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{UID: 1}),
+			changelog.NewMessage(changelog.TypeMessageUpdated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{
+				UID:   1,
+				Flags: []string{`\Seen`},
+			}),
+			changelog.NewAccount(changelog.TypeAccountCreated, acct.ID_, &changelog.AccountEntry{}),
+		))
+
+		entries, err := r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{1, 2, 3, 4}, entryModSeqs(entries))
+		entries, err = r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 1, 2)
+		require.NoError(t, err)
+		require.Equal(t, []int64{2, 3}, entryModSeqs(entries))
+
+		entries, err = r.ChangeLog.GetFolderChanges(ctx, f.ID_, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{2, 3}, entryModSeqs(entries))
+
+		entries, err = r.ChangeLog.GetMessageChanges(ctx, msg.ID_, 2, 0)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		ent := entries[0]
+		require.Equal(t, changelog.Type(changelog.TypeMessageUpdated), ent.Type)
+		require.Equal(t, acct.ID_, ent.AccountID)
+		require.Equal(t, f.ID_, ent.FolderID)
+		require.Equal(t, msg.ID_, ent.MessageID)
+		require.Equal(t, &changelog.MessageEntry{UID: 1, Flags: []string{`\Seen`}}, ent.Message)
+
+		entries, err = r.ChangeLog.GetMessageChanges(ctx, msg.ID_, 3, 0)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+	t.Run("Prune", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		other := newAccount(t, r, "other")
+		f := newFolder(t, r, acct, nil, "INBOX")
+		msg := newMessage(t, r, acct, "a")
+
+		old := changelog.NewFolder(changelog.TypeFolderCreated, acct.ID_, f.ID_, &changelog.FolderEntry{NewName: "INBOX"})
+		old.At = time.Now().Add(-time.Hour)
+		require.NoError(t, r.ChangeLog.Create(ctx, old))
+		for i := 0; i < 3; i++ {
+			require.NoError(t, r.ChangeLog.Create(ctx,
+				changelog.NewMessage(changelog.TypeMessageCreated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{UID: 1}),
+				changelog.NewAccount(changelog.TypeAccountCreated, other.ID_, &changelog.AccountEntry{})))
+		}
+
+		pruned, err := r.ChangeLog.Prune(ctx, time.Now().Add(-time.Minute), 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, pruned)
+
+		_, err = r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 0, 0)
+		require.ErrorIs(t, err, changelog.ErrTooOld)
+		_, err = r.ChangeLog.GetFolderChanges(ctx, f.ID_, 0, 0)
+		require.ErrorIs(t, err, changelog.ErrTooOld)
+		entries, err := r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{2, 3, 4}, entryModSeqs(entries))
+
+		// Each account keeps its latest entries.
+		pruned, err = r.ChangeLog.Prune(ctx, time.Time{}, 2)
+		require.NoError(t, err)
+		require.Equal(t, 2, pruned)
+
+		_, err = r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 1, 0)
+		require.ErrorIs(t, err, changelog.ErrTooOld)
+		_, err = r.ChangeLog.GetFolderChanges(ctx, f.ID_, 1, 0)
+		require.ErrorIs(t, err, changelog.ErrTooOld)
+		entries, err = r.ChangeLog.GetAccountChanges(ctx, acct.ID_, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{3, 4}, entryModSeqs(entries))
+		entries, err = r.ChangeLog.GetAccountChanges(ctx, other.ID_, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{2, 3}, entryModSeqs(entries))
+
+		// Message changes are not checked for pruning.
+		entries, err = r.ChangeLog.GetMessageChanges(ctx, msg.ID_, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{3, 4}, entryModSeqs(entries))
+	})
+	t.Run("Compact", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+		a := newMessage(t, r, acct, "a")
+		b := newMessage(t, r, acct, "b")
+
+		msgEntry := func(type_ string, msg *message.Msg, uid uint32) *changelog.Entry {
+			return changelog.NewMessage(type_, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{UID: uid})
+		}
+		require.NoError(t, r.ChangeLog.Create(ctx,
+			msgEntry(changelog.TypeMessageCreated, a, 1), // 1
+			msgEntry(changelog.TypeMessageUpdated, a, 1), // 2, superseded
+			msgEntry(changelog.TypeMessageCreated, b, 2), // 3
+			msgEntry(changelog.TypeMessageUpdated, a, 1), // 4, superseded
+			msgEntry(changelog.TypeMessageUpdated, b, 2), // 5
+			msgEntry(changelog.TypeMessageDeleted, a, 1), // 6
+		))
+
+		compacted, err := r.ChangeLog.Compact(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 2, compacted)
+
+		entries, err := r.ChangeLog.GetFolderChanges(ctx, f.ID_, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []int64{1, 3, 5, 6}, entryModSeqs(entries))
+	})
+}
@@ -0,0 +1,453 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func folderPaths(folders []folder.Folder) []string {
+	paths := make([]string, len(folders))
+	for i, f := range folders {
+		paths[i] = f.Path_
+	}
+	return paths
+}
+
+func entryUIDs(entries []folder.Entry) []uint32 {
+	uids := make([]uint32, len(entries))
+	for i, e := range entries {
+		uids[i] = e.UID_
+	}
+	return uids
+}
+
+func RunFolderRepo(t *testing.T, newRepos Factory) {
+	t.Run("Create", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		other := newAccount(t, r, "other")
+
+		parent := newFolder(t, r, acct, nil, "a")
+		child := newFolder(t, r, acct, parent, "b")
+		newFolder(t, r, other, nil, "a")
+
+		got, err := r.Folders.GetByID(ctx, child.ID_)
+		require.NoError(t, err)
+		require.Equal(t, "a/b", got.Path_)
+		require.Equal(t, "b", got.Name_)
+		require.Equal(t, parent.ID_, got.ParentID_)
+		require.Equal(t, acct.ID_, got.AccountID_)
+		require.Equal(t, child.UIDValidity_, got.UIDValidity_)
+		require.EqualValues(t, 1, got.UIDNext_)
+
+		got, err = r.Folders.GetByPath(ctx, acct.ID_, "a/b")
+		require.NoError(t, err)
+		require.Equal(t, child.ID_, got.ID_)
+
+		_, err = r.Folders.GetByID(ctx, ulid.Make())
+		require.ErrorIs(t, err, folder.ErrNotFound)
+		_, err = r.Folders.GetByPath(ctx, acct.ID_, "b")
+		require.ErrorIs(t, err, folder.ErrNotFound)
+		_, err = r.Folders.GetByPath(ctx, other.ID_, "a/b")
+		require.ErrorIs(t, err, folder.ErrNotFound)
+
+		dup, err := folder.NewFolder(parent, acct.ID_, "b", folder.RoleNone)
+		require.NoError(t, err)
+		require.ErrorIs(t, r.Folders.Create(ctx, dup), folder.ErrAlreadyExists)
+	})
+	t.Run("Filter", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		other := newAccount(t, r, "other")
+
+		a, err := folder.NewFolder(nil, acct.ID_, "a", folder.RoleNone)
+		require.NoError(t, err)
+		a.Subscribed_ = true
+		require.NoError(t, r.Folders.Create(ctx, a))
+		newFolder(t, r, acct, a, "b")
+		c, err := folder.NewFolder(a, acct.ID_, "c", folder.RoleTrash)
+		require.NoError(t, err)
+		require.NoError(t, r.Folders.Create(ctx, c))
+		newFolder(t, r, acct, nil, "d")
+		newFolder(t, r, other, nil, "a")
+
+		str := func(s string) *string { return &s }
+		boolean := func(b bool) *bool { return &b }
+		trash := folder.RoleTrash
+		for _, tc := range []struct {
+			name   string
+			filter folder.Filter
+			paths  []string
+		}{
+			{"all", folder.Filter{}, []string{"a", "a/b", "a/c", "d"}},
+			{"NameContains", folder.Filter{NameContains: str("b")}, []string{"a/b"}},
+			{"Path", folder.Filter{Path: str("a/c")}, []string{"a/c"}},
+			{"PathPrefix", folder.Filter{PathPrefix: str("a")}, []string{"a", "a/b", "a/c"}},
+			{"ParentID", folder.Filter{ParentID: &a.ID_}, []string{"a/b", "a/c"}},
+			{"ParentPath", folder.Filter{ParentPath: str("a")}, []string{"a/b", "a/c"}},
+			{"Subscribed", folder.Filter{Subscribed: boolean(true)}, []string{"a"}},
+			{"NotSubscribed", folder.Filter{Subscribed: boolean(false)}, []string{"a/b", "a/c", "d"}},
+			{"HasRole", folder.Filter{HasRole: boolean(true)}, []string{"a/c"}},
+			{"NoRole", folder.Filter{HasRole: boolean(false)}, []string{"a", "a/b", "d"}},
+			{"Role", folder.Filter{Role: &trash}, []string{"a/c"}},
+			{"PathRegex", folder.Filter{PathRegex: []*regexp.Regexp{regexp.MustCompile(`^a/.*$`)}}, []string{"a/b", "a/c"}},
+			{"PathRegexes", folder.Filter{PathRegex: []*regexp.Regexp{
+				regexp.MustCompile(`^a$`), regexp.MustCompile(`^d$`),
+			}}, []string{"a", "d"}},
+			{"Combined", folder.Filter{PathPrefix: str("a"), HasRole: boolean(false)}, []string{"a", "a/b"}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				folders, err := r.Folders.GetByAccount(ctx, acct.ID_, tc.filter, folder.OrderByName)
+				require.NoError(t, err)
+				require.Equal(t, tc.paths, folderPaths(folders))
+
+				cnt, err := r.Folders.CountByAccount(ctx, acct.ID_, tc.filter)
+				require.NoError(t, err)
+				require.Equal(t, len(tc.paths), cnt)
+			})
+		}
+	})
+	t.Run("Order", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		for _, name := range []string{"b", "c", "a"} {
+			newFolder(t, r, acct, nil, name)
+		}
+
+		for _, tc := range []struct {
+			order folder.Order
+			paths []string
+		}{
+			{folder.OrderByName, []string{"a", "b", "c"}},
+			{folder.OrderByNameDesc, []string{"c", "b", "a"}},
+			{folder.OrderByCreatedAt, []string{"b", "c", "a"}},
+			{folder.OrderByCreatedAtDesc, []string{"a", "c", "b"}},
+		} {
+			folders, err := r.Folders.GetByAccount(ctx, acct.ID_, folder.Filter{}, tc.order)
+			require.NoError(t, err)
+			require.Equal(t, tc.paths, folderPaths(folders), "order %d", tc.order)
+		}
+	})
+	t.Run("Update", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		newFolder(t, r, acct, nil, "a")
+
+		f, err := r.Folders.GetByPath(ctx, acct.ID_, "a")
+		require.NoError(t, err)
+		stale, err := r.Folders.GetByPath(ctx, acct.ID_, "a")
+		require.NoError(t, err)
+
+		f.SetSubscribed(true)
+		f.SetRole(folder.RoleDrafts)
+		require.NoError(t, r.Folders.Update(ctx, f))
+
+		got, err := r.Folders.GetByID(ctx, f.ID_)
+		require.NoError(t, err)
+		require.True(t, got.Subscribed_)
+		require.Equal(t, folder.RoleDrafts, got.Role_)
+
+		// Changed concurrently.
+		stale.SetSubscribed(false)
+		require.Error(t, r.Folders.Update(ctx, stale))
+		got, err = r.Folders.GetByID(ctx, f.ID_)
+		require.NoError(t, err)
+		require.True(t, got.Subscribed_)
+
+		require.ErrorIs(t, r.Folders.Update(ctx, &folder.Folder{ID_: ulid.Make()}), folder.ErrNotFound)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		parent := newFolder(t, r, acct, nil, "a")
+		child := newFolder(t, r, acct, parent, "b")
+
+		require.ErrorIs(t, r.Folders.Delete(ctx, parent.ID_), folder.ErrHasChildren)
+		_, err := r.Folders.GetByID(ctx, parent.ID_)
+		require.NoError(t, err)
+
+		require.NoError(t, r.Folders.Delete(ctx, child.ID_))
+		require.NoError(t, r.Folders.Delete(ctx, parent.ID_))
+		_, err = r.Folders.GetByID(ctx, parent.ID_)
+		require.ErrorIs(t, err, folder.ErrNotFound)
+	})
+	t.Run("RenameMove", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		a := newFolder(t, r, acct, nil, "a")
+		b := newFolder(t, r, acct, a, "b")
+		c := newFolder(t, r, acct, b, "c")
+		d := newFolder(t, r, acct, nil, "d")
+
+		// Rename.
+		renamed, err := r.Folders.RenameMove(ctx, acct.ID_, a, a, "b", "e")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []folder.RenamedFolder{
+			{ID: b.ID_, OldPath: "a/b", NewPath: "a/e"},
+			{ID: c.ID_, OldPath: "a/b/c", NewPath: "a/e/c"},
+		}, renamed)
+
+		// Move.
+		renamed, err = r.Folders.RenameMove(ctx, acct.ID_, a, d, "e", "e")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []folder.RenamedFolder{
+			{ID: b.ID_, OldPath: "a/e", NewPath: "d/e"},
+			{ID: c.ID_, OldPath: "a/e/c", NewPath: "d/e/c"},
+		}, renamed)
+
+		got, err := r.Folders.GetByPath(ctx, acct.ID_, "d/e")
+		require.NoError(t, err)
+		require.Equal(t, b.ID_, got.ID_)
+		require.Equal(t, "e", got.Name_)
+		require.Equal(t, d.ID_, got.ParentID_)
+		got, err = r.Folders.GetByPath(ctx, acct.ID_, "d/e/c")
+		require.NoError(t, err)
+		require.Equal(t, c.ID_, got.ID_)
+		require.Equal(t, b.ID_, got.ParentID_)
+		_, err = r.Folders.GetByPath(ctx, acct.ID_, "a/b/c")
+		require.ErrorIs(t, err, folder.ErrNotFound)
+
+		// Move to the root.
+		renamed, err = r.Folders.RenameMove(ctx, acct.ID_, d, nil, "e", "f")
+		require.NoError(t, err)
+		require.Len(t, renamed, 2)
+		got, err = r.Folders.GetByPath(ctx, acct.ID_, "f/c")
+		require.NoError(t, err)
+		require.Equal(t, c.ID_, got.ID_)
+		got, err = r.Folders.GetByPath(ctx, acct.ID_, "f")
+		require.NoError(t, err)
+		require.Equal(t, ulid.ULID{}, got.ParentID_)
+
+		_, err = r.Folders.RenameMove(ctx, acct.ID_, a, a, "b", "x")
+		require.ErrorIs(t, err, folder.ErrNotFound)
+		_, err = r.Folders.RenameMove(ctx, acct.ID_, nil, nil, "f", "d")
+		require.ErrorIs(t, err, folder.ErrAlreadyExists)
+		_, err = r.Folders.GetByPath(ctx, acct.ID_, "f/c")
+		require.NoError(t, err, "failed rename changed folders")
+	})
+	t.Run("DeleteTree", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		other := newAccount(t, r, "other")
+
+		a := newFolder(t, r, acct, nil, "a")
+		b := newFolder(t, r, acct, a, "b")
+		newFolder(t, r, acct, nil, "ab")
+		otherA := newFolder(t, r, other, nil, "a")
+		newFolder(t, r, other, otherA, "b")
+
+		deleted, err := r.Folders.DeleteTree(ctx, acct.ID_, "a")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []folder.DeletedFolder{
+			{ID: a.ID_, Path: "a"},
+			{ID: b.ID_, Path: "a/b"},
+		}, deleted)
+
+		folders, err := r.Folders.GetByAccount(ctx, acct.ID_, folder.Filter{}, folder.OrderByName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"ab"}, folderPaths(folders))
+		folders, err = r.Folders.GetByAccount(ctx, other.ID_, folder.Filter{}, folder.OrderByName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "a/b"}, folderPaths(folders))
+
+		deleted, err = r.Folders.DeleteTree(ctx, acct.ID_, "a")
+		require.NoError(t, err)
+		require.Empty(t, deleted)
+	})
+	t.Run("NextUID", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		uids, err := r.Folders.NextUID(ctx, f.ID_, 1)
+		require.NoError(t, err)
+		require.Equal(t, []uint32{1}, uids)
+		uids, err = r.Folders.NextUID(ctx, f.ID_, 3)
+		require.NoError(t, err)
+		require.Equal(t, []uint32{2, 3, 4}, uids)
+
+		got, err := r.Folders.GetByID(ctx, f.ID_)
+		require.NoError(t, err)
+		require.EqualValues(t, 5, got.UIDNext_)
+
+		_, err = r.Folders.NextUID(ctx, ulid.Make(), 1)
+		require.ErrorIs(t, err, folder.ErrNotFound)
+	})
+	t.Run("NextUIDConcurrent", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		const workers, perWorker = 8, 3
+		var (
+			wg   sync.WaitGroup
+			lock sync.Mutex
+			uids []uint32
+			errs = make(chan error, workers)
+		)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- r.Tx.InTx(ctx, func(ctx context.Context) error {
+					allocated, err := r.Folders.NextUID(ctx, f.ID_, perWorker)
+					if err != nil {
+						return err
+					}
+					lock.Lock()
+					uids = append(uids, allocated...)
+					lock.Unlock()
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		require.Len(t, uids, workers*perWorker)
+		for i, uid := range uids {
+			require.EqualValues(t, i+1, uid)
+		}
+	})
+	t.Run("Rollback", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		errFail := errors.New("fail")
+		err := r.Tx.InTx(ctx, func(ctx context.Context) error {
+			if _, err := r.Folders.NextUID(ctx, f.ID_, 2); err != nil {
+				return err
+			}
+			child, err := folder.NewFolder(f, acct.ID_, "child", folder.RoleNone)
+			if err != nil {
+				return err
+			}
+			if err := r.Folders.Create(ctx, child); err != nil {
+				return err
+			}
+			if _, err := r.Folders.RenameMove(ctx, acct.ID_, nil, nil, "INBOX", "Inbox"); err != nil {
+				return err
+			}
+			return errFail
+		})
+		require.ErrorIs(t, err, errFail)
+
+		folders, err := r.Folders.GetByAccount(ctx, acct.ID_, folder.Filter{}, folder.OrderByName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"INBOX"}, folderPaths(folders))
+		require.EqualValues(t, 1, folders[0].UIDNext_)
+	})
+	t.Run("Entries", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		msgs := make([]ulid.ULID, 4)
+		entries := make([]folder.Entry, 4)
+		for i := range msgs {
+			msgs[i] = newMessage(t, r, acct, "hello").ID_
+			entries[i] = folder.NewEntry(f.ID_, msgs[i], uint32(i+1))
+		}
+		require.NoError(t, r.Folders.CreateEntry(ctx, entries...))
+
+		got, err := r.Folders.GetEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 2, Until: 3})
+		require.NoError(t, err)
+		require.Equal(t, entries[1:3], got)
+
+		got, err = r.Folders.GetEntryByUIDRange(ctx, f.ID_,
+			folder.UIDRange{Since: 4, Until: 10}, folder.UIDRange{Since: 1, Until: 1}, folder.UIDRange{Since: 1, Until: 2})
+		require.NoError(t, err)
+		require.Equal(t, []uint32{1, 2, 4}, entryUIDs(got))
+
+		got, err = r.Folders.GetEntryByMsgID(ctx, msgs[3], msgs[0], ulid.Make())
+		require.NoError(t, err)
+		require.Equal(t, []folder.Entry{entries[0], entries[3]}, got)
+
+		cnt, err := r.Folders.CountEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 1, Until: 3}, folder.UIDRange{Since: 2, Until: 4})
+		require.NoError(t, err)
+		require.Equal(t, 4, cnt)
+		cnt, err = r.Folders.CountEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 5, Until: 10})
+		require.NoError(t, err)
+		require.Equal(t, 0, cnt)
+
+		require.NoError(t, r.Folders.DeleteEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 2, Until: 2}, folder.UIDRange{Since: 4, Until: 4}))
+		got, err = r.Folders.GetEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 1, Until: 10})
+		require.NoError(t, err)
+		require.Equal(t, []uint32{1, 3}, entryUIDs(got))
+
+		require.NoError(t, r.Folders.ReplaceEntries(ctx,
+			[]folder.Entry{entries[0]},
+			[]folder.Entry{folder.NewEntry(f.ID_, msgs[0], 5)}))
+		got, err = r.Folders.GetEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 1, Until: 10})
+		require.NoError(t, err)
+		require.Equal(t, []folder.Entry{entries[2], folder.NewEntry(f.ID_, msgs[0], 5)}, got)
+
+		err = r.Folders.CreateEntry(ctx, folder.NewEntry(f.ID_, msgs[1], 3))
+		require.ErrorIs(t, err, folder.ErrEntryAlreadyExists)
+		err = r.Folders.CreateEntry(ctx, folder.NewEntry(f.ID_, ulid.Make(), 6))
+		require.ErrorIs(t, err, folder.ErrDanglingEntry)
+		err = r.Folders.CreateEntry(ctx, folder.NewEntry(ulid.Make(), msgs[1], 6))
+		require.ErrorIs(t, err, folder.ErrDanglingEntry)
+
+		// Entries are removed together with the folder.
+		require.NoError(t, r.Folders.Delete(ctx, f.ID_))
+		got, err = r.Folders.GetEntryByUIDRange(ctx, f.ID_, folder.UIDRange{Since: 1, Until: 10})
+		require.NoError(t, err)
+		require.Empty(t, got)
+	})
+	t.Run("Stats", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		stats, err := r.Folders.GetStats(ctx, f.ID_)
+		require.NoError(t, err)
+		require.Equal(t, folder.Stats{}, *stats)
+
+		seen := newMessage(t, r, acct, "a", `\seen`)
+		deleted := newMessage(t, r, acct, "bb", `\Deleted`, "$Label")
+		unseen := newMessage(t, r, acct, "ccc")
+		require.NoError(t, r.Folders.CreateEntry(ctx,
+			folder.NewEntry(f.ID_, seen.ID_, 1),
+			folder.NewEntry(f.ID_, deleted.ID_, 2),
+			folder.NewEntry(f.ID_, unseen.ID_, 3)))
+
+		stats, err = r.Folders.GetStats(ctx, f.ID_)
+		require.NoError(t, err)
+		require.Equal(t, folder.Stats{
+			Msgs:        3,
+			UnseenMsgs:  2,
+			DeletedMsgs: 1,
+			Size:        6,
+			DeletedSize: 2,
+		}, *stats)
+	})
+}
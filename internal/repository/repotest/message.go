@@ -0,0 +1,179 @@
+package repotest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func RunMessageRepo(t *testing.T, newRepos Factory) {
+	t.Run("Create", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		msg := newMessage(t, r, acct, "hello", `\Seen`, "$Label")
+
+		got, err := r.Messages.GetByID(ctx, msg.ID_)
+		require.NoError(t, err)
+		require.Equal(t, msg.ID_, got.ID_)
+		require.Equal(t, acct.ID_, got.AccountID_)
+		require.ElementsMatch(t, []string{`\Seen`, "$Label"}, got.Flags_)
+		require.EqualValues(t, 5, got.Content_.Size)
+		require.Len(t, got.Parts_, 1)
+		require.Equal(t, message.Path{1}, got.Parts_[0].Path_)
+		require.Equal(t, []byte("hello"), got.Parts_[0].Inline_)
+
+		require.ErrorIs(t, r.Messages.Create(ctx, *msg), message.ErrAlreadyExists)
+
+		_, err = r.Messages.GetByID(ctx, ulid.Make())
+		require.ErrorIs(t, err, message.ErrNotFound)
+	})
+	t.Run("GetByIDs", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		a := newMessage(t, r, acct, "a")
+		b := newMessage(t, r, acct, "b")
+
+		msgs, err := r.Messages.GetByIDs(ctx, b.ID_, ulid.Make(), a.ID_)
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+		require.Equal(t, b.ID_, msgs[0].ID_)
+		require.Equal(t, a.ID_, msgs[1].ID_)
+	})
+	t.Run("Flags", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		a := newMessage(t, r, acct, "a", `\Seen`)
+		b := newMessage(t, r, acct, "b")
+		missing := ulid.Make()
+
+		flags, err := r.Messages.GetFlags(ctx, a.ID_, b.ID_, missing)
+		require.NoError(t, err)
+		require.Len(t, flags, 2)
+		require.Equal(t, []string{`\Seen`}, flags[a.ID_])
+		require.Empty(t, flags[b.ID_])
+
+		res, err := r.Messages.UpdateFlags(ctx, message.FlagUpdate{
+			Op:    message.FlagsAdd,
+			Flags: []string{`\seen`, `\Flagged`},
+		}, a.ID_, b.ID_, missing)
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		for _, r := range res {
+			require.True(t, r.Changed)
+			require.False(t, r.Modified)
+		}
+
+		flags, err = r.Messages.GetFlags(ctx, a.ID_, b.ID_)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{`\Seen`, `\Flagged`}, flags[a.ID_])
+		require.ElementsMatch(t, []string{`\seen`, `\Flagged`}, flags[b.ID_])
+
+		res, err = r.Messages.UpdateFlags(ctx, message.FlagUpdate{
+			Op:    message.FlagsRemove,
+			Flags: []string{`\Flagged`, "$Missing"},
+		}, a.ID_)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].Changed)
+		require.Equal(t, []string{`\Seen`}, res[0].Flags)
+
+		// No-op update.
+		res, err = r.Messages.UpdateFlags(ctx, message.FlagUpdate{
+			Op:    message.FlagsReplace,
+			Flags: []string{`\SEEN`},
+		}, a.ID_)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.False(t, res[0].Changed)
+	})
+	t.Run("UnchangedSince", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+		msg := newMessage(t, r, acct, "a")
+
+		for i := 0; i < 2; i++ {
+			ent := changelog.NewMessage(changelog.TypeMessageUpdated, acct.ID_, f.ID_, msg.ID_, &changelog.MessageEntry{UID: 1})
+			require.NoError(t, r.ChangeLog.Create(ctx, ent))
+		}
+
+		unchangedSince := int64(1)
+		upd := message.FlagUpdate{
+			Op:             message.FlagsAdd,
+			Flags:          []string{`\Seen`},
+			UnchangedSince: &unchangedSince,
+		}
+		res, err := r.Messages.UpdateFlags(ctx, upd, msg.ID_)
+		require.NoError(t, err)
+		require.Equal(t, []message.FlagsResult{{
+			ID:       msg.ID_,
+			Flags:    []string{},
+			ModSeq:   2,
+			Modified: true,
+		}}, res)
+
+		// RFC 7162: UNCHANGEDSINCE 0 fails for all messages.
+		unchangedSince = 0
+		res, err = r.Messages.UpdateFlags(ctx, upd, msg.ID_)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].Modified)
+
+		unchangedSince = 2
+		res, err = r.Messages.UpdateFlags(ctx, upd, msg.ID_)
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.True(t, res[0].Changed)
+		require.False(t, res[0].Modified)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+
+		a := newMessage(t, r, acct, "a")
+		b := newMessage(t, r, acct, "b")
+
+		require.NoError(t, r.Messages.DeleteByID(ctx, a.ID_, ulid.Make()))
+		_, err := r.Messages.GetByID(ctx, a.ID_)
+		require.ErrorIs(t, err, message.ErrNotFound)
+		_, err = r.Messages.GetByID(ctx, b.ID_)
+		require.NoError(t, err)
+	})
+	t.Run("DeleteOrphaned", func(t *testing.T) {
+		ctx := context.Background()
+		r := newRepos(t)
+		acct := newAccount(t, r, "test")
+		f := newFolder(t, r, acct, nil, "INBOX")
+
+		used := newMessage(t, r, acct, "a")
+		orphaned := newMessage(t, r, acct, "b")
+		require.NoError(t, r.Folders.CreateEntry(ctx, folder.NewEntry(f.ID_, used.ID_, 1)))
+
+		deleted, err := r.Messages.DeleteOrphaned(ctx, time.Now().Add(-time.Minute))
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+
+		deleted, err = r.Messages.DeleteOrphaned(ctx, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, 1, deleted)
+
+		_, err = r.Messages.GetByID(ctx, orphaned.ID_)
+		require.ErrorIs(t, err, message.ErrNotFound)
+		_, err = r.Messages.GetByID(ctx, used.ID_)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,71 @@
+// Package repotest contains the conformance test suite for repository
+// implementations. Each backend runs it from its own tests:
+//
+//	func TestFolderRepo(t *testing.T) {
+//		repotest.RunFolderRepo(t, newRepos)
+//	}
+package repotest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/account"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/stretchr/testify/require"
+)
+
+// Repos is a set of repositories sharing the same storage.
+type Repos struct {
+	Accounts  account.Repo
+	Folders   folder.Repo
+	Messages  message.Repo
+	ChangeLog changelog.Repo
+
+	// Tx runs fn in a transaction all repositories participate in.
+	Tx interface {
+		InTx(ctx context.Context, fn func(ctx context.Context) error) error
+	}
+}
+
+// Factory returns repositories using the new empty storage. Storage
+// should be cleaned up using t.Cleanup.
+type Factory func(t *testing.T) Repos
+
+func newAccount(t *testing.T, r Repos, name string) *account.Account {
+	t.Helper()
+
+	acct, err := account.NewAccount(name)
+	require.NoError(t, err)
+	require.NoError(t, r.Accounts.Create(context.Background(), acct))
+	return acct
+}
+
+func newFolder(t *testing.T, r Repos, acct *account.Account, parent *folder.Folder, name string) *folder.Folder {
+	t.Helper()
+
+	f, err := folder.NewFolder(parent, acct.ID_, name, folder.RoleNone)
+	require.NoError(t, err)
+	require.NoError(t, r.Folders.Create(context.Background(), f))
+	return f
+}
+
+func newMessage(t *testing.T, r Repos, acct *account.Account, body string, flags ...string) *message.Msg {
+	t.Helper()
+
+	msg, err := message.New(&message.NewMsg{
+		AccountID: acct.ID_,
+		Flags:     flags,
+		Content:   &message.ContentData{Type: "text/plain", Size: int64(len(body))},
+		Parts: []message.NewPart{{
+			Path:       message.Path{1},
+			Content:    &message.ContentPartData{Type: "text/plain", Size: uint32(len(body))},
+			InlineBlob: []byte(body),
+		}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, r.Messages.Create(context.Background(), *msg))
+	return msg
+}
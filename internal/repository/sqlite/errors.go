@@ -13,8 +13,9 @@ func IsUniqueConstraintError(err error) bool {
 		return true
 	}
 	var sqlErr sqlite3.Error
-	if errors.As(err, &sqlErr) && errors.Is(sqlErr.ExtendedCode, sqlite3.ErrConstraintUnique) {
-		return true
+	if errors.As(err, &sqlErr) {
+		return errors.Is(sqlErr.ExtendedCode, sqlite3.ErrConstraintUnique) ||
+			errors.Is(sqlErr.ExtendedCode, sqlite3.ErrConstraintPrimaryKey)
 	}
 	return false
 }
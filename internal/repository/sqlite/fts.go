@@ -0,0 +1,84 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// ftsSetup creates the FTS5 index over message_search table if SQLite
+// library is built with FTS5 support (sqlite_fts5 build tag for
+// mattn/go-sqlite3). Otherwise, full-text search falls back to the slow
+// LIKE-based matching.
+//
+// The trigram tokenizer is used since IMAP SEARCH matches substrings, not
+// words. The index only narrows down the set of rows, matches are still
+// checked using LIKE.
+const ftsSetup = `
+CREATE VIRTUAL TABLE message_search_fts USING fts5(
+	from_field, to_field, cc_field, bcc_field, subject, header, body,
+	content='message_search',
+	tokenize='trigram'
+);
+
+CREATE TRIGGER message_search_ai AFTER INSERT ON message_search BEGIN
+	INSERT INTO message_search_fts(rowid, from_field, to_field, cc_field, bcc_field, subject, header, body)
+	VALUES (new.rowid, new.from_field, new.to_field, new.cc_field, new.bcc_field, new.subject, new.header, new.body);
+END;
+
+CREATE TRIGGER message_search_ad AFTER DELETE ON message_search BEGIN
+	INSERT INTO message_search_fts(message_search_fts, rowid, from_field, to_field, cc_field, bcc_field, subject, header, body)
+	VALUES ('delete', old.rowid, old.from_field, old.to_field, old.cc_field, old.bcc_field, old.subject, old.header, old.body);
+END;
+
+INSERT INTO message_search_fts(message_search_fts) VALUES ('rebuild');
+`
+
+// ftsDrop removes the index created by ftsSetup.
+const ftsDrop = `
+DROP TRIGGER IF EXISTS message_search_ai;
+DROP TRIGGER IF EXISTS message_search_ad;
+DROP TABLE message_search_fts;
+`
+
+func (db *DB) setupFTS(ctx context.Context) error {
+	var supported bool
+	err := db.Gorm(ctx).Raw(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Row().Scan(&supported)
+	if err != nil {
+		return err
+	}
+
+	var schema sql.NullString
+	err = db.Gorm(ctx).Raw(`SELECT max(sql) FROM sqlite_master WHERE name = 'message_search_fts'`).Row().Scan(&schema)
+	if err != nil {
+		return err
+	}
+	exists := schema.Valid
+
+	// Index created by older versions uses the unicode61 tokenizer, it
+	// can't be used for substring matching.
+	if exists && supported && !strings.Contains(schema.String, "trigram") {
+		if err := db.Gorm(ctx).Exec(ftsDrop).Error; err != nil {
+			return err
+		}
+		exists = false
+	}
+
+	switch {
+	case exists && !supported:
+		return errors.New("sqlite: database has FTS5 index, but SQLite is built without FTS5 support")
+	case !exists && supported:
+		if err := db.Gorm(ctx).Exec(ftsSetup).Error; err != nil {
+			return err
+		}
+	}
+
+	db.fts5 = supported
+	return nil
+}
+
+// FTS5 reports whether message_search_fts index is available.
+func (db DB) FTS5() bool {
+	return db.fts5
+}
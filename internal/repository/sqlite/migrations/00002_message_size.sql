@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE messages ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+
+UPDATE messages SET size = coalesce(json_extract(CAST(content AS TEXT), '$.size'), 0);
+
+CREATE INDEX folder_entries_message_id ON folder_entries(message_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX folder_entries_message_id;
+
+ALTER TABLE messages DROP COLUMN size;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Text extracted from messages for the full-text search. FTS5 index over
+-- this table is created separately if SQLite is built with FTS5 support,
+-- see fts.go.
+CREATE TABLE message_search (
+    message_id BLOB NOT NULL UNIQUE
+        REFERENCES messages(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    from_field TEXT NOT NULL DEFAULT '',
+    to_field TEXT NOT NULL DEFAULT '',
+    cc_field TEXT NOT NULL DEFAULT '',
+    bcc_field TEXT NOT NULL DEFAULT '',
+    subject TEXT NOT NULL DEFAULT '',
+    header TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL DEFAULT ''
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS message_search_ai;
+DROP TRIGGER IF EXISTS message_search_ad;
+DROP TABLE IF EXISTS message_search_fts;
+DROP TABLE message_search;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE changelog_entries (
+    at TIMESTAMP NOT NULL,
+    type TEXT NOT NULL,
+    account_id BLOB NOT NULL,
+    folder_id BLOB,
+    message_id BLOB,
+    meta BLOB NOT NULL,
+    data BLOB
+);
+CREATE INDEX changelog_entries_account_id ON changelog_entries(account_id, at);
+CREATE INDEX changelog_entries_folder_id ON changelog_entries(folder_id, at);
+CREATE INDEX changelog_entries_message_id ON changelog_entries(message_id, at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE changelog_entries;
+-- +goose StatementEnd
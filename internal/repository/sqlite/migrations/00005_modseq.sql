@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Modification sequences are allocated from the per-account counter
+-- (accounts.modseq) by changelog repository, folder and message rows hold
+-- modseq of the latest change.
+ALTER TABLE accounts ADD COLUMN modseq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE folders ADD COLUMN modseq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN modseq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE changelog_entries ADD COLUMN modseq INTEGER NOT NULL DEFAULT 0;
+
+-- Existing entries are numbered in the order of their timestamps.
+UPDATE changelog_entries SET modseq = (
+    SELECT numbered.n FROM (
+        SELECT rowid AS id, row_number() OVER (PARTITION BY account_id ORDER BY at, rowid) AS n
+        FROM changelog_entries
+    ) AS numbered
+    WHERE numbered.id = changelog_entries.rowid
+);
+UPDATE accounts SET modseq = coalesce(
+    (SELECT max(modseq) FROM changelog_entries WHERE account_id = accounts.id), 0);
+UPDATE folders SET modseq = coalesce(
+    (SELECT max(modseq) FROM changelog_entries WHERE folder_id = folders.id), 0);
+UPDATE messages SET modseq = coalesce(
+    (SELECT max(modseq) FROM changelog_entries WHERE message_id = messages.id), 0);
+
+DROP INDEX changelog_entries_account_id;
+DROP INDEX changelog_entries_folder_id;
+DROP INDEX changelog_entries_message_id;
+CREATE UNIQUE INDEX changelog_entries_account_id ON changelog_entries(account_id, modseq);
+CREATE INDEX changelog_entries_folder_id ON changelog_entries(folder_id, modseq);
+CREATE INDEX changelog_entries_message_id ON changelog_entries(message_id, modseq);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX changelog_entries_account_id;
+DROP INDEX changelog_entries_folder_id;
+DROP INDEX changelog_entries_message_id;
+CREATE INDEX changelog_entries_account_id ON changelog_entries(account_id, at);
+CREATE INDEX changelog_entries_folder_id ON changelog_entries(folder_id, at);
+CREATE INDEX changelog_entries_message_id ON changelog_entries(message_id, at);
+
+ALTER TABLE changelog_entries DROP COLUMN modseq;
+ALTER TABLE messages DROP COLUMN modseq;
+ALTER TABLE folders DROP COLUMN modseq;
+ALTER TABLE accounts DROP COLUMN modseq;
+-- +goose StatementEnd
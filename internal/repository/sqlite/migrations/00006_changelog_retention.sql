@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Highest modification sequence of pruned changelog entries, changes
+-- since lower values cannot be calculated.
+ALTER TABLE accounts ADD COLUMN pruned_modseq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE folders ADD COLUMN pruned_modseq INTEGER NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE folders DROP COLUMN pruned_modseq;
+ALTER TABLE accounts DROP COLUMN pruned_modseq;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Reference counts of external blobs. Blobs are content-addressed, so the
+-- same blob can be used by parts of many messages. Unused rows are
+-- removed together with blobs by the garbage collector.
+CREATE TABLE blobs (
+    id TEXT NOT NULL PRIMARY KEY,
+    refcount INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    CHECK(refcount >= 0)
+) WITHOUT ROWID;
+
+CREATE INDEX blobs_unused ON blobs(updated_at) WHERE refcount = 0;
+
+INSERT INTO blobs (id, refcount)
+SELECT external_blob_id, count(*) FROM message_parts
+WHERE external_blob_id IS NOT NULL AND external_blob_id != ''
+GROUP BY external_blob_id;
+
+CREATE TRIGGER blobs_ref AFTER INSERT ON message_parts
+WHEN new.external_blob_id IS NOT NULL AND new.external_blob_id != '' BEGIN
+    INSERT INTO blobs (id, refcount) VALUES (new.external_blob_id, 1)
+    ON CONFLICT (id) DO UPDATE SET refcount = refcount + 1, updated_at = CURRENT_TIMESTAMP;
+END;
+
+CREATE TRIGGER blobs_unref AFTER DELETE ON message_parts
+WHEN old.external_blob_id IS NOT NULL AND old.external_blob_id != '' BEGIN
+    UPDATE blobs SET refcount = refcount - 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = old.external_blob_id;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER blobs_unref;
+DROP TRIGGER blobs_ref;
+DROP TABLE blobs;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Compression codec of the part body, empty if stored as is.
+ALTER TABLE message_parts ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE message_parts DROP COLUMN codec;
+-- +goose StatementEnd
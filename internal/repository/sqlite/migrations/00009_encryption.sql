@@ -0,0 +1,54 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Per-account data keys encrypted by the master key.
+CREATE TABLE account_keys (
+    account_id BLOB NOT NULL
+        REFERENCES accounts(id)
+            ON UPDATE CASCADE ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    wrapped BLOB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY(account_id, version),
+    CHECK(version > 0)
+) WITHOUT ROWID;
+
+-- Messages are encrypted using keys of the account they belong to.
+ALTER TABLE messages ADD COLUMN account_id BLOB DEFAULT NULL;
+UPDATE messages SET account_id = (
+    SELECT folders.account_id FROM folder_entries
+    JOIN folders ON folders.id = folder_entries.folder_id
+    WHERE folder_entries.message_id = messages.id
+    LIMIT 1
+);
+
+-- Key version used for messages.meta, messages.content and
+-- message_parts.content, 0 if not encrypted.
+ALTER TABLE messages ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX messages_account_id ON messages(account_id, key_version);
+
+-- Key version used for the part body (inline or external), 0 if not
+-- encrypted.
+ALTER TABLE message_parts ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
+
+-- Re-encrypted parts are stored in new blobs.
+CREATE TRIGGER blobs_reref AFTER UPDATE OF external_blob_id ON message_parts
+WHEN old.external_blob_id IS NOT new.external_blob_id BEGIN
+    UPDATE blobs SET refcount = refcount - 1, updated_at = CURRENT_TIMESTAMP
+    WHERE id = old.external_blob_id;
+    INSERT INTO blobs (id, refcount)
+    SELECT new.external_blob_id, 1
+    WHERE new.external_blob_id IS NOT NULL AND new.external_blob_id != ''
+    ON CONFLICT (id) DO UPDATE SET refcount = refcount + 1, updated_at = CURRENT_TIMESTAMP;
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER blobs_reref;
+ALTER TABLE message_parts DROP COLUMN key_version;
+DROP INDEX messages_account_id;
+ALTER TABLE messages DROP COLUMN key_version;
+ALTER TABLE messages DROP COLUMN account_id;
+DROP TABLE account_keys;
+-- +goose StatementEnd
@@ -0,0 +1,49 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	changelogsqlite "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/sqlite"
+	foldersqlite "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/sqlite"
+	messagesqlite "github.com/foxcpp/maddy-storage/internal/domain/message/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/repository/repotest"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+func newRepos(t *testing.T) repotest.Repos {
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sqlDB, err := db.SQL()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return repotest.Repos{
+		Accounts:  accountsqlite.New(db),
+		Folders:   foldersqlite.New(db),
+		Messages:  messagesqlite.New(db),
+		ChangeLog: changelogsqlite.New(db),
+		Tx:        db,
+	}
+}
+
+func TestAccountRepo(t *testing.T) {
+	repotest.RunAccountRepo(t, newRepos)
+}
+
+func TestFolderRepo(t *testing.T) {
+	repotest.RunFolderRepo(t, newRepos)
+}
+
+func TestMessageRepo(t *testing.T) {
+	repotest.RunMessageRepo(t, newRepos)
+}
+
+func TestChangeLogRepo(t *testing.T) {
+	repotest.RunChangeLogRepo(t, newRepos)
+}
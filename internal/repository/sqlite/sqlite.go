@@ -16,7 +16,8 @@ type Cfg struct {
 }
 
 type DB struct {
-	db *gorm.DB
+	db   *gorm.DB
+	fts5 bool
 }
 
 func New(path string, cfg Cfg) (DB, error) {
@@ -38,19 +39,41 @@ func New(path string, cfg Cfg) (DB, error) {
 	if err := ret.migrationsUp(context.Background()); err != nil {
 		return DB{}, err
 	}
+	if err := ret.setupFTS(context.Background()); err != nil {
+		return DB{}, err
+	}
 
 	return ret, nil
 }
 
 func (db DB) Tx(ctx context.Context, readOnly bool, fn func(tx DB) error) error {
 	return db.Gorm(ctx).Transaction(func(tx *gorm.DB) error {
-		return fn(DB{db: tx})
+		return fn(DB{db: tx, fts5: db.fts5})
 	}, &sql.TxOptions{
 		ReadOnly: readOnly,
 	})
 }
 
+type txKey struct{}
+
+// InTx runs fn in a transaction. All repositories using the DB with the
+// context passed to fn participate in this transaction. Nested InTx calls
+// reuse the outer transaction.
+func (db DB) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return fn(ctx)
+	}
+	return db.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// Gorm returns the handle for queries, bound to the transaction started
+// by InTx if there is one in ctx.
 func (db DB) Gorm(ctx context.Context) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
 	return db.db.WithContext(ctx)
 }
 
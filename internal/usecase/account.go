@@ -26,13 +26,15 @@ type Account struct {
 	repo      account.Repo
 	auth      Auth
 	changeLog changelog.Repo
+	tx        Transactor
 }
 
-func NewAccount(repo account.Repo, auth Auth, changeLog changelog.Repo) Account {
+func NewAccount(repo account.Repo, auth Auth, changeLog changelog.Repo, tx Transactor) Account {
 	return Account{
 		repo:      repo,
 		auth:      auth,
 		changeLog: changeLog,
+		tx:        tx,
 	}
 }
 
@@ -50,7 +52,14 @@ func (a Account) Create(ctx context.Context, name string) (*account.Account, err
 		return nil, err
 	}
 
-	if err := a.repo.Create(ctx, acct); err != nil {
+	err = a.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := a.repo.Create(ctx, acct); err != nil {
+			return err
+		}
+		return a.changeLog.Create(ctx, changelog.NewAccount(
+			changelog.TypeAccountCreated, acct.ID_, &changelog.AccountEntry{}))
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -58,17 +67,28 @@ func (a Account) Create(ctx context.Context, name string) (*account.Account, err
 }
 
 func (a Account) DeleteByName(ctx context.Context, name string) (ulid.ULID, error) {
-	acct, err := a.repo.GetByName(ctx, name)
-	if err != nil {
-		return ulid.ULID{}, err
-	}
-
-	err = a.repo.Delete(ctx, acct.ID_)
+	var id ulid.ULID
+	err := a.tx.InTx(ctx, func(ctx context.Context) error {
+		acct, err := a.repo.GetByName(ctx, name)
+		if err != nil {
+			return err
+		}
+		id = acct.ID_
+
+		// Entry is created first, modification sequence is allocated from
+		// the account counter.
+		err = a.changeLog.Create(ctx, changelog.NewAccount(
+			changelog.TypeAccountDeleted, acct.ID_, &changelog.AccountEntry{}))
+		if err != nil {
+			return err
+		}
+		return a.repo.Delete(ctx, acct.ID_)
+	})
 	if err != nil {
 		return ulid.ULID{}, err
 	}
 
-	return acct.ID_, nil
+	return id, nil
 }
 
 func (a Account) AuthPlain(ctx context.Context, username, password string) (ulid.ULID, error) {
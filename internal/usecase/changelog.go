@@ -0,0 +1,51 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"go.uber.org/zap"
+)
+
+type ChangeLog struct {
+	repo changelog.Repo
+}
+
+func NewChangeLog(repo changelog.Repo) ChangeLog {
+	return ChangeLog{repo: repo}
+}
+
+// RetentionPolicy limits the changelog size. Zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAge time.Duration
+	// Maximum amount of entries kept for each account.
+	MaxEntries int
+}
+
+// Prune compacts the changelog and removes entries according to the
+// policy. Clients that need pruned changes will have to do a full resync.
+func (c ChangeLog) Prune(ctx context.Context, policy RetentionPolicy) (compacted, pruned int, err error) {
+	log := contextlog.FromContext(ctx)
+
+	compacted, err = c.repo.Compact(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var olderThan time.Time
+	if policy.MaxAge != 0 {
+		olderThan = time.Now().Add(-policy.MaxAge)
+	}
+	if !olderThan.IsZero() || policy.MaxEntries != 0 {
+		pruned, err = c.repo.Prune(ctx, olderThan, policy.MaxEntries)
+		if err != nil {
+			return compacted, 0, err
+		}
+	}
+
+	log.Info("pruned changelog", zap.Int("compacted", compacted), zap.Int("pruned", pruned))
+
+	return compacted, pruned, nil
+}
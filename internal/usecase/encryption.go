@@ -0,0 +1,148 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+type Encryption struct {
+	keyring *datakey.Keyring
+	msgRepo message.Repo
+	blobs   blob.Store
+}
+
+// NewEncryption creates the Encryption usecase. msg should be the
+// repository that encrypts messages using keyring.
+func NewEncryption(keyring *datakey.Keyring, msg message.Repo, blobs blob.Store) Encryption {
+	return Encryption{
+		keyring: keyring,
+		msgRepo: msg,
+		blobs:   blobs,
+	}
+}
+
+// reencryptBatchSize is the amount of messages loaded into memory at once
+// by RotateKey.
+const reencryptBatchSize = 64
+
+// RotateKey creates a new data key for the account and re-encrypts all
+// account messages using it. Replaced blobs are removed by the garbage
+// collector.
+//
+// Old keys are kept, messages appended concurrently might still use them.
+func (e Encryption) RotateKey(ctx context.Context, accountID ulid.ULID) (version int, reencrypted int, err error) {
+	log := contextlog.FromContext(ctx)
+
+	version, err = e.keyring.Rotate(ctx, accountID)
+	if err != nil {
+		return 0, 0, err
+	}
+	key, err := e.keyring.Key(ctx, accountID, version)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	log.Info("created new data key", zap.Stringer("account_id", accountID), zap.Int("version", version))
+
+	seen := make(map[ulid.ULID]struct{})
+	for {
+		ids, err := e.msgRepo.GetIDsByOldKey(ctx, accountID, version, reencryptBatchSize)
+		if err != nil {
+			return version, reencrypted, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			if _, ok := seen[id]; ok {
+				// Repository does not encrypt messages.
+				return version, reencrypted, storeerrors.InternalError{Reason: fmt.Errorf("message %v was not re-encrypted", id)}
+			}
+			seen[id] = struct{}{}
+		}
+
+		msgs, err := e.msgRepo.GetByIDs(ctx, ids...)
+		if err != nil {
+			return version, reencrypted, err
+		}
+		for i := range msgs {
+			if err := e.reencryptParts(ctx, &msgs[i], version, key); err != nil {
+				return version, reencrypted, err
+			}
+		}
+		// CONSISTENCY: Messages deleted concurrently are skipped by the
+		// repository.
+		if err := e.msgRepo.Reencrypt(ctx, msgs...); err != nil {
+			return version, reencrypted, err
+		}
+		reencrypted += len(msgs)
+	}
+
+	log.Info("re-encrypted messages", zap.Stringer("account_id", accountID), zap.Int("count", reencrypted))
+
+	return version, reencrypted, nil
+}
+
+func (e Encryption) reencryptParts(ctx context.Context, msg *message.Msg, version int, key []byte) error {
+	for i := range msg.Parts_ {
+		p := &msg.Parts_[i]
+		if p.Inline_ == nil && p.ExternalBlobID_ == "" {
+			continue // multipart
+		}
+		if p.KeyVersion_ == version {
+			continue
+		}
+
+		data := p.Inline_
+		if p.ExternalBlobID_ != "" {
+			if e.blobs == nil {
+				return storeerrors.InternalError{Reason: fmt.Errorf("part %v is stored externally, but no blob store is configured", p.ID_)}
+			}
+			r, err := e.blobs.Open(ctx, p.ExternalBlobID_)
+			if err != nil {
+				return storeerrors.InternalError{Reason: fmt.Errorf("part %v: %w", p.ID_, err)}
+			}
+			data, err = io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return storeerrors.InternalError{Reason: fmt.Errorf("part %v: %w", p.ID_, err)}
+			}
+		}
+
+		if p.KeyVersion_ != 0 {
+			oldKey, err := e.keyring.Key(ctx, msg.AccountID_, p.KeyVersion_)
+			if err != nil {
+				return err
+			}
+			data, err = crypt.Open(oldKey, data, nil)
+			if err != nil {
+				return storeerrors.InternalError{Reason: fmt.Errorf("part %v: %w", p.ID_, err)}
+			}
+		}
+
+		data, err := crypt.SealDeterministic(key, data, nil)
+		if err != nil {
+			return storeerrors.InternalError{Reason: err}
+		}
+		if p.ExternalBlobID_ != "" {
+			p.ExternalBlobID_, err = blob.Put(ctx, e.blobs, data)
+			if err != nil {
+				return storeerrors.InternalError{Reason: err}
+			}
+		} else {
+			p.Inline_ = data
+		}
+		p.KeyVersion_ = version
+	}
+	return nil
+}
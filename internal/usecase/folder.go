@@ -3,6 +3,7 @@ package usecase
 import (
 	"context"
 	"errors"
+	"math"
 	"strings"
 
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
@@ -13,11 +14,22 @@ import (
 
 type Folder struct {
 	repo      folder.Repo
+	searcher  folder.Searcher
 	changeLog changelog.Repo
+	tx        Transactor
+	messages  *Message
 }
 
-func NewFolder(repo folder.Repo, changeLog changelog.Repo) Folder {
-	return Folder{repo: repo, changeLog: changeLog}
+func NewFolder(repo folder.Repo, searcher folder.Searcher, changeLog changelog.Repo, tx Transactor) Folder {
+	return Folder{repo: repo, searcher: searcher, changeLog: changeLog, tx: tx}
+}
+
+// WithEncryption returns the Folder that matches text conditions against
+// encrypted messages by decrypting them using messages. Text of encrypted
+// messages is not indexed.
+func (f Folder) WithEncryption(messages Message) Folder {
+	f.messages = &messages
+	return f
 }
 
 type ListOpts struct {
@@ -26,10 +38,11 @@ type ListOpts struct {
 
 	CheckChildren bool
 
-	CountMsgs    bool
-	CountDeleted bool
-	CountUnseen  bool
-	CountSize    bool
+	CountMsgs        bool
+	CountDeleted     bool
+	CountUnseen      bool
+	CountSize        bool
+	CountDeletedSize bool
 
 	SortAsTree bool
 }
@@ -44,6 +57,7 @@ type FolderData struct {
 	DeletedMsgs int
 	UnseenMsgs  int
 	Size        int64
+	DeletedSize int64
 }
 
 func (f Folder) List(ctx context.Context, accountID ulid.ULID, opts *ListOpts, order folder.Order) ([]FolderData, error) {
@@ -84,17 +98,18 @@ func (f Folder) List(ctx context.Context, accountID ulid.ULID, opts *ListOpts, o
 			data.HasChildren = cnt != 0
 		}
 
-		if opts.CountMsgs {
-			panic("not implemented") // TODO: implement me
-		}
-		if opts.CountDeleted {
-			panic("not implemented") // TODO: implement me
-		}
-		if opts.CountUnseen {
-			panic("not implemented") // TODO: implement me
-		}
-		if opts.CountSize {
-			panic("not implemented") // TODO: implement me
+		if opts.CountMsgs || opts.CountDeleted || opts.CountUnseen || opts.CountSize || opts.CountDeletedSize {
+			// All counters are computed by a single query, so there is no
+			// point in requesting them separately.
+			stats, err := f.repo.GetStats(ctx, fold.ID_)
+			if err != nil {
+				return nil, err
+			}
+			data.Msgs = stats.Msgs
+			data.DeletedMsgs = stats.DeletedMsgs
+			data.UnseenMsgs = stats.UnseenMsgs
+			data.Size = stats.Size
+			data.DeletedSize = stats.DeletedSize
 		}
 
 		dataList[i] = data
@@ -102,6 +117,8 @@ func (f Folder) List(ctx context.Context, accountID ulid.ULID, opts *ListOpts, o
 
 	if opts.SortAsTree {
 		folder.SortAsTree(dataList, func(i int) ulid.ULID {
+			return dataList[i].Folder.ID_
+		}, func(i int) ulid.ULID {
 			return dataList[i].Folder.ParentID_
 		}, func(i int, j int) bool {
 			return order.Less(&dataList[i].Folder, &dataList[j].Folder)
@@ -111,7 +128,61 @@ func (f Folder) List(ctx context.Context, accountID ulid.ULID, opts *ListOpts, o
 	return dataList, nil
 }
 
+// Open returns the folder together with all of its entries ordered by UID.
+func (f Folder) Open(ctx context.Context, accountID ulid.ULID, path string) (*folder.Folder, []folder.Entry, error) {
+	var (
+		fold    *folder.Folder
+		entries []folder.Entry
+	)
+	err := f.repo.Tx(ctx, true, func(r folder.Repo) error {
+		var err error
+		fold, err = r.GetByPath(ctx, accountID, path)
+		if err != nil {
+			return err
+		}
+
+		entries, err = r.GetEntryByUIDRange(ctx, fold.ID_, folder.UIDRange{Since: 1, Until: math.MaxUint32})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fold, entries, nil
+}
+
+// Search returns entries of the account folders matching cond.
+func (f Folder) Search(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond) ([]folder.Entry, error) {
+	if f.messages == nil || !cond.HasText() {
+		return f.searcher.Search(ctx, accountID, cond)
+	}
+	return f.searchEncrypted(ctx, accountID, cond)
+}
+
+// SearchMsgIDs returns IDs of messages referenced by matching entries of the
+// account folders ordered by order and then by ID. At most limit IDs are
+// returned, 0 means no limit.
+func (f Folder) SearchMsgIDs(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond, order []folder.SearchOrder, limit int) ([]ulid.ULID, error) {
+	if f.messages == nil || !cond.HasText() {
+		return f.searcher.SearchMsgIDs(ctx, accountID, cond, order, limit)
+	}
+	return f.searchEncryptedMsgIDs(ctx, accountID, cond, order, limit)
+}
+
 func (f Folder) Create(ctx context.Context, accountID ulid.ULID, path string, role folder.Role) (*folder.Folder, error) {
+	var created *folder.Folder
+	err := f.tx.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		created, err = f.create(ctx, accountID, path, role)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (f Folder) create(ctx context.Context, accountID ulid.ULID, path string, role folder.Role) (*folder.Folder, error) {
 	var parent *folder.Folder
 	name := path
 	if strings.Contains(path, folder.PathSeparator) {
@@ -125,7 +196,7 @@ func (f Folder) Create(ctx context.Context, accountID ulid.ULID, path string, ro
 			}
 
 			// TODO: Limit recursion
-			parent, err = f.Create(ctx, accountID, parentPath, folder.RoleNone)
+			parent, err = f.create(ctx, accountID, parentPath, folder.RoleNone)
 			if err != nil {
 				return nil, err
 			}
@@ -140,6 +211,12 @@ func (f Folder) Create(ctx context.Context, accountID ulid.ULID, path string, ro
 	if err := f.repo.Create(ctx, newFolder); err != nil {
 		return nil, err
 	}
+	err = f.changeLog.Create(ctx, changelog.NewFolder(
+		changelog.TypeFolderCreated, accountID, newFolder.ID_,
+		&changelog.FolderEntry{NewName: newFolder.Path_}))
+	if err != nil {
+		return nil, err
+	}
 
 	return newFolder, nil
 }
@@ -148,10 +225,32 @@ func (f Folder) Rename(ctx context.Context, accountID ulid.ULID, oldPath, newPat
 	if oldPath == newPath {
 		return nil, nil
 	}
-	if strings.HasPrefix(newPath, oldPath) {
+	if strings.HasPrefix(newPath, oldPath+folder.PathSeparator) {
 		return nil, storeerrors.LogicError{Text: "cannot move folder into itself"}
 	}
 
+	var renamed []folder.RenamedFolder
+	err := f.tx.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		renamed, err = f.rename(ctx, accountID, oldPath, newPath)
+		if err != nil {
+			return err
+		}
+
+		entries := make([]*changelog.Entry, len(renamed))
+		for i, r := range renamed {
+			entries[i] = changelog.NewFolder(changelog.TypeFolderRenamed, accountID, r.ID,
+				&changelog.FolderEntry{OldName: r.OldPath, NewName: r.NewPath})
+		}
+		return f.changeLog.Create(ctx, entries...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renamed, nil
+}
+
+func (f Folder) rename(ctx context.Context, accountID ulid.ULID, oldPath, newPath string) ([]folder.RenamedFolder, error) {
 	var oldParent *folder.Folder
 	oldName := oldPath
 	if strings.Contains(oldPath, folder.PathSeparator) {
@@ -177,7 +276,7 @@ func (f Folder) Rename(ctx context.Context, accountID ulid.ULID, oldPath, newPat
 			}
 
 			// TODO: Limit recursion
-			newParent, err = f.Create(ctx, accountID, parentPath, folder.RoleNone)
+			newParent, err = f.create(ctx, accountID, parentPath, folder.RoleNone)
 			if err != nil {
 				return nil, err
 			}
@@ -192,6 +291,65 @@ func (f Folder) Rename(ctx context.Context, accountID ulid.ULID, oldPath, newPat
 }
 
 func (f Folder) Delete(ctx context.Context, accountID ulid.ULID, recursive bool, path string) ([]folder.DeletedFolder, error) {
+	var deleted []folder.DeletedFolder
+	err := f.tx.InTx(ctx, func(ctx context.Context) error {
+		msgEntries, err := f.treeEntries(ctx, accountID, recursive, path)
+		if err != nil {
+			return err
+		}
+		deleted, err = f.delete(ctx, accountID, recursive, path)
+		if err != nil {
+			return err
+		}
+
+		// Messages are removed together with folders, record it so
+		// clients tracking messages across folders can notice.
+		entries := make([]*changelog.Entry, 0, len(msgEntries)+len(deleted))
+		for _, ent := range msgEntries {
+			entries = append(entries, changelog.NewMessage(changelog.TypeMessageDeleted, accountID, ent.FolderID_, ent.MsgID_,
+				&changelog.MessageEntry{UID: ent.UID_}))
+		}
+		for _, d := range deleted {
+			entries = append(entries, changelog.NewFolder(changelog.TypeFolderDeleted, accountID, d.ID,
+				&changelog.FolderEntry{OldName: d.Path}))
+		}
+		return f.changeLog.Create(ctx, entries...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// treeEntries returns entries of the folder at path and, if recursive is
+// set, of all its descendants.
+func (f Folder) treeEntries(ctx context.Context, accountID ulid.ULID, recursive bool, path string) ([]folder.Entry, error) {
+	root, err := f.repo.GetByPath(ctx, accountID, path)
+	if err != nil {
+		return nil, err
+	}
+	folders := []folder.Folder{*root}
+	if recursive {
+		prefix := path + folder.PathSeparator
+		children, err := f.repo.GetByAccount(ctx, accountID, folder.Filter{PathPrefix: &prefix}, folder.OrderByName)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, children...)
+	}
+
+	var entries []folder.Entry
+	for _, fold := range folders {
+		folderEntries, err := f.repo.GetEntryByUIDRange(ctx, fold.ID_, folder.UIDRange{Since: 1, Until: math.MaxUint32})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, folderEntries...)
+	}
+	return entries, nil
+}
+
+func (f Folder) delete(ctx context.Context, accountID ulid.ULID, recursive bool, path string) ([]folder.DeletedFolder, error) {
 	if !recursive {
 		deleted, err := f.repo.GetByPath(ctx, accountID, path)
 		if err != nil {
@@ -211,29 +369,86 @@ func (f Folder) Delete(ctx context.Context, accountID ulid.ULID, recursive bool,
 }
 
 func (f Folder) Subscribe(ctx context.Context, accountID ulid.ULID, path string) error {
-	folder, err := f.repo.GetByPath(ctx, accountID, path)
+	return f.setSubscribed(ctx, accountID, path, true)
+}
+
+func (f Folder) Unsubscribe(ctx context.Context, accountID ulid.ULID, path string) error {
+	return f.setSubscribed(ctx, accountID, path, false)
+}
+
+func (f Folder) setSubscribed(ctx context.Context, accountID ulid.ULID, path string, sub bool) error {
+	return f.tx.InTx(ctx, func(ctx context.Context) error {
+		fold, err := f.repo.GetByPath(ctx, accountID, path)
+		if err != nil {
+			return err
+		}
+		if fold.Subscribed_ == sub {
+			return nil
+		}
+
+		fold.SetSubscribed(sub)
+		return f.update(ctx, fold)
+	})
+}
+
+// GetByID returns the folder if it belongs to the account.
+func (f Folder) GetByID(ctx context.Context, accountID, id ulid.ULID) (*folder.Folder, error) {
+	fold, err := f.repo.GetByID(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if fold.AccountID_ != accountID {
+		return nil, folder.ErrNotFound
+	}
+	return fold, nil
+}
 
-	folder.SetSubscribed(true)
+// Vanished returns UIDs of messages removed from the folder after the
+// modification sequence. changelog.ErrTooOld is returned if the changes
+// are no longer available.
+func (f Folder) Vanished(ctx context.Context, accountID, id ulid.ULID, modSeq int64) ([]uint32, error) {
+	if _, err := f.GetByID(ctx, accountID, id); err != nil {
+		return nil, err
+	}
 
-	if err := f.repo.Update(ctx, folder); err != nil {
-		return err
+	changes, err := f.changeLog.GetFolderChanges(ctx, id, modSeq, 0)
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, c := range changes {
+		if c.Type == changelog.TypeMessageDeleted {
+			uids = append(uids, c.Message.UID)
+		}
 	}
-	return nil
+	return uids, nil
 }
 
-func (f Folder) Unsubscribe(ctx context.Context, accountID ulid.ULID, path string) error {
-	folder, err := f.repo.GetByPath(ctx, accountID, path)
+// Update changes mutable properties of the folder using fn.
+func (f Folder) Update(ctx context.Context, accountID, id ulid.ULID, fn func(fold *folder.Folder) error) (*folder.Folder, error) {
+	var fold *folder.Folder
+	err := f.tx.InTx(ctx, func(ctx context.Context) error {
+		var err error
+		fold, err = f.GetByID(ctx, accountID, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(fold); err != nil {
+			return err
+		}
+		return f.update(ctx, fold)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return fold, nil
+}
 
-	folder.SetSubscribed(false)
-
-	if err := f.repo.Update(ctx, folder); err != nil {
+func (f Folder) update(ctx context.Context, fold *folder.Folder) error {
+	if err := f.repo.Update(ctx, fold); err != nil {
 		return err
 	}
-	return nil
+	return f.changeLog.Create(ctx, changelog.NewFolder(
+		changelog.TypeFolderUpdated, fold.AccountID_, fold.ID_,
+		&changelog.FolderEntry{OldName: fold.Path_, NewName: fold.Path_}))
 }
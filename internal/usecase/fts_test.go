@@ -0,0 +1,59 @@
+//go:build sqlite_fts5
+
+package usecase_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchFTS(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+	require.True(t, s.db.FTS5(), "FTS5 index is not used")
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	appendSearchText(t, s, acct.ID_)
+	checkSearchText(t, s, acct.ID_)
+}
+
+func TestSearchFTSUpgrade(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "db.sqlite")
+	s := openEncryptedStore(t, path)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+	appendSearchText(t, s, acct.ID_)
+
+	// Replace the index with the one created by older versions.
+	require.NoError(t, s.db.Gorm(ctx).Exec(`
+		DROP TABLE message_search_fts;
+		CREATE VIRTUAL TABLE message_search_fts USING fts5(
+			from_field, to_field, cc_field, bcc_field, subject, header, body,
+			content='message_search',
+			tokenize='unicode61 remove_diacritics 2'
+		);
+		INSERT INTO message_search_fts(message_search_fts) VALUES ('rebuild');
+	`).Error)
+	sqlDB, err := s.db.SQL()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+
+	s = openEncryptedStore(t, path)
+	var schema string
+	require.NoError(t, s.db.Gorm(ctx).Raw(`SELECT sql FROM sqlite_master WHERE name = 'message_search_fts'`).Row().Scan(&schema))
+	require.Contains(t, schema, "trigram")
+
+	checkSearchText(t, s, acct.ID_)
+}
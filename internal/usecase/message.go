@@ -2,11 +2,19 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"io"
+	"math"
+	"time"
 
+	"github.com/foxcpp/maddy-storage/internal/domain/blob"
 	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
 	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messageparser "github.com/foxcpp/maddy-storage/internal/domain/message/parser"
 	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/oklog/ulid/v2"
 	"go.uber.org/zap"
 )
@@ -15,16 +23,519 @@ type Message struct {
 	folderRepo folder.Repo
 	msgRepo    message.Repo
 	changeLog  changelog.Repo
+	tx         Transactor
+	blobs      blob.Store
+	keys       crypt.Keys
+	parser     messageparser.Parser
 }
 
-func NewMessage(folder folder.Repo, msg message.Repo, changeLog changelog.Repo) Message {
+func NewMessage(folder folder.Repo, msg message.Repo, changeLog changelog.Repo, tx Transactor, blobs blob.Store) Message {
 	return Message{
 		folderRepo: folder,
 		msgRepo:    msg,
 		changeLog:  changeLog,
+		tx:         tx,
+		blobs:      blobs,
+		parser:     messageparser.New(blobs, messageparser.DefaultInlineThreshold),
 	}
 }
 
+// WithCompression returns the Message that compresses part bodies larger
+// than threshold using the named codec. Empty codec disables compression.
+func (m Message) WithCompression(codec string, threshold int) (Message, error) {
+	if codec == "" {
+		m.parser = messageparser.New(m.blobs, messageparser.DefaultInlineThreshold)
+		return m, nil
+	}
+
+	parser, err := messageparser.New(m.blobs, messageparser.DefaultInlineThreshold).WithCompression(codec, threshold)
+	if err != nil {
+		return Message{}, err
+	}
+	m.parser = parser
+	return m, nil
+}
+
+// WithEncryption returns the Message that encrypts part bodies of new
+// messages using account keys. Message repository should encrypt metadata
+// using the same keys.
+func (m Message) WithEncryption(keys crypt.Keys) Message {
+	m.keys = keys
+	return m
+}
+
+// keyFunc returns the function to get keys of the account.
+func (m Message) keyFunc(accountID ulid.ULID) message.KeyFunc {
+	if m.keys == nil {
+		return nil
+	}
+	return func(ctx context.Context, version int) ([]byte, error) {
+		return m.keys.Key(ctx, accountID, version)
+	}
+}
+
+type AppendData struct {
+	Folder *folder.Folder
+	Entry  folder.Entry
+}
+
+// Append parses the message from r and adds it to the folder at path.
+func (m Message) Append(ctx context.Context, accountID ulid.ULID, path string, r io.Reader, flags []string, date time.Time) (*AppendData, error) {
+	log := contextlog.FromContext(ctx)
+
+	fold, err := m.folderRepo.GetByPath(ctx, accountID, path)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := m.parser
+	if m.keys != nil {
+		version, key, err := m.keys.CurrentKey(ctx, accountID)
+		if err != nil {
+			return nil, err
+		}
+		parser = parser.WithKey(version, key)
+	}
+
+	data, err := parser.Parse(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	data.AccountID = accountID
+	data.Date = date
+	data.Flags = uniqueFlags(flags)
+
+	msg, err := message.New(data)
+	if err != nil {
+		return nil, storeerrors.InternalError{Reason: err}
+	}
+
+	// CONSISTENCY: External blobs will be dangling if transaction fails.
+	var entry folder.Entry
+	err = m.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := m.msgRepo.Create(ctx, *msg); err != nil {
+			return err
+		}
+
+		uids, err := m.folderRepo.NextUID(ctx, fold.ID_, 1)
+		if err != nil {
+			// CONSISTENCY: Folder might be gone, will return folder.ErrNotFound
+			return err
+		}
+		entry = folder.NewEntry(fold.ID_, msg.ID_, uids[0])
+		if err := m.folderRepo.CreateEntry(ctx, entry); err != nil {
+			return err
+		}
+
+		return m.changeLog.Create(ctx, changelog.NewMessage(
+			changelog.TypeMessageCreated, accountID, fold.ID_, msg.ID_,
+			&changelog.MessageEntry{UID: entry.UID_, Flags: msg.Flags_}))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("appended message",
+		zap.Stringer("folder_id", fold.ID_), zap.Stringer("msg_id", msg.ID_),
+		zap.Uint32("uid", entry.UID_), zap.Int64("size", msg.Content_.Size))
+
+	return &AppendData{
+		Folder: fold,
+		Entry:  entry,
+	}, nil
+}
+
+func uniqueFlags(flags []string) []string {
+	res := make([]string, 0, len(flags))
+	seen := make(map[string]struct{}, len(flags))
+	for _, f := range flags {
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		res = append(res, f)
+	}
+	return res
+}
+
+// fetchBatchSize is the amount of messages loaded into memory at once by
+// FetchByUID.
+const fetchBatchSize = 64
+
+// FetchByUID calls fn for each message in the UID ranges. Messages are
+// loaded in batches, so fn should not keep references to the passed
+// objects.
+func (m Message) FetchByUID(ctx context.Context, accountID ulid.ULID, folderID ulid.ULID, uids []folder.UIDRange, fn func(ent folder.Entry, msg *message.Msg) error) error {
+	fold, err := m.folderRepo.GetByID(ctx, folderID)
+	if err != nil {
+		return err
+	}
+	if fold.AccountID_ != accountID {
+		return folder.ErrNotFound
+	}
+
+	entries, err := m.folderRepo.GetEntryByUIDRange(ctx, folderID, uids...)
+	if err != nil {
+		return err
+	}
+
+	for len(entries) != 0 {
+		batch := entries
+		if len(batch) > fetchBatchSize {
+			batch = batch[:fetchBatchSize]
+		}
+		entries = entries[len(batch):]
+
+		msgIDs := make([]ulid.ULID, len(batch))
+		for i, ent := range batch {
+			msgIDs[i] = ent.MsgID_
+		}
+		msgs, err := m.msgRepo.GetByIDs(ctx, msgIDs...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[ulid.ULID]*message.Msg, len(msgs))
+		for i := range msgs {
+			byID[msgs[i].ID_] = &msgs[i]
+		}
+
+		for _, ent := range batch {
+			msg, ok := byID[ent.MsgID_]
+			if !ok {
+				// CONSISTENCY: Message was deleted after we fetched entries.
+				continue
+			}
+			if err := fn(ent, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type MessageData struct {
+	Msg *message.Msg
+	// Folder entries referencing the message. Usually there is only one,
+	// COPY creates new messages instead of sharing existing ones.
+	Entries []folder.Entry
+}
+
+// GetByIDs returns the listed messages of the account. Missing messages
+// and ones that are not in any folder are skipped.
+func (m Message) GetByIDs(ctx context.Context, accountID ulid.ULID, ids ...ulid.ULID) ([]MessageData, error) {
+	msgs, err := m.msgRepo.GetByIDs(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := m.folderRepo.GetEntryByMsgID(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	byMsg := make(map[ulid.ULID][]folder.Entry, len(entries))
+	for _, ent := range entries {
+		byMsg[ent.MsgID_] = append(byMsg[ent.MsgID_], ent)
+	}
+
+	res := make([]MessageData, 0, len(msgs))
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.AccountID_ != accountID || len(byMsg[msg.ID_]) == 0 {
+			continue
+		}
+		res = append(res, MessageData{
+			Msg:     msg,
+			Entries: byMsg[msg.ID_],
+		})
+	}
+	return res, nil
+}
+
+type FlagsEntry struct {
+	Entry  folder.Entry
+	Flags  []string
+	ModSeq int64
+}
+
+type FlagsData struct {
+	// Messages that were not changed due to UnchangedSince check failure.
+	Modified []folder.Entry
+	// All other messages, with flags after the update.
+	Updated []FlagsEntry
+	// Subset of Updated that actually had flags changed.
+	Changed []FlagsEntry
+}
+
+// UpdateFlags changes flags for messages in the UID ranges.
+func (m Message) UpdateFlags(ctx context.Context, accountID ulid.ULID, folderID ulid.ULID, uids []folder.UIDRange, upd message.FlagUpdate) (*FlagsData, error) {
+	log := contextlog.FromContext(ctx)
+
+	fold, err := m.folderRepo.GetByID(ctx, folderID)
+	if err != nil {
+		return nil, err
+	}
+	if fold.AccountID_ != accountID {
+		return nil, folder.ErrNotFound
+	}
+
+	var data *FlagsData
+	err = m.tx.InTx(ctx, func(ctx context.Context) error {
+		entries, err := m.folderRepo.GetEntryByUIDRange(ctx, folderID, uids...)
+		if err != nil {
+			return err
+		}
+		msgIDs := make([]ulid.ULID, len(entries))
+		for i, ent := range entries {
+			msgIDs[i] = ent.MsgID_
+		}
+
+		results, err := m.msgRepo.UpdateFlags(ctx, upd, msgIDs...)
+		if err != nil {
+			return err
+		}
+		byID := make(map[ulid.ULID]*message.FlagsResult, len(results))
+		for i := range results {
+			byID[results[i].ID] = &results[i]
+		}
+
+		data = &FlagsData{}
+		var changes []*changelog.Entry
+		for _, ent := range entries {
+			res, ok := byID[ent.MsgID_]
+			if !ok {
+				// CONSISTENCY: Message was deleted after we fetched entries.
+				continue
+			}
+			if res.Modified {
+				data.Modified = append(data.Modified, ent)
+				continue
+			}
+
+			flagsEnt := FlagsEntry{
+				Entry:  ent,
+				Flags:  res.Flags,
+				ModSeq: res.ModSeq,
+			}
+			data.Updated = append(data.Updated, flagsEnt)
+			if res.Changed {
+				data.Changed = append(data.Changed, flagsEnt)
+				changes = append(changes, changelog.NewMessage(
+					changelog.TypeMessageUpdated, accountID, folderID, ent.MsgID_,
+					&changelog.MessageEntry{UID: ent.UID_, Flags: res.Flags}))
+			}
+		}
+
+		if err := m.changeLog.Create(ctx, changes...); err != nil {
+			return err
+		}
+
+		modSeqs := make(map[ulid.ULID]int64, len(changes))
+		for _, c := range changes {
+			modSeqs[c.MessageID] = c.ModSeq
+		}
+		for i, ent := range data.Updated {
+			if modSeq, ok := modSeqs[ent.Entry.MsgID_]; ok {
+				data.Updated[i].ModSeq = modSeq
+			}
+		}
+		for i, ent := range data.Changed {
+			data.Changed[i].ModSeq = modSeqs[ent.Entry.MsgID_]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("updated flags",
+		zap.Stringer("folder_id", folderID),
+		zap.Int("changed", len(data.Changed)), zap.Int("modified", len(data.Modified)))
+
+	return data, nil
+}
+
+// Expunge removes entries for messages with \Deleted flag from the folder.
+// If uids is not nil, only messages in the UID ranges are considered.
+// Removed entries are returned.
+func (m Message) Expunge(ctx context.Context, accountID ulid.ULID, folderID ulid.ULID, uids []folder.UIDRange) ([]folder.Entry, error) {
+	return m.remove(ctx, accountID, folderID, uids, true)
+}
+
+// Delete removes entries in the UID ranges from the folder regardless of
+// flags. Removed entries are returned.
+func (m Message) Delete(ctx context.Context, accountID ulid.ULID, folderID ulid.ULID, uids []folder.UIDRange) ([]folder.Entry, error) {
+	return m.remove(ctx, accountID, folderID, uids, false)
+}
+
+func (m Message) remove(ctx context.Context, accountID ulid.ULID, folderID ulid.ULID, uids []folder.UIDRange, onlyDeleted bool) ([]folder.Entry, error) {
+	log := contextlog.FromContext(ctx)
+
+	fold, err := m.folderRepo.GetByID(ctx, folderID)
+	if err != nil {
+		return nil, err
+	}
+	if fold.AccountID_ != accountID {
+		return nil, folder.ErrNotFound
+	}
+
+	if uids == nil {
+		uids = []folder.UIDRange{{Since: 1, Until: math.MaxUint32}}
+	}
+	entries, err := m.folderRepo.GetEntryByUIDRange(ctx, folderID, uids...)
+	if err != nil {
+		return nil, err
+	}
+	msgIDs := make([]ulid.ULID, len(entries))
+	for i, ent := range entries {
+		msgIDs[i] = ent.MsgID_
+	}
+
+	var flags map[ulid.ULID][]string
+	if onlyDeleted {
+		flags, err = m.msgRepo.GetFlags(ctx, msgIDs...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		expunged []folder.Entry
+		ranges   []folder.UIDRange
+	)
+	for _, ent := range entries {
+		if onlyDeleted && !message.HasFlag(flags[ent.MsgID_], deletedFlag) {
+			continue
+		}
+		expunged = append(expunged, ent)
+		ranges = append(ranges, folder.UIDRange{Since: ent.UID_, Until: ent.UID_})
+	}
+	if len(expunged) == 0 {
+		return nil, nil
+	}
+
+	// CONSISTENCY: \Deleted flag might be removed concurrently, message will be removed anyway.
+	err = m.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := m.folderRepo.DeleteEntryByUIDRange(ctx, folderID, ranges...); err != nil {
+			return err
+		}
+		return m.changeLog.Create(ctx, deletedChanges(accountID, expunged)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages that are no longer referenced are removed later by
+	// CollectGarbage.
+	log.Info("expunged messages", zap.Stringer("folder_id", folderID), zap.Int("count", len(expunged)))
+
+	return expunged, nil
+}
+
+const deletedFlag = `\Deleted`
+
+func deletedChanges(accountID ulid.ULID, entries []folder.Entry) []*changelog.Entry {
+	changes := make([]*changelog.Entry, len(entries))
+	for i, ent := range entries {
+		changes[i] = changelog.NewMessage(changelog.TypeMessageDeleted, accountID, ent.FolderID_, ent.MsgID_,
+			&changelog.MessageEntry{UID: ent.UID_})
+	}
+	return changes
+}
+
+func createdChanges(accountID ulid.ULID, entries []folder.Entry, flags map[ulid.ULID][]string) []*changelog.Entry {
+	changes := make([]*changelog.Entry, len(entries))
+	for i, ent := range entries {
+		changes[i] = changelog.NewMessage(changelog.TypeMessageCreated, accountID, ent.FolderID_, ent.MsgID_,
+			&changelog.MessageEntry{UID: ent.UID_, Flags: flags[ent.MsgID_]})
+	}
+	return changes
+}
+
+// gcGracePeriod is the minimal age of the message before it can be
+// removed by CollectGarbage. Messages are created before folder entries
+// referencing them, so recently created messages might be not referenced
+// yet.
+const gcGracePeriod = time.Hour
+
+// CollectGarbage removes messages that are not referenced by any folder
+// entry and external blobs that are not referenced by any message.
+func (m Message) CollectGarbage(ctx context.Context) (int, error) {
+	log := contextlog.FromContext(ctx)
+
+	deleted, err := m.msgRepo.DeleteOrphaned(ctx, time.Now().Add(-gcGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+	if deleted != 0 {
+		log.Info("removed orphaned messages", zap.Int("count", deleted))
+	}
+
+	if m.blobs == nil {
+		// Keep counters so blobs can be removed once the store is
+		// configured.
+		return deleted, nil
+	}
+
+	// Parser reuses existing blobs, so recently unreferenced blobs might be
+	// used by messages that are not saved yet.
+	blobIDs, err := m.msgRepo.DeleteUnusedBlobs(ctx, time.Now().Add(-gcGracePeriod))
+	if err != nil {
+		return deleted, err
+	}
+	for _, id := range blobIDs {
+		// CONSISTENCY: Blob will be leaked if deletion fails.
+		if err := m.blobs.Delete(ctx, id); err != nil && !errors.Is(err, blob.ErrNotFound) {
+			log.Error("failed to delete blob", zap.String("blob_id", id), zap.Error(err))
+		}
+	}
+	if len(blobIDs) != 0 {
+		log.Info("removed unused blobs", zap.Int("count", len(blobIDs)))
+	}
+
+	return deleted, nil
+}
+
+// RunGarbageCollector calls CollectGarbage every interval until ctx is
+// cancelled. Errors are logged, the next run retries.
+func (m Message) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	log := contextlog.FromContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := m.CollectGarbage(ctx); err != nil {
+			log.Error("garbage collection failed", zap.Error(err))
+		}
+	}
+}
+
+// OpenBody returns the reader for message section contents.
+func (m Message) OpenBody(ctx context.Context, accountID ulid.ULID, body *message.Body) io.ReadCloser {
+	return body.Open(ctx, m.blobs, m.keyFunc(accountID))
+}
+
+// searchText returns the message text to match search conditions against,
+// it is not stored for encrypted messages.
+func (m Message) searchText(ctx context.Context, accountID ulid.ULID, msg *message.Msg) (*message.SearchText, error) {
+	raw, err := msg.Raw()
+	if err != nil {
+		return nil, err
+	}
+	r := m.OpenBody(ctx, accountID, raw)
+	defer r.Close()
+
+	data, err := messageparser.New(nil, 0).Parse(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return data.Search, nil
+}
+
 type CopyData struct {
 	Source        *folder.Folder
 	Target        *folder.Folder
@@ -82,49 +593,46 @@ func (m Message) CopyByUID(ctx context.Context, accountID ulid.ULID, uids []fold
 		// CONSISTENCY: Folder might be gone, will return folder.ErrNotFound
 		return nil, err
 	}
+	// copiedEntries[i] is the source of targetEntries[i].
+	copiedEntries := make([]folder.Entry, 0, len(msgs))
 	targetEntries := make([]folder.Entry, 0, len(msgs))
-	sourceToTargetEnt := make(map[ulid.ULID]*folder.Entry, len(msgs))
-	for i, e := range sourceEntries {
+	for _, e := range sourceEntries {
 		// CONSISTENCY: Some created entries might referer to non-existing messages now.
 		newMsgID, ok := oldToNewMsgID[e.MsgID_]
 		if !ok {
 			log.Info("message disappeared while copy is in progress", zap.Stringer("msg_id", e.MsgID_))
 			continue
 		}
+		copiedEntries = append(copiedEntries, e)
 		targetEntries = append(targetEntries,
-			folder.NewEntry(targetFolder.ID_, newMsgID, targetUIDs[i]))
-		sourceToTargetEnt[e.MsgID_] = &targetEntries[i]
+			folder.NewEntry(targetFolder.ID_, newMsgID, targetUIDs[len(targetEntries)]))
 	}
 
 	log.Debug("created target entries", zap.Stringers("entries", targetEntries))
 
-	// CONSISTENCY: Might create dangling messages if next operation fails, will be GC'ed later.
-	// TODO: Might create messages that include missing external parts. Need to figure out
-	// a way to defend against it.
-	if err := m.msgRepo.Create(ctx, msgs...); err != nil {
-		return nil, err
+	flags := make(map[ulid.ULID][]string, len(msgs))
+	for _, msg := range msgs {
+		flags[msg.ID_] = msg.Flags_
 	}
 
-	if err := m.folderRepo.CreateEntry(ctx, targetEntries...); err != nil {
+	// TODO: Might create messages that include missing external parts. Need to figure out
+	// a way to defend against it.
+	err = m.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := m.msgRepo.Create(ctx, msgs...); err != nil {
+			return err
+		}
+		if err := m.folderRepo.CreateEntry(ctx, targetEntries...); err != nil {
+			return err
+		}
+		return m.changeLog.Create(ctx, createdChanges(accountID, targetEntries, flags)...)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	copyData.SourceEntries = sourceEntries
+	copyData.SourceEntries = copiedEntries
 	copyData.TargetEntries = targetEntries
 
-	if len(copyData.TargetEntries) < len(copyData.SourceEntries) {
-		// Some messages disappeared during copy, need to filter.
-		copyData.SourceEntries = copyData.SourceEntries[:0]
-		copyData.TargetEntries = make([]folder.Entry, 0, len(copyData.TargetEntries))
-		for _, entry := range sourceEntries {
-			targetEnt, ok := sourceToTargetEnt[entry.MsgID_]
-			if !ok {
-				continue
-			}
-			copyData.TargetEntries = append(copyData.TargetEntries, *targetEnt)
-		}
-	}
-
 	log.Info("copied messages", zap.Int("count", len(copyData.TargetEntries)))
 
 	return copyData, nil
@@ -172,7 +680,15 @@ func (m Message) MoveByUID(ctx context.Context, accountID ulid.ULID, uids []fold
 
 	log.Debug("created target entries for move", zap.Stringers("entries", targetEntries))
 
-	if err := m.folderRepo.ReplaceEntries(ctx, sourceEntries, targetEntries); err != nil {
+	err = m.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := m.folderRepo.ReplaceEntries(ctx, sourceEntries, targetEntries); err != nil {
+			return err
+		}
+		changes := deletedChanges(accountID, sourceEntries)
+		changes = append(changes, createdChanges(accountID, targetEntries, nil)...)
+		return m.changeLog.Create(ctx, changes...)
+	})
+	if err != nil {
 		return nil, err
 	}
 
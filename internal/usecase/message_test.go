@@ -0,0 +1,86 @@
+package usecase_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	accountmemory "github.com/foxcpp/maddy-storage/internal/domain/account/repository/memory"
+	changelogmemory "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	foldermemory "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messagememory "github.com/foxcpp/maddy-storage/internal/domain/message/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// vanishingRepo simulates messages removed concurrently with the
+// operation: they are not returned by GetByIDs.
+type vanishingRepo struct {
+	message.Repo
+	gone map[ulid.ULID]bool
+}
+
+func (r vanishingRepo) GetByIDs(ctx context.Context, ids ...ulid.ULID) ([]message.Msg, error) {
+	msgs, err := r.Repo.GetByIDs(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if !r.gone[msg.ID_] {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
+
+func TestCopyByUID(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	folderRepo := foldermemory.New(db)
+	changeLog := changelogmemory.New(db)
+	msgRepo := vanishingRepo{Repo: messagememory.New(db), gone: map[ulid.ULID]bool{}}
+
+	accounts := usecase.NewAccount(accountmemory.New(db), usecase.StubAuth{}, changeLog, db)
+	folders := usecase.NewFolder(folderRepo, foldermemory.NewSearcher(db), changeLog, db)
+	messages := usecase.NewMessage(folderRepo, msgRepo, changeLog, db, nil)
+
+	acct, err := accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	inbox, err := folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+	_, err = folders.Create(ctx, acct.ID_, "Archive", folder.RoleNone)
+	require.NoError(t, err)
+
+	var appended []*usecase.AppendData
+	for _, body := range []string{"first", "second", "third", "fourth"} {
+		data, err := messages.Append(ctx, acct.ID_, "INBOX", strings.NewReader("Subject: "+body+"\r\n\r\n"+body), nil, time.Now())
+		require.NoError(t, err)
+		appended = append(appended, data)
+	}
+
+	// UID 2 is missing and the message with UID 3 disappears during copy.
+	_, err = messages.Delete(ctx, acct.ID_, inbox.ID_, []folder.UIDRange{{Since: 2, Until: 2}})
+	require.NoError(t, err)
+	msgRepo.gone[appended[2].Entry.MsgID_] = true
+
+	res, err := messages.CopyByUID(ctx, acct.ID_, []folder.UIDRange{{Since: 1, Until: 4}}, inbox.ID_, "Archive")
+	require.NoError(t, err)
+	require.Len(t, res.SourceEntries, 2)
+	require.Len(t, res.TargetEntries, 2)
+	require.Equal(t, appended[0].Entry, res.SourceEntries[0])
+	require.Equal(t, appended[3].Entry, res.SourceEntries[1])
+	require.EqualValues(t, 1, res.TargetEntries[0].UID_)
+	require.EqualValues(t, 2, res.TargetEntries[1].UID_)
+
+	copied, err := msgRepo.GetByIDs(ctx, res.TargetEntries[0].MsgID_, res.TargetEntries[1].MsgID_)
+	require.NoError(t, err)
+	require.Len(t, copied, 2)
+	subjects := []string{copied[0].Content_.Envelope.Subject, copied[1].Content_.Envelope.Subject}
+	require.ElementsMatch(t, []string{"first", "fourth"}, subjects)
+}
@@ -0,0 +1,157 @@
+package usecase
+
+import (
+	"context"
+	"sort"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+)
+
+// searchBatch is the number of messages loaded at once to match them.
+const searchBatch = 100
+
+// withoutText returns cond with text conditions removed, it matches a
+// superset of cond matches. Nested conditions are removed as well, they
+// might contain text ones.
+func withoutText(cond *folder.SearchCond) *folder.SearchCond {
+	res := *cond
+	res.Body, res.Text, res.Header = nil, nil, nil
+	res.From, res.To, res.Cc, res.Bcc, res.Subject = nil, nil, nil, nil, nil
+	res.Not, res.Or = nil, nil
+	return &res
+}
+
+// withoutNot returns cond with negated conditions removed, including
+// nested ones, it matches a superset of cond matches.
+func withoutNot(cond *folder.SearchCond) *folder.SearchCond {
+	res := *cond
+	res.Not = nil
+	if cond.Or != nil {
+		res.Or = make([][]*folder.SearchCond, len(cond.Or))
+		for i, group := range cond.Or {
+			res.Or[i] = make([]*folder.SearchCond, len(group))
+			for j, alt := range group {
+				res.Or[i][j] = withoutNot(alt)
+			}
+		}
+	}
+	return &res
+}
+
+// searchEncrypted matches plaintext messages using the search index and
+// encrypted ones by decrypting and parsing them.
+//
+// Searcher text matching is not exactly the same as folder.Match one (e.g.
+// HEADER value is allowed to be in the following fields), so plaintext
+// messages found using the index are checked by folder.Match too, to get
+// the same results regardless of encryption. NOT conditions are not passed
+// to the searcher since its false positives would become false negatives.
+func (f Folder) searchEncrypted(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond) ([]folder.Entry, error) {
+	plaintext, encrypted := false, true
+
+	plainCond := withoutNot(cond)
+	plainCond.Encrypted = &plaintext
+	candidates, err := f.searcher.Search(ctx, accountID, plainCond)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.matchEntries(ctx, accountID, cond, candidates, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Conditions other than text ones are left to narrow down the set of
+	// messages to decrypt.
+	encCond := withoutText(cond)
+	encCond.Encrypted = &encrypted
+	candidates, err = f.searcher.Search(ctx, accountID, encCond)
+	if err != nil {
+		return nil, err
+	}
+	encEntries, err := f.matchEntries(ctx, accountID, cond, candidates, true)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, encEntries...)
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FolderID_ != entries[j].FolderID_ {
+			return entries[i].FolderID_.Compare(entries[j].FolderID_) < 0
+		}
+		return entries[i].UID_ < entries[j].UID_
+	})
+	return entries, nil
+}
+
+// matchEntries returns candidates matching cond, text is extracted from
+// each message.
+func (f Folder) matchEntries(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond, candidates []folder.Entry, encrypted bool) ([]folder.Entry, error) {
+	var entries []folder.Entry
+	for len(candidates) != 0 {
+		batch := candidates
+		if len(batch) > searchBatch {
+			batch = batch[:searchBatch]
+		}
+		candidates = candidates[len(batch):]
+
+		ids := make([]ulid.ULID, len(batch))
+		for i, ent := range batch {
+			ids[i] = ent.MsgID_
+		}
+		msgs, err := f.messages.msgRepo.GetByIDs(ctx, ids...)
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[ulid.ULID]*message.Msg, len(msgs))
+		for i := range msgs {
+			byID[msgs[i].ID_] = &msgs[i]
+		}
+
+		for _, ent := range batch {
+			msg, ok := byID[ent.MsgID_]
+			if !ok {
+				// Removed concurrently.
+				continue
+			}
+			text, err := f.messages.searchText(ctx, accountID, msg)
+			if err != nil {
+				return nil, err
+			}
+			if folder.Match(cond, &ent, msg, text, encrypted) {
+				entries = append(entries, ent)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// searchEncryptedMsgIDs is searchEncrypted for Folder.SearchMsgIDs.
+func (f Folder) searchEncryptedMsgIDs(ctx context.Context, accountID ulid.ULID, cond *folder.SearchCond, order []folder.SearchOrder, limit int) ([]ulid.ULID, error) {
+	entries, err := f.searchEncrypted(ctx, accountID, cond)
+	if err != nil {
+		return nil, err
+	}
+	matched := make(map[ulid.ULID]bool, len(entries))
+	for _, ent := range entries {
+		matched[ent.MsgID_] = true
+	}
+
+	// Searcher cannot match text of encrypted messages, so it orders all
+	// messages matching other conditions.
+	ordered, err := f.searcher.SearchMsgIDs(ctx, accountID, withoutText(cond), order, 0)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ulid.ULID, 0, len(matched))
+	for _, id := range ordered {
+		if limit != 0 && len(ids) == limit {
+			break
+		}
+		if matched[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
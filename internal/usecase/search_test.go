@@ -0,0 +1,397 @@
+package usecase_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	changelogsqlite "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/datakey"
+	datakeysqlite "github.com/foxcpp/maddy-storage/internal/domain/datakey/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	foldersqlite "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/sqlite"
+	messagesqlite "github.com/foxcpp/maddy-storage/internal/domain/message/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/pkg/crypt"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type encryptedStore struct {
+	db       sqlite.DB
+	accounts usecase.Account
+	folders  usecase.Folder
+	messages usecase.Message
+	// plaintext stores messages without encryption, as if they were added
+	// before it was enabled.
+	plaintext usecase.Message
+}
+
+func newEncryptedStore(t *testing.T) encryptedStore {
+	return openEncryptedStore(t, filepath.Join(t.TempDir(), "db.sqlite"))
+}
+
+func openEncryptedStore(t *testing.T, path string) encryptedStore {
+	db, err := sqlite.New(path, sqlite.Cfg{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sqlDB, err := db.SQL()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+	master, err := crypt.NewKey()
+	require.NoError(t, err)
+	keyring := datakey.NewKeyring(datakeysqlite.New(db), master)
+
+	folderRepo := foldersqlite.New(db)
+	changeLog := changelogsqlite.New(db)
+	messages := usecase.NewMessage(folderRepo, messagesqlite.NewEncrypted(db, keyring), changeLog, db, nil).
+		WithEncryption(keyring)
+	return encryptedStore{
+		db:       db,
+		accounts: usecase.NewAccount(accountsqlite.New(db), usecase.StubAuth{}, changeLog, db),
+		folders: usecase.NewFolder(folderRepo, foldersqlite.NewSearcher(db), changeLog, db).
+			WithEncryption(messages),
+		messages:  messages,
+		plaintext: usecase.NewMessage(folderRepo, messagesqlite.New(db), changeLog, db, nil),
+	}
+}
+
+func searchUIDs(t *testing.T, folders usecase.Folder, accountID ulid.ULID, cond *folder.SearchCond) []uint32 {
+	t.Helper()
+
+	entries, err := folders.Search(context.Background(), accountID, cond)
+	require.NoError(t, err)
+	uids := []uint32{}
+	for _, ent := range entries {
+		uids = append(uids, ent.UID_)
+	}
+	return uids
+}
+
+// appendSearchText adds plaintext messages used by TestSearchText.
+func appendSearchText(t *testing.T, s encryptedStore, accountID ulid.ULID) {
+	t.Helper()
+
+	for _, text := range []string{
+		"From: Alice <alice@example.org>\r\nSubject: Unencrypted hello\r\n\r\nsome body",
+		"From: bob@example.org\r\nReply-To: carol@example.net\r\nSubject: bye\r\nX-Tag: red_green\r\nX-Other: blue\r\n\r\nab",
+	} {
+		_, err := s.plaintext.Append(context.Background(), accountID, "INBOX", strings.NewReader(text), nil, time.Now())
+		require.NoError(t, err)
+	}
+}
+
+// checkSearchText checks that text conditions match case-insensitive
+// substrings, as the in-memory matching does.
+func checkSearchText(t *testing.T, s encryptedStore, accountID ulid.ULID) {
+	cases := []struct {
+		name string
+		cond *folder.SearchCond
+		uids []uint32
+	}{
+		{"inside word", &folder.SearchCond{Subject: []string{"ncrypt"}}, []uint32{1}},
+		{"case", &folder.SearchCond{Subject: []string{"UNENCRYPTED"}}, []uint32{1}},
+		{"across words", &folder.SearchCond{Subject: []string{"ted hel"}}, []uint32{1}},
+		{"short", &folder.SearchCond{Body: []string{"ab"}}, []uint32{2}},
+		{"address", &folder.SearchCond{From: []string{"ice@exa"}}, []uint32{1}},
+		{"from only", &folder.SearchCond{From: []string{"carol"}}, []uint32{}},
+		{"other address", &folder.SearchCond{Text: []string{"carol"}}, []uint32{2}},
+		{"text", &folder.SearchCond{Text: []string{"example.org"}}, []uint32{1, 2}},
+		{"header", &folder.SearchCond{Header: []folder.HeaderCond{{Name: "X-Tag", Value: "d_gr"}}}, []uint32{2}},
+		{"header name", &folder.SearchCond{Header: []folder.HeaderCond{{Name: "x-tag"}}}, []uint32{2}},
+		{"wildcard", &folder.SearchCond{Header: []folder.HeaderCond{{Name: "X-Tag", Value: "d_"}}}, []uint32{2}},
+		{"not wildcard", &folder.SearchCond{Subject: []string{"b_e"}}, []uint32{}},
+		{"no match", &folder.SearchCond{Body: []string{"bodies"}}, []uint32{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.uids, searchUIDs(t, s.folders, accountID, c.cond))
+		})
+	}
+}
+
+func TestSearchText(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	appendSearchText(t, s, acct.ID_)
+	checkSearchText(t, s, acct.ID_)
+}
+
+func TestSearchEncryptedSentDate(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	received := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, text := range []string{
+		"Date: Tue, 02 Jan 2024 10:00:00 +0000\r\nSubject: january\r\n\r\nbody",
+		"Date: Thu, 01 Feb 2024 10:00:00 +0000\r\nSubject: february\r\n\r\nbody",
+		"Subject: no date\r\n\r\nbody",
+	} {
+		_, err := s.messages.Append(ctx, acct.ID_, "INBOX", strings.NewReader(text), nil, received)
+		require.NoError(t, err)
+	}
+
+	jan := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, []uint32{1}, searchUIDs(t, s.folders, acct.ID_, &folder.SearchCond{SentSince: jan, SentUntil: feb}))
+	require.Equal(t, []uint32{2}, searchUIDs(t, s.folders, acct.ID_, &folder.SearchCond{SentSince: feb, SentUntil: mar}))
+	// Missing Date field falls back to the internal date.
+	require.Equal(t, []uint32{3}, searchUIDs(t, s.folders, acct.ID_, &folder.SearchCond{SentSince: mar}))
+}
+
+func TestSearchEncryptedText(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	for i, text := range []string{
+		"From: alice@example.org\r\nSubject: plain hello\r\n\r\nunencrypted body",
+		"From: alice@example.org\r\nSubject: secret hello\r\n\r\nencrypted body",
+		"From: bob@example.org\r\nSubject: secret bye\r\nX-Tag: red\r\n\r\nanother body",
+	} {
+		messages := s.messages
+		if i == 0 {
+			messages = s.plaintext
+		}
+		_, err := messages.Append(ctx, acct.ID_, "INBOX", strings.NewReader(text), nil, time.Now())
+		require.NoError(t, err)
+	}
+
+	var indexed int64
+	require.NoError(t, s.db.Gorm(ctx).Table("message_search").Count(&indexed).Error)
+	require.EqualValues(t, 1, indexed, "encrypted message text is indexed")
+
+	cases := []struct {
+		name string
+		cond *folder.SearchCond
+		uids []uint32
+	}{
+		{
+			name: "body",
+			cond: &folder.SearchCond{Body: []string{"encrypted"}},
+			uids: []uint32{1, 2},
+		},
+		{
+			name: "from",
+			cond: &folder.SearchCond{From: []string{"alice"}},
+			uids: []uint32{1, 2},
+		},
+		{
+			name: "header",
+			cond: &folder.SearchCond{Header: []folder.HeaderCond{{Name: "X-Tag", Value: "red"}}},
+			uids: []uint32{3},
+		},
+		{
+			name: "not",
+			cond: &folder.SearchCond{Not: &folder.SearchCond{Subject: []string{"hello"}}},
+			uids: []uint32{3},
+		},
+		{
+			name: "or",
+			cond: &folder.SearchCond{Or: [][]*folder.SearchCond{{
+				{Subject: []string{"plain"}},
+				{Subject: []string{"bye"}},
+			}}},
+			uids: []uint32{1, 3},
+		},
+		{
+			name: "uids",
+			cond: &folder.SearchCond{UIDs: []folder.UIDRange{{Since: 2, Until: 3}}, Text: []string{"secret"}},
+			uids: []uint32{2, 3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.uids, searchUIDs(t, s.folders, acct.ID_, c.cond))
+		})
+	}
+}
+
+// TestSearchEncryptedSame checks that plaintext and encrypted messages are
+// matched the same way.
+func TestSearchEncryptedSame(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	texts := []string{
+		"From: alice@example.org\r\nSubject: Unencrypted hello\r\n\r\nsome body",
+		"From: bob@example.org\r\nSubject: \xc3\x9cber\r\nX-Tag: red\r\nX-Other: blue\r\n\r\nab",
+	}
+	// Plaintext messages get UIDs 1 and 2, encrypted ones 3 and 4.
+	for _, messages := range []usecase.Message{s.plaintext, s.messages} {
+		for _, text := range texts {
+			_, err := messages.Append(ctx, acct.ID_, "INBOX", strings.NewReader(text), nil, time.Now())
+			require.NoError(t, err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		cond *folder.SearchCond
+		uids []uint32
+	}{
+		{"inside word", &folder.SearchCond{Subject: []string{"ENCRYPTED"}}, []uint32{1}},
+		{"short", &folder.SearchCond{Body: []string{"ab"}}, []uint32{2}},
+		{"ascii case only", &folder.SearchCond{Subject: []string{"\xc3\xbcber"}}, []uint32{}},
+		{"non-ascii", &folder.SearchCond{Subject: []string{"\xc3\x9cber"}}, []uint32{2}},
+		{"header", &folder.SearchCond{Header: []folder.HeaderCond{{Name: "x-tag", Value: "RED"}}}, []uint32{2}},
+		{"header other field", &folder.SearchCond{Header: []folder.HeaderCond{{Name: "X-Tag", Value: "blue"}}}, []uint32{}},
+		{"not header other field", &folder.SearchCond{Not: &folder.SearchCond{
+			Header: []folder.HeaderCond{{Name: "X-Tag", Value: "blue"}},
+		}}, []uint32{1, 2}},
+		{"or", &folder.SearchCond{Or: [][]*folder.SearchCond{{
+			{Header: []folder.HeaderCond{{Name: "X-Tag", Value: "blue"}}},
+			{From: []string{"alice"}},
+		}}}, []uint32{1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			uids := append([]uint32{}, c.uids...)
+			for _, uid := range c.uids {
+				uids = append(uids, uid+uint32(len(texts)))
+			}
+			require.Equal(t, uids, searchUIDs(t, s.folders, acct.ID_, c.cond))
+		})
+	}
+}
+
+func TestSearchMsgIDs(t *testing.T) {
+	ctx := context.Background()
+	s := newEncryptedStore(t)
+
+	acct, err := s.accounts.Create(ctx, "test")
+	require.NoError(t, err)
+	_, err = s.folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	var ids []ulid.ULID
+	for i, msg := range []struct {
+		text  string
+		flags []string
+		date  time.Time
+	}{
+		{"Date: Fri, 05 Jan 2024 10:00:00 +0000\r\nSubject: apples\r\n\r\nshort", nil, day(2)},
+		{"Subject: oranges\r\n\r\na somewhat longer body to be in the middle by size", []string{`\Flagged`}, day(1)},
+		{"Date: Wed, 03 Jan 2024 10:00:00 +0000\r\nSubject: apples\r\n\r\nthe longest body of all", nil, day(3)},
+	} {
+		messages := s.messages
+		if i == 0 {
+			messages = s.plaintext
+		}
+		data, err := messages.Append(ctx, acct.ID_, "INBOX", strings.NewReader(msg.text), msg.flags, msg.date)
+		require.NoError(t, err)
+		ids = append(ids, data.Entry.MsgID_)
+	}
+	msgs, err := s.messages.GetByIDs(ctx, acct.ID_, ids[1])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	modSeq := msgs[0].Msg.ModSeq()
+
+	cases := []struct {
+		name  string
+		cond  *folder.SearchCond
+		order []folder.SearchOrder
+		limit int
+		res   []ulid.ULID
+	}{
+		{
+			name:  "received",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortReceived, Desc: true}},
+			res:   []ulid.ULID{ids[2], ids[0], ids[1]},
+		},
+		{
+			name:  "sent",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortSent}},
+			res:   []ulid.ULID{ids[1], ids[2], ids[0]},
+		},
+		{
+			name:  "size",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortSize}},
+			res:   []ulid.ULID{ids[0], ids[1], ids[2]},
+		},
+		{
+			name:  "flag",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortFlag, Flag: `\flagged`, Desc: true}, {Key: folder.SortReceived}},
+			res:   []ulid.ULID{ids[1], ids[0], ids[2]},
+		},
+		{
+			name:  "modseq",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortModSeq, Desc: true}},
+			res:   []ulid.ULID{ids[2], ids[1], ids[0]},
+		},
+		{
+			name:  "modseq since",
+			cond:  &folder.SearchCond{ModSeqSince: modSeq},
+			order: []folder.SearchOrder{{Key: folder.SortModSeq}},
+			res:   []ulid.ULID{ids[1], ids[2]},
+		},
+		{
+			name:  "modseq since text",
+			cond:  &folder.SearchCond{ModSeqSince: modSeq, Subject: []string{"apples"}},
+			order: []folder.SearchOrder{{Key: folder.SortModSeq}},
+			res:   []ulid.ULID{ids[2]},
+		},
+		{
+			name:  "limit",
+			cond:  &folder.SearchCond{},
+			order: []folder.SearchOrder{{Key: folder.SortReceived}},
+			limit: 2,
+			res:   []ulid.ULID{ids[1], ids[0]},
+		},
+		{
+			name:  "text",
+			cond:  &folder.SearchCond{Subject: []string{"apples"}},
+			order: []folder.SearchOrder{{Key: folder.SortSize, Desc: true}},
+			res:   []ulid.ULID{ids[2], ids[0]},
+		},
+		{
+			name:  "text limit",
+			cond:  &folder.SearchCond{Subject: []string{"apples"}},
+			order: []folder.SearchOrder{{Key: folder.SortReceived}},
+			limit: 1,
+			res:   []ulid.ULID{ids[0]},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res, err := s.folders.SearchMsgIDs(ctx, acct.ID_, c.cond, c.order, c.limit)
+			require.NoError(t, err)
+			require.Equal(t, c.res, res)
+		})
+	}
+}
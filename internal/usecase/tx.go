@@ -0,0 +1,9 @@
+package usecase
+
+import "context"
+
+// Transactor runs fn in a transaction shared by all repositories that are
+// called with the context passed to fn.
+type Transactor interface {
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
@@ -63,3 +63,31 @@ func (a AppProvider) deleteAccount(c *cli.Context) error {
 
 	return nil
 }
+
+func (a AppProvider) rotateAccountKey(c *cli.Context) error {
+	app, err := a(c)
+	if err != nil {
+		return err
+	}
+
+	if c.NArg() != 1 {
+		return cli.Exit("Account name is required", 2)
+	}
+	if app.Encryption == nil {
+		return cli.Exit("Encryption is not configured, set --master-key-file", 2)
+	}
+
+	acct, err := app.Accounts.GetByName(c.Context, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	version, reencrypted, err := app.Encryption.RotateKey(c.Context, acct.ID_)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Created key version", version, "and re-encrypted", reencrypted, "messages")
+
+	return nil
+}
@@ -8,9 +8,12 @@ import (
 type AppProvider func(ctx *cli.Context) (App, error)
 
 type App struct {
-	Accounts usecase.Account
-	Folders  usecase.Folder
-	Message  usecase.Message
+	Accounts  usecase.Account
+	Folders   usecase.Folder
+	Message   usecase.Message
+	ChangeLog usecase.ChangeLog
+	// Encryption is nil if encryption is not configured.
+	Encryption *usecase.Encryption
 }
 
 func BuildCommands(provider AppProvider) cli.Commands {
@@ -38,6 +41,13 @@ func BuildCommands(provider AppProvider) cli.Commands {
 					ArgsUsage: "<account name>",
 					Action:    provider.deleteAccount,
 				},
+				{
+					Name:      "rotate-key",
+					Usage:     "Create new data key for an account and re-encrypt its messages",
+					Args:      true,
+					ArgsUsage: "<account name>",
+					Action:    provider.rotateAccountKey,
+				},
 			},
 		},
 		{
@@ -82,9 +92,36 @@ func BuildCommands(provider AppProvider) cli.Commands {
 			},
 		},
 		{
-			Name:        "messages",
-			Usage:       "Messages management",
-			Subcommands: []*cli.Command{},
+			Name:  "messages",
+			Usage: "Messages management",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "gc",
+					Usage:  "Remove messages that are not stored in any folder",
+					Action: provider.collectGarbage,
+				},
+			},
+		},
+		{
+			Name:  "changelog",
+			Usage: "Changelog management",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "prune",
+					Usage: "Compact changelog and remove old entries",
+					Flags: []cli.Flag{
+						&cli.DurationFlag{
+							Name:  "max-age",
+							Usage: "Remove entries older than this",
+						},
+						&cli.IntFlag{
+							Name:  "max-entries",
+							Usage: "Keep at most this many entries for each account",
+						},
+					},
+					Action: provider.pruneChangeLog,
+				},
+			},
 		},
 	}
 }
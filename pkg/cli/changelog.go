@@ -0,0 +1,27 @@
+package storagecli
+
+import (
+	"fmt"
+
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/urfave/cli/v2"
+)
+
+func (a AppProvider) pruneChangeLog(c *cli.Context) error {
+	app, err := a(c)
+	if err != nil {
+		return err
+	}
+
+	compacted, pruned, err := app.ChangeLog.Prune(c.Context, usecase.RetentionPolicy{
+		MaxAge:     c.Duration("max-age"),
+		MaxEntries: c.Int("max-entries"),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Compacted", compacted, "and pruned", pruned, "changelog entries")
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package storagecli
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+func (a AppProvider) collectGarbage(c *cli.Context) error {
+	app, err := a(c)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := app.Message.CollectGarbage(c.Context)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Removed", deleted, "orphaned messages")
+
+	return nil
+}
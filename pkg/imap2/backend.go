@@ -4,12 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"runtime/trace"
+	"sync"
 
 	"github.com/emersion/go-imap/v2"
-	"github.com/emersion/go-imap/v2/imapserver"
 	mess "github.com/foxcpp/go-imap-mess/v2"
 	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
 	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
 	"github.com/oklog/ulid/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -21,6 +22,10 @@ type Config struct {
 
 	TLS          *tls.Config
 	InsecureAuth bool
+
+	// AppendLimit is the maximum size of the message accepted by APPEND,
+	// zero means no limit. It is reported via STATUS APPENDLIMIT.
+	AppendLimit uint32
 }
 
 type Backend struct {
@@ -32,6 +37,11 @@ type Backend struct {
 	messages usecase.Message
 
 	updateManager *mess.Manager[ulid.ULID]
+
+	// Channels closed on the next change reported to updateManager, see
+	// session.Idle.
+	watchLock sync.Mutex
+	watchers  map[ulid.ULID]chan struct{}
 }
 
 func New(
@@ -49,7 +59,77 @@ func New(
 		messages: messages,
 
 		updateManager: mess.NewManager[ulid.ULID](),
+		watchers:      make(map[ulid.ULID]chan struct{}),
+	}
+}
+
+// watchFolder returns the channel that is closed once folderChanged is
+// called for the folder.
+func (b *Backend) watchFolder(folderID ulid.ULID) <-chan struct{} {
+	b.watchLock.Lock()
+	defer b.watchLock.Unlock()
+
+	ch, ok := b.watchers[folderID]
+	if !ok {
+		ch = make(chan struct{})
+		b.watchers[folderID] = ch
+	}
+	return ch
+}
+
+// folderChanged wakes up sessions idling in the folder. It should be called
+// after the change is reported to updateManager.
+func (b *Backend) folderChanged(folderID ulid.ULID) {
+	b.watchLock.Lock()
+	defer b.watchLock.Unlock()
+
+	if ch, ok := b.watchers[folderID]; ok {
+		close(ch)
+		delete(b.watchers, folderID)
+	}
+}
+
+// NewMessages reports messages added to the folder outside of IMAP
+// sessions, e.g. via JMAP.
+func (b *Backend) NewMessages(folderID ulid.ULID, uids []uint32) {
+	b.updateManager.NewMessages(folderID, uidsAsSet(uids))
+	b.folderChanged(folderID)
+}
+
+// FlagsChanged reports the message flags changed outside of IMAP sessions.
+func (b *Backend) FlagsChanged(folderID ulid.ULID, uid uint32, flags []string) {
+	b.updateManager.ExternalUpdate(mess.Update[ulid.ULID]{
+		Type:     mess.UpdFlags,
+		Key:      folderID,
+		SeqSet:   imap.UIDSetNum(imap.UID(uid)),
+		NewFlags: flagsAsIMAP(flags),
+	})
+	b.folderChanged(folderID)
+}
+
+// Removed reports messages removed from the folder outside of IMAP
+// sessions.
+func (b *Backend) Removed(folderID ulid.ULID, uids []uint32) {
+	b.updateManager.ExternalUpdate(mess.Update[ulid.ULID]{
+		Type:   mess.UpdRemoved,
+		Key:    folderID,
+		SeqSet: uidsAsSet(uids),
+	})
+	b.folderChanged(folderID)
+}
+
+// FolderDestroyed reports the folder deleted outside of IMAP sessions.
+func (b *Backend) FolderDestroyed(folderID ulid.ULID) {
+	b.updateManager.MailboxDestroyed(folderID)
+	b.folderChanged(folderID)
+}
+
+func uidsAsSet(uids []uint32) imap.UIDSet {
+	set := imap.UIDSet{}
+	for _, uid := range uids {
+		set.AddNum(imap.UID(uid))
 	}
+	return set
 }
 
 func (b *Backend) newSession(c *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
@@ -96,6 +176,8 @@ func (b *Backend) Options() *imapserver.Options {
 			imap.CapBinary:           {},
 			imap.CapCreateSpecialUse: {},
 			imap.CapUnauthenticate:   {},
+			imap.CapCondStore:        {},
+			imap.CapQResync:          {},
 		},
 		Logger: IMAPLogger{
 			Zap:   b.log,
@@ -0,0 +1,290 @@
+package imap2
+
+import (
+	"errors"
+	"runtime/trace"
+	"sort"
+
+	"github.com/emersion/go-imap/v2"
+	mess "github.com/foxcpp/go-imap-mess/v2"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+// RFC 7162 (CONDSTORE and QRESYNC) support. Mod-sequences are the ones
+// assigned by changelog.Repo, VANISHED responses are built from the
+// changelog too.
+//
+// With QRESYNC enabled, expunges are reported using VANISHED, so the session
+// needs UIDs of expunged messages. go-imap-mess reports expunges using
+// sequence numbers while holding the handle lock, so the session keeps its
+// own copy of the UID map in s.uids.
+
+func (s *session) condStore() bool {
+	return s.c.Enabled().Has(imap.CapCondStore)
+}
+
+func (s *session) qresync() bool {
+	return s.c.Enabled().Has(imap.CapQResync)
+}
+
+// highestModSeq converts the folder mod-sequence into HIGHESTMODSEQ value,
+// which cannot be zero.
+func highestModSeq(modSeq int64) uint64 {
+	if modSeq < 1 {
+		return 1
+	}
+	return uint64(modSeq)
+}
+
+// Vanished returns UIDs from the set that were expunged from the selected
+// folder after modSeq. If the changelog was already pruned, all UIDs from the
+// set that are not in the folder are returned, RFC 7162 permits UIDs that
+// never existed in VANISHED (EARLIER) responses.
+func (s *session) Vanished(uids imap.UIDSet, modSeq uint64) (imap.UIDSet, error) {
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Vanished")
+	defer task.End()
+
+	if imap.IsSearchRes(uids) {
+		uids = s.searchRes
+	}
+
+	fold, err := s.b.folders.GetByID(ctx, s.accountID, s.selectedFolderID)
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
+	// Expunged messages can have UIDs above the last message in the folder,
+	// so "*" is the last assigned UID.
+	lastUID := imap.UID(fold.UIDNext_ - 1)
+	if lastUID == 0 {
+		return nil, nil
+	}
+	requested := imap.UIDSet{}
+	for _, r := range uids {
+		start, stop := r.Start, r.Stop
+		if start == 0 || start > lastUID {
+			start = lastUID
+		}
+		if stop == 0 || stop > lastUID {
+			stop = lastUID
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		requested.AddRange(start, stop)
+	}
+
+	var vanished imap.UIDSet
+	removed, err := s.b.folders.Vanished(ctx, s.accountID, s.selectedFolderID, int64(modSeq))
+	switch {
+	case err == nil:
+		vanished = imap.UIDSet{}
+		for _, uid := range removed {
+			if requested.Contains(imap.UID(uid)) {
+				vanished.AddNum(imap.UID(uid))
+			}
+		}
+	case errors.Is(err, changelog.ErrTooOld):
+		s.log.Debug("changelog is pruned, reporting all missing UIDs as vanished",
+			zap.Uint64("modseq", modSeq))
+		vanished, err = s.missingUIDs(requested)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, s.asIMAPError(err)
+	}
+
+	// Messages that are still known to the session are reported using
+	// usual expunge updates.
+	if err := s.trackUIDs(); err != nil {
+		return nil, err
+	}
+	res := imap.UIDSet{}
+	nums, _ := vanished.Nums()
+	for _, uid := range nums {
+		i := sort.Search(len(s.uids), func(i int) bool { return s.uids[i] >= uid })
+		if i == len(s.uids) || s.uids[i] != uid {
+			res.AddNum(uid)
+		}
+	}
+	return res, nil
+}
+
+// missingUIDs returns UIDs from the set that are not in the selected folder.
+// The set should not contain "*".
+func (s *session) missingUIDs(set imap.UIDSet) (imap.UIDSet, error) {
+	entries, err := s.b.folders.Search(s.ctx, s.accountID, &folder.SearchCond{
+		FolderIDs: []ulid.ULID{s.selectedFolderID},
+		UIDs:      uidSetAsRange(set),
+	})
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
+	existing := imap.UIDSet{}
+	for _, ent := range entries {
+		existing.AddNum(imap.UID(ent.UID_))
+	}
+
+	res := imap.UIDSet{}
+	for _, r := range set {
+		start := r.Start
+		for _, e := range existing {
+			if e.Stop < start || e.Start > r.Stop {
+				continue
+			}
+			if e.Start > start {
+				res.AddRange(start, e.Start-1)
+			}
+			start = e.Stop + 1
+		}
+		if start <= r.Stop {
+			res.AddRange(start, r.Stop)
+		}
+	}
+	return res, nil
+}
+
+type vanishedWriter interface {
+	mess.ExpungeWriter
+	WriteVanished(uids imap.UIDSet) error
+}
+
+// trackUIDs starts maintaining s.uids if QRESYNC was enabled after SELECT.
+func (s *session) trackUIDs() error {
+	if s.uids != nil || !s.qresync() {
+		return nil
+	}
+	s.uids = make([]imap.UID, 0, s.updateHandler.MsgsCount())
+	return s.appendNewUIDs()
+}
+
+// appendNewUIDs adds UIDs of messages reported to the client since the last
+// call to s.uids.
+func (s *session) appendNewUIDs() error {
+	for seq := len(s.uids) + 1; seq <= s.updateHandler.MsgsCount(); seq++ {
+		uids, err := s.updateHandler.ResolveSeq(imap.SeqSetNum(uint32(seq)))
+		if err != nil {
+			return err
+		}
+		s.uids = append(s.uids, uids[0].Start)
+	}
+	return nil
+}
+
+// syncExpunge reports expunge of messages removed by the session itself.
+func (s *session) syncExpunge(w vanishedWriter, set imap.UIDSet) error {
+	if err := s.trackUIDs(); err != nil {
+		return err
+	}
+	if s.uids == nil {
+		return s.updateHandler.SyncSingleExpunge(w, set)
+	}
+
+	// Sequence numbers are not needed, only the handle state is updated.
+	if err := s.updateHandler.SyncSingleExpunge(&imapserver.ExpungeWriter{}, set); err != nil {
+		return err
+	}
+	removed := imap.UIDSet{}
+	uids := s.uids[:0]
+	for _, uid := range s.uids {
+		if set.Contains(uid) {
+			removed.AddNum(uid)
+			continue
+		}
+		uids = append(uids, uid)
+	}
+	s.uids = uids
+	return w.WriteVanished(removed)
+}
+
+// sync sends pending updates for the selected folder. If CONDSTORE is
+// enabled, flag updates include MODSEQ and, with QRESYNC, expunges are
+// reported using VANISHED.
+func (s *session) sync(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	if !s.condStore() {
+		return s.updateHandler.Sync(w, allowExpunge)
+	}
+
+	if err := s.trackUIDs(); err != nil {
+		return err
+	}
+	uw := &updateWriter{s: s, w: w, vanished: imap.UIDSet{}}
+	if err := s.updateHandler.Sync(uw, allowExpunge); err != nil {
+		return err
+	}
+	if err := uw.flush(); err != nil {
+		return err
+	}
+	if s.uids != nil {
+		return s.appendNewUIDs()
+	}
+	return nil
+}
+
+// updateWriter wraps UpdateWriter to add mod-sequences and VANISHED
+// responses. Methods are called with the mess handle locked, so they cannot
+// use s.updateHandler.
+type updateWriter struct {
+	s        *session
+	w        *imapserver.UpdateWriter
+	vanished imap.UIDSet
+}
+
+func (uw *updateWriter) WriteExpunge(seqNum uint32) error {
+	if uw.s.uids == nil {
+		return uw.w.WriteExpunge(seqNum)
+	}
+
+	// Expunges are reported in descending order, so the following indexes
+	// are not affected by the removal.
+	i := int(seqNum) - 1
+	uw.vanished.AddNum(uw.s.uids[i])
+	uw.s.uids = append(uw.s.uids[:i], uw.s.uids[i+1:]...)
+	return nil
+}
+
+func (uw *updateWriter) flush() error {
+	if len(uw.vanished) == 0 {
+		return nil
+	}
+	err := uw.w.WriteVanished(uw.vanished)
+	uw.vanished = imap.UIDSet{}
+	return err
+}
+
+func (uw *updateWriter) WriteNumMessages(n uint32) error {
+	if err := uw.flush(); err != nil {
+		return err
+	}
+	return uw.w.WriteNumMessages(n)
+}
+
+func (uw *updateWriter) WriteMailboxFlags(flags []imap.Flag) error {
+	if err := uw.flush(); err != nil {
+		return err
+	}
+	return uw.w.WriteMailboxFlags(flags)
+}
+
+func (uw *updateWriter) WriteMessageFlags(seqNum uint32, uid imap.UID, flags []imap.Flag) error {
+	var modSeq int64
+	err := uw.s.b.messages.FetchByUID(uw.s.ctx, uw.s.accountID, uw.s.selectedFolderID,
+		[]folder.UIDRange{{Since: uint32(uid), Until: uint32(uid)}},
+		func(_ folder.Entry, msg *message.Msg) error {
+			modSeq = msg.ModSeq()
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if modSeq == 0 {
+		// Expunged already, the expunge update will follow.
+		return nil
+	}
+	return uw.w.WriteMessageFlagsModSeq(seqNum, uid, flags, uint64(modSeq))
+}
@@ -0,0 +1,221 @@
+package imap2_test
+
+import (
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// rawConn is the IMAP connection used to test extensions imapclient does
+// not support.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	text *textproto.Conn
+	tag  int
+}
+
+func (s *testServer) dialRaw(t *testing.T) *rawConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	c := &rawConn{t: t, conn: conn, text: textproto.NewConn(conn)}
+	c.readLine() // greeting
+	c.ok("LOGIN " + testUsername + " password")
+	return c
+}
+
+func (c *rawConn) readLine() string {
+	c.t.Helper()
+
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := c.text.ReadLine()
+	require.NoError(c.t, err)
+	return line
+}
+
+func (c *rawConn) writeLine(line string) {
+	c.t.Helper()
+	require.NoError(c.t, c.text.PrintfLine("%s", line))
+}
+
+// cmd sends the command and returns untagged responses and the tagged
+// status response.
+func (c *rawConn) cmd(command string) ([]string, string) {
+	c.t.Helper()
+
+	c.tag++
+	tag := "t" + strconv.Itoa(c.tag)
+	c.writeLine(tag + " " + command)
+
+	var untagged []string
+	for {
+		line := c.readLine()
+		if status, ok := strings.CutPrefix(line, tag+" "); ok {
+			return untagged, status
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+// ok sends the command and checks it completed successfully.
+func (c *rawConn) ok(command string) []string {
+	c.t.Helper()
+
+	untagged, status := c.cmd(command)
+	require.True(c.t, strings.HasPrefix(status, "OK"), "%s: %s", command, status)
+	return untagged
+}
+
+var modSeqRe = regexp.MustCompile(`(?:HIGHESTMODSEQ|MODSEQ \(?)(\d+)`)
+
+// modSeq returns the mod-sequence from the response line.
+func modSeq(t *testing.T, line string) uint64 {
+	t.Helper()
+
+	m := modSeqRe.FindStringSubmatch(line)
+	require.NotNil(t, m, line)
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	require.NoError(t, err)
+	return n
+}
+
+// findLine returns the first line containing substr.
+func findLine(t *testing.T, lines []string, substr string) string {
+	t.Helper()
+
+	for _, l := range lines {
+		if strings.Contains(l, substr) {
+			return l
+		}
+	}
+	t.Fatalf("no %q in %q", substr, lines)
+	return ""
+}
+
+func TestCondStore(t *testing.T) {
+	srv := newTestServer(t)
+	c := srv.dial(t, nil)
+	for _, subj := range []string{"one", "two", "three"} {
+		appendMsg(t, c, "INBOX", testMessage(subj, "text"))
+	}
+
+	raw := srv.dialRaw(t)
+	caps := raw.ok("CAPABILITY")
+	require.Contains(t, findLine(t, caps, "* CAPABILITY"), " CONDSTORE")
+	require.Contains(t, findLine(t, caps, "* CAPABILITY"), " QRESYNC")
+
+	resp := raw.ok("SELECT INBOX (CONDSTORE)")
+	highest := modSeq(t, findLine(t, resp, "HIGHESTMODSEQ"))
+
+	resp = raw.ok("STATUS INBOX (HIGHESTMODSEQ)")
+	require.Equal(t, highest, modSeq(t, findLine(t, resp, "* STATUS")))
+
+	resp = raw.ok("FETCH 1:* (FLAGS MODSEQ)")
+	require.Len(t, resp, 3)
+	for _, l := range resp {
+		require.LessOrEqual(t, modSeq(t, l), highest)
+	}
+
+	// MODSEQ is sent even for .SILENT once CONDSTORE is enabled.
+	resp = raw.ok(`STORE 1 +FLAGS.SILENT (\Flagged)`)
+	require.Len(t, resp, 1)
+	require.NotContains(t, resp[0], "FLAGS")
+	changed := modSeq(t, resp[0])
+	require.Greater(t, changed, highest)
+
+	resp = raw.ok("FETCH 1:* (FLAGS) (CHANGEDSINCE " + strconv.FormatUint(highest, 10) + ")")
+	require.Len(t, resp, 1)
+	require.True(t, strings.HasPrefix(resp[0], "* 1 FETCH "), resp[0])
+	require.Contains(t, resp[0], `\Flagged`)
+	require.Equal(t, changed, modSeq(t, resp[0]))
+
+	resp = raw.ok("SEARCH MODSEQ " + strconv.FormatUint(changed, 10))
+	require.Equal(t, []string{"* SEARCH 1 (MODSEQ " + strconv.FormatUint(changed, 10) + ")"}, resp)
+
+	resp, status := raw.cmd("STORE 1:2 (UNCHANGEDSINCE " + strconv.FormatUint(changed-1, 10) + `) +FLAGS (\Seen)`)
+	require.True(t, strings.HasPrefix(status, "OK [MODIFIED 1]"), status)
+	require.Len(t, resp, 1)
+	require.True(t, strings.HasPrefix(resp[0], "* 2 FETCH "), resp[0])
+	require.Contains(t, resp[0], "MODSEQ")
+
+	// RFC 7162: UNCHANGEDSINCE 0 fails for every existing message.
+	resp, status = raw.cmd(`UID STORE 1:3 (UNCHANGEDSINCE 0) +FLAGS (\Answered)`)
+	require.True(t, strings.HasPrefix(status, "OK [MODIFIED 1:3]"), status)
+	require.Empty(t, resp)
+	resp = raw.ok(`FETCH 1:* (FLAGS)`)
+	for _, l := range resp {
+		require.NotContains(t, l, `\Answered`)
+	}
+}
+
+func TestQResync(t *testing.T) {
+	srv := newTestServer(t)
+	c := srv.dial(t, nil)
+	for _, subj := range []string{"one", "two", "three"} {
+		appendMsg(t, c, "INBOX", testMessage(subj, "text"))
+	}
+	_, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+
+	raw := srv.dialRaw(t)
+	require.Equal(t, []string{"* ENABLED CONDSTORE QRESYNC"}, raw.ok("ENABLE CONDSTORE QRESYNC"))
+	resp := raw.ok("SELECT INBOX")
+	highest := strconv.FormatUint(modSeq(t, findLine(t, resp, "HIGHESTMODSEQ")), 10)
+	uidValidity := regexp.MustCompile(`UIDVALIDITY (\d+)`).FindStringSubmatch(findLine(t, resp, "UIDVALIDITY"))[1]
+
+	// Expunges by other sessions.
+	require.NoError(t, c.Store(imap.SeqSetNum(2), &imap.StoreFlags{
+		Op:    imap.StoreFlagsAdd,
+		Flags: []imap.Flag{imap.FlagDeleted},
+	}, nil).Close())
+	require.NoError(t, c.Expunge().Close())
+	resp = raw.ok("NOOP")
+	require.Contains(t, resp, "* VANISHED 2")
+
+	raw2 := srv.dialRaw(t)
+	raw2.ok("ENABLE QRESYNC")
+	resp = raw2.ok("SELECT INBOX (QRESYNC (" + uidValidity + " " + highest + " 1:3))")
+	require.Contains(t, resp, "* VANISHED (EARLIER) 2")
+	findLine(t, resp, "HIGHESTMODSEQ")
+
+	resp = raw2.ok("UID FETCH 1:* (FLAGS) (CHANGEDSINCE " + highest + " VANISHED)")
+	require.Equal(t, []string{"* VANISHED (EARLIER) 2"}, resp)
+
+	// Own expunges.
+	raw2.ok(`STORE 1 +FLAGS.SILENT (\Deleted)`)
+	resp = raw2.ok("EXPUNGE")
+	require.Equal(t, []string{"* VANISHED 1"}, resp)
+
+	// Updates while idling.
+	require.Equal(t, []string{"* VANISHED 1"}, raw.ok("NOOP"))
+	raw.writeLine("i IDLE")
+	require.True(t, strings.HasPrefix(raw.readLine(), "+ "))
+	require.NoError(t, c.Store(imap.UIDSetNum(3), &imap.StoreFlags{
+		Op:    imap.StoreFlagsAdd,
+		Flags: []imap.Flag{imap.FlagFlagged},
+	}, nil).Close())
+	line := raw.readLine()
+	require.True(t, strings.HasPrefix(line, "* 1 FETCH "), line)
+	require.Contains(t, line, `\Flagged`)
+	require.Contains(t, line, "MODSEQ")
+	appendMsg(t, c, "INBOX", testMessage("four", "text"))
+	require.Equal(t, "* 2 EXISTS", raw.readLine())
+	raw2.ok(`UID STORE 3 +FLAGS.SILENT (\Deleted)`)
+	raw2.ok("UID EXPUNGE 3")
+	require.Contains(t, raw.readLine(), `\Deleted`)
+	require.Equal(t, "* VANISHED 3", raw.readLine())
+	raw.writeLine("DONE")
+	require.True(t, strings.HasPrefix(raw.readLine(), "i OK"))
+}
@@ -0,0 +1,463 @@
+package imap2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	mess "github.com/foxcpp/go-imap-mess/v2"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
+	"github.com/oklog/ulid/v2"
+)
+
+func (s *session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Fetch")
+	defer task.End()
+
+	uids, err := s.resolveNumSet(numSet)
+	if err != nil {
+		if errors.Is(err, mess.ErrNoMessages) {
+			return nil
+		}
+		return err
+	}
+
+	if options.ChangedSince != 0 {
+		entries, err := s.b.folders.Search(ctx, s.accountID, &folder.SearchCond{
+			FolderIDs:   []ulid.ULID{s.selectedFolderID},
+			UIDs:        uidSetAsRange(uids),
+			ModSeqSince: int64(options.ChangedSince) + 1,
+		})
+		if err != nil {
+			return s.asIMAPError(err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		uids = imap.UIDSet{}
+		for _, ent := range entries {
+			uids.AddNum(imap.UID(ent.UID_))
+		}
+	}
+
+	// Flags changed by this command need to be reported even if they were
+	// not requested.
+	var seenSet imap.UIDSet
+	if !s.readOnly && setsSeen(options) {
+		result, err := s.b.messages.UpdateFlags(ctx, s.accountID, s.selectedFolderID, uidSetAsRange(uids), message.FlagUpdate{
+			Op:    message.FlagsAdd,
+			Flags: []string{string(imap.FlagSeen)},
+		})
+		if err != nil {
+			return s.asIMAPError(err)
+		}
+		for _, ent := range result.Changed {
+			s.updateHandler.FlagsChanged(imap.UID(ent.Entry.UID_), flagsAsIMAP(ent.Flags), true)
+			seenSet.AddNum(imap.UID(ent.Entry.UID_))
+		}
+		if len(result.Changed) != 0 {
+			s.b.folderChanged(s.selectedFolderID)
+		}
+	}
+
+	condStore := s.condStore()
+	err = s.b.messages.FetchByUID(ctx, s.accountID, s.selectedFolderID, uidSetAsRange(uids), func(ent folder.Entry, msg *message.Msg) error {
+		seq, ok := s.updateHandler.UidAsSeq(imap.UID(ent.UID_))
+		if !ok {
+			// Not visible to this session (yet).
+			return nil
+		}
+		writeFlags := options.Flags || seenSet.Contains(imap.UID(ent.UID_))
+		// RFC 7162: flag changes are reported with MODSEQ once CONDSTORE
+		// is enabled.
+		writeModSeq := options.ModSeq || (writeFlags && condStore)
+		return s.fetchMsg(ctx, w.CreateMessage(seq), ent, msg, options, writeFlags, writeModSeq)
+	})
+	return s.asIMAPError(err)
+}
+
+// setsSeen reports whether the FETCH command implicitly sets \Seen flag.
+func setsSeen(options *imap.FetchOptions) bool {
+	for _, section := range options.BodySection {
+		if !section.Peek {
+			return true
+		}
+	}
+	for _, section := range options.BinarySection {
+		if !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) fetchMsg(ctx context.Context, w *imapserver.FetchResponseWriter, ent folder.Entry, msg *message.Msg, options *imap.FetchOptions, writeFlags, writeModSeq bool) error {
+	if options.UID {
+		w.WriteUID(imap.UID(ent.UID_))
+	}
+	if writeFlags {
+		w.WriteFlags(flagsAsIMAP(msg.Flags_))
+	}
+	if writeModSeq {
+		w.WriteModSeq(uint64(msg.ModSeq()))
+	}
+	if options.InternalDate {
+		w.WriteInternalDate(msg.ReceivedAt_)
+	}
+	if options.RFC822Size {
+		w.WriteRFC822Size(msg.Content_.Size)
+	}
+	if options.Envelope {
+		w.WriteEnvelope(envelopeAsIMAP(msg.Content_.Envelope))
+	}
+	if options.BodyStructure != nil {
+		w.WriteBodyStructure(messageBodyStructure(msg, message.EmptyPath(), msg.Content_))
+	}
+
+	for _, section := range options.BodySection {
+		body, err := bodySection(msg, section)
+		if err != nil {
+			return err
+		}
+		if section.Partial != nil {
+			body = body.Slice(section.Partial.Offset, section.Partial.Size)
+		}
+
+		if err := s.writeBody(ctx, w.WriteBodySection(section, body.Size()), body); err != nil {
+			return err
+		}
+	}
+	for _, section := range options.BinarySection {
+		data, err := s.binarySection(ctx, msg, section.Part)
+		if err != nil {
+			return err
+		}
+		body := message.BodyFromBytes(data)
+		if section.Partial != nil {
+			body = body.Slice(section.Partial.Offset, section.Partial.Size)
+		}
+
+		if err := s.writeBody(ctx, w.WriteBinarySection(&imap.FetchItemBinarySection{
+			Part:    section.Part,
+			Partial: section.Partial,
+			Peek:    section.Peek,
+		}, body.Size()), body); err != nil {
+			return err
+		}
+	}
+	for _, section := range options.BinarySectionSize {
+		data, err := s.binarySection(ctx, msg, section.Part)
+		if err != nil {
+			return err
+		}
+		w.WriteBinarySectionSize(&imap.FetchItemBinarySection{
+			Part: section.Part,
+		}, uint32(len(data)))
+	}
+
+	return w.Close()
+}
+
+func (s *session) writeBody(ctx context.Context, w io.WriteCloser, body *message.Body) error {
+	r := s.b.messages.OpenBody(ctx, s.accountID, body)
+	defer r.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		// Literal is already partially written, we cannot recover the
+		// connection state from there.
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func bodySection(msg *message.Msg, section *imap.FetchItemBodySection) (*message.Body, error) {
+	path := message.Path(section.Part)
+
+	var (
+		body *message.Body
+		err  error
+	)
+	switch section.Specifier {
+	case imap.PartSpecifierNone:
+		body, err = msg.PartBody(path)
+	case imap.PartSpecifierHeader:
+		var hdr []byte
+		hdr, err = msg.Header(path)
+		if len(section.HeaderFields) != 0 {
+			hdr = filterHeader(hdr, section.HeaderFields, false)
+		} else if len(section.HeaderFieldsNot) != 0 {
+			hdr = filterHeader(hdr, section.HeaderFieldsNot, true)
+		}
+		body = message.BodyFromBytes(hdr)
+	case imap.PartSpecifierText:
+		body, err = msg.Text(path)
+	case imap.PartSpecifierMIME:
+		var hdr []byte
+		hdr, err = msg.MIMEHeader(path)
+		body = message.BodyFromBytes(hdr)
+	}
+	if errors.Is(err, message.ErrNoSuchPart) {
+		// Non-existent section is returned as empty string.
+		return message.BodyFromBytes(nil), nil
+	}
+	return body, err
+}
+
+// filterHeader returns header fields that match (or do not match, if not is
+// set) one of the listed names.
+func filterHeader(hdr []byte, names []string, not bool) []byte {
+	var (
+		res     bytes.Buffer
+		include bool
+	)
+	for len(hdr) != 0 {
+		line := hdr
+		if i := bytes.IndexByte(hdr, '\n'); i != -1 {
+			line = hdr[:i+1]
+		}
+		hdr = hdr[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of header.
+			break
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			// New field, not a continuation line.
+			name, _, _ := bytes.Cut(line, []byte{':'})
+			name = bytes.TrimSpace(name)
+
+			matched := false
+			for _, n := range names {
+				if strings.EqualFold(string(name), n) {
+					matched = true
+					break
+				}
+			}
+			include = matched != not
+		}
+
+		if include {
+			res.Write(line)
+		}
+	}
+	res.WriteString("\r\n")
+	return res.Bytes()
+}
+
+// binarySection returns part content with Content-Transfer-Encoding
+// removed.
+func (s *session) binarySection(ctx context.Context, msg *message.Msg, partPath []int) ([]byte, error) {
+	path := message.Path(partPath)
+
+	body, err := msg.PartBody(path)
+	if err != nil {
+		if errors.Is(err, message.ErrNoSuchPart) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r := s.b.messages.OpenBody(ctx, s.accountID, body)
+	defer r.Close()
+
+	var decoded io.Reader = r
+	if part, ok := msg.Part(path); ok && !part.Content_.IsMultipart() && !part.Content_.IsMessage() {
+		switch strings.ToLower(part.Content_.Encoding) {
+		case "", "7bit", "8bit", "binary":
+		case "base64":
+			decoded = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+		case "quoted-printable":
+			decoded = quotedprintable.NewReader(r)
+		default:
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeUnknownCTE,
+				Text: "Unknown Content-Transfer-Encoding: " + part.Content_.Encoding,
+			}
+		}
+	}
+
+	return io.ReadAll(decoded)
+}
+
+// newlineStripper removes CR and LF characters from the stream, as
+// required by base64 decoder.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		c, err := n.r.Read(p)
+		filtered := p[:0]
+		for _, b := range p[:c] {
+			if b != '\r' && b != '\n' {
+				filtered = append(filtered, b)
+			}
+		}
+		if len(filtered) != 0 || err != nil {
+			return len(filtered), err
+		}
+	}
+}
+
+func flagsAsIMAP(flags []string) []imap.Flag {
+	res := make([]imap.Flag, len(flags))
+	for i, f := range flags {
+		res[i] = imap.Flag(f)
+	}
+	return res
+}
+
+func addressesAsIMAP(addrs []message.Address) []imap.Address {
+	if addrs == nil {
+		return nil
+	}
+	res := make([]imap.Address, len(addrs))
+	for i, a := range addrs {
+		res[i] = imap.Address{
+			Name:    a.Name,
+			Mailbox: a.Mailbox,
+			Host:    a.Host,
+		}
+	}
+	return res
+}
+
+func envelopeAsIMAP(env *message.ContentEnvelope) *imap.Envelope {
+	if env == nil {
+		return nil
+	}
+	return &imap.Envelope{
+		Date:      env.Date,
+		Subject:   env.Subject,
+		From:      addressesAsIMAP(env.From),
+		Sender:    addressesAsIMAP(env.Sender),
+		ReplyTo:   addressesAsIMAP(env.ReplyTo),
+		To:        addressesAsIMAP(env.To),
+		Cc:        addressesAsIMAP(env.Cc),
+		Bcc:       addressesAsIMAP(env.Bcc),
+		InReplyTo: env.InReplyTo,
+		MessageID: env.MessageID,
+	}
+}
+
+func dispositionAsIMAP(d message.Disposition) *imap.BodyStructureDisposition {
+	if d.Value == "" {
+		return nil
+	}
+	return &imap.BodyStructureDisposition{
+		Value:  d.Value,
+		Params: d.Params,
+	}
+}
+
+func splitMediaType(typ string) (string, string) {
+	t, sub, ok := strings.Cut(typ, "/")
+	if !ok {
+		return "text", "plain"
+	}
+	return t, sub
+}
+
+// messageBodyStructure returns body structure for the top-level message
+// (empty path) or encapsulated message/rfc822 part.
+func messageBodyStructure(msg *message.Msg, path message.Path, cd *message.ContentData) imap.BodyStructure {
+	if cd.IsMultipart() {
+		_, subtype := splitMediaType(cd.Type)
+		return multipartBodyStructure(msg, path, subtype, &imap.BodyStructureMultiPartExt{
+			Params:      cd.Params,
+			Disposition: dispositionAsIMAP(cd.Disposition),
+			Language:    cd.Language,
+			Location:    cd.Location,
+		})
+	}
+
+	part, ok := msg.Part(path.FirstChild())
+	if !ok {
+		return emptyBodyStructure()
+	}
+	return partBodyStructure(msg, part)
+}
+
+func multipartBodyStructure(msg *message.Msg, path message.Path, subtype string, ext *imap.BodyStructureMultiPartExt) imap.BodyStructure {
+	children := msg.Children(path)
+	if len(children) == 0 {
+		return emptyBodyStructure()
+	}
+
+	bs := &imap.BodyStructureMultiPart{
+		Children: make([]imap.BodyStructure, len(children)),
+		Subtype:  subtype,
+		Extended: ext,
+	}
+	for i, child := range children {
+		bs.Children[i] = partBodyStructure(msg, child)
+	}
+	return bs
+}
+
+func partBodyStructure(msg *message.Msg, part *message.Part) imap.BodyStructure {
+	c := part.Content_
+	typ, subtype := splitMediaType(c.Type)
+
+	if c.IsMultipart() {
+		return multipartBodyStructure(msg, part.Path_, subtype, &imap.BodyStructureMultiPartExt{
+			Params:      c.Params,
+			Disposition: dispositionAsIMAP(c.Disposition),
+			Language:    c.Language,
+			Location:    c.Location,
+		})
+	}
+
+	bs := &imap.BodyStructureSinglePart{
+		Type:        typ,
+		Subtype:     subtype,
+		Params:      c.Params,
+		ID:          c.ID,
+		Description: c.Description,
+		Encoding:    c.Encoding,
+		Size:        c.Size,
+		Extended: &imap.BodyStructureSinglePartExt{
+			Disposition: dispositionAsIMAP(c.Disposition),
+			Language:    c.Language,
+			Location:    c.Location,
+		},
+	}
+	switch {
+	case c.IsMessage():
+		bs.MessageRFC822 = &imap.BodyStructureMessageRFC822{
+			Envelope:      envelopeAsIMAP(c.Envelope),
+			BodyStructure: messageBodyStructure(msg, part.Path_, c.Message),
+			NumLines:      c.NumLines,
+		}
+	case strings.EqualFold(typ, "text"):
+		bs.Text = &imap.BodyStructureText{
+			NumLines: c.NumLines,
+		}
+	}
+
+	return bs
+}
+
+// emptyBodyStructure is used in place of missing parts to keep
+// BODYSTRUCTURE syntactically valid.
+func emptyBodyStructure() imap.BodyStructure {
+	return &imap.BodyStructureSinglePart{
+		Type:     "text",
+		Subtype:  "plain",
+		Encoding: "7bit",
+		Text:     &imap.BodyStructureText{},
+		Extended: &imap.BodyStructureSinglePartExt{},
+	}
+}
@@ -0,0 +1,209 @@
+package imap2_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/stretchr/testify/require"
+)
+
+const fetchTestMsg = "From: <sender@example.org>\r\n" +
+	"Subject: sections\r\n" +
+	"X-Folded: first\r\n second\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=C3=A9 au=\r\n lait\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<b>html</b>\r\n" +
+	"--inner\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAwQF\r\nBgcICQ==\r\n" +
+	"--inner--\r\n" +
+	"--outer--\r\n"
+
+// fetchOne fetches the first message of the selected mailbox.
+func fetchOne(t *testing.T, c *imapclient.Client, options *imap.FetchOptions) *imapclient.FetchMessageBuffer {
+	t.Helper()
+
+	msgs, err := c.Fetch(imap.SeqSetNum(1), options).Collect()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	return msgs[0]
+}
+
+func TestFetchBodySection(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+	appendMsg(t, c, "INBOX", fetchTestMsg)
+	_, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait()
+	require.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		section *imap.FetchItemBodySection
+		res     string
+	}{
+		{
+			name: "header fields",
+			section: &imap.FetchItemBodySection{
+				Specifier:    imap.PartSpecifierHeader,
+				HeaderFields: []string{"subject", "X-FOLDED", "Missing"},
+			},
+			res: "Subject: sections\r\nX-Folded: first\r\n second\r\n\r\n",
+		},
+		{
+			name: "header fields not",
+			section: &imap.FetchItemBodySection{
+				Specifier:       imap.PartSpecifierHeader,
+				HeaderFieldsNot: []string{"content-type", "x-folded"},
+			},
+			res: "From: <sender@example.org>\r\nSubject: sections\r\n\r\n",
+		},
+		{
+			name: "nested part",
+			section: &imap.FetchItemBodySection{
+				Part: []int{2, 1},
+			},
+			res: "<b>html</b>",
+		},
+		{
+			name: "nested part MIME",
+			section: &imap.FetchItemBodySection{
+				Part:      []int{2, 2},
+				Specifier: imap.PartSpecifierMIME,
+			},
+			res: "Content-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n",
+		},
+		{
+			name: "missing part",
+			section: &imap.FetchItemBodySection{
+				Part: []int{2, 3},
+			},
+			res: "",
+		},
+		{
+			name: "partial",
+			section: &imap.FetchItemBodySection{
+				Part:    []int{2, 1},
+				Partial: &imap.SectionPartial{Offset: 3, Size: 4},
+			},
+			res: "html",
+		},
+		{
+			name: "partial past EOF",
+			section: &imap.FetchItemBodySection{
+				Part:    []int{2, 1},
+				Partial: &imap.SectionPartial{Offset: 7, Size: 100},
+			},
+			res: "</b>",
+		},
+		{
+			name: "partial offset past EOF",
+			section: &imap.FetchItemBodySection{
+				Part:    []int{2, 1},
+				Partial: &imap.SectionPartial{Offset: 100, Size: 10},
+			},
+			res: "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := fetchOne(t, c, &imap.FetchOptions{
+				BodySection: []*imap.FetchItemBodySection{tc.section},
+			})
+			require.Len(t, msg.BodySection, 1)
+			for _, body := range msg.BodySection {
+				require.Equal(t, tc.res, string(body))
+			}
+		})
+	}
+}
+
+func TestFetchBinary(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+	appendMsg(t, c, "INBOX", fetchTestMsg)
+	_, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait()
+	require.NoError(t, err)
+
+	cases := []struct {
+		name string
+		part []int
+		res  string
+	}{
+		{
+			name: "quoted-printable",
+			part: []int{1},
+			res:  "café au lait",
+		},
+		{
+			name: "base64",
+			part: []int{2, 2},
+			res:  "\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09",
+		},
+		{
+			name: "identity",
+			part: []int{2, 1},
+			res:  "<b>html</b>",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// BINARY.SIZE is not checked, imapclient fails to parse it.
+			msg := fetchOne(t, c, &imap.FetchOptions{
+				BinarySection: []*imap.FetchItemBinarySection{{Part: tc.part}},
+			})
+			require.Len(t, msg.BinarySection, 1)
+			for _, body := range msg.BinarySection {
+				require.Equal(t, tc.res, string(body))
+			}
+		})
+	}
+}
+
+func TestFetchBodyStructure(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+	appendMsg(t, c, "INBOX", fetchTestMsg)
+	_, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait()
+	require.NoError(t, err)
+
+	msg := fetchOne(t, c, &imap.FetchOptions{
+		BodyStructure: &imap.FetchItemBodyStructure{Extended: true},
+	})
+
+	root, ok := msg.BodyStructure.(*imap.BodyStructureMultiPart)
+	require.True(t, ok)
+	require.Equal(t, "mixed", root.Subtype)
+	require.Equal(t, "outer", root.Extended.Params["boundary"])
+	require.Len(t, root.Children, 2)
+
+	text, ok := root.Children[0].(*imap.BodyStructureSinglePart)
+	require.True(t, ok)
+	require.Equal(t, "text/plain", text.MediaType())
+	require.Equal(t, "utf-8", text.Params["charset"])
+	require.True(t, strings.EqualFold("quoted-printable", text.Encoding))
+	require.EqualValues(t, len("caf=C3=A9 au=\r\n lait"), text.Size)
+	require.EqualValues(t, 2, text.Text.NumLines)
+
+	alt, ok := root.Children[1].(*imap.BodyStructureMultiPart)
+	require.True(t, ok)
+	require.Equal(t, "alternative", alt.Subtype)
+	require.Len(t, alt.Children, 2)
+	require.Equal(t, "text/html", alt.Children[0].MediaType())
+	attachment, ok := alt.Children[1].(*imap.BodyStructureSinglePart)
+	require.True(t, ok)
+	require.Equal(t, "application/octet-stream", attachment.MediaType())
+	require.True(t, strings.EqualFold("base64", attachment.Encoding))
+	require.Nil(t, attachment.Text)
+}
@@ -0,0 +1,163 @@
+package imap2_test
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	accountsqlite "github.com/foxcpp/maddy-storage/internal/domain/account/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	changelogsqlite "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	foldersqlite "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/sqlite"
+	messagesqlite "github.com/foxcpp/maddy-storage/internal/domain/message/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/repository/sqlite"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/imap2"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
+	"github.com/foxcpp/maddy-storage/pkg/jmap"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testUsername = "test"
+
+// testServer is imap2.Backend served on the loopback interface using
+// the temporary SQLite DB. The account testUsername with INBOX is created
+// in advance, any password is accepted.
+type testServer struct {
+	addr      string
+	accountID string
+
+	backend   *imap2.Backend
+	accounts  usecase.Account
+	folders   usecase.Folder
+	messages  usecase.Message
+	changeLog changelog.Repo
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "db.sqlite"), sqlite.Cfg{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sqlDB, err := db.SQL()
+		if err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	folderRepo := foldersqlite.New(db)
+	changelogRepo := changelogsqlite.New(db)
+	accounts := usecase.NewAccount(accountsqlite.New(db), usecase.StubAuth{}, changelogRepo, db)
+	folders := usecase.NewFolder(folderRepo, foldersqlite.NewSearcher(db), changelogRepo, db)
+	messages := usecase.NewMessage(folderRepo, messagesqlite.New(db), changelogRepo, db, nil)
+
+	acct, err := accounts.Create(ctx, testUsername)
+	require.NoError(t, err)
+	_, err = folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	backend := imap2.New(imap2.Config{InsecureAuth: true}, zap.NewNop(), accounts, folders, messages)
+	srv := imapserver.New(backend.Options())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	return &testServer{
+		addr:      ln.Addr().String(),
+		accountID: acct.ID_.String(),
+		backend:   backend,
+		accounts:  accounts,
+		folders:   folders,
+		messages:  messages,
+		changeLog: changelogRepo,
+	}
+}
+
+// serveJMAP returns the URL of the JMAP server sharing repositories and
+// update notifications with the IMAP server.
+func (s *testServer) serveJMAP(t *testing.T) string {
+	t.Helper()
+
+	srv := httptest.NewServer(jmap.New(jmap.Config{Notifier: s.backend}, zap.NewNop(),
+		s.accounts, s.folders, s.messages, s.changeLog))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// dial returns the client logged in as testUsername. Unilateral updates
+// are passed to handler, it can be nil.
+func (s *testServer) dial(t *testing.T, handler *imapclient.UnilateralDataHandler) *imapclient.Client {
+	t.Helper()
+
+	c, err := imapclient.DialInsecure(s.addr, &imapclient.Options{
+		UnilateralDataHandler: handler,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	require.NoError(t, c.Login(testUsername, "password").Wait())
+	return c
+}
+
+func testMessage(subject, body string) string {
+	return "From: <sender@example.org>\r\n" +
+		"To: <test@example.org>\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Message-Id: <" + subject + "@example.org>\r\n" +
+		"\r\n" +
+		body + "\r\n"
+}
+
+func appendMsg(t *testing.T, c *imapclient.Client, mailbox, msg string, flags ...imap.Flag) *imap.AppendData {
+	t.Helper()
+
+	cmd := c.Append(mailbox, int64(len(msg)), &imap.AppendOptions{Flags: flags})
+	_, err := cmd.Write([]byte(msg))
+	require.NoError(t, err)
+	require.NoError(t, cmd.Close())
+	data, err := cmd.Wait()
+	require.NoError(t, err)
+	return data
+}
+
+func listMailboxes(t *testing.T, c *imapclient.Client) []string {
+	t.Helper()
+
+	list, err := c.List("", "*", nil).Collect()
+	require.NoError(t, err)
+	names := make([]string, 0, len(list))
+	for _, data := range list {
+		names = append(names, data.Mailbox)
+	}
+	return names
+}
+
+// waitUpdate returns the next value sent to ch or fails the test if there is
+// none for a while.
+func waitUpdate[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for update")
+		panic("unreachable")
+	}
+}
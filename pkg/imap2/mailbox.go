@@ -6,13 +6,22 @@ import (
 	"strings"
 
 	"github.com/emersion/go-imap/v2"
-	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
 	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
 	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
 	"github.com/oklog/ulid/v2"
 )
 
+// mailboxPath converts IMAP mailbox name into the folder path, taking care
+// of the case-insensitive INBOX name.
+func mailboxPath(mailbox string) string {
+	if strings.EqualFold(mailbox, "INBOX") {
+		return "INBOX"
+	}
+	return mailbox
+}
+
 func (s *session) Create(mailbox string, options *imap.CreateOptions) error {
 	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Create")
 	defer task.End()
@@ -62,6 +71,7 @@ func (s *session) Delete(mailbox string) error {
 
 	for _, d := range deleted {
 		s.b.updateManager.MailboxDestroyed(d.ID)
+		s.b.folderChanged(d.ID)
 	}
 
 	return nil
@@ -160,6 +170,9 @@ func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string,
 		},
 		CheckChildren: true,
 	}
+	if options.ReturnStatus != nil {
+		setStatusCounters(opts, options.ReturnStatus)
+	}
 	if options.SelectRecursiveMatch {
 		if options.SelectSubscribed {
 			opts.DescendantFilter.Subscribed = &options.SelectSubscribed
@@ -187,7 +200,7 @@ func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string,
 	for _, f := range folders {
 		data := &imap.ListData{
 			Delim:   rune(folder.PathSeparator[0]),
-			Mailbox: f.Folder.Name_,
+			Mailbox: f.Folder.Path_,
 		}
 
 		if options.ReturnSubscribed && f.Folder.Subscribed_ {
@@ -204,36 +217,7 @@ func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string,
 			}
 		}
 		if options.ReturnStatus != nil {
-			data.Status = &imap.StatusData{
-				Mailbox: data.Mailbox,
-			}
-			if options.ReturnStatus.NumMessages {
-				msgs := uint32(f.Msgs)
-				data.Status.NumMessages = &msgs
-			}
-			if options.ReturnStatus.UIDValidity {
-				data.Status.UIDValidity = f.Folder.UIDValidity_
-			}
-			if options.ReturnStatus.UIDNext {
-				data.Status.UIDNext = imap.UID(f.Folder.UIDNext_)
-			}
-			if options.ReturnStatus.NumUnseen {
-				msgs := uint32(f.UnseenMsgs)
-				data.Status.NumUnseen = &msgs
-			}
-			if options.ReturnStatus.NumDeleted {
-				msgs := uint32(f.DeletedMsgs)
-				data.Status.NumDeleted = &msgs
-			}
-			if options.ReturnStatus.Size {
-				data.Status.Size = &f.Size
-			}
-			if options.ReturnStatus.AppendLimit {
-				panic("not implemented") // TODO: implement me
-			}
-			if options.ReturnStatus.DeletedStorage {
-				panic("not implemented") // TODO: implement me
-			}
+			data.Status = s.statusData(data.Mailbox, &f, options.ReturnStatus)
 		}
 		if options.SelectRecursiveMatch && len(f.MatchingDescendant) > 0 {
 			data.ChildInfo = &imap.ListDataChildInfo{}
@@ -256,6 +240,56 @@ func (s *session) List(w *imapserver.ListWriter, ref string, patterns []string,
 	return nil
 }
 
+func setStatusCounters(opts *usecase.ListOpts, options *imap.StatusOptions) {
+	opts.CountMsgs = options.NumMessages
+	opts.CountUnseen = options.NumUnseen
+	opts.CountDeleted = options.NumDeleted
+	opts.CountSize = options.Size
+	opts.CountDeletedSize = options.DeletedStorage
+}
+
+func (s *session) statusData(mailbox string, f *usecase.FolderData, options *imap.StatusOptions) *imap.StatusData {
+	data := &imap.StatusData{
+		Mailbox: mailbox,
+	}
+	if options.NumMessages {
+		msgs := uint32(f.Msgs)
+		data.NumMessages = &msgs
+	}
+	if options.UIDValidity {
+		data.UIDValidity = f.Folder.UIDValidity_
+	}
+	if options.UIDNext {
+		data.UIDNext = imap.UID(f.Folder.UIDNext_)
+	}
+	if options.HighestModSeq {
+		data.HighestModSeq = highestModSeq(f.Folder.ModSeq())
+	}
+	if options.NumUnseen {
+		msgs := uint32(f.UnseenMsgs)
+		data.NumUnseen = &msgs
+	}
+	if options.NumDeleted {
+		msgs := uint32(f.DeletedMsgs)
+		data.NumDeleted = &msgs
+	}
+	if options.Size {
+		size := f.Size
+		data.Size = &size
+	}
+	if options.AppendLimit && s.b.cfg.AppendLimit != 0 {
+		limit := s.b.cfg.AppendLimit
+		data.AppendLimit = &limit
+	}
+	if options.DeletedStorage {
+		// Upper bound: messages that are also stored in other folders are
+		// not freed by EXPUNGE.
+		size := f.DeletedSize
+		data.DeletedStorage = &size
+	}
+	return data
+}
+
 func (s *session) Unselect() error {
 	_, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Unselect")
 	defer task.End()
@@ -266,6 +300,8 @@ func (s *session) Unselect() error {
 		s.updateHandler = nil
 	}
 	s.readOnly = false
+	s.searchRes = nil
+	s.uids = nil
 
 	return nil
 }
@@ -1,11 +1,16 @@
 package imap2
 
 import (
+	"errors"
 	"runtime/trace"
+	"strings"
 
 	"github.com/emersion/go-imap/v2"
-	"github.com/emersion/go-imap/v2/imapserver"
+	mess "github.com/foxcpp/go-imap-mess/v2"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
 	"go.uber.org/zap"
 )
 
@@ -20,68 +25,279 @@ func uidSetAsRange(set imap.UIDSet) []folder.UIDRange {
 	return res
 }
 
+// resolveNumSet converts the sequence or UID set into the set of UIDs
+// known to the session.
+func (s *session) resolveNumSet(numSet imap.NumSet) (imap.UIDSet, error) {
+	switch set := numSet.(type) {
+	case imap.UIDSet:
+		if imap.IsSearchRes(set) {
+			if len(s.searchRes) == 0 {
+				return nil, mess.ErrNoMessages
+			}
+			// ResolveUID modifies the set in-place.
+			set = append(imap.UIDSet(nil), s.searchRes...)
+		}
+		return s.updateHandler.ResolveUID(set)
+	case imap.SeqSet:
+		return s.updateHandler.ResolveSeq(set)
+	default:
+		panic("unexpected NumSet type")
+	}
+}
+
+var (
+	supportedFlags = []imap.Flag{
+		imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged,
+		imap.FlagDeleted, imap.FlagDraft,
+	}
+	// Copied so that permanentFlags never shares the backing array
+	// with supportedFlags.
+	permanentFlags = append(append([]imap.Flag{}, supportedFlags...), imap.FlagWildcard)
+)
+
 func (s *session) Select(mailbox string, options *imap.SelectOptions) (*imap.SelectData, error) {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Select")
-	//defer task.End()
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Select")
+	defer task.End()
+
+	fold, entries, err := s.b.folders.Open(ctx, s.accountID, mailboxPath(mailbox))
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
 
-	//TODO implement me
-	panic("implement me")
+	uids := make([]imap.UID, len(entries))
+	for i, ent := range entries {
+		uids[i] = imap.UID(ent.UID_)
+	}
+
+	handle, err := s.b.updateManager.Mailbox(fold.ID_, uids, imap.UIDSet{})
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
+	if s.updateHandler != nil {
+		s.updateHandler.Close()
+	}
+
+	s.selectedFolderID = fold.ID_
+	s.updateHandler = handle
+	s.readOnly = options.ReadOnly
+	s.searchRes = nil
+	s.uids = nil
+	if s.qresync() {
+		// updateManager keeps the passed slice.
+		s.uids = append([]imap.UID(nil), uids...)
+	}
+
+	s.log.Debug("selected folder",
+		zap.Stringer("folder_id", fold.ID_), zap.Bool("read_only", s.readOnly))
+
+	data := &imap.SelectData{
+		Flags:          supportedFlags,
+		PermanentFlags: permanentFlags,
+		NumMessages:    uint32(len(uids)),
+		UIDNext:        imap.UID(fold.UIDNext_),
+		UIDValidity:    fold.UIDValidity_,
+		HighestModSeq:  highestModSeq(fold.ModSeq()),
+	}
+	if s.readOnly {
+		// No flags can be changed in EXAMINE-d mailbox.
+		data.PermanentFlags = nil
+	}
+
+	return data, nil
 }
 
 func (s *session) Status(mailbox string, options *imap.StatusOptions) (*imap.StatusData, error) {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Status")
-	//defer task.End()
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Status")
+	defer task.End()
 
-	//TODO implement me
-	panic("implement me")
+	path := mailboxPath(mailbox)
+	opts := &usecase.ListOpts{
+		Filter: folder.Filter{
+			Path: &path,
+		},
+	}
+	setStatusCounters(opts, options)
+
+	folders, err := s.b.folders.List(ctx, s.accountID, opts, folder.OrderByName)
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
+	if len(folders) == 0 {
+		return nil, s.asIMAPError(folder.ErrNotFound)
+	}
+
+	return s.statusData(mailbox, &folders[0], options), nil
 }
 
 func (s *session) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Expunge")
-	//defer task.End()
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Expunge")
+	defer task.End()
 
-	//TODO implement me
-	panic("implement me")
-}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 
-func (s *session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Search")
-	//defer task.End()
+	var ranges []folder.UIDRange
+	if uids != nil {
+		resolved, err := s.updateHandler.ResolveUID(*uids)
+		if err != nil {
+			if errors.Is(err, mess.ErrNoMessages) {
+				return nil
+			}
+			return err
+		}
+		ranges = uidSetAsRange(resolved)
+	}
 
-	//TODO implement me
-	panic("implement me")
-}
+	expunged, err := s.b.messages.Expunge(ctx, s.accountID, s.selectedFolderID, ranges)
+	if err != nil {
+		return s.asIMAPError(err)
+	}
+	if len(expunged) == 0 {
+		return nil
+	}
 
-func (s *session) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Fetch")
-	//defer task.End()
+	expungedUIDs := imap.UIDSet{}
+	for _, ent := range expunged {
+		expungedUIDs.AddNum(imap.UID(ent.UID_))
+	}
+	s.updateHandler.RemovedSet(expungedUIDs, true)
+	s.b.folderChanged(s.selectedFolderID)
 
-	//TODO implement me
-	panic("implement me")
+	if err := s.syncExpunge(w, expungedUIDs); err != nil {
+		s.log.Error("update synchronization error", zap.Error(err))
+		return s.c.Bye("Update synchronization failed, terminating connection to prevent corruption")
+	}
+	return nil
 }
 
-func (s *session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Store")
-	//defer task.End()
+func (s *session) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imapserver.StoreOptions) error {
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Store")
+	defer task.End()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	uids, err := s.resolveNumSet(numSet)
+	if err != nil {
+		if errors.Is(err, mess.ErrNoMessages) {
+			return nil
+		}
+		return err
+	}
+	_, byUID := numSet.(imap.UIDSet)
+
+	upd := message.FlagUpdate{
+		Flags: flagsFromIMAP(flags.Flags),
+	}
+	if options.UnchangedSince != nil {
+		unchangedSince := int64(*options.UnchangedSince)
+		upd.UnchangedSince = &unchangedSince
+	}
+	switch flags.Op {
+	case imap.StoreFlagsAdd:
+		upd.Op = message.FlagsAdd
+	case imap.StoreFlagsDel:
+		upd.Op = message.FlagsRemove
+	case imap.StoreFlagsSet:
+		upd.Op = message.FlagsReplace
+	default:
+		panic("unexpected StoreFlagsOp")
+	}
+
+	result, err := s.b.messages.UpdateFlags(ctx, s.accountID, s.selectedFolderID, uidSetAsRange(uids), upd)
+	if err != nil {
+		return s.asIMAPError(err)
+	}
+
+	for _, ent := range result.Changed {
+		s.updateHandler.FlagsChanged(imap.UID(ent.Entry.UID_), flagsAsIMAP(ent.Flags), true)
+	}
+	if len(result.Changed) != 0 {
+		s.b.folderChanged(s.selectedFolderID)
+	}
+
+	// RFC 7162: MODSEQ of changed messages is sent even for .SILENT.
+	condStore := s.condStore()
+	updated := result.Updated
+	if flags.Silent {
+		updated = nil
+		if condStore {
+			updated = result.Changed
+		}
+	}
+	for _, ent := range updated {
+		seq, ok := s.updateHandler.UidAsSeq(imap.UID(ent.Entry.UID_))
+		if !ok {
+			continue
+		}
+
+		resp := w.CreateMessage(seq)
+		if byUID {
+			resp.WriteUID(imap.UID(ent.Entry.UID_))
+		}
+		if !flags.Silent {
+			resp.WriteFlags(flagsAsIMAP(ent.Flags))
+		}
+		if condStore {
+			resp.WriteModSeq(uint64(ent.ModSeq))
+		}
+		if err := resp.Close(); err != nil {
+			return err
+		}
+	}
+
+	if len(result.Modified) != 0 {
+		var modified imap.NumSet
+		if byUID {
+			set := imap.UIDSet{}
+			for _, ent := range result.Modified {
+				set.AddNum(imap.UID(ent.UID_))
+			}
+			modified = set
+		} else {
+			set := imap.SeqSet{}
+			for _, ent := range result.Modified {
+				if seq, ok := s.updateHandler.UidAsSeq(imap.UID(ent.UID_)); ok {
+					set.AddNum(seq)
+				}
+			}
+			modified = set
+		}
+
+		return &imap.Error{
+			Type: imap.StatusResponseTypeOK,
+			Code: imap.ResponseCode("MODIFIED " + modified.String()),
+			Text: "Conditional STORE failed for some messages",
+		}
+	}
 
-	//TODO implement me
-	panic("implement me")
+	return nil
+}
+
+// flagsFromIMAP converts flags for storage, \Recent flag is dropped since
+// it cannot be set by clients.
+func flagsFromIMAP(flags []imap.Flag) []string {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if strings.EqualFold(string(f), `\Recent`) {
+			continue
+		}
+		res = append(res, string(f))
+	}
+	return res
 }
 
 func (s *session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string) error {
 	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Move")
 	defer task.End()
 
-	var uids imap.UIDSet
-	var err error
-	switch set := numSet.(type) {
-	case *imap.UIDSet:
-		uids, err = s.updateHandler.ResolveUID(*set)
-	case *imap.SeqSet:
-		uids, err = s.updateHandler.ResolveSeq(*set)
-	default:
-		panic("unexpected NumSet type")
+	if err := s.checkWritable(); err != nil {
+		return err
 	}
+
+	uids, err := s.resolveNumSet(numSet)
 	if err != nil {
 		return err
 	}
@@ -113,8 +329,10 @@ func (s *session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, dest string
 		// TODO: proper \Recent support
 	}
 	s.updateHandler.RemovedSet(sourceUIDs, true)
+	s.b.folderChanged(result.Target.ID_)
+	s.b.folderChanged(s.selectedFolderID)
 
-	if err := s.updateHandler.SyncSingleExpunge(w, sourceUIDs); err != nil {
+	if err := s.syncExpunge(w, sourceUIDs); err != nil {
 		s.log.Error("update synchronization error", zap.Error(err))
 		return s.c.Bye("Update synchronization failed, terminating connection to prevent corruption")
 	}
@@ -125,16 +343,7 @@ func (s *session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Move")
 	defer task.End()
 
-	var uids imap.UIDSet
-	var err error
-	switch set := numSet.(type) {
-	case *imap.UIDSet:
-		uids, err = s.updateHandler.ResolveUID(*set)
-	case *imap.SeqSet:
-		uids, err = s.updateHandler.ResolveSeq(*set)
-	default:
-		panic("unexpected NumSet type")
-	}
+	uids, err := s.resolveNumSet(numSet)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +366,7 @@ func (s *session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 	if storeRecent {
 		// TODO: proper \Recent support
 	}
+	s.b.folderChanged(result.Target.ID_)
 
 	return &imap.CopyData{
 		UIDValidity: result.Target.UIDValidity_,
@@ -166,11 +376,41 @@ func (s *session) Copy(numSet imap.NumSet, dest string) (*imap.CopyData, error)
 }
 
 func (s *session) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
-	//ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Append")
-	//defer task.End()
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Append")
+	defer task.End()
+
+	if limit := s.b.cfg.AppendLimit; limit != 0 && r.Size() > int64(limit) {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTooBig,
+			Text: "Message is too big",
+		}
+	}
 
-	//TODO implement me
-	panic("implement me")
+	result, err := s.b.messages.Append(ctx, s.accountID, mailboxPath(mailbox), r, flagsFromIMAP(options.Flags), options.Time)
+	if err != nil {
+		if errors.Is(err, folder.ErrNotFound) {
+			return nil, &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeTryCreate,
+				Text: "No such mailbox",
+			}
+		}
+		return nil, s.asIMAPError(err)
+	}
+
+	uids := imap.UIDSet{}
+	uids.AddNum(imap.UID(result.Entry.UID_))
+	storeRecent := s.b.updateManager.NewMessages(result.Folder.ID_, uids)
+	if storeRecent {
+		// TODO: proper \Recent support
+	}
+	s.b.folderChanged(result.Folder.ID_)
+
+	return &imap.AppendData{
+		UID:         imap.UID(result.Entry.UID_),
+		UIDValidity: result.Folder.UIDValidity_,
+	}, nil
 }
 
 func (s *session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
@@ -181,7 +421,7 @@ func (s *session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
 		return nil
 	}
 
-	return s.updateHandler.Sync(w, allowExpunge)
+	return s.sync(w, allowExpunge)
 }
 
 func (s *session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
@@ -193,10 +433,35 @@ func (s *session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
 		return nil
 	}
 
-	err := s.updateHandler.Idle(w, stop)
-	if err != nil {
+	if err := s.trackUIDs(); err != nil {
 		s.log.Error("update synchronization error in idle", zap.Error(err))
 		return s.c.Bye("Update synchronization failed, terminating connection to prevent corruption")
 	}
-	return nil
+	if s.uids == nil {
+		var uw mess.UpdateWriter = w
+		if s.condStore() {
+			uw = &updateWriter{s: s, w: w, vanished: imap.UIDSet{}}
+		}
+		err := s.updateHandler.Idle(uw, stop)
+		if err != nil {
+			s.log.Error("update synchronization error in idle", zap.Error(err))
+			return s.c.Bye("Update synchronization failed, terminating connection to prevent corruption")
+		}
+		return nil
+	}
+
+	// s.uids has to be updated after each synchronization with the handle
+	// unlocked, which is not possible with updateHandler.Idle.
+	for {
+		changed := s.b.watchFolder(s.selectedFolderID)
+		if err := s.sync(w, true); err != nil {
+			s.log.Error("update synchronization error in idle", zap.Error(err))
+			return s.c.Bye("Update synchronization failed, terminating connection to prevent corruption")
+		}
+		select {
+		case <-changed:
+		case <-stop:
+			return nil
+		}
+	}
 }
@@ -0,0 +1,114 @@
+package imap2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/stretchr/testify/require"
+)
+
+// jmapCall sends a single JMAP method call and returns the response
+// arguments.
+func jmapCall(t *testing.T, url, method string, args map[string]any) map[string]any {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{
+		"using":       []string{"urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail"},
+		"methodCalls": []any{[]any{method, args, "0"}},
+	})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url+"/jmap/api", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth(testUsername, "password")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var res struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Len(t, res.MethodResponses, 1)
+	var name string
+	require.NoError(t, json.Unmarshal(res.MethodResponses[0][0], &name))
+	var resArgs map[string]any
+	require.NoError(t, json.Unmarshal(res.MethodResponses[0][1], &resArgs))
+	require.Equal(t, method, name, resArgs)
+	return resArgs
+}
+
+func TestJMAPUpdates(t *testing.T) {
+	srv := newTestServer(t)
+	jmapURL := srv.serveJMAP(t)
+
+	flags := make(chan []imap.Flag, 10)
+	expunged := make(chan uint32, 10)
+	c := srv.dial(t, &imapclient.UnilateralDataHandler{
+		Fetch: func(msg *imapclient.FetchMessageData) {
+			buf, err := msg.Collect()
+			if err == nil && buf.Flags != nil {
+				flags <- buf.Flags
+			}
+		},
+		Expunge: func(seqNum uint32) {
+			expunged <- seqNum
+		},
+	})
+	appendMsg(t, c, "INBOX", testMessage("first", "1"))
+	appendMsg(t, c, "INBOX", testMessage("second", "2"))
+	appendMsg(t, c, "INBOX", testMessage("third", "3"))
+	require.NoError(t, c.Create("Archive", nil).Wait())
+	_, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+
+	accountID := srv.accountID
+	mailboxes := jmapCall(t, jmapURL, "Mailbox/get", map[string]any{"accountId": accountID})
+	var archiveID string
+	for _, mbox := range mailboxes["list"].([]any) {
+		mbox := mbox.(map[string]any)
+		if mbox["name"] == "Archive" {
+			archiveID = mbox["id"].(string)
+		}
+	}
+	require.NotEmpty(t, archiveID)
+	query := jmapCall(t, jmapURL, "Email/query", map[string]any{
+		"accountId": accountID,
+		"sort":      []any{map[string]any{"property": "receivedAt", "isAscending": true}},
+	})
+	ids := query["ids"].([]any)
+	require.Len(t, ids, 3)
+
+	res := jmapCall(t, jmapURL, "Email/set", map[string]any{
+		"accountId": accountID,
+		"update": map[string]any{
+			ids[0].(string): map[string]any{"keywords/$flagged": true},
+		},
+	})
+	require.Contains(t, res["updated"], ids[0])
+	require.NoError(t, c.Noop().Wait())
+	require.Equal(t, []imap.Flag{imap.FlagFlagged}, waitUpdate(t, flags))
+
+	res = jmapCall(t, jmapURL, "Email/set", map[string]any{
+		"accountId": accountID,
+		"update": map[string]any{
+			ids[1].(string): map[string]any{"mailboxIds": map[string]any{archiveID: true}},
+		},
+	})
+	require.Contains(t, res["updated"], ids[1])
+	require.NoError(t, c.Noop().Wait())
+	require.EqualValues(t, 2, waitUpdate(t, expunged))
+
+	res = jmapCall(t, jmapURL, "Email/set", map[string]any{
+		"accountId": accountID,
+		"destroy":   []any{ids[2]},
+	})
+	require.Equal(t, []any{ids[2]}, res["destroyed"])
+	require.NoError(t, c.Noop().Wait())
+	require.EqualValues(t, 2, waitUpdate(t, expunged))
+	require.EqualValues(t, 1, c.Mailbox().NumMessages)
+}
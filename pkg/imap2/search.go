@@ -0,0 +1,236 @@
+package imap2
+
+import (
+	"errors"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	mess "github.com/foxcpp/go-imap-mess/v2"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
+	"github.com/oklog/ulid/v2"
+)
+
+func (s *session) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	ctx, task := trace.NewTask(s.ctx, "maddy-storage/imap2.Search")
+	defer task.End()
+
+	cond, err := s.searchCond(criteria)
+	if err != nil {
+		return nil, err
+	}
+	cond.FolderIDs = []ulid.ULID{s.selectedFolderID}
+
+	entries, err := s.b.folders.Search(ctx, s.accountID, cond)
+	if err != nil {
+		return nil, s.asIMAPError(err)
+	}
+
+	var (
+		uids    imap.UIDSet
+		seqNums imap.SeqSet
+		nums    []uint32
+	)
+	for _, ent := range entries {
+		// Skip messages the client does not know about yet.
+		seq, ok := s.updateHandler.UidAsSeq(imap.UID(ent.UID_))
+		if !ok {
+			continue
+		}
+		uids.AddNum(imap.UID(ent.UID_))
+		seqNums.AddNum(seq)
+		if kind == imapserver.NumKindUID {
+			nums = append(nums, ent.UID_)
+		} else {
+			nums = append(nums, seq)
+		}
+	}
+
+	data := &imap.SearchData{
+		UID:   kind == imapserver.NumKindUID,
+		Count: uint32(len(nums)),
+	}
+	if kind == imapserver.NumKindUID {
+		data.All = uids
+	} else {
+		data.All = seqNums
+	}
+	if len(nums) != 0 {
+		// Entries are sorted by UID, so sequence numbers are sorted too.
+		data.Min = nums[0]
+		data.Max = nums[len(nums)-1]
+	}
+	if len(nums) != 0 && hasModSeq(criteria) {
+		// RFC 7162: the highest mod-sequence of found messages is returned.
+		data.ModSeq, err = s.highestMsgModSeq(uids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.ReturnSave {
+		s.searchRes = uids
+		// RFC 5182: if only MIN and/or MAX are requested, only these
+		// messages are saved.
+		if len(uids) != 0 && !options.ReturnAll && !options.ReturnCount {
+			all, _ := uids.Nums()
+			s.searchRes = imap.UIDSet{}
+			if options.ReturnMin {
+				s.searchRes.AddNum(all[0])
+			}
+			if options.ReturnMax {
+				s.searchRes.AddNum(all[len(all)-1])
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// searchCond converts IMAP search criteria into the SearchCond for the
+// currently selected folder.
+func (s *session) searchCond(criteria *imap.SearchCriteria) (*folder.SearchCond, error) {
+	cond := &folder.SearchCond{
+		DateSince: criteria.Since,
+		DateUntil: criteria.Before,
+		SentSince: criteria.SentSince,
+		SentUntil: criteria.SentBefore,
+		Body:      criteria.Body,
+		Text:      criteria.Text,
+	}
+
+	// FROM, TO, CC, BCC and SUBJECT keys are parsed as HEADER too.
+	for _, h := range criteria.Header {
+		switch strings.ToLower(h.Key) {
+		case "from":
+			cond.From = append(cond.From, h.Value)
+		case "to":
+			cond.To = append(cond.To, h.Value)
+		case "cc":
+			cond.Cc = append(cond.Cc, h.Value)
+		case "bcc":
+			cond.Bcc = append(cond.Bcc, h.Value)
+		case "subject":
+			cond.Subject = append(cond.Subject, h.Value)
+		default:
+			cond.Header = append(cond.Header, folder.HeaderCond{
+				Name:  h.Key,
+				Value: h.Value,
+			})
+		}
+	}
+
+	for _, set := range criteria.SeqNum {
+		uids, err := s.resolveSearchSet(set)
+		if err != nil {
+			return nil, err
+		}
+		cond.Or = append(cond.Or, []*folder.SearchCond{{UIDs: uids}})
+	}
+	for _, set := range criteria.UID {
+		uids, err := s.resolveSearchSet(set)
+		if err != nil {
+			return nil, err
+		}
+		cond.Or = append(cond.Or, []*folder.SearchCond{{UIDs: uids}})
+	}
+
+	for _, f := range criteria.Flag {
+		cond.Flag = append(cond.Flag, string(f))
+	}
+	for _, f := range criteria.NotFlag {
+		cond.NoFlag = append(cond.NoFlag, string(f))
+	}
+
+	if criteria.Larger != 0 {
+		cond.SizeSince = criteria.Larger + 1
+	}
+	if criteria.Smaller != 0 {
+		cond.SizeUntil = criteria.Smaller
+	}
+	if criteria.ModSeq != nil {
+		cond.ModSeqSince = int64(criteria.ModSeq.ModSeq)
+	}
+
+	// NOT a NOT b is NOT (a OR b).
+	if len(criteria.Not) != 0 {
+		group := make([]*folder.SearchCond, 0, len(criteria.Not))
+		for i := range criteria.Not {
+			notCond, err := s.searchCond(&criteria.Not[i])
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, notCond)
+		}
+		cond.Not = &folder.SearchCond{Or: [][]*folder.SearchCond{group}}
+	}
+	for i := range criteria.Or {
+		lhs, err := s.searchCond(&criteria.Or[i][0])
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := s.searchCond(&criteria.Or[i][1])
+		if err != nil {
+			return nil, err
+		}
+		cond.Or = append(cond.Or, []*folder.SearchCond{lhs, rhs})
+	}
+
+	return cond, nil
+}
+
+// resolveSearchSet converts the set into UID ranges. Unlike other commands,
+// empty result is not an error for SEARCH, non-nil empty slice is returned
+// instead so the condition matches nothing.
+func (s *session) resolveSearchSet(numSet imap.NumSet) ([]folder.UIDRange, error) {
+	if set, ok := numSet.(imap.UIDSet); ok && !imap.IsSearchRes(set) {
+		// ResolveUID modifies the set in-place.
+		numSet = append(imap.UIDSet(nil), set...)
+	}
+	uids, err := s.resolveNumSet(numSet)
+	if err != nil {
+		if errors.Is(err, mess.ErrNoMessages) {
+			return []folder.UIDRange{}, nil
+		}
+		return nil, err
+	}
+	return uidSetAsRange(uids), nil
+}
+
+func hasModSeq(criteria *imap.SearchCriteria) bool {
+	if criteria.ModSeq != nil {
+		return true
+	}
+	for i := range criteria.Not {
+		if hasModSeq(&criteria.Not[i]) {
+			return true
+		}
+	}
+	for i := range criteria.Or {
+		if hasModSeq(&criteria.Or[i][0]) || hasModSeq(&criteria.Or[i][1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// highestMsgModSeq returns the highest mod-sequence of messages in the
+// selected folder.
+func (s *session) highestMsgModSeq(uids imap.UIDSet) (uint64, error) {
+	ids, err := s.b.folders.SearchMsgIDs(s.ctx, s.accountID, &folder.SearchCond{
+		FolderIDs: []ulid.ULID{s.selectedFolderID},
+		UIDs:      uidSetAsRange(uids),
+	}, []folder.SearchOrder{{Key: folder.SortModSeq, Desc: true}}, 1)
+	if err != nil {
+		return 0, s.asIMAPError(err)
+	}
+	msgs, err := s.b.messages.GetByIDs(s.ctx, s.accountID, ids...)
+	if err != nil {
+		return 0, s.asIMAPError(err)
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	return uint64(msgs[0].Msg.ModSeq()), nil
+}
@@ -7,10 +7,10 @@ import (
 	"runtime/trace"
 
 	"github.com/emersion/go-imap/v2"
-	"github.com/emersion/go-imap/v2/imapserver"
 	mess "github.com/foxcpp/go-imap-mess/v2"
 	"github.com/foxcpp/maddy-storage/internal/domain/folder"
 	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver"
 	"github.com/oklog/ulid/v2"
 	"go.uber.org/zap"
 )
@@ -24,6 +24,10 @@ type session struct {
 	selectedFolderID ulid.ULID
 	updateHandler    *mess.MailboxHandle[ulid.ULID]
 	readOnly         bool
+	searchRes        imap.UIDSet // saved by SEARCH RETURN (SAVE)
+	// UIDs known to the client in sequence number order, only maintained
+	// if QRESYNC is enabled, see condstore.go.
+	uids []imap.UID
 
 	log           *zap.Logger
 	ctx           context.Context
@@ -42,6 +46,19 @@ func (s *session) Unauthenticate() error {
 	return nil
 }
 
+// checkWritable returns an error if the selected folder was opened using
+// EXAMINE and cannot be modified.
+func (s *session) checkWritable() error {
+	if s.readOnly {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Mailbox is opened in read-only mode",
+		}
+	}
+	return nil
+}
+
 func (s *session) Namespace() (*imap.NamespaceData, error) {
 	return &imap.NamespaceData{
 		Personal: []imap.NamespaceDescriptor{
@@ -0,0 +1,372 @@
+package imap2_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailboxes(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	require.NoError(t, c.Create("Work", nil).Wait())
+	require.NoError(t, c.Create("Work/Projects", nil).Wait())
+	require.Error(t, c.Create("Work", nil).Wait())
+	require.ElementsMatch(t, []string{"INBOX", "Work", "Work/Projects"}, listMailboxes(t, c))
+
+	require.NoError(t, c.Rename("Work", "Archive").Wait())
+	require.ElementsMatch(t, []string{"INBOX", "Archive", "Archive/Projects"}, listMailboxes(t, c))
+	require.Error(t, c.Rename("Work", "Other").Wait())
+
+	require.NoError(t, c.Delete("Archive/Projects").Wait())
+	require.NoError(t, c.Delete("Archive").Wait())
+	require.Error(t, c.Delete("Archive").Wait())
+	require.Equal(t, []string{"INBOX"}, listMailboxes(t, c))
+}
+
+func TestAppendFetch(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	msg := testMessage("hello", "Hello, world!")
+	appended := appendMsg(t, c, "INBOX", msg, imap.FlagSeen)
+	require.Equal(t, imap.UID(1), appended.UID)
+
+	selected, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, selected.NumMessages)
+	require.Equal(t, appended.UIDValidity, selected.UIDValidity)
+
+	msgs, err := c.Fetch(imap.SeqSetNum(1), &imap.FetchOptions{
+		UID:         true,
+		Flags:       true,
+		Envelope:    true,
+		RFC822Size:  true,
+		BodySection: []*imap.FetchItemBodySection{{}},
+	}).Collect()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, appended.UID, msgs[0].UID)
+	require.Equal(t, []imap.Flag{imap.FlagSeen}, msgs[0].Flags)
+	require.Equal(t, "hello", msgs[0].Envelope.Subject)
+	require.EqualValues(t, len(msg), msgs[0].RFC822Size)
+	require.Len(t, msgs[0].BodySection, 1)
+	for _, body := range msgs[0].BodySection {
+		require.Equal(t, msg, string(body))
+	}
+
+	_, err = c.Select("Missing", nil).Wait()
+	require.Error(t, err)
+}
+
+func TestCopyMove(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	appendMsg(t, c, "INBOX", testMessage("first", "1"))
+	appendMsg(t, c, "INBOX", testMessage("second", "2"))
+	require.NoError(t, c.Create("Archive", nil).Wait())
+
+	_, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+
+	copied, err := c.Copy(imap.SeqSetNum(1), "Archive").Wait()
+	require.NoError(t, err)
+	require.Equal(t, "1", copied.SourceUIDs.String())
+	require.Equal(t, "1", copied.DestUIDs.String())
+
+	moved, err := c.Move(imap.SeqSetNum(2), "Archive").Wait()
+	require.NoError(t, err)
+	require.Equal(t, "2", moved.SourceUIDs.String())
+	require.Equal(t, "2", moved.DestUIDs.String())
+	require.EqualValues(t, 1, c.Mailbox().NumMessages)
+
+	status, err := c.Status("Archive", &imap.StatusOptions{NumMessages: true}).Wait()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, *status.NumMessages)
+
+	_, err = c.Select("Archive", nil).Wait()
+	require.NoError(t, err)
+	msgs, err := c.Fetch(imap.SeqSetNum(1, 2), &imap.FetchOptions{Envelope: true}).Collect()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, "first", msgs[0].Envelope.Subject)
+	require.Equal(t, "second", msgs[1].Envelope.Subject)
+}
+
+func TestIdle(t *testing.T) {
+	srv := newTestServer(t)
+
+	exists := make(chan uint32, 10)
+	expunged := make(chan uint32, 10)
+	watcher := srv.dial(t, &imapclient.UnilateralDataHandler{
+		Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+			if data.NumMessages != nil {
+				exists <- *data.NumMessages
+			}
+		},
+		Expunge: func(seqNum uint32) {
+			expunged <- seqNum
+		},
+	})
+	c := srv.dial(t, nil)
+
+	_, err := watcher.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+	idle, err := watcher.Idle()
+	require.NoError(t, err)
+
+	appendMsg(t, c, "INBOX", testMessage("first", "1"))
+	require.EqualValues(t, 1, waitUpdate(t, exists))
+	appendMsg(t, c, "INBOX", testMessage("second", "2"))
+	require.EqualValues(t, 2, waitUpdate(t, exists))
+
+	_, err = c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+	require.NoError(t, c.Create("Archive", nil).Wait())
+	_, err = c.Move(imap.SeqSetNum(1), "Archive").Wait()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, waitUpdate(t, expunged))
+
+	require.NoError(t, idle.Close())
+	require.NoError(t, idle.Wait())
+	require.EqualValues(t, 1, watcher.Mailbox().NumMessages)
+}
+
+func TestSelectFlags(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	flags := []imap.Flag{
+		imap.FlagSeen, imap.FlagAnswered, imap.FlagFlagged,
+		imap.FlagDeleted, imap.FlagDraft,
+	}
+
+	selected, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+	require.Equal(t, flags, selected.Flags)
+	require.Equal(t, append(flags, imap.FlagWildcard), selected.PermanentFlags)
+	require.EqualValues(t, 1, selected.UIDNext)
+
+	examined, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait()
+	require.NoError(t, err)
+	require.Equal(t, flags, examined.Flags)
+	require.Empty(t, examined.PermanentFlags)
+}
+
+func TestAppend(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	date := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	msg := testMessage("first", "1")
+	cmd := c.Append("INBOX", int64(len(msg)), &imap.AppendOptions{
+		Flags: []imap.Flag{imap.FlagFlagged, "$Custom"},
+		Time:  date,
+	})
+	_, err := cmd.Write([]byte(msg))
+	require.NoError(t, err)
+	require.NoError(t, cmd.Close())
+	first, err := cmd.Wait()
+	require.NoError(t, err)
+	second := appendMsg(t, c, "INBOX", testMessage("second", "2"))
+	require.Equal(t, first.UIDValidity, second.UIDValidity)
+	require.Greater(t, second.UID, first.UID)
+
+	_, err = c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+	fetched := fetchOne(t, c, &imap.FetchOptions{Flags: true, InternalDate: true})
+	require.ElementsMatch(t, []imap.Flag{imap.FlagFlagged, "$Custom"}, fetched.Flags)
+	require.True(t, date.Equal(fetched.InternalDate))
+
+	cmd = c.Append("Missing", int64(len(msg)), nil)
+	_, err = cmd.Write([]byte(msg))
+	require.NoError(t, err)
+	require.NoError(t, cmd.Close())
+	_, err = cmd.Wait()
+	var imapErr *imap.Error
+	require.ErrorAs(t, err, &imapErr)
+	require.Equal(t, imap.ResponseCodeTryCreate, imapErr.Code)
+}
+
+func TestStore(t *testing.T) {
+	srv := newTestServer(t)
+	c := srv.dial(t, nil)
+	appendMsg(t, c, "INBOX", testMessage("first", "1"))
+	appendMsg(t, c, "INBOX", testMessage("second", "2"), imap.FlagSeen)
+
+	_, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+
+	store := func(op imap.StoreFlagsOp, silent bool, flags ...imap.Flag) []*imapclient.FetchMessageBuffer {
+		t.Helper()
+		msgs, err := c.Store(imap.SeqSetNum(1, 2), &imap.StoreFlags{
+			Op:     op,
+			Silent: silent,
+			Flags:  flags,
+		}, nil).Collect()
+		require.NoError(t, err)
+		return msgs
+	}
+	flags := func() [][]imap.Flag {
+		t.Helper()
+		msgs, err := c.Fetch(imap.SeqSetNum(1, 2), &imap.FetchOptions{Flags: true}).Collect()
+		require.NoError(t, err)
+		res := make([][]imap.Flag, len(msgs))
+		for i, msg := range msgs {
+			res[i] = msg.Flags
+		}
+		return res
+	}
+
+	msgs := store(imap.StoreFlagsAdd, false, imap.FlagFlagged, "$Label")
+	require.Len(t, msgs, 2)
+	require.ElementsMatch(t, []imap.Flag{imap.FlagFlagged, "$Label"}, msgs[0].Flags)
+	require.ElementsMatch(t, []imap.Flag{imap.FlagSeen, imap.FlagFlagged, "$Label"}, msgs[1].Flags)
+
+	require.Empty(t, store(imap.StoreFlagsDel, true, imap.FlagFlagged, imap.FlagSeen))
+	res := flags()
+	require.Equal(t, []imap.Flag{"$Label"}, res[0])
+	require.Equal(t, []imap.Flag{"$Label"}, res[1])
+
+	store(imap.StoreFlagsSet, true, imap.FlagAnswered)
+	res = flags()
+	require.Equal(t, []imap.Flag{imap.FlagAnswered}, res[0])
+	require.Equal(t, []imap.Flag{imap.FlagAnswered}, res[1])
+
+	_, err = c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait()
+	require.NoError(t, err)
+	_, err = c.Store(imap.SeqSetNum(1), &imap.StoreFlags{
+		Op:    imap.StoreFlagsAdd,
+		Flags: []imap.Flag{imap.FlagDeleted},
+	}, nil).Collect()
+	require.Error(t, err)
+}
+
+func TestStatus(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	first := testMessage("first", "1")
+	second := testMessage("second", "22")
+	appendMsg(t, c, "INBOX", first, imap.FlagSeen)
+	appendMsg(t, c, "INBOX", second, imap.FlagDeleted)
+	require.NoError(t, c.Create("Empty", nil).Wait())
+
+	options := &imap.StatusOptions{
+		NumMessages:    true,
+		UIDNext:        true,
+		NumUnseen:      true,
+		NumDeleted:     true,
+		Size:           true,
+		DeletedStorage: true,
+	}
+	status, err := c.Status("INBOX", options).Wait()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, *status.NumMessages)
+	require.EqualValues(t, 3, status.UIDNext)
+	require.EqualValues(t, 1, *status.NumUnseen)
+	require.EqualValues(t, 1, *status.NumDeleted)
+	require.EqualValues(t, len(first)+len(second), *status.Size)
+	require.EqualValues(t, len(second), *status.DeletedStorage)
+
+	_, err = c.Status("Missing", options).Wait()
+	require.Error(t, err)
+
+	list, err := c.List("", "*", &imap.ListOptions{
+		ReturnStatus: &imap.StatusOptions{NumMessages: true, NumUnseen: true},
+	}).Collect()
+	require.NoError(t, err)
+	counts := map[string][2]uint32{}
+	for _, data := range list {
+		require.NotNil(t, data.Status)
+		counts[data.Mailbox] = [2]uint32{*data.Status.NumMessages, *data.Status.NumUnseen}
+	}
+	require.Equal(t, map[string][2]uint32{
+		"INBOX": {2, 1},
+		"Empty": {0, 0},
+	}, counts)
+}
+
+func TestSearch(t *testing.T) {
+	c := newTestServer(t).dial(t, nil)
+
+	appendMsg(t, c, "INBOX", testMessage("apples", "red fruit"), imap.FlagSeen)
+	appendMsg(t, c, "INBOX", testMessage("bananas", "yellow fruit"))
+	appendMsg(t, c, "INBOX", testMessage("carrots", "orange vegetable "+strings.Repeat("x", 1000)), imap.FlagFlagged)
+	_, err := c.Select("INBOX", nil).Wait()
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		res      []uint32
+	}{
+		{
+			name:     "all",
+			criteria: &imap.SearchCriteria{},
+			res:      []uint32{1, 2, 3},
+		},
+		{
+			name:     "flag",
+			criteria: &imap.SearchCriteria{NotFlag: []imap.Flag{imap.FlagSeen}},
+			res:      []uint32{2, 3},
+		},
+		{
+			name: "subject",
+			criteria: &imap.SearchCriteria{
+				Header: []imap.SearchCriteriaHeaderField{{Key: "Subject", Value: "BANANA"}},
+			},
+			res: []uint32{2},
+		},
+		{
+			name:     "body",
+			criteria: &imap.SearchCriteria{Body: []string{"fruit"}},
+			res:      []uint32{1, 2},
+		},
+		{
+			name:     "larger",
+			criteria: &imap.SearchCriteria{Larger: 500},
+			res:      []uint32{3},
+		},
+		{
+			name: "sent date",
+			criteria: &imap.SearchCriteria{
+				SentSince:  time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC),
+				SentBefore: time.Date(2006, 1, 3, 0, 0, 0, 0, time.UTC),
+			},
+			res: []uint32{1, 2, 3},
+		},
+		{
+			name: "or",
+			criteria: &imap.SearchCriteria{
+				Or: [][2]imap.SearchCriteria{{
+					{Flag: []imap.Flag{imap.FlagFlagged}},
+					{Flag: []imap.Flag{imap.FlagSeen}},
+				}},
+			},
+			res: []uint32{1, 3},
+		},
+		{
+			name: "not",
+			criteria: &imap.SearchCriteria{
+				Not: []imap.SearchCriteria{{Body: []string{"yellow"}}},
+			},
+			res: []uint32{1, 3},
+		},
+		{
+			name: "sequence set",
+			criteria: &imap.SearchCriteria{
+				SeqNum: []imap.SeqSet{imap.SeqSetNum(2, 3)},
+				Body:   []string{"fruit"},
+			},
+			res: []uint32{2},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := c.Search(tc.criteria, nil).Wait()
+			require.NoError(t, err)
+			require.Equal(t, tc.res, data.AllSeqNums())
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package imapserver
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver/internal/imapwire"
+)
+
+func (c *Conn) handleEnable(dec *imapwire.Decoder) error {
+	var requested []imap.Cap
+	for dec.SP() {
+		var c string
+		if !dec.ExpectAtom(&c) {
+			return dec.Err()
+		}
+		requested = append(requested, imap.Cap(strings.ToUpper(c)))
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return err
+	}
+
+	available := c.server.options.caps()
+	var enabled []imap.Cap
+	for _, req := range requested {
+		switch req {
+		case imap.CapIMAP4rev2, imap.CapUTF8Accept:
+			enabled = append(enabled, req)
+		case imap.CapCondStore, imap.CapQResync:
+			// QRESYNC implies CONDSTORE, see imap.CapSet.Has.
+			if available.Has(req) {
+				enabled = append(enabled, req)
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	for _, e := range enabled {
+		c.enabled[e] = struct{}{}
+	}
+	c.mutex.Unlock()
+
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("ENABLED")
+	for _, c := range enabled {
+		enc.SP().Atom(string(c))
+	}
+	return enc.CRLF()
+}
@@ -0,0 +1,289 @@
+package imapserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver/internal/imapwire"
+)
+
+func (c *Conn) handleSelect(tag string, dec *imapwire.Decoder, readOnly bool) error {
+	var (
+		mailbox string
+		options = imap.SelectOptions{ReadOnly: readOnly}
+		qresync *selectQResync
+	)
+	if !dec.ExpectSP() || !dec.ExpectMailbox(&mailbox) {
+		return dec.Err()
+	}
+	if dec.SP() {
+		err := dec.ExpectList(func() error {
+			var name string
+			if !dec.ExpectAtom(&name) {
+				return dec.Err()
+			}
+			switch strings.ToUpper(name) {
+			case "CONDSTORE":
+				options.CondStore = true
+			case "QRESYNC":
+				if !dec.ExpectSP() {
+					return dec.Err()
+				}
+				var err error
+				qresync, err = readSelectQResync(dec)
+				return err
+			default:
+				return newClientBugError("Unknown SELECT parameter")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	if err := c.checkState(imap.ConnStateAuthenticated); err != nil {
+		return err
+	}
+	if qresync != nil && !c.Enabled().Has(imap.CapQResync) {
+		return newClientBugError("QRESYNC is not enabled")
+	}
+	if options.CondStore || qresync != nil {
+		if err := c.enableCondStore(); err != nil {
+			return err
+		}
+		options.CondStore = true
+	}
+
+	if c.state == imap.ConnStateSelected {
+		if err := c.session.Unselect(); err != nil {
+			return err
+		}
+		c.state = imap.ConnStateAuthenticated
+		err := c.writeStatusResp("", &imap.StatusResponse{
+			Type: imap.StatusResponseTypeOK,
+			Code: "CLOSED",
+			Text: "Previous mailbox is now closed",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := c.session.Select(mailbox, &options)
+	if err != nil {
+		return err
+	}
+
+	if err := c.writeExists(data.NumMessages); err != nil {
+		return err
+	}
+	if !c.enabled.Has(imap.CapIMAP4rev2) {
+		if err := c.writeObsoleteRecent(); err != nil {
+			return err
+		}
+	}
+	if err := c.writeUIDValidity(data.UIDValidity); err != nil {
+		return err
+	}
+	if err := c.writeUIDNext(data.UIDNext); err != nil {
+		return err
+	}
+	if err := c.writeFlags(data.Flags); err != nil {
+		return err
+	}
+	if err := c.writePermanentFlags(data.PermanentFlags); err != nil {
+		return err
+	}
+	if data.List != nil {
+		if err := c.writeList(data.List); err != nil {
+			return err
+		}
+	}
+	if data.HighestModSeq != 0 {
+		if err := c.writeHighestModSeq(data.HighestModSeq); err != nil {
+			return err
+		}
+	}
+
+	c.state = imap.ConnStateSelected
+
+	if qresync != nil && qresync.uidValidity == data.UIDValidity {
+		if err := c.resync(qresync); err != nil {
+			return err
+		}
+	}
+	// TODO: forbid write commands in read-only mode
+
+	var (
+		cmdName string
+		code    imap.ResponseCode
+	)
+	if readOnly {
+		cmdName = "EXAMINE"
+		code = "READ-ONLY"
+	} else {
+		cmdName = "SELECT"
+		code = "READ-WRITE"
+	}
+	return c.writeStatusResp(tag, &imap.StatusResponse{
+		Type: imap.StatusResponseTypeOK,
+		Code: code,
+		Text: fmt.Sprintf("%v completed", cmdName),
+	})
+}
+
+func (c *Conn) handleUnselect(dec *imapwire.Decoder, expunge bool) error {
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	if err := c.checkState(imap.ConnStateSelected); err != nil {
+		return err
+	}
+
+	if expunge {
+		w := &ExpungeWriter{}
+		if err := c.session.Expunge(w, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := c.session.Unselect(); err != nil {
+		return err
+	}
+
+	c.state = imap.ConnStateAuthenticated
+	return nil
+}
+
+func (c *Conn) writeExists(numMessages uint32) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	return enc.Atom("*").SP().Number(numMessages).SP().Atom("EXISTS").CRLF()
+}
+
+func (c *Conn) writeObsoleteRecent() error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	return enc.Atom("*").SP().Number(0).SP().Atom("RECENT").CRLF()
+}
+
+func (c *Conn) writeUIDValidity(uidValidity uint32) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("UIDVALIDITY").SP().Number(uidValidity).Special(']')
+	enc.SP().Text("UIDs valid")
+	return enc.CRLF()
+}
+
+func (c *Conn) writeUIDNext(uidNext imap.UID) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("UIDNEXT").SP().UID(uidNext).Special(']')
+	enc.SP().Text("Predicted next UID")
+	return enc.CRLF()
+}
+
+func (c *Conn) writeFlags(flags []imap.Flag) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("FLAGS").SP().List(len(flags), func(i int) {
+		enc.Flag(flags[i])
+	})
+	return enc.CRLF()
+}
+
+func (c *Conn) writeHighestModSeq(modSeq uint64) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("HIGHESTMODSEQ").SP().ModSeq(modSeq).Special(']')
+	enc.SP().Text("Highest mod-sequence")
+	return enc.CRLF()
+}
+
+func (c *Conn) writePermanentFlags(flags []imap.Flag) error {
+	enc := newResponseEncoder(c)
+	defer enc.end()
+	enc.Atom("*").SP().Atom("OK").SP()
+	enc.Special('[').Atom("PERMANENTFLAGS").SP().List(len(flags), func(i int) {
+		enc.Flag(flags[i])
+	}).Special(']')
+	enc.SP().Text("Permanent flags")
+	return enc.CRLF()
+}
+
+// selectQResync contains the QRESYNC parameter of SELECT and EXAMINE.
+type selectQResync struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   imap.UIDSet
+}
+
+func readSelectQResync(dec *imapwire.Decoder) (*selectQResync, error) {
+	var qresync selectQResync
+	if !dec.ExpectSpecial('(') || !dec.ExpectNumber(&qresync.uidValidity) || !dec.ExpectSP() || !dec.ExpectModSeq(&qresync.modSeq) {
+		return nil, dec.Err()
+	}
+	if dec.SP() {
+		hasSeqMatch := dec.Special('(')
+		if !hasSeqMatch {
+			if !dec.ExpectUIDSet(&qresync.knownUIDs) {
+				return nil, dec.Err()
+			}
+			if dec.SP() {
+				if !dec.ExpectSpecial('(') {
+					return nil, dec.Err()
+				}
+				hasSeqMatch = true
+			}
+		}
+		if hasSeqMatch {
+			// The sequence match data only helps to reduce the size of
+			// the VANISHED response, so it is parsed and ignored.
+			var (
+				seqNums imap.NumSet
+				uids    imap.UIDSet
+			)
+			if !dec.ExpectNumSet(imapwire.NumKindSeq, &seqNums) || !dec.ExpectSP() || !dec.ExpectUIDSet(&uids) || !dec.ExpectSpecial(')') {
+				return nil, dec.Err()
+			}
+		}
+	}
+	if !dec.ExpectSpecial(')') {
+		return nil, dec.Err()
+	}
+	return &qresync, nil
+}
+
+// resync sends the changes since the mod-sequence known to the client
+// after the mailbox is selected with the QRESYNC parameter.
+func (c *Conn) resync(qresync *selectQResync) error {
+	uids := qresync.knownUIDs
+	if uids == nil {
+		uids = imap.UIDSet{imap.UIDRange{Start: 1, Stop: 0}}
+	}
+
+	vanished, err := c.session.(SessionQResync).Vanished(uids, qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	if err := c.writeVanished(vanished, true); err != nil {
+		return err
+	}
+
+	w := &FetchWriter{conn: c}
+	return c.session.Fetch(w, uids, &imap.FetchOptions{
+		UID:          true,
+		Flags:        true,
+		ModSeq:       true,
+		ChangedSince: qresync.modSeq,
+	})
+}
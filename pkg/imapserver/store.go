@@ -0,0 +1,108 @@
+package imapserver
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver/internal"
+	"github.com/foxcpp/maddy-storage/pkg/imapserver/internal/imapwire"
+)
+
+func (c *Conn) handleStore(dec *imapwire.Decoder, numKind NumKind) error {
+	var (
+		numSet  imap.NumSet
+		item    string
+		options StoreOptions
+	)
+	if !dec.ExpectSP() || !dec.ExpectNumSet(numKind.wire(), &numSet) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+	if dec.Special('(') {
+		var modifier string
+		if !dec.ExpectAtom(&modifier) {
+			return dec.Err()
+		}
+		if !strings.EqualFold(modifier, "UNCHANGEDSINCE") {
+			return newClientBugError("Unknown STORE modifier")
+		}
+		var modSeq uint64
+		if !dec.ExpectSP() || !dec.ExpectModSeq(&modSeq) || !dec.ExpectSpecial(')') || !dec.ExpectSP() {
+			return dec.Err()
+		}
+		options.UnchangedSince = &modSeq
+	}
+	if !dec.ExpectAtom(&item) || !dec.ExpectSP() {
+		return dec.Err()
+	}
+	var flags []imap.Flag
+	isList, err := dec.List(func() error {
+		flag, err := internal.ExpectFlag(dec)
+		if err != nil {
+			return err
+		}
+		flags = append(flags, flag)
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if !isList {
+		for {
+			flag, err := internal.ExpectFlag(dec)
+			if err != nil {
+				return err
+			}
+			flags = append(flags, flag)
+
+			if !dec.SP() {
+				break
+			}
+		}
+	}
+	if !dec.ExpectCRLF() {
+		return dec.Err()
+	}
+
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+
+	var op imap.StoreFlagsOp
+	switch {
+	case strings.HasPrefix(item, "+"):
+		op = imap.StoreFlagsAdd
+		item = strings.TrimPrefix(item, "+")
+	case strings.HasPrefix(item, "-"):
+		op = imap.StoreFlagsDel
+		item = strings.TrimPrefix(item, "-")
+	default:
+		op = imap.StoreFlagsSet
+	}
+
+	if item != "FLAGS" {
+		return newClientBugError("STORE can only change FLAGS")
+	}
+
+	if err := c.checkState(imap.ConnStateSelected); err != nil {
+		return err
+	}
+
+	if options.UnchangedSince != nil {
+		if err := c.enableCondStore(); err != nil {
+			return err
+		}
+	}
+
+	w := &FetchWriter{conn: c}
+	return c.session.Store(w, numSet, &imap.StoreFlags{
+		Op:     op,
+		Silent: silent,
+		Flags:  flags,
+	}, &options)
+}
+
+// StoreOptions contains options for the STORE command.
+type StoreOptions struct {
+	// UNCHANGEDSINCE modifier value (RFC 7162), nil if not specified. Zero
+	// is a valid value that fails the check for every message.
+	UnchangedSince *uint64
+}
@@ -0,0 +1,282 @@
+package jmap
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	"github.com/oklog/ulid/v2"
+)
+
+var bodyPartProperties = []string{
+	"partId", "blobId", "size", "headers", "name", "type", "charset",
+	"disposition", "cid", "language", "location", "subParts",
+}
+
+// Properties returned if none are requested (RFC 8621, Section 4.2).
+var bodyPartDefaultProperties = []string{
+	"partId", "blobId", "size", "name", "type", "charset",
+	"disposition", "cid", "language", "location",
+}
+
+// bodyPart is the node of the EmailBodyPart tree.
+type bodyPart struct {
+	path     message.Path // empty for the top-level multipart
+	content  *message.ContentPartData
+	header   []headerField
+	subParts []*bodyPart
+}
+
+// bodyStructure returns the MIME structure of the message. Top-level
+// multipart is not stored as a part, so its node is built from the
+// message content data.
+func bodyStructure(msg *message.Msg) (*bodyPart, error) {
+	cd := msg.Content_
+	if cd == nil {
+		return nil, errors.New("jmap: missing content data")
+	}
+	if !cd.IsMultipart() {
+		part, ok := msg.Part(message.EmptyPath().FirstChild())
+		if !ok {
+			return nil, message.ErrNoSuchPart
+		}
+		return newBodyPart(msg, part)
+	}
+
+	root := &bodyPart{
+		path: message.EmptyPath(),
+		content: &message.ContentPartData{
+			Type:        cd.Type,
+			Params:      cd.Params,
+			Disposition: cd.Disposition,
+			Language:    cd.Language,
+			Location:    cd.Location,
+			Size:        uint32(cd.Size - int64(len(cd.Header))),
+		},
+		header: parseHeader(cd.Header),
+	}
+	for _, child := range msg.Children(root.path) {
+		sub, err := newBodyPart(msg, child)
+		if err != nil {
+			return nil, err
+		}
+		root.subParts = append(root.subParts, sub)
+	}
+	return root, nil
+}
+
+func newBodyPart(msg *message.Msg, part *message.Part) (*bodyPart, error) {
+	hdr, err := msg.MIMEHeader(part.Path_)
+	if err != nil {
+		return nil, err
+	}
+	bp := &bodyPart{
+		path:    part.Path_,
+		content: part.Content_,
+		header:  parseHeader(hdr),
+	}
+	if part.Content_.IsMultipart() {
+		for _, child := range msg.Children(part.Path_) {
+			sub, err := newBodyPart(msg, child)
+			if err != nil {
+				return nil, err
+			}
+			bp.subParts = append(bp.subParts, sub)
+		}
+	}
+	return bp, nil
+}
+
+// partID is null for multipart parts.
+func (p *bodyPart) partID() *string {
+	if p.content.IsMultipart() {
+		return nil
+	}
+	id := p.path.String()
+	return &id
+}
+
+// blobID of the part is derived from the message ID and part path,
+// parts are not stored as separate blobs.
+func (p *bodyPart) blobID(msgID ulid.ULID) *string {
+	if p.content.IsMultipart() {
+		return nil
+	}
+	id := msgID.String() + "-" + strings.ReplaceAll(p.path.String(), ".", "_")
+	return &id
+}
+
+func (p *bodyPart) name() *string {
+	name := p.content.Disposition.Params["filename"]
+	if name == "" {
+		name = p.content.Params["name"]
+	}
+	if name == "" {
+		return nil
+	}
+	// Some clients use RFC 2047 encoding for parameters.
+	name = asText(name)
+	return &name
+}
+
+func (p *bodyPart) charset() *string {
+	charset := p.content.Params["charset"]
+	if charset == "" {
+		if !strings.HasPrefix(p.content.Type, "text/") {
+			return nil
+		}
+		charset = "us-ascii"
+	}
+	return &charset
+}
+
+func (p *bodyPart) isText() bool {
+	return strings.HasPrefix(p.content.Type, "text/")
+}
+
+// walk calls fn for the part and all its descendants in order.
+func (p *bodyPart) walk(fn func(p *bodyPart)) {
+	fn(p)
+	for _, sub := range p.subParts {
+		sub.walk(fn)
+	}
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func bodyPartAsJSON(msgID ulid.ULID, p *bodyPart, properties []string) map[string]any {
+	res := make(map[string]any, len(properties))
+	for _, prop := range properties {
+		switch prop {
+		case "partId":
+			res[prop] = p.partID()
+		case "blobId":
+			res[prop] = p.blobID(msgID)
+		case "size":
+			res[prop] = p.content.Size
+		case "headers":
+			if p.header == nil {
+				res[prop] = []headerField{}
+			} else {
+				res[prop] = p.header
+			}
+		case "name":
+			res[prop] = p.name()
+		case "type":
+			res[prop] = p.content.Type
+		case "charset":
+			res[prop] = p.charset()
+		case "disposition":
+			res[prop] = optional(p.content.Disposition.Value)
+		case "cid":
+			res[prop] = optional(strings.TrimSuffix(strings.TrimPrefix(p.content.ID, "<"), ">"))
+		case "language":
+			if len(p.content.Language) == 0 {
+				res[prop] = nil
+			} else {
+				res[prop] = p.content.Language
+			}
+		case "location":
+			res[prop] = optional(p.content.Location)
+		case "subParts":
+			if p.content.IsMultipart() {
+				subParts := make([]map[string]any, len(p.subParts))
+				for i, sub := range p.subParts {
+					subParts[i] = bodyPartAsJSON(msgID, sub, properties)
+				}
+				res[prop] = subParts
+			} else {
+				res[prop] = nil
+			}
+		default:
+			if hp, ok := parseHeaderProperty(prop); ok {
+				res[prop] = hp.value(p.header)
+			}
+		}
+	}
+	return res
+}
+
+func bodyPartsAsJSON(msgID ulid.ULID, parts []*bodyPart, properties []string) []map[string]any {
+	res := make([]map[string]any, len(parts))
+	for i, p := range parts {
+		res[i] = bodyPartAsJSON(msgID, p, properties)
+	}
+	return res
+}
+
+func isInlineMediaType(typ string) bool {
+	return strings.HasPrefix(typ, "image/") || strings.HasPrefix(typ, "audio/") || strings.HasPrefix(typ, "video/")
+}
+
+// classifyParts finds textBody, htmlBody and attachments of the email
+// using the algorithm from RFC 8621, Section 4.1.4. Nil text or html
+// means the list is not filled in the current branch of the tree.
+func classifyParts(parts []*bodyPart, multipartType string, inAlternative bool, text, html, attachments *[]*bodyPart) {
+	textLen, htmlLen := -1, -1
+	if text != nil {
+		textLen = len(*text)
+	}
+	if html != nil {
+		htmlLen = len(*html)
+	}
+
+	for i, part := range parts {
+		typ := part.content.Type
+		isInline := part.content.Disposition.Value != "attachment" &&
+			(typ == "text/plain" || typ == "text/html" || isInlineMediaType(typ)) &&
+			(i == 0 || (multipartType != "related" && (isInlineMediaType(typ) || part.name() == nil)))
+
+		switch {
+		case part.content.IsMultipart():
+			subType := strings.TrimPrefix(typ, "multipart/")
+			classifyParts(part.subParts, subType, inAlternative || subType == "alternative", text, html, attachments)
+		case isInline:
+			if multipartType == "alternative" {
+				switch {
+				case typ == "text/plain" && text != nil:
+					*text = append(*text, part)
+				case typ == "text/html" && html != nil:
+					*html = append(*html, part)
+				default:
+					*attachments = append(*attachments, part)
+				}
+				continue
+			}
+			if inAlternative {
+				if typ == "text/plain" {
+					html = nil
+				}
+				if typ == "text/html" {
+					text = nil
+				}
+			}
+			if text != nil {
+				*text = append(*text, part)
+			}
+			if html != nil {
+				*html = append(*html, part)
+			}
+			if (text == nil || html == nil) && isInlineMediaType(typ) {
+				*attachments = append(*attachments, part)
+			}
+		default:
+			*attachments = append(*attachments, part)
+		}
+	}
+
+	// Alternative without a text or HTML version uses the other one.
+	if multipartType == "alternative" && text != nil && html != nil {
+		if textLen == len(*text) && htmlLen != len(*html) {
+			*text = append(*text, (*html)[htmlLen:]...)
+		}
+		if htmlLen == len(*html) && textLen != len(*text) {
+			*html = append(*html, (*text)[textLen:]...)
+		}
+	}
+}
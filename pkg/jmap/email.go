@@ -0,0 +1,1114 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/domain/message"
+	messageparser "github.com/foxcpp/maddy-storage/internal/domain/message/parser"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/oklog/ulid/v2"
+)
+
+var emailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "headers", "bodyStructure", "bodyValues",
+	"textBody", "htmlBody", "attachments", "hasAttachment", "preview",
+}
+
+// Properties returned if none are requested (RFC 8621, Section 4.2).
+var emailDefaultProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+	"textBody", "htmlBody", "attachments",
+}
+
+// Convenience properties for parsed forms of common header fields.
+var emailHeaderProperties = map[string]headerProperty{
+	"messageId":  {name: "Message-ID", form: formMessageIDs},
+	"inReplyTo":  {name: "In-Reply-To", form: formMessageIDs},
+	"references": {name: "References", form: formMessageIDs},
+	"sender":     {name: "Sender", form: formAddresses},
+	"from":       {name: "From", form: formAddresses},
+	"to":         {name: "To", form: formAddresses},
+	"cc":         {name: "Cc", form: formAddresses},
+	"bcc":        {name: "Bcc", form: formAddresses},
+	"replyTo":    {name: "Reply-To", form: formAddresses},
+	"subject":    {name: "Subject", form: formText},
+	"sentAt":     {name: "Date", form: formDate},
+}
+
+// checkProperties validates the requested properties, "header:" ones are
+// accepted in addition to known.
+func checkProperties(requested *[]string, known, defaults []string) ([]string, error) {
+	if requested == nil {
+		return defaults, nil
+	}
+	for _, prop := range *requested {
+		if _, ok := parseHeaderProperty(prop); ok {
+			continue
+		}
+		if !contains(known, prop) {
+			return nil, invalidArguments("unknown property: " + prop)
+		}
+	}
+	return *requested, nil
+}
+
+// IMAP system flags that have keyword counterparts. Other system flags
+// (e.g. \Deleted) are not visible over JMAP.
+var keywordFlags = map[string]string{
+	"$seen":     `\Seen`,
+	"$flagged":  `\Flagged`,
+	"$answered": `\Answered`,
+	"$draft":    `\Draft`,
+}
+
+func flagAsKeyword(flag string) (string, bool) {
+	if !strings.HasPrefix(flag, `\`) {
+		return strings.ToLower(flag), true
+	}
+	for kw, f := range keywordFlags {
+		if strings.EqualFold(f, flag) {
+			return kw, true
+		}
+	}
+	return "", false
+}
+
+func keywordAsFlag(kw string) string {
+	if flag, ok := keywordFlags[kw]; ok {
+		return flag
+	}
+	return kw
+}
+
+// validKeyword reports whether kw is a valid IMAP flag keyword, which
+// JMAP keywords are limited to.
+func validKeyword(kw string) bool {
+	if kw == "" || len(kw) > 255 {
+		return false
+	}
+	for i := 0; i < len(kw); i++ {
+		if kw[i] < 0x21 || kw[i] > 0x7e || strings.IndexByte(`()]{%*"\`, kw[i]) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+func keywords(flags []string) map[string]bool {
+	res := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		if kw, ok := flagAsKeyword(f); ok {
+			res[kw] = true
+		}
+	}
+	return res
+}
+
+// email is the message with its parsed header and MIME structure.
+type email struct {
+	msg     *message.Msg
+	entries []folder.Entry
+	header  []headerField
+	body    *bodyPart
+
+	text, html, attachments []*bodyPart
+}
+
+func newEmail(data *usecase.MessageData) (*email, error) {
+	body, err := bodyStructure(data.Msg)
+	if err != nil {
+		return nil, err
+	}
+	e := &email{
+		msg:         data.Msg,
+		entries:     data.Entries,
+		header:      parseHeader(data.Msg.Content_.Header),
+		body:        body,
+		text:        []*bodyPart{},
+		html:        []*bodyPart{},
+		attachments: []*bodyPart{},
+	}
+	classifyParts([]*bodyPart{body}, "mixed", false, &e.text, &e.html, &e.attachments)
+	return e, nil
+}
+
+type emailGetArgs struct {
+	getArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+type bodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+// maxSizePreview is the length of the preview property in characters.
+const maxSizePreview = 256
+
+func (c *call) emailAsJSON(ctx context.Context, e *email, properties, bodyProperties []string, args *emailGetArgs) (map[string]any, error) {
+	msgID := e.msg.ID_
+
+	var err error
+	res := make(map[string]any, len(properties)+1)
+	res["id"] = msgID.String()
+	for _, prop := range properties {
+		switch prop {
+		case "blobId":
+			res[prop] = msgID.String()
+		case "threadId":
+			// Threads are not tracked, each email is a thread of its own.
+			res[prop] = msgID.String()
+		case "mailboxIds":
+			ids := make(map[string]bool, len(e.entries))
+			for _, ent := range e.entries {
+				ids[ent.FolderID_.String()] = true
+			}
+			res[prop] = ids
+		case "keywords":
+			res[prop] = keywords(e.msg.Flags_)
+		case "size":
+			res[prop] = e.msg.Content_.Size
+		case "receivedAt":
+			res[prop] = e.msg.ReceivedAt_.UTC().Format(time.RFC3339)
+		case "headers":
+			if e.header == nil {
+				res[prop] = []headerField{}
+			} else {
+				res[prop] = e.header
+			}
+		case "bodyStructure":
+			res[prop] = bodyPartAsJSON(msgID, e.body, bodyProperties)
+		case "textBody":
+			res[prop] = bodyPartsAsJSON(msgID, e.text, bodyProperties)
+		case "htmlBody":
+			res[prop] = bodyPartsAsJSON(msgID, e.html, bodyProperties)
+		case "attachments":
+			res[prop] = bodyPartsAsJSON(msgID, e.attachments, bodyProperties)
+		case "hasAttachment":
+			res[prop] = len(e.attachments) != 0
+		case "preview":
+			res[prop], err = c.preview(ctx, e)
+		case "bodyValues":
+			res[prop], err = c.bodyValues(ctx, e, args)
+		default:
+			if hp, ok := emailHeaderProperties[prop]; ok {
+				res[prop] = hp.value(e.header)
+			} else if hp, ok := parseHeaderProperty(prop); ok {
+				res[prop] = hp.value(e.header)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// partText returns decoded contents of the text/* part.
+func (c *call) partText(ctx context.Context, msg *message.Msg, p *bodyPart) (string, error) {
+	body, err := msg.PartBody(p.path)
+	if err != nil {
+		return "", err
+	}
+	rd := c.s.messages.OpenBody(ctx, c.sess.accountID, body)
+	defer rd.Close()
+	raw, err := io.ReadAll(rd)
+	if err != nil {
+		return "", err
+	}
+	return messageparser.DecodeText(p.content, raw), nil
+}
+
+func (c *call) bodyValues(ctx context.Context, e *email, args *emailGetArgs) (map[string]bodyValue, error) {
+	var parts []*bodyPart
+	if args.FetchAllBodyValues {
+		e.body.walk(func(p *bodyPart) {
+			parts = append(parts, p)
+		})
+	} else {
+		if args.FetchTextBodyValues {
+			parts = append(parts, e.text...)
+		}
+		if args.FetchHTMLBodyValues {
+			parts = append(parts, e.html...)
+		}
+	}
+
+	res := make(map[string]bodyValue, len(parts))
+	for _, p := range parts {
+		if !p.isText() {
+			continue
+		}
+		id := p.path.String()
+		if _, ok := res[id]; ok {
+			continue
+		}
+
+		text, err := c.partText(ctx, e.msg, p)
+		if err != nil {
+			return nil, err
+		}
+		val := bodyValue{Value: text}
+		if args.MaxBodyValueBytes > 0 && len(text) > args.MaxBodyValueBytes {
+			n := args.MaxBodyValueBytes
+			for n > 0 && !utf8.RuneStart(text[n]) {
+				n--
+			}
+			val.Value = text[:n]
+			val.IsTruncated = true
+		}
+		res[id] = val
+	}
+	return res, nil
+}
+
+// preview returns the beginning of the first plain text body part with
+// whitespace collapsed.
+func (c *call) preview(ctx context.Context, e *email) (string, error) {
+	for _, p := range e.text {
+		if p.content.Type != "text/plain" {
+			continue
+		}
+		text, err := c.partText(ctx, e.msg, p)
+		if err != nil {
+			return "", err
+		}
+		text = strings.Join(strings.Fields(text), " ")
+		if utf8.RuneCountInString(text) > maxSizePreview {
+			text = string([]rune(text)[:maxSizePreview])
+		}
+		return text, nil
+	}
+	return "", nil
+}
+
+// messageIDs returns unique message IDs of entries in order.
+func messageIDs(entries []folder.Entry) []ulid.ULID {
+	ids := make([]ulid.ULID, 0, len(entries))
+	seen := make(map[ulid.ULID]bool, len(entries))
+	for _, ent := range entries {
+		if seen[ent.MsgID_] {
+			continue
+		}
+		seen[ent.MsgID_] = true
+		ids = append(ids, ent.MsgID_)
+	}
+	return ids
+}
+
+func (c *call) emailGet(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args emailGetArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs != nil && len(*args.IDs) > c.s.cfg.MaxObjectsInGet {
+		return nil, &methodError{Type: errRequestTooLarge}
+	}
+	if args.MaxBodyValueBytes < 0 {
+		return nil, invalidArguments("maxBodyValueBytes must not be negative")
+	}
+	properties, err := checkProperties(args.Properties, emailProperties, emailDefaultProperties)
+	if err != nil {
+		return nil, err
+	}
+	bodyProperties, err := checkProperties(args.BodyProperties, bodyPartProperties, bodyPartDefaultProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if args.IDs != nil {
+		ids = *args.IDs
+	} else {
+		entries, err := c.s.folders.Search(ctx, c.sess.accountID, &folder.SearchCond{})
+		if err != nil {
+			return nil, err
+		}
+		all := messageIDs(entries)
+		if len(all) > c.s.cfg.MaxObjectsInGet {
+			return nil, &methodError{Type: errRequestTooLarge}
+		}
+		for _, id := range all {
+			ids = append(ids, id.String())
+		}
+	}
+
+	msgIDs := make([]ulid.ULID, 0, len(ids))
+	for _, id := range ids {
+		if parsed, ok := c.resolveID(id); ok {
+			msgIDs = append(msgIDs, parsed)
+		}
+	}
+	found, err := c.s.messages.GetByIDs(ctx, c.sess.accountID, msgIDs...)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[ulid.ULID]*usecase.MessageData, len(found))
+	for i := range found {
+		byID[found[i].Msg.ID_] = &found[i]
+	}
+
+	resp := getResponse{
+		AccountID: args.AccountID,
+		State:     state,
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+	for _, id := range ids {
+		parsed, ok := c.resolveID(id)
+		data := byID[parsed]
+		if !ok || data == nil {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+
+		e, err := newEmail(data)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := c.emailAsJSON(ctx, e, properties, bodyProperties, &args)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, obj)
+	}
+	return resp, nil
+}
+
+func (c *call) emailChanges(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args changesArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	entries, resp, err := c.changes(ctx, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(changeSet)
+	for _, ent := range entries {
+		if ent.MessageID == (ulid.ULID{}) {
+			continue
+		}
+		switch ent.Type {
+		case changelog.TypeMessageCreated:
+			changes.add(ent.MessageID, changeCreated)
+		case changelog.TypeMessageUpdated:
+			changes.add(ent.MessageID, changeUpdated)
+		case changelog.TypeMessageDeleted:
+			changes.add(ent.MessageID, changeDestroyed)
+		}
+	}
+	changes.fill(resp)
+	return resp, nil
+}
+
+type emailFilter struct {
+	Operator   string        `json:"operator"`
+	Conditions []emailFilter `json:"conditions"`
+
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int64     `json:"minSize"`
+	MaxSize                 *int64     `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+// searchCond converts the filter into the search condition. Each email is
+// a thread of its own, so thread keyword conditions check the email
+// itself.
+func (c *call) searchCond(flt *emailFilter) (*folder.SearchCond, error) {
+	switch flt.Operator {
+	case "":
+	case "AND", "OR", "NOT":
+		alts := make([]*folder.SearchCond, len(flt.Conditions))
+		for i := range flt.Conditions {
+			var err error
+			alts[i], err = c.searchCond(&flt.Conditions[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch flt.Operator {
+		case "AND":
+			cond := &folder.SearchCond{}
+			for _, alt := range alts {
+				cond.Or = append(cond.Or, []*folder.SearchCond{alt})
+			}
+			return cond, nil
+		case "OR":
+			return &folder.SearchCond{Or: [][]*folder.SearchCond{alts}}, nil
+		default:
+			return &folder.SearchCond{Not: &folder.SearchCond{Or: [][]*folder.SearchCond{alts}}}, nil
+		}
+	default:
+		return nil, &methodError{Type: errUnsupportedFilter, Description: "unknown operator: " + flt.Operator}
+	}
+
+	cond := &folder.SearchCond{}
+	if flt.InMailbox != nil {
+		// Unknown mailbox matches nothing.
+		id, _ := c.resolveID(*flt.InMailbox)
+		cond.FolderIDs = []ulid.ULID{id}
+	}
+	if len(flt.InMailboxOtherThan) != 0 {
+		not := &folder.SearchCond{}
+		for _, ref := range flt.InMailboxOtherThan {
+			if id, ok := c.resolveID(ref); ok {
+				not.FolderIDs = append(not.FolderIDs, id)
+			}
+		}
+		if not.FolderIDs != nil {
+			cond.Not = not
+		}
+	}
+	if flt.Before != nil {
+		cond.DateUntil = *flt.Before
+	}
+	if flt.After != nil {
+		cond.DateSince = *flt.After
+	}
+	if flt.MinSize != nil {
+		cond.SizeSince = *flt.MinSize
+	}
+	if flt.MaxSize != nil {
+		if *flt.MaxSize <= 0 {
+			cond.UIDs = []folder.UIDRange{}
+		}
+		cond.SizeUntil = *flt.MaxSize
+	}
+	for _, kw := range []*string{flt.AllInThreadHaveKeyword, flt.SomeInThreadHaveKeyword, flt.HasKeyword} {
+		if kw != nil {
+			cond.Flag = append(cond.Flag, keywordAsFlag(strings.ToLower(*kw)))
+		}
+	}
+	for _, kw := range []*string{flt.NoneInThreadHaveKeyword, flt.NotKeyword} {
+		if kw != nil {
+			cond.NoFlag = append(cond.NoFlag, keywordAsFlag(strings.ToLower(*kw)))
+		}
+	}
+	if flt.HasAttachment != nil {
+		return nil, &methodError{Type: errUnsupportedFilter, Description: "hasAttachment is not supported"}
+	}
+	for _, text := range []struct {
+		value *string
+		cond  *[]string
+	}{
+		{flt.Text, &cond.Text},
+		{flt.From, &cond.From},
+		{flt.To, &cond.To},
+		{flt.Cc, &cond.Cc},
+		{flt.Bcc, &cond.Bcc},
+		{flt.Subject, &cond.Subject},
+		{flt.Body, &cond.Body},
+	} {
+		if text.value != nil {
+			*text.cond = append(*text.cond, *text.value)
+		}
+	}
+	switch len(flt.Header) {
+	case 0:
+	case 1:
+		cond.Header = append(cond.Header, folder.HeaderCond{Name: flt.Header[0]})
+	case 2:
+		cond.Header = append(cond.Header, folder.HeaderCond{Name: flt.Header[0], Value: flt.Header[1]})
+	default:
+		return nil, invalidArguments("header must contain name and optional value")
+	}
+	return cond, nil
+}
+
+var emailSortProperties = []string{
+	"receivedAt", "size", "from", "to", "subject", "sentAt",
+	"hasKeyword", "allInThreadHaveKeyword", "someInThreadHaveKeyword",
+}
+
+func envelope(msg *message.Msg) *message.ContentEnvelope {
+	if msg.Content_ == nil || msg.Content_.Envelope == nil {
+		return &message.ContentEnvelope{}
+	}
+	return msg.Content_.Envelope
+}
+
+// addressKey is the display name of the first address or the address
+// itself if there is no name.
+func addressKey(list []message.Address) string {
+	if len(list) == 0 {
+		return ""
+	}
+	if list[0].Name != "" {
+		return strings.ToLower(list[0].Name)
+	}
+	return strings.ToLower(list[0].Mailbox + "@" + list[0].Host)
+}
+
+func compareTime(lhs, rhs time.Time) int {
+	switch {
+	case lhs.Before(rhs):
+		return -1
+	case lhs.After(rhs):
+		return 1
+	}
+	return 0
+}
+
+// emailLess returns the function ordering messages according to the
+// comparators. Most recently received messages go first by default.
+func emailLess(sortBy []comparator) (func(lhs, rhs *message.Msg) bool, error) {
+	if len(sortBy) == 0 {
+		ascending := false
+		sortBy = []comparator{{Property: "receivedAt", IsAscending: &ascending}}
+	}
+	for _, cmp := range sortBy {
+		if !contains(emailSortProperties, cmp.Property) {
+			return nil, &methodError{Type: errUnsupportedSort, Description: "cannot sort by " + cmp.Property}
+		}
+		if cmp.Collation != "" {
+			return nil, &methodError{Type: errUnsupportedSort, Description: "collations are not supported"}
+		}
+		if strings.HasSuffix(cmp.Property, "Keyword") && cmp.Keyword == "" {
+			return nil, invalidArguments("keyword is required to sort by " + cmp.Property)
+		}
+	}
+
+	return func(lhs, rhs *message.Msg) bool {
+		for _, cmp := range sortBy {
+			var res int
+			switch cmp.Property {
+			case "receivedAt":
+				res = compareTime(lhs.ReceivedAt_, rhs.ReceivedAt_)
+			case "size":
+				switch {
+				case lhs.Content_.Size < rhs.Content_.Size:
+					res = -1
+				case lhs.Content_.Size > rhs.Content_.Size:
+					res = 1
+				}
+			case "from":
+				res = strings.Compare(addressKey(envelope(lhs).From), addressKey(envelope(rhs).From))
+			case "to":
+				res = strings.Compare(addressKey(envelope(lhs).To), addressKey(envelope(rhs).To))
+			case "subject":
+				res = strings.Compare(strings.ToLower(envelope(lhs).Subject), strings.ToLower(envelope(rhs).Subject))
+			case "sentAt":
+				res = compareTime(envelope(lhs).Date, envelope(rhs).Date)
+			default:
+				flag := keywordAsFlag(strings.ToLower(cmp.Keyword))
+				lhsHas, rhsHas := message.HasFlag(lhs.Flags_, flag), message.HasFlag(rhs.Flags_, flag)
+				switch {
+				case !lhsHas && rhsHas:
+					res = -1
+				case lhsHas && !rhsHas:
+					res = 1
+				}
+			}
+			if cmp.IsAscending != nil && !*cmp.IsAscending {
+				res = -res
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		return lhs.ID_.Compare(rhs.ID_) < 0
+	}, nil
+}
+
+// searchOrder converts comparators to the order applied by the searcher.
+// It returns false if messages have to be sorted by emailLess instead:
+// from, to and subject are kept in message content, which might be
+// encrypted.
+func searchOrder(sortBy []comparator) ([]folder.SearchOrder, bool) {
+	if len(sortBy) == 0 {
+		return []folder.SearchOrder{{Key: folder.SortReceived, Desc: true}}, true
+	}
+
+	order := make([]folder.SearchOrder, len(sortBy))
+	for i, cmp := range sortBy {
+		order[i].Desc = cmp.IsAscending != nil && !*cmp.IsAscending
+		switch cmp.Property {
+		case "receivedAt":
+			order[i].Key = folder.SortReceived
+		case "size":
+			order[i].Key = folder.SortSize
+		case "sentAt":
+			order[i].Key = folder.SortSent
+		case "hasKeyword", "allInThreadHaveKeyword", "someInThreadHaveKeyword":
+			order[i].Key = folder.SortFlag
+			order[i].Flag = keywordAsFlag(strings.ToLower(cmp.Keyword))
+		default:
+			return nil, false
+		}
+	}
+	return order, true
+}
+
+type emailQueryArgs struct {
+	AccountID       string       `json:"accountId"`
+	Filter          *emailFilter `json:"filter"`
+	Sort            []comparator `json:"sort"`
+	Position        int          `json:"position"`
+	Anchor          *string      `json:"anchor"`
+	AnchorOffset    int          `json:"anchorOffset"`
+	Limit           *int         `json:"limit"`
+	CalculateTotal  bool         `json:"calculateTotal"`
+	CollapseThreads bool         `json:"collapseThreads"`
+}
+
+// emailQueryResponse is the Email/query response. Threads are not
+// supported, each email is a thread of its own, so results are the same
+// whether collapseThreads is set or not.
+type emailQueryResponse struct {
+	queryResponse
+	CollapseThreads bool `json:"collapseThreads"`
+}
+
+func (c *call) emailQuery(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args emailQueryArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	less, err := emailLess(args.Sort)
+	if err != nil {
+		return nil, err
+	}
+	cond := &folder.SearchCond{}
+	if args.Filter != nil {
+		cond, err = c.searchCond(args.Filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if order, ok := searchOrder(args.Sort); ok {
+		// Only IDs up to the end of the window are needed if there is no
+		// anchor and the total is not requested.
+		limit := 0
+		if args.Anchor == nil && args.Position >= 0 && args.Limit != nil && *args.Limit > 0 && !args.CalculateTotal {
+			limit = args.Position + *args.Limit
+		}
+		msgIDs, err := c.s.folders.SearchMsgIDs(ctx, c.sess.accountID, cond, order, limit)
+		if err != nil {
+			return nil, err
+		}
+		ids = make([]string, len(msgIDs))
+		for i, id := range msgIDs {
+			ids[i] = id.String()
+		}
+	} else {
+		entries, err := c.s.folders.Search(ctx, c.sess.accountID, cond)
+		if err != nil {
+			return nil, err
+		}
+		found, err := c.s.messages.GetByIDs(ctx, c.sess.accountID, messageIDs(entries)...)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(found, func(i, j int) bool {
+			return less(found[i].Msg, found[j].Msg)
+		})
+		ids = make([]string, len(found))
+		for i := range found {
+			ids[i] = found[i].Msg.ID_.String()
+		}
+	}
+
+	resp := emailQueryResponse{
+		queryResponse: queryResponse{
+			AccountID:  args.AccountID,
+			QueryState: state,
+		},
+		CollapseThreads: args.CollapseThreads,
+	}
+	if args.CalculateTotal {
+		total := len(ids)
+		resp.Total = &total
+	}
+	resp.IDs, resp.Position, err = window(ids, args.Position, args.Anchor, args.AnchorOffset, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// emailPatch contains changes to client-settable Email properties.
+// Emails cannot be changed otherwise.
+type emailPatch struct {
+	keywords       map[string]bool // replaces all keywords if not nil
+	keywordChanges map[string]bool // keyword -> added or removed
+	mailboxIDs     map[string]bool // replaces all mailboxes if not nil
+	mailboxChanges map[string]bool // mailbox id -> added or removed
+}
+
+// parseSetPatch parses the value of the property that is a set of keys
+// (e.g. keywords), all values must be true.
+func parseSetPatch(value json.RawMessage) (map[string]bool, error) {
+	var set map[string]bool
+	if err := json.Unmarshal(value, &set); err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, errors.New("must not be null")
+	}
+	for _, v := range set {
+		if !v {
+			return nil, errors.New("values must be true")
+		}
+	}
+	return set, nil
+}
+
+// parseKeyPatch parses the value for a "property/key" patch, it is true
+// to add the key or null to remove it.
+func parseKeyPatch(value json.RawMessage) (bool, error) {
+	switch strings.TrimSpace(string(value)) {
+	case "true":
+		return true, nil
+	case "null":
+		return false, nil
+	}
+	return false, errors.New("must be true or null")
+}
+
+func parseEmailPatch(raw map[string]json.RawMessage) (*emailPatch, *setError) {
+	patch := &emailPatch{
+		keywordChanges: make(map[string]bool),
+		mailboxChanges: make(map[string]bool),
+	}
+	var bad []string
+	for prop, value := range raw {
+		var err error
+		switch {
+		case prop == "keywords":
+			var set map[string]bool
+			set, err = parseSetPatch(value)
+			if err == nil {
+				patch.keywords = make(map[string]bool, len(set))
+				for kw := range set {
+					patch.keywords[strings.ToLower(kw)] = true
+				}
+			}
+		case strings.HasPrefix(prop, "keywords/"):
+			kw := strings.ToLower(strings.TrimPrefix(prop, "keywords/"))
+			patch.keywordChanges[kw], err = parseKeyPatch(value)
+		case prop == "mailboxIds":
+			patch.mailboxIDs, err = parseSetPatch(value)
+		case strings.HasPrefix(prop, "mailboxIds/"):
+			id := strings.TrimPrefix(prop, "mailboxIds/")
+			patch.mailboxChanges[id], err = parseKeyPatch(value)
+		default:
+			// Server-set, immutable or unknown property.
+			err = errors.New("cannot be set")
+		}
+		if err != nil {
+			bad = append(bad, prop)
+		}
+	}
+	if len(bad) != 0 {
+		sort.Strings(bad)
+		return nil, &setError{Type: setErrInvalidProperties, Properties: bad}
+	}
+	if (patch.keywords != nil && len(patch.keywordChanges) != 0) ||
+		(patch.mailboxIDs != nil && len(patch.mailboxChanges) != 0) {
+		return nil, &setError{Type: setErrInvalidPatch, Description: "property is both replaced and patched"}
+	}
+
+	for _, set := range []map[string]bool{patch.keywords, patch.keywordChanges} {
+		for kw := range set {
+			if !validKeyword(kw) {
+				return nil, &setError{Type: setErrInvalidProperties, Description: "invalid keyword: " + kw, Properties: []string{"keywords"}}
+			}
+		}
+	}
+	return patch, nil
+}
+
+func (p *emailPatch) hasKeywords() bool {
+	return p.keywords != nil || len(p.keywordChanges) != 0
+}
+
+func (p *emailPatch) hasMailboxes() bool {
+	return p.mailboxIDs != nil || len(p.mailboxChanges) != 0
+}
+
+// patchSet returns the updated copy of the set.
+func patchSet(current, replace, changes map[string]bool) map[string]bool {
+	if replace != nil {
+		current = replace
+	}
+	res := make(map[string]bool, len(current))
+	for k := range current {
+		res[k] = true
+	}
+	for k, add := range changes {
+		if add {
+			res[k] = true
+		} else {
+			delete(res, k)
+		}
+	}
+	return res
+}
+
+func sameKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveIDs returns the set with keys resolved using resolveID.
+func (c *call) resolveIDs(set map[string]bool) (map[string]bool, bool) {
+	if set == nil {
+		return nil, true
+	}
+	res := make(map[string]bool, len(set))
+	for key, v := range set {
+		id, ok := c.resolveID(key)
+		if !ok {
+			return nil, false
+		}
+		res[id.String()] = v
+	}
+	return res, true
+}
+
+func (c *call) emailSet(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args setArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	resp, err := c.beginSet(ctx, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	for cid := range args.Create {
+		// Messages are added over IMAP, building them from JMAP objects is
+		// not implemented.
+		resp.NotCreated[cid] = &setError{Type: setErrForbidden, Description: "creating emails is not supported"}
+	}
+
+	ids := make([]string, 0, len(args.Update))
+	for id := range args.Update {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		setErr, err := c.updateEmail(ctx, id, args.Update[id])
+		if err != nil {
+			return nil, err
+		}
+		if setErr != nil {
+			resp.NotUpdated[id] = setErr
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+
+	for _, id := range args.Destroy {
+		setErr, err := c.destroyEmail(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if setErr != nil {
+			resp.NotDestroyed[id] = setErr
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	return c.endSet(ctx, resp)
+}
+
+// email returns the message of the account or nil if it does not exist.
+func (c *call) email(ctx context.Context, id string) (*usecase.MessageData, error) {
+	msgID, ok := c.resolveID(id)
+	if !ok {
+		return nil, nil
+	}
+	found, err := c.s.messages.GetByIDs(ctx, c.sess.accountID, msgID)
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return &found[0], nil
+}
+
+func (c *call) updateEmail(ctx context.Context, id string, raw map[string]json.RawMessage) (*setError, error) {
+	patch, setErr := parseEmailPatch(raw)
+	if setErr != nil {
+		return setErr, nil
+	}
+	data, err := c.email(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &setError{Type: setErrNotFound}, nil
+	}
+	ent := data.Entries[0]
+	uids := []folder.UIDRange{{Since: ent.UID_, Until: ent.UID_}}
+
+	if patch.hasKeywords() {
+		current := keywords(data.Msg.Flags_)
+		updated := patchSet(current, patch.keywords, patch.keywordChanges)
+		if !sameKeys(current, updated) {
+			// Flags without keywords are kept as is.
+			var flags []string
+			for _, f := range data.Msg.Flags_ {
+				if _, ok := flagAsKeyword(f); !ok {
+					flags = append(flags, f)
+				}
+			}
+			for kw := range updated {
+				flags = append(flags, keywordAsFlag(kw))
+			}
+			sort.Strings(flags)
+
+			res, err := c.s.messages.UpdateFlags(ctx, c.sess.accountID, ent.FolderID_, uids, message.FlagUpdate{
+				Op:    message.FlagsReplace,
+				Flags: flags,
+			})
+			if err != nil {
+				return checkSetError(err, "keywords")
+			}
+			for _, upd := range res.Changed {
+				c.s.cfg.Notifier.FlagsChanged(upd.Entry.FolderID_, upd.Entry.UID_, upd.Flags)
+			}
+		}
+	}
+
+	if patch.hasMailboxes() {
+		replace, ok := c.resolveIDs(patch.mailboxIDs)
+		changes, ok2 := c.resolveIDs(patch.mailboxChanges)
+		if !ok || !ok2 {
+			return &setError{Type: setErrInvalidProperties, Description: "no such mailbox", Properties: []string{"mailboxIds"}}, nil
+		}
+		current := make(map[string]bool, len(data.Entries))
+		for _, ent := range data.Entries {
+			current[ent.FolderID_.String()] = true
+		}
+		updated := patchSet(current, replace, changes)
+
+		switch {
+		case len(updated) == 0:
+			return &setError{Type: setErrInvalidProperties, Description: "email must be in a mailbox", Properties: []string{"mailboxIds"}}, nil
+		case len(updated) > 1:
+			return &setError{Type: setErrTooManyMailboxes}, nil
+		}
+		if !sameKeys(current, updated) {
+			var target string
+			for id := range updated {
+				target = id
+			}
+			setErr, err := c.moveEmail(ctx, ent, target)
+			if err != nil || setErr != nil {
+				return setErr, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (c *call) moveEmail(ctx context.Context, ent folder.Entry, target string) (*setError, error) {
+	targetID, _ := ulid.Parse(target)
+	f, err := c.s.folders.GetByID(ctx, c.sess.accountID, targetID)
+	if err != nil {
+		if setErr := asSetError(err); setErr != nil {
+			setErr.Type = setErrInvalidProperties
+			setErr.Properties = []string{"mailboxIds"}
+			return setErr, nil
+		}
+		return nil, err
+	}
+
+	uids := []folder.UIDRange{{Since: ent.UID_, Until: ent.UID_}}
+	res, err := c.s.messages.MoveByUID(ctx, c.sess.accountID, uids, ent.FolderID_, f.Path_)
+	if err != nil {
+		return checkSetError(err, "mailboxIds")
+	}
+	c.s.cfg.Notifier.NewMessages(res.Target.ID_, entryUIDs(res.TargetEntries))
+	c.s.cfg.Notifier.Removed(ent.FolderID_, entryUIDs(res.SourceEntries))
+	return nil, nil
+}
+
+func entryUIDs(entries []folder.Entry) []uint32 {
+	uids := make([]uint32, len(entries))
+	for i, ent := range entries {
+		uids[i] = ent.UID_
+	}
+	return uids
+}
+
+func (c *call) destroyEmail(ctx context.Context, id string) (*setError, error) {
+	data, err := c.email(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return &setError{Type: setErrNotFound}, nil
+	}
+
+	for _, ent := range data.Entries {
+		uids := []folder.UIDRange{{Since: ent.UID_, Until: ent.UID_}}
+		deleted, err := c.s.messages.Delete(ctx, c.sess.accountID, ent.FolderID_, uids)
+		if err != nil {
+			return checkSetError(err)
+		}
+		c.s.cfg.Notifier.Removed(ent.FolderID_, entryUIDs(deleted))
+	}
+	return nil, nil
+}
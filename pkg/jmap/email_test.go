@@ -0,0 +1,384 @@
+package jmap_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const multipartMsg = "From: Alice <alice@example.org>\r\n" +
+	"To: Bob <bob@example.org>, carol@example.org\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?= plans\r\n" +
+	"Date: Mon, 02 Jan 2023 15:04:05 +0000\r\n" +
+	"Message-ID: <1@example.org>\r\n" +
+	"X-Custom: first\r\n" +
+	"X-Custom:  second\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello   there,\r\nBob\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Hello there, Bob</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=plan.pdf\r\n" +
+	"Content-Disposition: attachment; filename=plan.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--outer--\r\n"
+
+func plainMsg(subject, body string) string {
+	return "From: alice@example.org\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" +
+		body + "\r\n"
+}
+
+// appendMsg adds the message to the folder and returns the email id.
+func (s *testServer) appendMsg(t *testing.T, path, msg string, flags []string, date time.Time) string {
+	t.Helper()
+
+	data, err := s.messages.Append(context.Background(), s.acctID, path, strings.NewReader(msg), flags, date)
+	require.NoError(t, err)
+	return data.Entry.MsgID_.String()
+}
+
+func mustParse(t *testing.T, id string) ulid.ULID {
+	t.Helper()
+
+	parsed, err := ulid.Parse(id)
+	require.NoError(t, err)
+	return parsed
+}
+
+// mailbox creates the mailbox (if name is not INBOX) and returns its id.
+func (s *testServer) mailbox(t *testing.T, name string) string {
+	t.Helper()
+
+	if name != "INBOX" {
+		resp := s.call(t, []any{"Mailbox/set", map[string]any{
+			"accountId": s.accountID,
+			"create":    map[string]any{"m": map[string]any{"name": name}},
+		}, "0"})
+		return resp[0].Args["created"].(map[string]any)["m"].(map[string]any)["id"].(string)
+	}
+	resp := s.call(t, []any{"Mailbox/query", map[string]any{
+		"accountId": s.accountID,
+		"filter":    map[string]any{"role": "inbox"},
+	}, "0"})
+	return resp[0].Args["ids"].([]any)[0].(string)
+}
+
+func TestEmailGet(t *testing.T) {
+	s := newTestServer(t)
+	inbox := s.mailbox(t, "INBOX")
+	id := s.appendMsg(t, "INBOX", multipartMsg, []string{`\Seen`, `\Deleted`, "$Forwarded"}, time.Date(2023, 1, 2, 16, 0, 0, 0, time.UTC))
+
+	resp := s.call(t, []any{"Email/get", map[string]any{
+		"accountId":           s.accountID,
+		"ids":                 []string{id, "missing"},
+		"fetchTextBodyValues": true,
+	}, "0"})
+	require.Equal(t, "Email/get", resp[0].Name, resp[0].Args)
+	require.Equal(t, []any{"missing"}, resp[0].Args["notFound"])
+	list := resp[0].Args["list"].([]any)
+	require.Len(t, list, 1)
+	email := list[0].(map[string]any)
+
+	require.Equal(t, id, email["id"])
+	require.Equal(t, map[string]any{inbox: true}, email["mailboxIds"])
+	require.Equal(t, map[string]any{"$seen": true, "$forwarded": true}, email["keywords"])
+	require.Equal(t, "2023-01-02T16:00:00Z", email["receivedAt"])
+	require.Equal(t, "Café plans", email["subject"])
+	require.Equal(t, "2023-01-02T15:04:05Z", email["sentAt"])
+	require.Equal(t, []any{"1@example.org"}, email["messageId"])
+	require.Nil(t, email["inReplyTo"])
+	require.Equal(t, []any{map[string]any{"name": "Alice", "email": "alice@example.org"}}, email["from"])
+	require.Equal(t, []any{
+		map[string]any{"name": "Bob", "email": "bob@example.org"},
+		map[string]any{"name": nil, "email": "carol@example.org"},
+	}, email["to"])
+	require.Nil(t, email["sender"])
+	require.Equal(t, true, email["hasAttachment"])
+	require.Equal(t, "Hello there, Bob", email["preview"])
+
+	partIDs := func(prop string) []any {
+		var ids []any
+		for _, p := range email[prop].([]any) {
+			ids = append(ids, p.(map[string]any)["partId"])
+		}
+		return ids
+	}
+	require.Equal(t, []any{"1.1"}, partIDs("textBody"))
+	require.Equal(t, []any{"1.2"}, partIDs("htmlBody"))
+	require.Equal(t, []any{"2"}, partIDs("attachments"))
+	attachment := email["attachments"].([]any)[0].(map[string]any)
+	require.Equal(t, "plan.pdf", attachment["name"])
+	require.Equal(t, "application/pdf", attachment["type"])
+	require.Equal(t, "attachment", attachment["disposition"])
+	require.Nil(t, attachment["charset"])
+	require.Equal(t, map[string]any{
+		"1.1": map[string]any{"value": "Hello   there,\r\nBob", "isEncodingProblem": false, "isTruncated": false},
+	}, email["bodyValues"])
+
+	resp = s.call(t, []any{"Email/get", map[string]any{
+		"accountId": s.accountID,
+		"ids":       []string{id},
+		"properties": []string{
+			"bodyStructure", "bodyValues", "header:X-Custom", "header:X-Custom:asText:all",
+			"header:To:asAddresses", "header:Missing:all",
+		},
+		"bodyProperties":     []string{"partId", "type", "subParts"},
+		"fetchAllBodyValues": true,
+		"maxBodyValueBytes":  5,
+	}, "0"})
+	require.Equal(t, "Email/get", resp[0].Name, resp[0].Args)
+	email = resp[0].Args["list"].([]any)[0].(map[string]any)
+	require.Equal(t, map[string]any{
+		"partId": nil,
+		"type":   "multipart/mixed",
+		"subParts": []any{
+			map[string]any{
+				"partId": nil,
+				"type":   "multipart/alternative",
+				"subParts": []any{
+					map[string]any{"partId": "1.1", "type": "text/plain", "subParts": nil},
+					map[string]any{"partId": "1.2", "type": "text/html", "subParts": nil},
+				},
+			},
+			map[string]any{"partId": "2", "type": "application/pdf", "subParts": nil},
+		},
+	}, email["bodyStructure"])
+	require.Equal(t, "  second", email["header:X-Custom"])
+	require.Equal(t, []any{"first", "second"}, email["header:X-Custom:asText:all"])
+	require.Len(t, email["header:To:asAddresses"], 2)
+	require.Equal(t, []any{}, email["header:Missing:all"])
+	require.Equal(t, map[string]any{
+		"1.1": map[string]any{"value": "Hello", "isEncodingProblem": false, "isTruncated": true},
+		"1.2": map[string]any{"value": "<p>He", "isEncodingProblem": false, "isTruncated": true},
+	}, email["bodyValues"])
+
+	resp = s.call(t, []any{"Email/get", map[string]any{
+		"accountId":  s.accountID,
+		"ids":        []string{id},
+		"properties": []string{"header:X-Custom:asBogus"},
+	}, "0"})
+	require.Equal(t, "error", resp[0].Name)
+	require.Equal(t, "invalidArguments", resp[0].Args["type"])
+}
+
+func TestEmailQuery(t *testing.T) {
+	s := newTestServer(t)
+	inbox := s.mailbox(t, "INBOX")
+	archive := s.mailbox(t, "Archive")
+
+	day := func(d int) time.Time {
+		return time.Date(2023, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	first := s.appendMsg(t, "INBOX", plainMsg("first", "apples"), nil, day(1))
+	second := s.appendMsg(t, "INBOX", plainMsg("second", "oranges and more oranges"), []string{`\Flagged`}, day(2))
+	third := s.appendMsg(t, "Archive", plainMsg("third", "apples again"), []string{`\Seen`}, day(3))
+
+	query := func(args map[string]any) map[string]any {
+		t.Helper()
+		args["accountId"] = s.accountID
+		resp := s.call(t, []any{"Email/query", args, "0"})
+		require.Equal(t, "Email/query", resp[0].Name, resp[0].Args)
+		return resp[0].Args
+	}
+
+	res := query(map[string]any{"calculateTotal": true, "collapseThreads": true})
+	require.Equal(t, []any{third, second, first}, res["ids"])
+	require.EqualValues(t, 3, res["total"])
+	require.Equal(t, true, res["collapseThreads"])
+	res = query(map[string]any{})
+	require.Equal(t, []any{third, second, first}, res["ids"])
+	require.Equal(t, false, res["collapseThreads"])
+
+	res = query(map[string]any{"sort": []any{map[string]any{"property": "receivedAt"}}})
+	require.Equal(t, []any{first, second, third}, res["ids"])
+	res = query(map[string]any{"sort": []any{
+		map[string]any{"property": "hasKeyword", "keyword": "$flagged", "isAscending": false},
+		map[string]any{"property": "size"},
+	}})
+	require.Equal(t, []any{second, first, third}, res["ids"])
+	res = query(map[string]any{"sort": []any{map[string]any{"property": "subject", "isAscending": false}}})
+	require.Equal(t, []any{third, second, first}, res["ids"])
+
+	res = query(map[string]any{"filter": map[string]any{"inMailbox": inbox}})
+	require.Equal(t, []any{second, first}, res["ids"])
+	res = query(map[string]any{"filter": map[string]any{"inMailboxOtherThan": []string{inbox}}})
+	require.Equal(t, []any{third}, res["ids"])
+	res = query(map[string]any{"filter": map[string]any{"body": "apples", "notKeyword": "$seen"}})
+	require.Equal(t, []any{first}, res["ids"])
+	res = query(map[string]any{"filter": map[string]any{"after": "2023-01-02T00:00:00Z", "before": "2023-01-03T00:00:00Z"}})
+	require.Equal(t, []any{second}, res["ids"])
+	res = query(map[string]any{"filter": map[string]any{
+		"operator": "OR",
+		"conditions": []any{
+			map[string]any{"subject": "first"},
+			map[string]any{"inMailbox": archive},
+		},
+	}})
+	require.Equal(t, []any{third, first}, res["ids"])
+	res = query(map[string]any{"filter": map[string]any{
+		"operator":   "NOT",
+		"conditions": []any{map[string]any{"hasKeyword": "$seen"}, map[string]any{"hasKeyword": "$flagged"}},
+	}})
+	require.Equal(t, []any{first}, res["ids"])
+
+	res = query(map[string]any{"position": 1, "limit": 1})
+	require.Equal(t, []any{second}, res["ids"])
+	require.EqualValues(t, 1, res["position"])
+	res = query(map[string]any{"position": 1, "limit": 1, "filter": map[string]any{"text": "apples"}})
+	require.Equal(t, []any{first}, res["ids"])
+	res = query(map[string]any{"anchor": first, "anchorOffset": -1})
+	require.Equal(t, []any{second, first}, res["ids"])
+
+	resp := s.call(t, []any{"Email/query", map[string]any{
+		"accountId": s.accountID,
+		"sort":      []any{map[string]any{"property": "bogus"}},
+	}, "0"})
+	require.Equal(t, "unsupportedSort", resp[0].Args["type"])
+	resp = s.call(t, []any{"Email/query", map[string]any{
+		"accountId": s.accountID,
+		"filter":    map[string]any{"hasAttachment": true},
+	}, "0"})
+	require.Equal(t, "unsupportedFilter", resp[0].Args["type"])
+}
+
+// RFC 8621: the from filter looks only at the From header field.
+func TestEmailQueryFrom(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.appendMsg(t, "INBOX", plainMsg("first", "text"), nil, time.Now())
+	s.appendMsg(t, "INBOX", "From: bob@example.org\r\n"+
+		"Sender: alice@example.org\r\n"+
+		"Reply-To: alice@example.org\r\n"+
+		"Subject: second\r\n"+
+		"\r\n"+
+		"text\r\n", nil, time.Now())
+
+	resp := s.call(t, []any{"Email/query", map[string]any{
+		"accountId": s.accountID,
+		"filter":    map[string]any{"from": "alice"},
+	}, "0"})
+	require.Equal(t, "Email/query", resp[0].Name, resp[0].Args)
+	require.Equal(t, []any{alice}, resp[0].Args["ids"])
+}
+
+func TestEmailSetChanges(t *testing.T) {
+	s := newTestServer(t)
+	inbox := s.mailbox(t, "INBOX")
+	archive := s.mailbox(t, "Archive")
+	id := s.appendMsg(t, "INBOX", plainMsg("hello", "text"), []string{`\Seen`, `\Deleted`}, time.Now())
+	other := s.appendMsg(t, "INBOX", plainMsg("other", "text"), nil, time.Now())
+
+	set := func(args map[string]any) map[string]any {
+		t.Helper()
+		args["accountId"] = s.accountID
+		resp := s.call(t, []any{"Email/set", args, "0"})
+		require.Equal(t, "Email/set", resp[0].Name, resp[0].Args)
+		return resp[0].Args
+	}
+	get := func(id string) map[string]any {
+		t.Helper()
+		resp := s.call(t, []any{"Email/get", map[string]any{
+			"accountId":  s.accountID,
+			"ids":        []string{id},
+			"properties": []string{"mailboxIds", "keywords"},
+		}, "0"})
+		return resp[0].Args["list"].([]any)[0].(map[string]any)
+	}
+	changes := func(since string) map[string]any {
+		t.Helper()
+		resp := s.call(t, []any{"Email/changes", map[string]any{"accountId": s.accountID, "sinceState": since}, "0"})
+		require.Equal(t, "Email/changes", resp[0].Name, resp[0].Args)
+		return resp[0].Args
+	}
+
+	initial := s.state(t)
+
+	res := set(map[string]any{"update": map[string]any{
+		id: map[string]any{"keywords/$flagged": true, "keywords/$seen": nil},
+	}})
+	require.Equal(t, map[string]any{id: nil}, res["updated"])
+	require.Equal(t, map[string]any{"$flagged": true}, get(id)["keywords"])
+
+	res = set(map[string]any{"update": map[string]any{
+		id: map[string]any{"keywords": map[string]any{"$Draft": true, "custom": true}},
+	}})
+	require.Equal(t, map[string]any{id: nil}, res["updated"])
+	require.Equal(t, map[string]any{"$draft": true, "custom": true}, get(id)["keywords"])
+
+	// \Deleted is not visible over JMAP but is kept.
+	res = set(map[string]any{"update": map[string]any{
+		id: map[string]any{"mailboxIds": map[string]any{archive: true}},
+	}})
+	require.Equal(t, map[string]any{id: nil}, res["updated"])
+	require.Equal(t, map[string]any{archive: true}, get(id)["mailboxIds"])
+	expunged, err := s.messages.Expunge(context.Background(), s.acctID, mustParse(t, archive), nil)
+	require.NoError(t, err)
+	require.Len(t, expunged, 1)
+
+	// Expunged over IMAP, so append it back.
+	expungedID := id
+	id = s.appendMsg(t, "INBOX", plainMsg("hello", "text"), nil, time.Now())
+	afterAppend := s.state(t)
+
+	res = set(map[string]any{"update": map[string]any{
+		id:        map[string]any{"mailboxIds/" + archive: true},
+		"missing": map[string]any{"keywords/$seen": true},
+		other:     map[string]any{"subject": "changed"},
+	}})
+	require.Equal(t, "tooManyMailboxes", res["notUpdated"].(map[string]any)[id].(map[string]any)["type"])
+	require.Equal(t, "notFound", res["notUpdated"].(map[string]any)["missing"].(map[string]any)["type"])
+	require.Equal(t, []any{"subject"}, res["notUpdated"].(map[string]any)[other].(map[string]any)["properties"])
+
+	res = set(map[string]any{"update": map[string]any{
+		id: map[string]any{"mailboxIds/" + archive: true, "mailboxIds/" + inbox: nil},
+	}})
+	require.Equal(t, map[string]any{id: nil}, res["updated"])
+
+	// Moved emails keep the id, so they are reported as updated.
+	res = changes(afterAppend)
+	require.Empty(t, res["created"])
+	require.Equal(t, []any{id}, res["updated"])
+	require.Empty(t, res["destroyed"])
+
+	res = set(map[string]any{
+		"create":  map[string]any{"new": map[string]any{"subject": "hi"}},
+		"destroy": []string{other, "missing"},
+	})
+	require.Equal(t, "forbidden", res["notCreated"].(map[string]any)["new"].(map[string]any)["type"])
+	require.Equal(t, []any{other}, res["destroyed"])
+	require.Equal(t, "notFound", res["notDestroyed"].(map[string]any)["missing"].(map[string]any)["type"])
+
+	res = changes(initial)
+	require.Equal(t, []any{id}, res["created"])
+	require.Empty(t, res["updated"])
+	require.ElementsMatch(t, []any{expungedID, other}, res["destroyed"])
+
+	// Emails are removed together with the mailbox.
+	beforeDestroy := s.state(t)
+	resp := s.call(t, []any{"Mailbox/set", map[string]any{
+		"accountId":             s.accountID,
+		"destroy":               []string{archive},
+		"onDestroyRemoveEmails": true,
+	}, "0"})
+	require.Equal(t, []any{archive}, resp[0].Args["destroyed"])
+	res = changes(beforeDestroy)
+	require.Equal(t, []any{id}, res["destroyed"])
+}
@@ -0,0 +1,119 @@
+package jmap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/storeerrors"
+	"go.uber.org/zap"
+)
+
+// Request-level errors (RFC 8620, Section 3.6.1).
+const (
+	problemUnknownCapability = "urn:ietf:params:jmap:error:unknownCapability"
+	problemNotJSON           = "urn:ietf:params:jmap:error:notJSON"
+	problemNotRequest        = "urn:ietf:params:jmap:error:notRequest"
+	problemLimit             = "urn:ietf:params:jmap:error:limit"
+)
+
+// problem is RFC 7807 problem details object.
+type problem struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+func writeProblem(ctx context.Context, w http.ResponseWriter, p problem) {
+	if p.Status == 0 {
+		p.Status = http.StatusBadRequest
+	}
+	contextlog.FromContext(ctx).Info("bad request", zap.String("type", p.Type), zap.String("detail", p.Detail))
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	writeJSON(ctx, w, p.Status, p)
+}
+
+// Method-level errors (RFC 8620, Section 3.6.2).
+const (
+	errServerFail             = "serverFail"
+	errUnknownMethod          = "unknownMethod"
+	errInvalidArguments       = "invalidArguments"
+	errInvalidResultReference = "invalidResultReference"
+	errAccountNotFound        = "accountNotFound"
+	errRequestTooLarge        = "requestTooLarge"
+	errStateMismatch          = "stateMismatch"
+	errCannotCalculateChanges = "cannotCalculateChanges"
+	errAnchorNotFound         = "anchorNotFound"
+	errUnsupportedSort        = "unsupportedSort"
+	errUnsupportedFilter      = "unsupportedFilter"
+)
+
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+func invalidArguments(description string) error {
+	return &methodError{Type: errInvalidArguments, Description: description}
+}
+
+// SetError types (RFC 8620, Section 5.3 and RFC 8621, Section 2.5).
+const (
+	setErrForbidden         = "forbidden"
+	setErrNotFound          = "notFound"
+	setErrInvalidPatch      = "invalidPatch"
+	setErrInvalidProperties = "invalidProperties"
+	setErrMailboxHasChild   = "mailboxHasChild"
+	setErrMailboxHasEmail   = "mailboxHasEmail"
+	setErrTooManyMailboxes  = "tooManyMailboxes"
+)
+
+type setError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+// asSetError converts storage errors caused by the client to SetError.
+// It returns nil for internal errors, they fail the whole method call.
+func asSetError(err error, properties ...string) *setError {
+	var notFound storeerrors.NotExistsError
+	if errors.As(err, &notFound) {
+		return &setError{Type: setErrNotFound, Description: notFound.Text}
+	}
+
+	var alreadyExists storeerrors.AlreadyExistsError
+	if errors.As(err, &alreadyExists) {
+		return &setError{Type: setErrInvalidProperties, Description: alreadyExists.Text, Properties: properties}
+	}
+
+	var valid storeerrors.ValidationError
+	if errors.As(err, &valid) {
+		text := valid.Text
+		if text == "" {
+			text = valid.Error()
+		}
+		return &setError{Type: setErrInvalidProperties, Description: text, Properties: properties}
+	}
+
+	var logic storeerrors.LogicError
+	if errors.As(err, &logic) {
+		if errors.Is(err, folder.ErrHasChildren) {
+			return &setError{Type: setErrMailboxHasChild, Description: logic.Text}
+		}
+		return &setError{Type: setErrInvalidProperties, Description: logic.Text, Properties: properties}
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package jmap
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"` // raw, as in the message
+}
+
+// parseHeader splits the raw header into fields. Values are kept as is,
+// including line folding.
+func parseHeader(hdr []byte) []headerField {
+	var fields []headerField
+	for len(hdr) != 0 {
+		line := hdr
+		if i := bytes.IndexByte(hdr, '\n'); i != -1 {
+			line = hdr[:i+1]
+		}
+		hdr = hdr[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of header.
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) != 0 {
+				fields[len(fields)-1].Value += string(line)
+			}
+			continue
+		}
+
+		name, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			// Malformed line, ignore it.
+			continue
+		}
+		fields = append(fields, headerField{
+			Name:  string(bytes.TrimSpace(name)),
+			Value: string(value),
+		})
+	}
+
+	for i := range fields {
+		fields[i].Value = strings.TrimRight(fields[i].Value, "\r\n")
+	}
+	return fields
+}
+
+// Parsed forms of header field values (RFC 8621, Section 4.1.2).
+const (
+	formRaw              = "Raw"
+	formText             = "Text"
+	formAddresses        = "Addresses"
+	formGroupedAddresses = "GroupedAddresses"
+	formMessageIDs       = "MessageIds"
+	formDate             = "Date"
+	formURLs             = "URLs"
+)
+
+// headerProperty is the parsed "header:{name}[:as{form}][:all]" property.
+type headerProperty struct {
+	name string
+	form string
+	all  bool
+}
+
+func parseHeaderProperty(prop string) (headerProperty, bool) {
+	parts := strings.Split(prop, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] != "header" || parts[1] == "" {
+		return headerProperty{}, false
+	}
+	hp := headerProperty{name: parts[1], form: formRaw}
+	rest := parts[2:]
+	if len(rest) != 0 && rest[len(rest)-1] == "all" {
+		hp.all = true
+		rest = rest[:len(rest)-1]
+	}
+	if len(rest) != 0 {
+		form, ok := strings.CutPrefix(rest[0], "as")
+		if !ok {
+			return headerProperty{}, false
+		}
+		switch form {
+		case formRaw, formText, formAddresses, formGroupedAddresses, formMessageIDs, formDate, formURLs:
+		default:
+			return headerProperty{}, false
+		}
+		hp.form = form
+	}
+	return hp, true
+}
+
+// value returns the property value for the header. Without :all, the
+// last field with the name is used.
+func (hp headerProperty) value(fields []headerField) any {
+	var values []any
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, hp.name) {
+			values = append(values, parseForm(hp.form, f.Value))
+		}
+	}
+	if hp.all {
+		if values == nil {
+			return []any{}
+		}
+		return values
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+var addrParser = mail.AddressParser{WordDecoder: &wordDecoder}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+func unfold(value string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type emailAddressGroup struct {
+	Name      *string        `json:"name"`
+	Addresses []emailAddress `json:"addresses"`
+}
+
+// parseForm converts the raw value into the form. Values that cannot be
+// parsed are returned as null.
+func parseForm(form, raw string) any {
+	switch form {
+	case formText:
+		return asText(raw)
+	case formAddresses:
+		if addrs := asAddresses(raw); addrs != nil {
+			return addrs
+		}
+	case formGroupedAddresses:
+		// Group names are not preserved by the address parser.
+		if addrs := asAddresses(raw); addrs != nil {
+			return []emailAddressGroup{{Addresses: addrs}}
+		}
+	case formMessageIDs:
+		if ids := asMessageIDs(raw); ids != nil {
+			return ids
+		}
+	case formDate:
+		if date := asDate(raw); date != nil {
+			return date
+		}
+	case formURLs:
+		if urls := asURLs(raw); urls != nil {
+			return urls
+		}
+	default:
+		return raw
+	}
+	return nil
+}
+
+func asText(raw string) string {
+	value := strings.TrimSpace(unfold(raw))
+	if dec, err := wordDecoder.DecodeHeader(value); err == nil {
+		return dec
+	}
+	return value
+}
+
+func asAddresses(raw string) []emailAddress {
+	value := strings.TrimSpace(unfold(raw))
+	if value == "" {
+		return []emailAddress{}
+	}
+	list, err := addrParser.ParseList(value)
+	if err != nil {
+		return nil
+	}
+	res := make([]emailAddress, len(list))
+	for i, a := range list {
+		res[i].Email = a.Address
+		if a.Name != "" {
+			name := a.Name
+			res[i].Name = &name
+		}
+	}
+	return res
+}
+
+// asMessageIDs returns message identifiers (without angle brackets)
+// listed in the value.
+func asMessageIDs(raw string) []string {
+	var ids []string
+	value := unfold(raw)
+	for {
+		start := strings.IndexByte(value, '<')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end == -1 {
+			break
+		}
+		ids = append(ids, value[start+1:start+end])
+		value = value[start+end+1:]
+	}
+	return ids
+}
+
+func asDate(raw string) *string {
+	date, err := mail.ParseDate(strings.TrimSpace(unfold(raw)))
+	if err != nil {
+		return nil
+	}
+	res := date.Format(time.RFC3339)
+	return &res
+}
+
+// asURLs returns URLs enclosed in angle brackets, as used by List-*
+// header fields.
+func asURLs(raw string) []string {
+	var urls []string
+	for _, item := range strings.Split(unfold(raw), ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "<") && strings.HasSuffix(item, ">") {
+			urls = append(urls, strings.TrimSpace(item[1:len(item)-1]))
+		}
+	}
+	return urls
+}
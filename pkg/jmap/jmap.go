@@ -0,0 +1,187 @@
+// Package jmap implements JMAP (RFC 8620, RFC 8621) HTTP endpoints on top
+// of the storage usecases.
+package jmap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime/trace"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+)
+
+const (
+	pathSession = "/.well-known/jmap"
+	pathAPI     = "/jmap/api"
+)
+
+type Config struct {
+	// BaseURL is the URL (e.g. "https://mx.example.org") the server is
+	// reachable at, it is used to construct URLs in the session resource.
+	// If empty, it is derived from the request.
+	BaseURL string
+
+	// Limits advertised in the session resource, zero values are replaced
+	// with defaults.
+	MaxSizeRequest    int64
+	MaxCallsInRequest int
+	MaxObjectsInGet   int
+	MaxObjectsInSet   int
+
+	// Notifier receives changes made by clients, so they are reported to
+	// IMAP sessions served by the same process. If nil, changes are not
+	// reported.
+	Notifier Notifier
+}
+
+// Notifier receives changes made via JMAP, imap2.Backend implements it.
+type Notifier interface {
+	NewMessages(folderID ulid.ULID, uids []uint32)
+	FlagsChanged(folderID ulid.ULID, uid uint32, flags []string)
+	Removed(folderID ulid.ULID, uids []uint32)
+	FolderDestroyed(folderID ulid.ULID)
+}
+
+type nopNotifier struct{}
+
+func (nopNotifier) NewMessages(ulid.ULID, []uint32)          {}
+func (nopNotifier) FlagsChanged(ulid.ULID, uint32, []string) {}
+func (nopNotifier) Removed(ulid.ULID, []uint32)              {}
+func (nopNotifier) FolderDestroyed(ulid.ULID)                {}
+
+func (cfg *Config) setDefaults() {
+	if cfg.MaxSizeRequest == 0 {
+		cfg.MaxSizeRequest = 10 * 1024 * 1024
+	}
+	if cfg.MaxCallsInRequest == 0 {
+		cfg.MaxCallsInRequest = 32
+	}
+	if cfg.MaxObjectsInGet == 0 {
+		cfg.MaxObjectsInGet = 500
+	}
+	if cfg.MaxObjectsInSet == 0 {
+		cfg.MaxObjectsInSet = 500
+	}
+	if cfg.Notifier == nil {
+		cfg.Notifier = nopNotifier{}
+	}
+}
+
+// Server is http.Handler serving the JMAP session resource at
+// /.well-known/jmap and the API endpoint at /jmap/api. Clients
+// authenticate using HTTP Basic authentication.
+type Server struct {
+	cfg Config
+	log *zap.Logger
+
+	accounts  usecase.Account
+	folders   usecase.Folder
+	messages  usecase.Message
+	changeLog changelog.Repo
+}
+
+func New(
+	cfg Config,
+	log *zap.Logger,
+	accounts usecase.Account,
+	folders usecase.Folder,
+	messages usecase.Message,
+	changeLog changelog.Repo,
+) *Server {
+	cfg.setDefaults()
+	return &Server{
+		cfg:       cfg,
+		log:       log,
+		accounts:  accounts,
+		folders:   folders,
+		messages:  messages,
+		changeLog: changeLog,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rid := ulid.Make()
+	log := s.log.With(zap.Stringer("request_id", rid))
+
+	ctx := contextlog.WithLogger(r.Context(), log)
+	ctx, task := trace.NewTask(ctx, "maddy-storage/jmap.Request")
+	defer task.End()
+	trace.Log(ctx, "request_id", rid.String())
+
+	var handler func(ctx context.Context, w http.ResponseWriter, r *http.Request, sess *session)
+	switch r.URL.Path {
+	case pathSession:
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler = s.serveSession
+	case pathAPI:
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler = s.serveAPI
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	sess, err := s.authenticate(ctx, r)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidCredentials) {
+			log.Info("invalid credentials")
+			w.Header().Set("WWW-Authenticate", `Basic realm="jmap"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		log.Error("authentication error", zap.Error(err))
+		http.Error(w, "internal server error, request id: "+rid.String(), http.StatusInternalServerError)
+		return
+	}
+
+	handler(contextlog.WithLogger(ctx, log.With(zap.Stringer("account_id", sess.accountID))), w, r, sess)
+}
+
+type session struct {
+	username  string
+	accountID ulid.ULID
+}
+
+func (s *Server) authenticate(ctx context.Context, r *http.Request) (*session, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, usecase.ErrInvalidCredentials
+	}
+
+	accountID, err := s.accounts.AuthPlain(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		username:  username,
+		accountID: accountID,
+	}, nil
+}
+
+func (s *Server) baseURL(r *http.Request) string {
+	if s.cfg.BaseURL != "" {
+		return s.cfg.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,380 @@
+package jmap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	accountmemory "github.com/foxcpp/maddy-storage/internal/domain/account/repository/memory"
+	changelogmemory "github.com/foxcpp/maddy-storage/internal/domain/changelog/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	foldermemory "github.com/foxcpp/maddy-storage/internal/domain/folder/repository/memory"
+	messagememory "github.com/foxcpp/maddy-storage/internal/domain/message/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/repository/memory"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/foxcpp/maddy-storage/pkg/jmap"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testUsername = "test"
+
+var using = []string{"urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail"}
+
+type testServer struct {
+	srv       *httptest.Server
+	accountID string
+
+	acctID   ulid.ULID
+	messages usecase.Message
+}
+
+// newTestServer returns the server backed by in-memory repositories with
+// the account testUsername that has INBOX.
+func newTestServer(t *testing.T) *testServer {
+	ctx := context.Background()
+
+	db := memory.New()
+	changeLog := changelogmemory.New(db)
+	accounts := usecase.NewAccount(accountmemory.New(db), usecase.StubAuth{}, changeLog, db)
+	folderRepo := foldermemory.New(db)
+	folders := usecase.NewFolder(folderRepo, foldermemory.NewSearcher(db), changeLog, db)
+	messages := usecase.NewMessage(folderRepo, messagememory.New(db), changeLog, db, nil)
+
+	acct, err := accounts.Create(ctx, testUsername)
+	require.NoError(t, err)
+	_, err = folders.Create(ctx, acct.ID_, "INBOX", folder.RoleInbox)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(jmap.New(jmap.Config{}, zap.NewNop(), accounts, folders, messages, changeLog))
+	t.Cleanup(srv.Close)
+
+	return &testServer{
+		srv:       srv,
+		accountID: acct.ID_.String(),
+		acctID:    acct.ID_,
+		messages:  messages,
+	}
+}
+
+func (s *testServer) post(t *testing.T, body []byte) (int, map[string]any) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, s.srv.URL+"/jmap/api", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth(testUsername, "password")
+	resp, err := s.srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var res map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	return resp.StatusCode, res
+}
+
+type methodResponse struct {
+	Name   string
+	Args   map[string]any
+	CallID string
+}
+
+// call sends method calls, each is [name, arguments, call id], and
+// returns method responses.
+func (s *testServer) call(t *testing.T, calls ...[]any) []methodResponse {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]any{
+		"using":       using,
+		"methodCalls": calls,
+	})
+	require.NoError(t, err)
+	status, res := s.post(t, body)
+	require.Equal(t, http.StatusOK, status, res)
+
+	var responses []methodResponse
+	for _, r := range res["methodResponses"].([]any) {
+		inv := r.([]any)
+		responses = append(responses, methodResponse{
+			Name:   inv[0].(string),
+			Args:   inv[1].(map[string]any),
+			CallID: inv[2].(string),
+		})
+	}
+	require.Len(t, responses, len(calls))
+	return responses
+}
+
+// state returns the current Mailbox state.
+func (s *testServer) state(t *testing.T) string {
+	t.Helper()
+
+	resp := s.call(t, []any{"Mailbox/get", map[string]any{"accountId": s.accountID, "ids": []string{}}, "0"})
+	return resp[0].Args["state"].(string)
+}
+
+func TestSession(t *testing.T) {
+	s := newTestServer(t)
+
+	resp, err := s.srv.Client().Get(s.srv.URL + "/.well-known/jmap")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, s.srv.URL+"/.well-known/jmap", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth(testUsername, "password")
+	resp, err = s.srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var session struct {
+		Capabilities    map[string]any            `json:"capabilities"`
+		Accounts        map[string]map[string]any `json:"accounts"`
+		PrimaryAccounts map[string]string         `json:"primaryAccounts"`
+		Username        string                    `json:"username"`
+		APIURL          string                    `json:"apiUrl"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	require.Contains(t, session.Capabilities, "urn:ietf:params:jmap:core")
+	require.Contains(t, session.Accounts, s.accountID)
+	require.Equal(t, s.accountID, session.PrimaryAccounts["urn:ietf:params:jmap:mail"])
+	require.Equal(t, testUsername, session.Username)
+	require.Equal(t, s.srv.URL+"/jmap/api", session.APIURL)
+}
+
+func TestRequestErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	status, res := s.post(t, []byte(`{"using": [`))
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "urn:ietf:params:jmap:error:notJSON", res["type"])
+
+	status, res = s.post(t, []byte(`{"using": [], "methodCalls": {}}`))
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "urn:ietf:params:jmap:error:notRequest", res["type"])
+
+	status, res = s.post(t, []byte(`{"using": ["urn:example"], "methodCalls": []}`))
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "urn:ietf:params:jmap:error:unknownCapability", res["type"])
+
+	resp := s.call(t,
+		[]any{"Foo/bar", map[string]any{}, "0"},
+		[]any{"Mailbox/get", map[string]any{"accountId": "other"}, "1"},
+		[]any{"Mailbox/get", map[string]any{"accountId": s.accountID, "foo": 1}, "2"},
+		[]any{"Core/echo", map[string]any{"hello": true}, "3"},
+		[]any{"Core/echo", map[string]any{"#hello": map[string]any{
+			"resultOf": "3", "name": "Core/echo", "path": "/missing",
+		}}, "4"},
+	)
+	for i, typ := range []string{"unknownMethod", "accountNotFound", "invalidArguments"} {
+		require.Equal(t, "error", resp[i].Name)
+		require.Equal(t, typ, resp[i].Args["type"])
+	}
+	require.Equal(t, "Core/echo", resp[3].Name)
+	require.Equal(t, map[string]any{"hello": true}, resp[3].Args)
+	require.Equal(t, "error", resp[4].Name)
+	require.Equal(t, "invalidResultReference", resp[4].Args["type"])
+}
+
+func TestMailboxSetGet(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.call(t,
+		[]any{"Mailbox/set", map[string]any{
+			"accountId": s.accountID,
+			"create": map[string]any{
+				"c2": map[string]any{"name": "Projects", "parentId": "#c1"},
+				"c1": map[string]any{"name": "Work", "sortOrder": 10, "isSubscribed": true},
+			},
+		}, "0"},
+		[]any{"Mailbox/query", map[string]any{
+			"accountId":  s.accountID,
+			"sortAsTree": true,
+		}, "1"},
+		[]any{"Mailbox/get", map[string]any{
+			"accountId":  s.accountID,
+			"#ids":       map[string]any{"resultOf": "1", "name": "Mailbox/query", "path": "/ids"},
+			"properties": []string{"name", "parentId", "role", "sortOrder", "isSubscribed"},
+		}, "2"},
+		[]any{"Mailbox/get", map[string]any{
+			"accountId":  s.accountID,
+			"ids":        []string{"#c2"},
+			"properties": []string{"name"},
+		}, "3"},
+	)
+	require.Equal(t, "Mailbox/set", resp[0].Name, resp[0].Args)
+	created := resp[0].Args["created"].(map[string]any)
+	require.Len(t, created, 2)
+	workID := created["c1"].(map[string]any)["id"].(string)
+	projectsID := created["c2"].(map[string]any)["id"].(string)
+
+	require.Equal(t, "Mailbox/get", resp[2].Name, resp[2].Args)
+	list := resp[2].Args["list"].([]any)
+	require.Len(t, list, 3)
+	require.Equal(t, "INBOX", list[0].(map[string]any)["name"])
+	require.Equal(t, "inbox", list[0].(map[string]any)["role"])
+	require.Equal(t, map[string]any{
+		"id":           workID,
+		"name":         "Work",
+		"parentId":     nil,
+		"role":         nil,
+		"sortOrder":    float64(10),
+		"isSubscribed": true,
+	}, list[1])
+	require.Equal(t, projectsID, list[2].(map[string]any)["id"])
+	require.Equal(t, workID, list[2].(map[string]any)["parentId"])
+
+	require.Equal(t, []any{map[string]any{"id": projectsID, "name": "Projects"}}, resp[3].Args["list"])
+
+	resp = s.call(t,
+		[]any{"Mailbox/set", map[string]any{
+			"accountId": s.accountID,
+			"update": map[string]any{
+				workID:     map[string]any{"name": "Archive", "role": "archive"},
+				projectsID: map[string]any{"parentId": nil},
+			},
+		}, "0"},
+		[]any{"Mailbox/query", map[string]any{
+			"accountId": s.accountID,
+			"filter":    map[string]any{"hasAnyRole": true},
+			"sort":      []any{map[string]any{"property": "name", "isAscending": false}},
+		}, "1"},
+		[]any{"Mailbox/get", map[string]any{
+			"accountId":  s.accountID,
+			"ids":        []string{workID, projectsID, "missing"},
+			"properties": []string{"name", "parentId", "role"},
+		}, "2"},
+	)
+	require.Len(t, resp[0].Args["updated"], 2, resp[0].Args)
+	require.Len(t, resp[1].Args["ids"], 2)
+	require.Equal(t, workID, resp[1].Args["ids"].([]any)[1])
+	require.Equal(t, []any{
+		map[string]any{"id": workID, "name": "Archive", "parentId": nil, "role": "archive"},
+		map[string]any{"id": projectsID, "name": "Projects", "parentId": nil, "role": nil},
+	}, resp[2].Args["list"])
+	require.Equal(t, []any{"missing"}, resp[2].Args["notFound"])
+}
+
+func TestMailboxSetErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.call(t, []any{"Mailbox/set", map[string]any{
+		"accountId": s.accountID,
+		"create": map[string]any{
+			"parent":  map[string]any{"name": "Parent"},
+			"child":   map[string]any{"name": "Child", "parentId": "#parent"},
+			"noName":  map[string]any{"sortOrder": 1},
+			"badRole": map[string]any{"name": "Bad", "role": "unknown"},
+			"inbox":   map[string]any{"name": "INBOX"},
+			"badProp": map[string]any{"name": "Bad", "totalEmails": 1},
+		},
+	}, "0"})
+	notCreated := resp[0].Args["notCreated"].(map[string]any)
+	require.Len(t, notCreated, 4)
+	for _, cid := range []string{"noName", "badRole", "inbox", "badProp"} {
+		require.Equal(t, "invalidProperties", notCreated[cid].(map[string]any)["type"], cid)
+	}
+	created := resp[0].Args["created"].(map[string]any)
+	parentID := created["parent"].(map[string]any)["id"].(string)
+	childID := created["child"].(map[string]any)["id"].(string)
+
+	state := s.state(t)
+	resp = s.call(t,
+		[]any{"Mailbox/set", map[string]any{
+			"accountId": s.accountID,
+			"ifInState": "0",
+			"destroy":   []string{parentID},
+		}, "0"},
+		[]any{"Mailbox/set", map[string]any{
+			"accountId": s.accountID,
+			"ifInState": state,
+			"update": map[string]any{
+				parentID: map[string]any{"parentId": childID},
+			},
+			"destroy": []string{parentID, "missing"},
+		}, "1"},
+	)
+	require.Equal(t, "error", resp[0].Name)
+	require.Equal(t, "stateMismatch", resp[0].Args["type"])
+
+	require.Equal(t, "invalidProperties", resp[1].Args["notUpdated"].(map[string]any)[parentID].(map[string]any)["type"])
+	notDestroyed := resp[1].Args["notDestroyed"].(map[string]any)
+	require.Equal(t, "mailboxHasChild", notDestroyed[parentID].(map[string]any)["type"])
+	require.Equal(t, "notFound", notDestroyed["missing"].(map[string]any)["type"])
+	require.Equal(t, state, resp[1].Args["newState"])
+
+	resp = s.call(t, []any{"Mailbox/set", map[string]any{
+		"accountId": s.accountID,
+		"destroy":   []string{parentID, childID},
+	}, "0"})
+	require.ElementsMatch(t, []any{parentID, childID}, resp[0].Args["destroyed"])
+}
+
+func TestMailboxChanges(t *testing.T) {
+	s := newTestServer(t)
+
+	changes := func(since string, maxChanges int) map[string]any {
+		args := map[string]any{"accountId": s.accountID, "sinceState": since}
+		if maxChanges != 0 {
+			args["maxChanges"] = maxChanges
+		}
+		resp := s.call(t, []any{"Mailbox/changes", args, "0"})
+		require.Equal(t, "Mailbox/changes", resp[0].Name, resp[0].Args)
+		return resp[0].Args
+	}
+	set := func(args map[string]any) map[string]any {
+		args["accountId"] = s.accountID
+		resp := s.call(t, []any{"Mailbox/set", args, "0"})
+		require.Equal(t, "Mailbox/set", resp[0].Name, resp[0].Args)
+		return resp[0].Args
+	}
+
+	initial := s.state(t)
+	res := changes(initial, 0)
+	require.Equal(t, initial, res["newState"])
+	require.Empty(t, res["created"])
+
+	created := set(map[string]any{"create": map[string]any{
+		"a": map[string]any{"name": "A"},
+		"b": map[string]any{"name": "B"},
+	}})["created"].(map[string]any)
+	a := created["a"].(map[string]any)["id"].(string)
+	b := created["b"].(map[string]any)["id"].(string)
+
+	res = changes(initial, 0)
+	require.Equal(t, []any{a, b}, res["created"])
+	require.Empty(t, res["updated"])
+	require.Equal(t, false, res["hasMoreChanges"])
+	afterCreate := res["newState"].(string)
+	require.Equal(t, s.state(t), afterCreate)
+
+	res = changes(initial, 1)
+	require.Equal(t, []any{a}, res["created"])
+	require.Equal(t, true, res["hasMoreChanges"])
+	res = changes(res["newState"].(string), 1)
+	require.Equal(t, []any{b}, res["created"])
+
+	set(map[string]any{
+		"update":  map[string]any{a: map[string]any{"name": "A2"}},
+		"destroy": []string{b},
+	})
+	res = changes(afterCreate, 0)
+	require.Empty(t, res["created"])
+	require.Equal(t, []any{a}, res["updated"])
+	require.Equal(t, []any{b}, res["destroyed"])
+	require.Nil(t, res["updatedProperties"])
+
+	// Objects created and destroyed since the state are not reported.
+	res = changes(initial, 0)
+	require.Equal(t, []any{a}, res["created"])
+	require.Empty(t, res["updated"])
+	require.Empty(t, res["destroyed"])
+
+	resp := s.call(t, []any{"Mailbox/changes", map[string]any{"accountId": s.accountID, "sinceState": "bad"}, "0"})
+	require.Equal(t, "cannotCalculateChanges", resp[0].Args["type"])
+}
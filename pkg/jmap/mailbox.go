@@ -0,0 +1,768 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/foxcpp/maddy-storage/internal/domain/folder"
+	"github.com/foxcpp/maddy-storage/internal/usecase"
+	"github.com/oklog/ulid/v2"
+)
+
+var mailboxProperties = []string{
+	"id", "name", "parentId", "role", "sortOrder",
+	"totalEmails", "unreadEmails", "totalThreads", "unreadThreads",
+	"myRights", "isSubscribed",
+}
+
+// Properties derived from folder contents, they change together with
+// emails.
+var mailboxCountProperties = []string{
+	"totalEmails", "unreadEmails", "totalThreads", "unreadThreads",
+}
+
+type mailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+// Mailboxes are not shared, so the owner can do everything.
+var ownerRights = mailboxRights{
+	MayReadItems:   true,
+	MayAddItems:    true,
+	MayRemoveItems: true,
+	MaySetSeen:     true,
+	MaySetKeywords: true,
+	MayCreateChild: true,
+	MayRename:      true,
+	MayDelete:      true,
+	MaySubmit:      true,
+}
+
+// roleAsJMAP converts the role to the lowercase name from the IANA
+// "IMAP Mailbox Name Attributes" registry.
+func roleAsJMAP(r folder.Role) *string {
+	if r == folder.RoleNone {
+		return nil
+	}
+	role := strings.ToLower(string(r))
+	return &role
+}
+
+func roleFromJMAP(role string) (folder.Role, bool) {
+	if role == "" || strings.ToLower(role) != role {
+		return folder.RoleNone, false
+	}
+	r := folder.Role(strings.ToUpper(role[:1]) + role[1:])
+	return r, r.Valid()
+}
+
+func mailboxAsJSON(data *usecase.FolderData, properties []string) map[string]any {
+	f := &data.Folder
+
+	res := make(map[string]any, len(properties)+1)
+	res["id"] = f.ID_.String()
+	for _, prop := range properties {
+		switch prop {
+		case "name":
+			res[prop] = f.Name_
+		case "parentId":
+			if f.ParentID_ == (ulid.ULID{}) {
+				res[prop] = nil
+			} else {
+				res[prop] = f.ParentID_.String()
+			}
+		case "role":
+			res[prop] = roleAsJMAP(f.Role_)
+		case "sortOrder":
+			res[prop] = f.SortOrder_
+		case "totalEmails", "totalThreads":
+			// Threads are not tracked, each email is a thread of its own.
+			res[prop] = data.Msgs
+		case "unreadEmails", "unreadThreads":
+			res[prop] = data.UnseenMsgs
+		case "myRights":
+			res[prop] = ownerRights
+		case "isSubscribed":
+			res[prop] = f.Subscribed_
+		}
+	}
+	return res
+}
+
+func (c *call) mailboxes(ctx context.Context, counts bool) ([]usecase.FolderData, error) {
+	return c.s.folders.List(ctx, c.sess.accountID, &usecase.ListOpts{
+		CountMsgs:   counts,
+		CountUnseen: counts,
+	}, folder.OrderBySortOrder)
+}
+
+func (c *call) mailboxGet(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args getArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs != nil && len(*args.IDs) > c.s.cfg.MaxObjectsInGet {
+		return nil, &methodError{Type: errRequestTooLarge}
+	}
+	properties, err := args.properties(mailboxProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := false
+	for _, prop := range mailboxCountProperties {
+		counts = counts || contains(properties, prop)
+	}
+	all, err := c.mailboxes(ctx, counts)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := getResponse{
+		AccountID: args.AccountID,
+		State:     state,
+		List:      []map[string]any{},
+		NotFound:  []string{},
+	}
+	if args.IDs == nil {
+		for i := range all {
+			resp.List = append(resp.List, mailboxAsJSON(&all[i], properties))
+		}
+		return resp, nil
+	}
+
+	byID := make(map[ulid.ULID]*usecase.FolderData, len(all))
+	for i := range all {
+		byID[all[i].Folder.ID_] = &all[i]
+	}
+	for _, id := range *args.IDs {
+		parsed, ok := c.resolveID(id)
+		data := byID[parsed]
+		if !ok || data == nil {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.List = append(resp.List, mailboxAsJSON(data, properties))
+	}
+	return resp, nil
+}
+
+type mailboxChangesResponse struct {
+	changesResponse
+	UpdatedProperties []string `json:"updatedProperties"`
+}
+
+func (c *call) mailboxChanges(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args changesArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	entries, resp, err := c.changes(ctx, &args)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(changeSet)
+	countsOnly := true
+	for _, ent := range entries {
+		if ent.FolderID == (ulid.ULID{}) {
+			continue
+		}
+		switch ent.Type {
+		case changelog.TypeFolderCreated:
+			changes.add(ent.FolderID, changeCreated)
+		case changelog.TypeFolderRenamed, changelog.TypeFolderUpdated:
+			changes.add(ent.FolderID, changeUpdated)
+			countsOnly = false
+		case changelog.TypeFolderDeleted:
+			changes.add(ent.FolderID, changeDestroyed)
+		case changelog.TypeMessageCreated, changelog.TypeMessageUpdated, changelog.TypeMessageDeleted:
+			changes.add(ent.FolderID, changeUpdated)
+		}
+	}
+	changes.fill(resp)
+
+	mresp := mailboxChangesResponse{changesResponse: *resp}
+	if countsOnly && len(resp.Updated) != 0 {
+		mresp.UpdatedProperties = mailboxCountProperties
+	}
+	return mresp, nil
+}
+
+type mailboxFilter struct {
+	Operator   string          `json:"operator"`
+	Conditions []mailboxFilter `json:"conditions"`
+
+	ParentID     nullable[string] `json:"parentId"`
+	Name         *string          `json:"name"`
+	Role         nullable[string] `json:"role"`
+	HasAnyRole   *bool            `json:"hasAnyRole"`
+	IsSubscribed *bool            `json:"isSubscribed"`
+}
+
+func (flt *mailboxFilter) match(f *folder.Folder) (bool, error) {
+	switch flt.Operator {
+	case "":
+	case "AND", "OR", "NOT":
+		for i := range flt.Conditions {
+			ok, err := flt.Conditions[i].match(f)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case flt.Operator == "AND" && !ok:
+				return false, nil
+			case flt.Operator == "OR" && ok:
+				return true, nil
+			case flt.Operator == "NOT" && ok:
+				return false, nil
+			}
+		}
+		return flt.Operator != "OR", nil
+	default:
+		return false, &methodError{Type: errUnsupportedFilter, Description: "unknown operator: " + flt.Operator}
+	}
+
+	if flt.ParentID.Set {
+		if flt.ParentID.Value == nil {
+			if f.ParentID_ != (ulid.ULID{}) {
+				return false, nil
+			}
+		} else if f.ParentID_ == (ulid.ULID{}) || f.ParentID_.String() != *flt.ParentID.Value {
+			return false, nil
+		}
+	}
+	if flt.Name != nil && !strings.Contains(strings.ToLower(f.Name_), strings.ToLower(*flt.Name)) {
+		return false, nil
+	}
+	if flt.Role.Set {
+		role := roleAsJMAP(f.Role_)
+		if flt.Role.Value == nil {
+			if role != nil {
+				return false, nil
+			}
+		} else if role == nil || *role != *flt.Role.Value {
+			return false, nil
+		}
+	}
+	if flt.HasAnyRole != nil && (f.Role_ != folder.RoleNone) != *flt.HasAnyRole {
+		return false, nil
+	}
+	if flt.IsSubscribed != nil && f.Subscribed_ != *flt.IsSubscribed {
+		return false, nil
+	}
+	return true, nil
+}
+
+type mailboxQueryArgs struct {
+	AccountID      string         `json:"accountId"`
+	Filter         *mailboxFilter `json:"filter"`
+	Sort           []comparator   `json:"sort"`
+	Position       int            `json:"position"`
+	Anchor         *string        `json:"anchor"`
+	AnchorOffset   int            `json:"anchorOffset"`
+	Limit          *int           `json:"limit"`
+	CalculateTotal bool           `json:"calculateTotal"`
+	SortAsTree     bool           `json:"sortAsTree"`
+	FilterAsTree   bool           `json:"filterAsTree"`
+}
+
+// mailboxLess returns the function ordering folders according to the
+// comparators. Folders are ordered by sortOrder and name by default.
+func mailboxLess(sortBy []comparator) (func(lhs, rhs *folder.Folder) bool, error) {
+	if len(sortBy) == 0 {
+		sortBy = []comparator{{Property: "sortOrder"}, {Property: "name"}}
+	}
+	for _, cmp := range sortBy {
+		if cmp.Property != "sortOrder" && cmp.Property != "name" {
+			return nil, &methodError{Type: errUnsupportedSort, Description: "cannot sort by " + cmp.Property}
+		}
+		if cmp.Collation != "" {
+			return nil, &methodError{Type: errUnsupportedSort, Description: "collations are not supported"}
+		}
+	}
+
+	return func(lhs, rhs *folder.Folder) bool {
+		for _, cmp := range sortBy {
+			var res int
+			switch cmp.Property {
+			case "sortOrder":
+				switch {
+				case lhs.SortOrder_ < rhs.SortOrder_:
+					res = -1
+				case lhs.SortOrder_ > rhs.SortOrder_:
+					res = 1
+				}
+			case "name":
+				res = strings.Compare(lhs.Name_, rhs.Name_)
+			}
+			if cmp.IsAscending != nil && !*cmp.IsAscending {
+				res = -res
+			}
+			if res != 0 {
+				return res < 0
+			}
+		}
+		return lhs.ID_.Compare(rhs.ID_) < 0
+	}, nil
+}
+
+func (c *call) mailboxQuery(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args mailboxQueryArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	less, err := mailboxLess(args.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := c.mailboxes(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(map[ulid.ULID]bool, len(all))
+	for i := range all {
+		ok := true
+		if args.Filter != nil {
+			ok, err = args.Filter.match(&all[i].Folder)
+			if err != nil {
+				return nil, err
+			}
+		}
+		matched[all[i].Folder.ID_] = ok
+	}
+
+	parents := make(map[ulid.ULID]ulid.ULID, len(all))
+	for i := range all {
+		parents[all[i].Folder.ID_] = all[i].Folder.ParentID_
+	}
+	// With filterAsTree, folders are included only if all of their
+	// ancestors match the filter too.
+	included := func(id ulid.ULID) bool {
+		if !args.FilterAsTree {
+			return matched[id]
+		}
+		for id != (ulid.ULID{}) {
+			if !matched[id] {
+				return false
+			}
+			id = parents[id]
+		}
+		return true
+	}
+
+	var list []*folder.Folder
+	for i := range all {
+		if included(all[i].Folder.ID_) {
+			list = append(list, &all[i].Folder)
+		}
+	}
+	if args.SortAsTree {
+		folder.SortAsTree(list, func(i int) ulid.ULID {
+			return list[i].ID_
+		}, func(i int) ulid.ULID {
+			return list[i].ParentID_
+		}, func(i, j int) bool {
+			return less(list[i], list[j])
+		})
+	} else {
+		sort.SliceStable(list, func(i, j int) bool {
+			return less(list[i], list[j])
+		})
+	}
+
+	ids := make([]string, len(list))
+	for i, f := range list {
+		ids[i] = f.ID_.String()
+	}
+
+	resp := queryResponse{
+		AccountID:  args.AccountID,
+		QueryState: state,
+	}
+	if args.CalculateTotal {
+		total := len(ids)
+		resp.Total = &total
+	}
+	resp.IDs, resp.Position, err = window(ids, args.Position, args.Anchor, args.AnchorOffset, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type mailboxSetArgs struct {
+	setArgs
+	OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+}
+
+// mailboxPatch contains client-settable Mailbox properties.
+type mailboxPatch struct {
+	Name         *string
+	ParentID     nullable[string]
+	Role         nullable[string]
+	SortOrder    *uint
+	IsSubscribed *bool
+}
+
+func parseMailboxPatch(raw map[string]json.RawMessage) (*mailboxPatch, *setError) {
+	var (
+		patch mailboxPatch
+		bad   []string
+	)
+	for prop, value := range raw {
+		var err error
+		switch prop {
+		case "name":
+			err = json.Unmarshal(value, &patch.Name)
+			if err == nil && patch.Name == nil {
+				err = errors.New("name must not be null")
+			}
+		case "parentId":
+			err = json.Unmarshal(value, &patch.ParentID)
+		case "role":
+			err = json.Unmarshal(value, &patch.Role)
+		case "sortOrder":
+			err = json.Unmarshal(value, &patch.SortOrder)
+		case "isSubscribed":
+			err = json.Unmarshal(value, &patch.IsSubscribed)
+		default:
+			// Server-set or unknown property.
+			err = errors.New("cannot be set")
+		}
+		if err != nil {
+			bad = append(bad, prop)
+		}
+	}
+	if len(bad) != 0 {
+		sort.Strings(bad)
+		return nil, &setError{Type: setErrInvalidProperties, Properties: bad}
+	}
+
+	if patch.Name != nil {
+		name := *patch.Name
+		if name == "" || len(name) > maxSizeMailboxName || strings.Contains(name, folder.PathSeparator) {
+			return nil, &setError{
+				Type:        setErrInvalidProperties,
+				Description: "name must be non-empty and must not contain " + folder.PathSeparator,
+				Properties:  []string{"name"},
+			}
+		}
+	}
+	if patch.Role.Value != nil {
+		if _, ok := roleFromJMAP(*patch.Role.Value); !ok {
+			return nil, &setError{Type: setErrInvalidProperties, Properties: []string{"role"}}
+		}
+	}
+	return &patch, nil
+}
+
+// apply sets mutable properties of the folder.
+func (p *mailboxPatch) apply(f *folder.Folder) {
+	if p.Role.Set {
+		role := folder.RoleNone
+		if p.Role.Value != nil {
+			role, _ = roleFromJMAP(*p.Role.Value)
+		}
+		f.SetRole(role)
+	}
+	if p.SortOrder != nil {
+		f.SetSortOrder(*p.SortOrder)
+	}
+	if p.IsSubscribed != nil {
+		f.SetSubscribed(*p.IsSubscribed)
+	}
+}
+
+func (p *mailboxPatch) hasMutable() bool {
+	return p.Role.Set || p.SortOrder != nil || p.IsSubscribed != nil
+}
+
+// parentPath returns the path of the new parent folder, it is empty for
+// top-level folders.
+func (c *call) parentPath(ctx context.Context, parentID *string) (string, *setError, error) {
+	if parentID == nil {
+		return "", nil, nil
+	}
+	id, ok := c.resolveID(*parentID)
+	if !ok {
+		return "", &setError{Type: setErrInvalidProperties, Description: "no such parent", Properties: []string{"parentId"}}, nil
+	}
+	parent, err := c.s.folders.GetByID(ctx, c.sess.accountID, id)
+	if err != nil {
+		if setErr := asSetError(err, "parentId"); setErr != nil {
+			setErr.Type = setErrInvalidProperties
+			setErr.Properties = []string{"parentId"}
+			return "", setErr, nil
+		}
+		return "", nil, err
+	}
+	return parent.Path_ + folder.PathSeparator, nil, nil
+}
+
+func (c *call) mailboxSet(ctx context.Context, rawArgs json.RawMessage) (any, error) {
+	var args mailboxSetArgs
+	if err := decodeArgs(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	resp, err := c.beginSet(ctx, &args.setArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.mailboxCreate(ctx, args.Create, resp); err != nil {
+		return nil, err
+	}
+	if err := c.mailboxUpdate(ctx, args.Update, resp); err != nil {
+		return nil, err
+	}
+	if err := c.mailboxDestroy(ctx, args.Destroy, args.OnDestroyRemoveEmails, resp); err != nil {
+		return nil, err
+	}
+
+	return c.endSet(ctx, resp)
+}
+
+func (c *call) mailboxCreate(ctx context.Context, create map[string]map[string]json.RawMessage, resp *setResponse) error {
+	patches := make(map[string]*mailboxPatch, len(create))
+	pending := make([]string, 0, len(create))
+	for cid, raw := range create {
+		patch, setErr := parseMailboxPatch(raw)
+		if setErr == nil && patch.Name == nil {
+			setErr = &setError{Type: setErrInvalidProperties, Properties: []string{"name"}}
+		}
+		if setErr != nil {
+			resp.NotCreated[cid] = setErr
+			continue
+		}
+		patches[cid] = patch
+		pending = append(pending, cid)
+	}
+	sort.Strings(pending)
+
+	// Parent can be created in the same call, so folders are created once
+	// their parents are.
+	for len(pending) != 0 {
+		var deferred []string
+		for _, cid := range pending {
+			patch := patches[cid]
+			if ref := patch.ParentID.Value; ref != nil && strings.HasPrefix(*ref, "#") {
+				if _, ok := patches[(*ref)[1:]]; ok && c.createdIDs[(*ref)[1:]] == "" && resp.NotCreated[(*ref)[1:]] == nil {
+					deferred = append(deferred, cid)
+					continue
+				}
+			}
+
+			created, setErr, err := c.createMailbox(ctx, patch)
+			if err != nil {
+				return err
+			}
+			if setErr != nil {
+				resp.NotCreated[cid] = setErr
+				continue
+			}
+			c.createdIDs[cid] = created.ID_.String()
+			resp.Created[cid] = mailboxAsJSON(&usecase.FolderData{Folder: *created}, mailboxProperties)
+		}
+
+		if len(deferred) == len(pending) {
+			// Parent references form a cycle.
+			for _, cid := range deferred {
+				resp.NotCreated[cid] = &setError{Type: setErrInvalidProperties, Properties: []string{"parentId"}}
+			}
+			break
+		}
+		pending = deferred
+	}
+	return nil
+}
+
+func (c *call) createMailbox(ctx context.Context, patch *mailboxPatch) (*folder.Folder, *setError, error) {
+	prefix, setErr, err := c.parentPath(ctx, patch.ParentID.Value)
+	if err != nil || setErr != nil {
+		return nil, setErr, err
+	}
+
+	role := folder.RoleNone
+	if patch.Role.Value != nil {
+		role, _ = roleFromJMAP(*patch.Role.Value)
+	}
+	created, err := c.s.folders.Create(ctx, c.sess.accountID, prefix+*patch.Name, role)
+	if err != nil {
+		setErr, err := checkSetError(err, "name", "role")
+		return nil, setErr, err
+	}
+
+	if patch.SortOrder != nil || patch.IsSubscribed != nil {
+		created, err = c.s.folders.Update(ctx, c.sess.accountID, created.ID_, func(f *folder.Folder) error {
+			patch.apply(f)
+			return nil
+		})
+		if err != nil {
+			setErr, err := checkSetError(err)
+			return nil, setErr, err
+		}
+	}
+	return created, nil, nil
+}
+
+func (c *call) mailboxUpdate(ctx context.Context, update map[string]map[string]json.RawMessage, resp *setResponse) error {
+	ids := make([]string, 0, len(update))
+	for id := range update {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		setErr, err := c.updateMailbox(ctx, id, update[id])
+		if err != nil {
+			return err
+		}
+		if setErr != nil {
+			resp.NotUpdated[id] = setErr
+			continue
+		}
+		resp.Updated[id] = nil
+	}
+	return nil
+}
+
+func (c *call) updateMailbox(ctx context.Context, id string, raw map[string]json.RawMessage) (*setError, error) {
+	folderID, ok := c.resolveID(id)
+	if !ok {
+		return &setError{Type: setErrNotFound}, nil
+	}
+	patch, setErr := parseMailboxPatch(raw)
+	if setErr != nil {
+		return setErr, nil
+	}
+
+	f, err := c.s.folders.GetByID(ctx, c.sess.accountID, folderID)
+	if err != nil {
+		return checkSetError(err)
+	}
+
+	if patch.Name != nil || patch.ParentID.Set {
+		prefix := ""
+		if i := strings.LastIndex(f.Path_, folder.PathSeparator); i != -1 {
+			prefix = f.Path_[:i+1]
+		}
+		if patch.ParentID.Set {
+			prefix, setErr, err = c.parentPath(ctx, patch.ParentID.Value)
+			if err != nil || setErr != nil {
+				return setErr, err
+			}
+		}
+		name := f.Name_
+		if patch.Name != nil {
+			name = *patch.Name
+		}
+
+		_, err := c.s.folders.Rename(ctx, c.sess.accountID, f.Path_, prefix+name)
+		if err != nil {
+			return checkSetError(err, "name", "parentId")
+		}
+	}
+
+	if patch.hasMutable() {
+		_, err := c.s.folders.Update(ctx, c.sess.accountID, folderID, func(f *folder.Folder) error {
+			patch.apply(f)
+			return nil
+		})
+		if err != nil {
+			return checkSetError(err, "role")
+		}
+	}
+	return nil, nil
+}
+
+func (c *call) mailboxDestroy(ctx context.Context, destroy []string, removeEmails bool, resp *setResponse) error {
+	type target struct {
+		id     string
+		folder *folder.Folder
+	}
+	targets := make([]target, 0, len(destroy))
+	for _, id := range destroy {
+		folderID, ok := c.resolveID(id)
+		if !ok {
+			resp.NotDestroyed[id] = &setError{Type: setErrNotFound}
+			continue
+		}
+		f, err := c.s.folders.GetByID(ctx, c.sess.accountID, folderID)
+		if err != nil {
+			setErr, err := checkSetError(err)
+			if err != nil {
+				return err
+			}
+			resp.NotDestroyed[id] = setErr
+			continue
+		}
+		targets = append(targets, target{id: id, folder: f})
+	}
+
+	// Children are destroyed before their parents.
+	sort.SliceStable(targets, func(i, j int) bool {
+		return len(targets[i].folder.Path_) > len(targets[j].folder.Path_)
+	})
+
+	for _, t := range targets {
+		if !removeEmails {
+			data, err := c.s.folders.List(ctx, c.sess.accountID, &usecase.ListOpts{
+				Filter:    folder.Filter{Path: &t.folder.Path_},
+				CountMsgs: true,
+			}, folder.OrderByName)
+			if err != nil {
+				return err
+			}
+			if len(data) != 0 && data[0].Msgs != 0 {
+				resp.NotDestroyed[t.id] = &setError{Type: setErrMailboxHasEmail}
+				continue
+			}
+		}
+
+		// Emails are removed from the folder together with it. Ones that
+		// are not in other folders are deleted by the garbage collection.
+		deleted, err := c.s.folders.Delete(ctx, c.sess.accountID, false, t.folder.Path_)
+		if err != nil {
+			setErr, err := checkSetError(err)
+			if err != nil {
+				return err
+			}
+			resp.NotDestroyed[t.id] = setErr
+			continue
+		}
+		for _, d := range deleted {
+			c.s.cfg.Notifier.FolderDestroyed(d.ID)
+		}
+		resp.Destroyed = append(resp.Destroyed, t.id)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/trace"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"github.com/oklog/ulid/v2"
+	"go.uber.org/zap"
+)
+
+// invocation is the method call or response, encoded as
+// [name, arguments, method call id].
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *invocation) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return errors.New("invocation must have 3 elements")
+	}
+	if err := json.Unmarshal(raw[0], &inv.Name); err != nil {
+		return fmt.Errorf("method name: %w", err)
+	}
+	if len(raw[1]) == 0 || raw[1][0] != '{' {
+		return errors.New("arguments must be an object")
+	}
+	inv.Args = raw[1]
+	if err := json.Unmarshal(raw[2], &inv.CallID); err != nil {
+		return fmt.Errorf("method call id: %w", err)
+	}
+	return nil
+}
+
+type request struct {
+	Using       []string          `json:"using"`
+	MethodCalls []invocation      `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+type response struct {
+	MethodResponses []invocation      `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// call is the state shared by method calls of the request.
+type call struct {
+	s    *Server
+	sess *session
+
+	// Creation id -> id of objects created by the request.
+	createdIDs map[string]string
+}
+
+type method struct {
+	capability string
+	fn         func(c *call, ctx context.Context, args json.RawMessage) (any, error)
+}
+
+var methods = map[string]method{
+	"Core/echo": {capCore, func(_ *call, _ context.Context, args json.RawMessage) (any, error) {
+		return args, nil
+	}},
+	"Mailbox/get":     {capMail, (*call).mailboxGet},
+	"Mailbox/changes": {capMail, (*call).mailboxChanges},
+	"Mailbox/query":   {capMail, (*call).mailboxQuery},
+	"Mailbox/set":     {capMail, (*call).mailboxSet},
+	"Email/get":       {capMail, (*call).emailGet},
+	"Email/changes":   {capMail, (*call).emailChanges},
+	"Email/query":     {capMail, (*call).emailQuery},
+	"Email/set":       {capMail, (*call).emailSet},
+}
+
+func (s *Server) serveAPI(ctx context.Context, w http.ResponseWriter, r *http.Request, sess *session) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxSizeRequest))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeProblem(ctx, w, problem{Type: problemLimit, Limit: "maxSizeRequest", Detail: "request is too large"})
+			return
+		}
+		contextlog.FromContext(ctx).Info("failed to read request", zap.Error(err))
+		return
+	}
+
+	if !json.Valid(body) {
+		writeProblem(ctx, w, problem{Type: problemNotJSON, Detail: "request is not a valid JSON"})
+		return
+	}
+	var req request
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeProblem(ctx, w, problem{Type: problemNotRequest, Detail: err.Error()})
+		return
+	}
+	if req.Using == nil || req.MethodCalls == nil {
+		writeProblem(ctx, w, problem{Type: problemNotRequest, Detail: "using and methodCalls are required"})
+		return
+	}
+
+	using := make(map[string]bool, len(req.Using))
+	for _, capability := range req.Using {
+		if capability != capCore && capability != capMail {
+			writeProblem(ctx, w, problem{Type: problemUnknownCapability, Detail: "unknown capability: " + capability})
+			return
+		}
+		using[capability] = true
+	}
+	if len(req.MethodCalls) > s.cfg.MaxCallsInRequest {
+		writeProblem(ctx, w, problem{Type: problemLimit, Limit: "maxCallsInRequest", Detail: "too many method calls"})
+		return
+	}
+
+	c := &call{
+		s:          s,
+		sess:       sess,
+		createdIDs: make(map[string]string, len(req.CreatedIDs)),
+	}
+	for k, v := range req.CreatedIDs {
+		c.createdIDs[k] = v
+	}
+
+	resp := response{
+		MethodResponses: make([]invocation, 0, len(req.MethodCalls)),
+		SessionState:    sess.state(),
+	}
+	for _, inv := range req.MethodCalls {
+		args, err := c.invoke(ctx, using, inv, resp.MethodResponses)
+		if err != nil {
+			var methodErr *methodError
+			if !errors.As(err, &methodErr) {
+				contextlog.FromContext(ctx).Error("internal server error",
+					zap.String("method", inv.Name), zap.Error(err))
+				methodErr = &methodError{Type: errServerFail}
+			}
+			resp.MethodResponses = append(resp.MethodResponses, invocation{
+				Name:   "error",
+				Args:   mustMarshal(methodErr),
+				CallID: inv.CallID,
+			})
+			continue
+		}
+
+		resp.MethodResponses = append(resp.MethodResponses, invocation{
+			Name:   inv.Name,
+			Args:   args,
+			CallID: inv.CallID,
+		})
+	}
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = c.createdIDs
+	}
+
+	writeJSON(ctx, w, http.StatusOK, resp)
+}
+
+func (c *call) invoke(ctx context.Context, using map[string]bool, inv invocation, prev []invocation) (json.RawMessage, error) {
+	ctx, task := trace.NewTask(ctx, "maddy-storage/jmap."+inv.Name)
+	defer task.End()
+
+	m, ok := methods[inv.Name]
+	if !ok || !using[m.capability] {
+		return nil, &methodError{Type: errUnknownMethod}
+	}
+
+	args, err := resolveRefs(inv.Args, prev)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := m.fn(c, ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+func mustMarshal(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// decodeArgs decodes method arguments into v, unknown arguments are
+// rejected.
+func decodeArgs(args json.RawMessage, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return invalidArguments(err.Error())
+	}
+	return nil
+}
+
+// checkAccount returns an error if id is not the authenticated account.
+func (c *call) checkAccount(id string) error {
+	if id != c.sess.accountID.String() {
+		return &methodError{Type: errAccountNotFound}
+	}
+	return nil
+}
+
+// resolveID parses the object id, which can be a reference to the
+// object created by the same request ("#" followed by the creation id).
+func (c *call) resolveID(id string) (ulid.ULID, bool) {
+	if strings.HasPrefix(id, "#") {
+		created, ok := c.createdIDs[id[1:]]
+		if !ok {
+			return ulid.ULID{}, false
+		}
+		id = created
+	}
+
+	parsed, err := ulid.Parse(id)
+	if err != nil {
+		return ulid.ULID{}, false
+	}
+	return parsed, true
+}
+
+type resultRef struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveRefs replaces arguments prefixed with "#" with values referenced
+// from previous method responses (RFC 8620, Section 3.7).
+func resolveRefs(args json.RawMessage, prev []invocation) (json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(args, &obj); err != nil {
+		return nil, invalidArguments(err.Error())
+	}
+
+	resolved := false
+	for key, val := range obj {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := key[1:]
+		if _, ok := obj[name]; ok {
+			return nil, invalidArguments("both " + name + " and " + key + " are present")
+		}
+
+		var ref resultRef
+		if err := decodeArgs(val, &ref); err != nil {
+			return nil, &methodError{Type: errInvalidResultReference, Description: err.Error()}
+		}
+		value, err := evalRef(ref, prev)
+		if err != nil {
+			return nil, &methodError{Type: errInvalidResultReference, Description: err.Error()}
+		}
+
+		delete(obj, key)
+		obj[name] = value
+		resolved = true
+	}
+	if !resolved {
+		return args, nil
+	}
+
+	return json.Marshal(obj)
+}
+
+func evalRef(ref resultRef, prev []invocation) (json.RawMessage, error) {
+	for _, inv := range prev {
+		if inv.CallID != ref.ResultOf {
+			continue
+		}
+		if inv.Name != ref.Name {
+			return nil, fmt.Errorf("response to %s is %s, not %s", ref.ResultOf, inv.Name, ref.Name)
+		}
+
+		var doc any
+		if err := json.Unmarshal(inv.Args, &doc); err != nil {
+			return nil, err
+		}
+		value, err := evalPointer(doc, ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+	return nil, fmt.Errorf("no response for %s", ref.ResultOf)
+}
+
+// evalPointer evaluates JSON pointer (RFC 6901) extended with "*" token,
+// which maps the rest of the path over array elements and flattens the
+// result.
+func evalPointer(doc any, path string) (any, error) {
+	if path == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("malformed path: %s", path)
+	}
+	return evalTokens(doc, strings.Split(path[1:], "/"))
+}
+
+func evalTokens(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return doc, nil
+	}
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+
+	switch v := doc.(type) {
+	case map[string]any:
+		child, ok := v[token]
+		if !ok {
+			return nil, fmt.Errorf("no such property: %s", token)
+		}
+		return evalTokens(child, tokens[1:])
+	case []any:
+		if token == "*" {
+			res := make([]any, 0, len(v))
+			for _, elem := range v {
+				value, err := evalTokens(elem, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if arr, ok := value.([]any); ok {
+					res = append(res, arr...)
+				} else {
+					res = append(res, value)
+				}
+			}
+			return res, nil
+		}
+
+		idx, err := strconv.Atoi(token)
+		if err != nil || idx < 0 || idx >= len(v) {
+			return nil, fmt.Errorf("invalid array index: %s", token)
+		}
+		return evalTokens(v[idx], tokens[1:])
+	default:
+		return nil, fmt.Errorf("cannot evaluate %s on a scalar value", token)
+	}
+}
@@ -0,0 +1,121 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/foxcpp/maddy-storage/internal/pkg/contextlog"
+	"go.uber.org/zap"
+)
+
+type coreCapability struct {
+	MaxSizeUpload         int64    `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int      `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int64    `json:"maxSizeRequest"`
+	MaxConcurrentRequests int      `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int      `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int      `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int      `json:"maxObjectsInSet"`
+	CollationAlgorithms   []string `json:"collationAlgorithms"`
+}
+
+type mailAccountCapability struct {
+	MaxMailboxesPerEmail       *int     `json:"maxMailboxesPerEmail"`
+	MaxMailboxDepth            *int     `json:"maxMailboxDepth"`
+	MaxSizeMailboxName         int      `json:"maxSizeMailboxName"`
+	MaxSizeAttachmentsPerEmail int64    `json:"maxSizeAttachmentsPerEmail"`
+	EmailQuerySortOptions      []string `json:"emailQuerySortOptions"`
+	MayCreateTopLevelMailbox   bool     `json:"mayCreateTopLevelMailbox"`
+}
+
+type sessionAccount struct {
+	Name                string         `json:"name"`
+	IsPersonal          bool           `json:"isPersonal"`
+	IsReadOnly          bool           `json:"isReadOnly"`
+	AccountCapabilities map[string]any `json:"accountCapabilities"`
+}
+
+type sessionResource struct {
+	Capabilities    map[string]any            `json:"capabilities"`
+	Accounts        map[string]sessionAccount `json:"accounts"`
+	PrimaryAccounts map[string]string         `json:"primaryAccounts"`
+	Username        string                    `json:"username"`
+	APIURL          string                    `json:"apiUrl"`
+	DownloadURL     string                    `json:"downloadUrl"`
+	UploadURL       string                    `json:"uploadUrl"`
+	EventSourceURL  string                    `json:"eventSourceUrl"`
+	State           string                    `json:"state"`
+}
+
+// state changes only if the session resource changes, which is
+// never the case for the same account.
+func (sess *session) state() string {
+	return sess.accountID.String()
+}
+
+func (s *Server) serveSession(ctx context.Context, w http.ResponseWriter, r *http.Request, sess *session) {
+	base := s.baseURL(r)
+	accountID := sess.accountID.String()
+
+	// Blob and push endpoints are not served yet, but the URLs are
+	// required to be present.
+	res := sessionResource{
+		Capabilities: map[string]any{
+			capCore: coreCapability{
+				MaxSizeUpload:         s.cfg.MaxSizeRequest,
+				MaxConcurrentUpload:   4,
+				MaxSizeRequest:        s.cfg.MaxSizeRequest,
+				MaxConcurrentRequests: 4,
+				MaxCallsInRequest:     s.cfg.MaxCallsInRequest,
+				MaxObjectsInGet:       s.cfg.MaxObjectsInGet,
+				MaxObjectsInSet:       s.cfg.MaxObjectsInSet,
+				CollationAlgorithms:   []string{},
+			},
+			capMail: struct{}{},
+		},
+		Accounts: map[string]sessionAccount{
+			accountID: {
+				Name:       sess.username,
+				IsPersonal: true,
+				IsReadOnly: false,
+				AccountCapabilities: map[string]any{
+					capMail: mailAccountCapability{
+						MaxMailboxesPerEmail:     &maxMailboxesPerEmail,
+						MaxSizeMailboxName:       maxSizeMailboxName,
+						EmailQuerySortOptions:    emailSortProperties,
+						MayCreateTopLevelMailbox: true,
+					},
+				},
+			},
+		},
+		PrimaryAccounts: map[string]string{
+			capMail: accountID,
+		},
+		Username:       sess.username,
+		APIURL:         base + pathAPI,
+		DownloadURL:    base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadURL:      base + "/jmap/upload/{accountId}/",
+		EventSourceURL: base + "/jmap/eventsource/?types={types}&closeafter={closeafter}&ping={ping}",
+		State:          sess.state(),
+	}
+
+	writeJSON(ctx, w, http.StatusOK, res)
+}
+
+// maxSizeMailboxName is advertised in the session resource and enforced
+// by Mailbox/set. It is in octets.
+const maxSizeMailboxName = 255
+
+// Messages are not shared between folders, COPY creates new ones.
+var maxMailboxesPerEmail = 1
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, status int, v any) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		contextlog.FromContext(ctx).Debug("failed to write response", zap.Error(err))
+	}
+}
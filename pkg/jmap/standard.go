@@ -0,0 +1,307 @@
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/foxcpp/maddy-storage/internal/domain/changelog"
+	"github.com/oklog/ulid/v2"
+)
+
+// Arguments and responses of the standard methods (RFC 8620, Section 5)
+// shared by all object types.
+
+// nullable is the property that can be absent, null or have a value.
+type nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (n *nullable[T]) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.Value = nil
+		return nil
+	}
+	n.Value = new(T)
+	return json.Unmarshal(b, n.Value)
+}
+
+// state returns the state string for all account objects. It is the
+// latest modification sequence of the account.
+func (c *call) state(ctx context.Context) (string, error) {
+	modSeq, err := c.s.changeLog.LastAccountModSeq(ctx, c.sess.accountID)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(modSeq, 10), nil
+}
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+type getResponse struct {
+	AccountID string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+// properties validates the requested properties, all of known ones are
+// returned if none are requested.
+func (args *getArgs) properties(known []string) ([]string, error) {
+	if args.Properties == nil {
+		return known, nil
+	}
+	for _, prop := range *args.Properties {
+		if !contains(known, prop) {
+			return nil, invalidArguments("unknown property: " + prop)
+		}
+	}
+	return *args.Properties, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, other := range list {
+		if other == s {
+			return true
+		}
+	}
+	return false
+}
+
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+type changesResponse struct {
+	AccountID      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// changes returns changelog entries of the account made since the state.
+// At most maxChanges entries are returned, so that there are no more
+// changed objects than that.
+func (c *call) changes(ctx context.Context, args *changesArgs) ([]changelog.Entry, *changesResponse, error) {
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, nil, err
+	}
+	limit := 0
+	if args.MaxChanges != nil {
+		if *args.MaxChanges <= 0 {
+			return nil, nil, invalidArguments("maxChanges must be positive")
+		}
+		limit = *args.MaxChanges
+	}
+	since, err := strconv.ParseInt(args.SinceState, 10, 64)
+	if err != nil || since < 0 {
+		return nil, nil, &methodError{Type: errCannotCalculateChanges, Description: "malformed state"}
+	}
+
+	entries, err := c.s.changeLog.GetAccountChanges(ctx, c.sess.accountID, since, limit)
+	if err != nil {
+		if errors.Is(err, changelog.ErrTooOld) {
+			return nil, nil, &methodError{Type: errCannotCalculateChanges, Description: err.Error()}
+		}
+		return nil, nil, err
+	}
+
+	resp := &changesResponse{
+		AccountID:      args.AccountID,
+		OldState:       args.SinceState,
+		NewState:       args.SinceState,
+		HasMoreChanges: limit != 0 && len(entries) == limit,
+		Created:        []string{},
+		Updated:        []string{},
+		Destroyed:      []string{},
+	}
+	if len(entries) != 0 {
+		resp.NewState = strconv.FormatInt(entries[len(entries)-1].ModSeq, 10)
+	}
+	return entries, resp, nil
+}
+
+type changeKind int
+
+const (
+	changeCreated changeKind = iota + 1
+	changeUpdated
+	changeDestroyed
+)
+
+// changeSet collapses changes of each object into one.
+type changeSet map[ulid.ULID]changeKind
+
+func (cs changeSet) add(id ulid.ULID, kind changeKind) {
+	prev, ok := cs[id]
+	switch {
+	case !ok:
+		cs[id] = kind
+	case prev == changeCreated && kind == changeDestroyed:
+		// Object is not visible to the client at all.
+		delete(cs, id)
+	case prev == changeCreated:
+	case prev == changeDestroyed && kind == changeCreated:
+		// Emails are moved between mailboxes by removing and adding them
+		// back with the same ID.
+		cs[id] = changeUpdated
+	default:
+		cs[id] = kind
+	}
+}
+
+func (cs changeSet) fill(resp *changesResponse) {
+	ids := make([]ulid.ULID, 0, len(cs))
+	for id := range cs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+
+	for _, id := range ids {
+		switch cs[id] {
+		case changeCreated:
+			resp.Created = append(resp.Created, id.String())
+		case changeUpdated:
+			resp.Updated = append(resp.Updated, id.String())
+		case changeDestroyed:
+			resp.Destroyed = append(resp.Destroyed, id.String())
+		}
+	}
+}
+
+type comparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+	Keyword     string `json:"keyword"` // for keyword sorts of Email/query
+}
+
+type queryResponse struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+}
+
+// window returns the part of ids requested using position or anchor
+// (RFC 8620, Section 5.5).
+func window(ids []string, position int, anchor *string, anchorOffset int, limit *int) ([]string, int, error) {
+	if limit != nil && *limit < 0 {
+		return nil, 0, invalidArguments("limit must not be negative")
+	}
+
+	if anchor != nil {
+		idx := -1
+		for i, id := range ids {
+			if id == *anchor {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return nil, 0, &methodError{Type: errAnchorNotFound}
+		}
+		position = idx + anchorOffset
+		if position < 0 {
+			position = 0
+		}
+	} else if position < 0 {
+		position += len(ids)
+		if position < 0 {
+			position = 0
+		}
+	}
+
+	if position >= len(ids) {
+		return []string{}, position, nil
+	}
+	res := ids[position:]
+	if limit != nil && *limit < len(res) {
+		res = res[:*limit]
+	}
+	return res, position, nil
+}
+
+type setArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]map[string]json.RawMessage `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+type setResponse struct {
+	AccountID    string                    `json:"accountId"`
+	OldState     string                    `json:"oldState"`
+	NewState     string                    `json:"newState"`
+	Created      map[string]map[string]any `json:"created"`
+	Updated      map[string]any            `json:"updated"`
+	Destroyed    []string                  `json:"destroyed"`
+	NotCreated   map[string]*setError      `json:"notCreated"`
+	NotUpdated   map[string]*setError      `json:"notUpdated"`
+	NotDestroyed map[string]*setError      `json:"notDestroyed"`
+}
+
+// beginSet validates common /set arguments and returns the response to fill.
+func (c *call) beginSet(ctx context.Context, args *setArgs) (*setResponse, error) {
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > c.s.cfg.MaxObjectsInSet {
+		return nil, &methodError{Type: errRequestTooLarge}
+	}
+
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if args.IfInState != nil && *args.IfInState != state {
+		return nil, &methodError{Type: errStateMismatch}
+	}
+
+	return &setResponse{
+		AccountID:    args.AccountID,
+		OldState:     state,
+		Created:      map[string]map[string]any{},
+		Updated:      map[string]any{},
+		Destroyed:    []string{},
+		NotCreated:   map[string]*setError{},
+		NotUpdated:   map[string]*setError{},
+		NotDestroyed: map[string]*setError{},
+	}, nil
+}
+
+func (c *call) endSet(ctx context.Context, resp *setResponse) (*setResponse, error) {
+	state, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp.NewState = state
+	return resp, nil
+}
+
+// checkSetError returns err as SetError if it is caused by the client or
+// as is otherwise.
+func checkSetError(err error, properties ...string) (*setError, error) {
+	if setErr := asSetError(err, properties...); setErr != nil {
+		return setErr, nil
+	}
+	return nil, err
+}